@@ -170,6 +170,12 @@ var OverlayBase = 4
 // Number of closest nodes to track in the virtual network.
 var OverlayLeaves = 8
 
+// Number of leaf candidates considered per slot when spreading across address classes.
+var OverlayLeafSpread = 2
+
+// Number of lowest latency nodes to track in the neighborhood set.
+var OverlayNeighbors = 8
+
 // Hash for mapping external ids into the overlay id space.
 var OverlayResolver = md5.New
 
@@ -179,15 +185,36 @@ var OverlayBootTimeout = 10000
 // Idle time after which to consider the overlay converged (ms).
 var OverlayConvTimeout = 3000
 
+// Re-resolution interval of the DNS seeds while the overlay is unstable (ms).
+var OverlaySeedInterval = 5000
+
+// Minimum interval between two state broadcasts, later ones being coalesced (ms).
+var OverlayBcastMinInterval = 100
+
+// Stable period after which a flood of new leaves is considered a partition heal (ms).
+var OverlayHealQuiet = 30000
+
+// Number of simultaneously appearing leaves to consider a partition healed.
+var OverlayHealLeaves = 4
+
 // Heartbeat period to ensure connections are alive and tear down unused ones (ms).
 var OverlayBeatPeriod = 10000
 
+// Number of silent heartbeat periods after which a peer connection is dropped.
+var OverlayKillCount = 3
+
+// Period of the TCP keepalive probes on the overlay peer connections (ms).
+var OverlayKeepAlive = 15000
+
 // Time to wait after session setup for the init packet (ms).
 var OverlayInitTimeout = 5000
 
 // Time limit for sending a message before the connection is dropped (ms).
 var OverlaySendTimeout = 3000
 
+// Whether overlay links should encrypt their messages with a per-link key.
+var OverlayEncryption = false
+
 // Messages to buffer to and from the network.
 var OverlayNetBuffer = 64
 
@@ -197,6 +224,51 @@ var OverlayAuthThreads = 8
 // Maximum number of state exchanges allowed concurrently.
 var OverlayExchThreads = 128
 
+// Maximum number of state exchanges allowed concurrently while bootstrapping.
+var OverlayExchBootThreads = 512
+
+// Maximum number of state exchanges allowed to wait for a free thread.
+var OverlayExchQueue = 4096
+
+// Connection count beyond which passive peers are evicted from the pool.
+var OverlayMaxConns = 1024
+
+// Maximum number of address entries processed from a single state exchange.
+var OverlayStateEntries = 1024
+
+// Encoded state exchange size beyond which it's compressed (bytes).
+var OverlayPackThreshold = 1024
+
+// Maximum size a packed state exchange may decompress into (bytes).
+var OverlayUnpackLimit = 4 * 1024 * 1024
+
+// Maximum number of hops an application message may be forwarded in the overlay.
+var OverlayMaxHops = 64
+
+// Clock difference beyond which a remote peer is reported as skewed (ms).
+var OverlayClockSkew = 5000
+
+// Time to wait for the peers to acknowledge a graceful leave (ms).
+var OverlayLeaveTimeout = 3000
+
+// Number of topology change events buffered per subscriber.
+var OverlayEventBuffer = 16
+
+// Initial re-dial interval of a node after a failed connection (ms).
+var OverlayDialBackoff = 1000
+
+// Maximum re-dial interval of repeatedly unreachable nodes (ms).
+var OverlayDialBackoffMax = 60000
+
+// Number of failed dials within the blacklist window to blacklist a node.
+var OverlayBlacklistFails = 5
+
+// Time window in which failed dials are counted towards blacklisting (ms).
+var OverlayBlacklistWindow = 60000
+
+// Time a blacklisted node is suppressed from discovery (ms).
+var OverlayBlacklistCooldown = 300000
+
 // Heartbeat period to distribute current cpu load and also check liveliness (ms).
 var CarrierBeatPeriod = 750
 
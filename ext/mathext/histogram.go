@@ -0,0 +1,101 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package mathext
+
+import (
+	"sort"
+	"sync"
+)
+
+// Fixed bucket histogram accumulating samples into a set of ranges delimited by
+// inclusive upper bounds, with an additional overflow bucket for larger values.
+// The zero value is not usable, create one through NewHistogram.
+type Histogram struct {
+	bounds []float64 // Sorted inclusive upper bounds of the buckets
+	counts []uint64  // Sample counts per bucket (last is the overflow)
+	sum    float64   // Sum of all the recorded samples
+	lock   sync.Mutex
+}
+
+// Creates a new histogram with the given bucket upper bounds.
+func NewHistogram(bounds ...float64) *Histogram {
+	sorted := append([]float64(nil), bounds...)
+	sort.Float64s(sorted)
+
+	return &Histogram{
+		bounds: sorted,
+		counts: make([]uint64, len(sorted)+1),
+	}
+}
+
+// Records a sample into the bucket with the smallest upper bound not less than
+// v, or into the overflow bucket if v is larger than all of them.
+func (h *Histogram) Add(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+}
+
+// Returns a consistent copy of the histogram.
+func (h *Histogram) Snapshot() *Histogram {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return &Histogram{
+		bounds: append([]float64(nil), h.bounds...),
+		counts: append([]uint64(nil), h.counts...),
+		sum:    h.sum,
+	}
+}
+
+// Returns the upper bounds of the buckets, excluding the overflow one.
+func (h *Histogram) Bounds() []float64 {
+	return append([]float64(nil), h.bounds...)
+}
+
+// Returns the sample counts of the buckets, the last one being the overflow.
+func (h *Histogram) Counts() []uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return append([]uint64(nil), h.counts...)
+}
+
+// Returns the total number of recorded samples.
+func (h *Histogram) Count() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	total := uint64(0)
+	for _, c := range h.counts {
+		total += c
+	}
+	return total
+}
+
+// Returns the sum of all the recorded samples.
+func (h *Histogram) Sum() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.sum
+}
@@ -0,0 +1,57 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package mathext
+
+import (
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(10, 1, 100)
+	for _, v := range []float64{0.5, 1, 2, 10, 50, 100, 101, 1000} {
+		h.Add(v)
+	}
+	// Ensure the bounds were sorted and the samples bucketed inclusively
+	if b := h.Bounds(); len(b) != 3 || b[0] != 1 || b[1] != 10 || b[2] != 100 {
+		t.Fatalf("bounds mismatch: have %v, want %v.", b, []float64{1, 10, 100})
+	}
+	want := []uint64{2, 2, 2, 2}
+	counts := h.Counts()
+	for i, c := range counts {
+		if c != want[i] {
+			t.Errorf("bucket %d: count mismatch: have %v, want %v.", i, c, want[i])
+		}
+	}
+	if c := h.Count(); c != 8 {
+		t.Errorf("total count mismatch: have %v, want %v.", c, 8)
+	}
+	if s := h.Sum(); s != 1264.5 {
+		t.Errorf("sum mismatch: have %v, want %v.", s, 1264.5)
+	}
+	// Ensure snapshots are detached from the original
+	snap := h.Snapshot()
+	h.Add(5)
+	if c := snap.Count(); c != 8 {
+		t.Errorf("snapshot count mismatch: have %v, want %v.", c, 8)
+	}
+	if c := h.Counts()[1]; c != 3 {
+		t.Errorf("bucket count mismatch: have %v, want %v.", c, 3)
+	}
+}
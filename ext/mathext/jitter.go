@@ -0,0 +1,43 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package mathext
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Returns the next delay of a decorrelated jittered backoff: a random duration
+// between base and three times the previous delay, capped at cap. The first call
+// should pass base as the previous delay. The result is always within [base, cap]
+// (given base <= cap), spreading out retries better than plain exponential ones.
+func DecorrelatedJitter(base, cap, prev time.Duration, rnd *rand.Rand) time.Duration {
+	if prev < base {
+		prev = base
+	}
+	next := base
+	if span := 3*prev - base; span > 0 {
+		next += time.Duration(rnd.Int63n(int64(span)))
+	}
+	if next > cap {
+		next = cap
+	}
+	return next
+}
@@ -0,0 +1,52 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package mathext
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestDecorrelatedJitter(t *testing.T) {
+	base, cap := 10*time.Millisecond, time.Second
+	rnd := rand.New(rand.NewSource(0))
+
+	// Iterate the recurrence and ensure the delays remain bounded
+	seen := make(map[time.Duration]bool)
+	for i, prev := 0, base; i < 1000; i++ {
+		next := DecorrelatedJitter(base, cap, prev, rnd)
+		if next < base || next > cap {
+			t.Fatalf("iteration %d: delay out of bounds: have %v, want in [%v, %v].", i, next, base, cap)
+		}
+		seen[next] = true
+		prev = next
+	}
+	if len(seen) < 100 {
+		t.Errorf("insufficient delay variation: %d distinct values.", len(seen))
+	}
+	// Ensure degenerate inputs are handled
+	if d := DecorrelatedJitter(base, cap, 0, rnd); d < base || d >= 3*base {
+		t.Errorf("zero previous delay mismatch: have %v, want in [%v, %v).", d, base, 3*base)
+	}
+	if d := DecorrelatedJitter(0, cap, 0, rnd); d != 0 {
+		t.Errorf("zero base delay mismatch: have %v, want %v.", d, 0)
+	}
+}
@@ -71,3 +71,18 @@ func MinBigRat(x, y *big.Rat) *big.Rat {
 	}
 	return y
 }
+
+// Returns the linear interpolation between a and b at t. Values of t outside
+// [0, 1] extrapolate along the same line.
+func Lerp(a, b, t float64) float64 {
+	return a + (b-a)*t
+}
+
+// Returns the interpolation parameter t at which Lerp(a, b, t) equals v. If a
+// and b are equal, the range is degenerate and zero is returned.
+func InverseLerp(a, b, v float64) float64 {
+	if a == b {
+		return 0
+	}
+	return (v - a) / (b - a)
+}
@@ -80,3 +80,32 @@ func TestBigRat(t *testing.T) {
 		t.Errorf("min mismatch: have %v, want %v.", m, neg)
 	}
 }
+
+var lerpTests = []struct {
+	a, b, t, v float64
+}{
+	{10, 20, 0, 10},
+	{10, 20, 1, 20},
+	{10, 20, 0.5, 15},
+	{10, 20, 2, 30},
+	{10, 20, -1, 0},
+	{20, 10, 0.25, 17.5},
+}
+
+func TestLerp(t *testing.T) {
+	for i, tt := range lerpTests {
+		if v := Lerp(tt.a, tt.b, tt.t); v != tt.v {
+			t.Errorf("test %d: lerp mismatch: have %v, want %v.", i, v, tt.v)
+		}
+		if r := InverseLerp(tt.a, tt.b, tt.v); r != tt.t {
+			t.Errorf("test %d: inverse lerp mismatch: have %v, want %v.", i, r, tt.t)
+		}
+	}
+	// Degenerate range
+	if v := Lerp(5, 5, 0.7); v != 5 {
+		t.Errorf("degenerate lerp mismatch: have %v, want %v.", v, 5)
+	}
+	if r := InverseLerp(5, 5, 7); r != 0 {
+		t.Errorf("degenerate inverse lerp mismatch: have %v, want %v.", r, 0)
+	}
+}
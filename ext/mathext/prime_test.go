@@ -0,0 +1,61 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package mathext
+
+import (
+	"testing"
+)
+
+type primeTest struct {
+	n     int
+	prime bool
+	next  int
+}
+
+var primeTests = []primeTest{
+	// Edge cases below the first prime
+	{-7, false, 2},
+	{0, false, 2},
+	{1, false, 2},
+
+	// Known primes
+	{2, true, 2},
+	{3, true, 3},
+	{13, true, 13},
+	{7919, true, 7919},
+
+	// Known composites
+	{4, false, 5},
+	{9, false, 11},
+	{25, false, 29},
+	{1000, false, 1009},
+	{7917, false, 7919},
+}
+
+func TestPrime(t *testing.T) {
+	for i, tt := range primeTests {
+		if p := IsPrime(tt.n); p != tt.prime {
+			t.Errorf("test %d: primality mismatch for %v: have %v, want %v.", i, tt.n, p, tt.prime)
+		}
+		if p := NextPrime(tt.n); p != tt.next {
+			t.Errorf("test %d: next prime mismatch for %v: have %v, want %v.", i, tt.n, p, tt.next)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package sortext
+
+import (
+	"math/big"
+)
+
+// InsertBigInt inserts x into a sorted slice of *big.Ints, keeping it sorted, and
+// returns the resulting slice. Equal elements are inserted before the present
+// ones. The slice must be sorted in ascending order.
+func InsertBigInt(a []*big.Int, x *big.Int) []*big.Int {
+	i := SearchBigInts(a, x)
+	a = append(a, nil)
+	copy(a[i+1:], a[i:])
+	a[i] = x
+	return a
+}
+
+// InsertBigRat inserts x into a sorted slice of *big.Rats, keeping it sorted, and
+// returns the resulting slice. Equal elements are inserted before the present
+// ones. The slice must be sorted in ascending order.
+func InsertBigRat(a []*big.Rat, x *big.Rat) []*big.Rat {
+	i := SearchBigRats(a, x)
+	a = append(a, nil)
+	copy(a[i+1:], a[i:])
+	a[i] = x
+	return a
+}
+
+// InsertBigFloat inserts x into a sorted slice of *big.Floats, keeping it sorted,
+// and returns the resulting slice. Equal elements are inserted before the present
+// ones. The slice must be sorted in ascending order.
+func InsertBigFloat(a []*big.Float, x *big.Float) []*big.Float {
+	i := SearchBigFloats(a, x)
+	a = append(a, nil)
+	copy(a[i+1:], a[i:])
+	a[i] = x
+	return a
+}
@@ -0,0 +1,67 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package sortext
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestInsertBigInt(t *testing.T) {
+	a := []*big.Int{}
+	for _, x := range []int64{5, -3, 11, 0, 5, 100, -50} {
+		a = InsertBigInt(a, big.NewInt(x))
+		if !BigIntsAreSorted(a) {
+			t.Fatalf("slice unsorted after inserting %v: %v.", x, a)
+		}
+	}
+	want := []int64{-50, -3, 0, 5, 5, 11, 100}
+	for i, x := range want {
+		if a[i].Int64() != x {
+			t.Fatalf("element %d mismatch: have %v, want %v.", i, a[i], x)
+		}
+	}
+}
+
+func TestInsertBigRat(t *testing.T) {
+	a := []*big.Rat{}
+	for _, x := range []*big.Rat{big.NewRat(1, 2), big.NewRat(-1, 3), big.NewRat(7, 1), big.NewRat(1, 3)} {
+		a = InsertBigRat(a, x)
+		if !BigRatsAreSorted(a) {
+			t.Fatalf("slice unsorted after inserting %v: %v.", x, a)
+		}
+	}
+	if len(a) != 4 || a[0].Cmp(big.NewRat(-1, 3)) != 0 || a[3].Cmp(big.NewRat(7, 1)) != 0 {
+		t.Fatalf("inserted slice mismatch: %v.", a)
+	}
+}
+
+func TestInsertBigFloat(t *testing.T) {
+	a := []*big.Float{}
+	for _, x := range []*big.Float{big.NewFloat(0.5), big.NewFloat(-0.25), big.NewFloat(7), big.NewFloat(0.25)} {
+		a = InsertBigFloat(a, x)
+		if !BigFloatsAreSorted(a) {
+			t.Fatalf("slice unsorted after inserting %v: %v.", x, a)
+		}
+	}
+	if len(a) != 4 || a[0].Cmp(big.NewFloat(-0.25)) != 0 || a[3].Cmp(big.NewFloat(7)) != 0 {
+		t.Fatalf("inserted slice mismatch: %v.", a)
+	}
+}
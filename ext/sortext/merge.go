@@ -0,0 +1,54 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package sortext
+
+import (
+	"math/big"
+)
+
+// MergeBigInts merges two sorted slices of *big.Ints into a new sorted slice,
+// dropping duplicates (both across and within the inputs). It is meant for the
+// plain ascending case only: ring ordered slices (see SortBigIntsAround) need to
+// be sorted ascending first. Both slices must be sorted in ascending order.
+func MergeBigInts(a, b []*big.Int) []*big.Int {
+	res := make([]*big.Int, 0, len(a)+len(b))
+	push := func(x *big.Int) {
+		if n := len(res); n == 0 || res[n-1].Cmp(x) != 0 {
+			res = append(res, x)
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].Cmp(b[j]) <= 0 {
+			push(a[i])
+			i++
+		} else {
+			push(b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		push(a[i])
+	}
+	for ; j < len(b); j++ {
+		push(b[j])
+	}
+	return res
+}
@@ -0,0 +1,96 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package sortext
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+var mergetests = []struct {
+	a, b []int64
+	res  []int64
+}{
+	{nil, nil, []int64{}},
+	{[]int64{1, 2}, nil, []int64{1, 2}},
+	{nil, []int64{-1, 5}, []int64{-1, 5}},
+	{[]int64{1, 3, 5}, []int64{2, 4, 6}, []int64{1, 2, 3, 4, 5, 6}},
+	{[]int64{1, 2, 3}, []int64{2, 3, 4}, []int64{1, 2, 3, 4}},
+	{[]int64{1, 1, 2}, []int64{2, 2, 7}, []int64{1, 2, 7}},
+	{[]int64{10, 20}, []int64{-5, 0}, []int64{-5, 0, 10, 20}},
+}
+
+func toBigInts(xs []int64) []*big.Int {
+	res := make([]*big.Int, len(xs))
+	for i, x := range xs {
+		res[i] = big.NewInt(x)
+	}
+	return res
+}
+
+func TestMergeBigInts(t *testing.T) {
+	for i, tt := range mergetests {
+		res := MergeBigInts(toBigInts(tt.a), toBigInts(tt.b))
+		if len(res) != len(tt.res) {
+			t.Errorf("test %d: merged length mismatch: have %v, want %v.", i, res, tt.res)
+			continue
+		}
+		for j, x := range tt.res {
+			if res[j].Int64() != x {
+				t.Errorf("test %d: merged element %d mismatch: have %v, want %v.", i, j, res[j], x)
+			}
+		}
+	}
+}
+
+// Generates two sorted random slices for the merge benchmarks.
+func mergeInputs(n int) ([]*big.Int, []*big.Int) {
+	a, b := make([]*big.Int, n), make([]*big.Int, n)
+	for i := 0; i < n; i++ {
+		a[i], b[i] = big.NewInt(rand.Int63()), big.NewInt(rand.Int63())
+	}
+	BigInts(a)
+	BigInts(b)
+	return a, b
+}
+
+func benchmarkMerge(b *testing.B, n int) {
+	x, y := mergeInputs(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MergeBigInts(x, y)
+	}
+}
+
+func benchmarkAppendSort(b *testing.B, n int) {
+	x, y := mergeInputs(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := append(append(make([]*big.Int, 0, 2*n), x...), y...)
+		BigInts(res)
+		res = res[:Unique(BigIntSlice(res))]
+	}
+}
+
+func BenchmarkMerge16(b *testing.B)        { benchmarkMerge(b, 16) }
+func BenchmarkMerge1024(b *testing.B)      { benchmarkMerge(b, 1024) }
+func BenchmarkAppendSort16(b *testing.B)   { benchmarkAppendSort(b, 16) }
+func BenchmarkAppendSort1024(b *testing.B) { benchmarkAppendSort(b, 1024) }
@@ -24,6 +24,14 @@ import (
 	"sort"
 )
 
+// SearchFunc uses binary search to find and return the smallest index i in [0, n)
+// at which f(i) is true, assuming that on the range [0, n), f(i) == true implies
+// f(i+1) == true. If there is no such index, SearchFunc returns n. It mirrors
+// sort.Search, allowing custom slices to be searched alongside the wrappers.
+func SearchFunc(n int, f func(int) bool) int {
+	return sort.Search(n, f)
+}
+
 // SearchBigInts searches for x in a sorted slice of *big.Ints and returns the
 // index as specified by Search. The return value is the index to insert x if x
 // is not present (it could be len(a)).
@@ -32,6 +40,20 @@ func SearchBigInts(a []*big.Int, x *big.Int) int {
 	return sort.Search(len(a), func(i int) bool { return a[i].Cmp(x) >= 0 })
 }
 
+// SearchBigIntsFrom searches for x in a sorted slice of *big.Ints, starting from
+// the known lower bound lo, and returns the index as specified by SearchBigInts
+// (relative to the whole slice, so at least lo). It allows a series of ascending
+// lookups to resume where the previous one stopped.
+// The slice must be sorted in ascending order.
+func SearchBigIntsFrom(a []*big.Int, x *big.Int, lo int) int {
+	if lo < 0 {
+		lo = 0
+	} else if lo > len(a) {
+		lo = len(a)
+	}
+	return lo + SearchBigInts(a[lo:], x)
+}
+
 // SearchBigRats searches for x in a sorted slice of *big.Rats and returns the
 // index as specified by Search. The return value is the index to insert x if x
 // is not present (it could be len(a)).
@@ -40,8 +62,81 @@ func SearchBigRats(a []*big.Rat, x *big.Rat) int {
 	return sort.Search(len(a), func(i int) bool { return a[i].Cmp(x) >= 0 })
 }
 
+// SearchBigFloats searches for x in a sorted slice of *big.Floats and returns the
+// index as specified by Search. The return value is the index to insert x if x
+// is not present (it could be len(a)).
+// The slice must be sorted in ascending order.
+func SearchBigFloats(a []*big.Float, x *big.Float) int {
+	return sort.Search(len(a), func(i int) bool { return a[i].Cmp(x) >= 0 })
+}
+
+// SearchBigIntsDesc searches for x in a slice of *big.Ints sorted in descending
+// order and returns the index of the first element not greater than x, i.e. the
+// index to insert x if x is not present (it could be len(a)).
+func SearchBigIntsDesc(a []*big.Int, x *big.Int) int {
+	return sort.Search(len(a), func(i int) bool { return a[i].Cmp(x) <= 0 })
+}
+
+// SearchBigRatsDesc searches for x in a slice of *big.Rats sorted in descending
+// order and returns the index of the first element not greater than x, i.e. the
+// index to insert x if x is not present (it could be len(a)).
+func SearchBigRatsDesc(a []*big.Rat, x *big.Rat) int {
+	return sort.Search(len(a), func(i int) bool { return a[i].Cmp(x) <= 0 })
+}
+
+// SearchBigFloatsDesc searches for x in a slice of *big.Floats sorted in
+// descending order and returns the index of the first element not greater than
+// x, i.e. the index to insert x if x is not present (it could be len(a)).
+func SearchBigFloatsDesc(a []*big.Float, x *big.Float) int {
+	return sort.Search(len(a), func(i int) bool { return a[i].Cmp(x) <= 0 })
+}
+
+// LowerBoundBigInt returns the index of the first element in a sorted slice of
+// *big.Ints not less than x, along with whether that index is a valid element
+// (false if x is greater than all elements and the index is len(a)).
+// The slice must be sorted in ascending order.
+func LowerBoundBigInt(a []*big.Int, x *big.Int) (idx int, inBounds bool) {
+	idx = SearchBigInts(a, x)
+	return idx, idx < len(a)
+}
+
+// IndexBigInt returns the index of x in a sorted slice of *big.Ints, or -1 if
+// x is not present (including the case when it would be appended at the end).
+// The slice must be sorted in ascending order.
+func IndexBigInt(a []*big.Int, x *big.Int) int {
+	if i, ok := LowerBoundBigInt(a, x); ok && a[i].Cmp(x) == 0 {
+		return i
+	}
+	return -1
+}
+
+// CountBigInts returns the number of occurrences of x in a sorted slice of
+// *big.Ints, using a lower and an upper bound binary search.
+// The slice must be sorted in ascending order.
+func CountBigInts(a []*big.Int, x *big.Int) int {
+	lo := SearchBigInts(a, x)
+	hi := lo + sort.Search(len(a)-lo, func(i int) bool { return a[lo+i].Cmp(x) > 0 })
+	return hi - lo
+}
+
+// RangeBigInts returns the half-open index span [start, end) of the elements of a
+// sorted slice of *big.Ints which fall within [lo, hi). An empty range (start ==
+// end) is returned if none do, including the case of hi not being above lo.
+// The slice must be sorted in ascending order.
+func RangeBigInts(a []*big.Int, lo, hi *big.Int) (start, end int) {
+	start = SearchBigInts(a, lo)
+	if hi.Cmp(lo) <= 0 {
+		return start, start
+	}
+	end = SearchBigIntsFrom(a, hi, start)
+	return start, end
+}
+
 // Search returns the result of applying SearchBigInts to the receiver and x.
 func (p BigIntSlice) Search(x *big.Int) int { return SearchBigInts(p, x) }
 
 // Search returns the result of applying SearchBigRats to the receiver and x.
 func (p BigRatSlice) Search(x *big.Rat) int { return SearchBigRats(p, x) }
+
+// Search returns the result of applying SearchBigFloats to the receiver and x.
+func (p BigFloatSlice) Search(x *big.Float) int { return SearchBigFloats(p, x) }
@@ -27,6 +27,7 @@ import (
 // Smoke tests for convenience wrappers - not comprehensive.
 var idata = []*big.Int{big.NewInt(-5), big.NewInt(0), big.NewInt(11), big.NewInt(100)}
 var rdata = []*big.Rat{big.NewRat(-314, 100), big.NewRat(0, 1), big.NewRat(1, 1), big.NewRat(2, 1), big.NewRat(10007, 10)}
+var fdata = []*big.Float{big.NewFloat(-3.14), big.NewFloat(0), big.NewFloat(1), big.NewFloat(2), big.NewFloat(1000.7)}
 
 var wrappertests = []struct {
 	name   string
@@ -35,8 +36,11 @@ var wrappertests = []struct {
 }{
 	{"SearchBigInts", SearchBigInts(idata, big.NewInt(11)), 2},
 	{"SearchBigRats", SearchBigRats(rdata, big.NewRat(21, 10)), 4},
+	{"SearchBigFloats", SearchBigFloats(fdata, big.NewFloat(2.1)), 4},
 	{"BigIntSlice.Search", BigIntSlice(idata).Search(big.NewInt(0)), 1},
 	{"BigRatSlice.Search", BigRatSlice(rdata).Search(big.NewRat(20, 10)), 3},
+	{"BigFloatSlice.Search", BigFloatSlice(fdata).Search(big.NewFloat(2)), 3},
+	{"SearchFunc", SearchFunc(len(idata), func(i int) bool { return idata[i].Cmp(big.NewInt(11)) >= 0 }), 2},
 }
 
 func TestSearchWrappers(t *testing.T) {
@@ -46,3 +50,203 @@ func TestSearchWrappers(t *testing.T) {
 		}
 	}
 }
+
+var countdata = []*big.Int{big.NewInt(-5), big.NewInt(0), big.NewInt(0), big.NewInt(11), big.NewInt(11), big.NewInt(11), big.NewInt(100)}
+
+var counttests = []struct {
+	x *big.Int
+	n int
+}{
+	{big.NewInt(-10), 0},
+	{big.NewInt(5), 0},
+	{big.NewInt(1000), 0},
+	{big.NewInt(-5), 1},
+	{big.NewInt(100), 1},
+	{big.NewInt(0), 2},
+	{big.NewInt(11), 3},
+}
+
+func TestCountBigInts(t *testing.T) {
+	for i, tt := range counttests {
+		if n := CountBigInts(countdata, tt.x); n != tt.n {
+			t.Errorf("test %d: count mismatch for %v: have %d, want %d.", i, tt.x, n, tt.n)
+		}
+	}
+	if n := CountBigInts(nil, big.NewInt(0)); n != 0 {
+		t.Errorf("empty slice count mismatch: have %d, want %d.", n, 0)
+	}
+}
+
+var indextests = []struct {
+	x *big.Int
+	i int
+}{
+	{big.NewInt(-10), -1},
+	{big.NewInt(-5), 0},
+	{big.NewInt(5), -1},
+	{big.NewInt(11), 2},
+	{big.NewInt(100), 3},
+	{big.NewInt(1000), -1}, // Append-at-end edge
+}
+
+func TestIndexBigInt(t *testing.T) {
+	for i, tt := range indextests {
+		if idx := IndexBigInt(idata, tt.x); idx != tt.i {
+			t.Errorf("test %d: index mismatch for %v: have %d, want %d.", i, tt.x, idx, tt.i)
+		}
+	}
+	if idx := IndexBigInt(nil, big.NewInt(0)); idx != -1 {
+		t.Errorf("empty slice index mismatch: have %d, want %d.", idx, -1)
+	}
+}
+
+var boundtests = []struct {
+	x  *big.Int
+	i  int
+	ok bool
+}{
+	{big.NewInt(-10), 0, true},
+	{big.NewInt(-5), 0, true},
+	{big.NewInt(5), 2, true},
+	{big.NewInt(100), 3, true},
+	{big.NewInt(1000), 4, false}, // Greater than all
+}
+
+func TestLowerBoundBigInt(t *testing.T) {
+	for i, tt := range boundtests {
+		if idx, ok := LowerBoundBigInt(idata, tt.x); idx != tt.i || ok != tt.ok {
+			t.Errorf("test %d: bound mismatch for %v: have %d/%v, want %d/%v.", i, tt.x, idx, ok, tt.i, tt.ok)
+		}
+	}
+	if idx, ok := LowerBoundBigInt(nil, big.NewInt(0)); idx != 0 || ok {
+		t.Errorf("empty slice bound mismatch: have %d/%v, want %d/%v.", idx, ok, 0, false)
+	}
+}
+
+var fromtests = []struct {
+	x  *big.Int
+	lo int
+	i  int
+}{
+	{big.NewInt(11), 0, 2},
+	{big.NewInt(11), 2, 2},
+	{big.NewInt(11), 3, 3},   // Lower bound past the element
+	{big.NewInt(5), 1, 2},    // Not found, insertion index
+	{big.NewInt(-10), 0, 0},  // Smaller than all
+	{big.NewInt(1000), 1, 4}, // Greater than all
+	{big.NewInt(0), -3, 1},   // Negative bound clamped
+	{big.NewInt(0), 10, 4},   // Bound beyond the slice clamped
+}
+
+func TestSearchBigIntsFrom(t *testing.T) {
+	for i, tt := range fromtests {
+		if idx := SearchBigIntsFrom(idata, tt.x, tt.lo); idx != tt.i {
+			t.Errorf("test %d: index mismatch for %v from %d: have %d, want %d.", i, tt.x, tt.lo, idx, tt.i)
+		}
+	}
+	// Resuming ascending lookups should match the full searches
+	lo := 0
+	for _, x := range []*big.Int{big.NewInt(-7), big.NewInt(0), big.NewInt(50), big.NewInt(101)} {
+		lo = SearchBigIntsFrom(idata, x, lo)
+		if want := SearchBigInts(idata, x); lo != want {
+			t.Errorf("resumed index mismatch for %v: have %d, want %d.", x, lo, want)
+		}
+	}
+}
+
+func TestSearchFunc(t *testing.T) {
+	for n := 0; n < 8; n++ {
+		for k := 0; k <= n; k++ {
+			if idx := SearchFunc(n, func(i int) bool { return i >= k }); idx != k {
+				t.Errorf("n %d: index mismatch: have %d, want %d.", n, idx, k)
+			}
+		}
+	}
+}
+
+var idataDesc = []*big.Int{big.NewInt(100), big.NewInt(11), big.NewInt(0), big.NewInt(-5)}
+var rdataDesc = []*big.Rat{big.NewRat(10007, 10), big.NewRat(2, 1), big.NewRat(1, 1), big.NewRat(0, 1), big.NewRat(-314, 100)}
+var fdataDesc = []*big.Float{big.NewFloat(1000.7), big.NewFloat(2), big.NewFloat(1), big.NewFloat(0), big.NewFloat(-3.14)}
+
+var desctests = []struct {
+	x *big.Int
+	i int
+}{
+	{big.NewInt(1000), 0}, // Missing high, inserted first
+	{big.NewInt(100), 0},
+	{big.NewInt(50), 1},
+	{big.NewInt(11), 1},
+	{big.NewInt(-5), 3},
+	{big.NewInt(-10), 4}, // Missing low, appended at the end
+}
+
+func TestSearchBigIntsDesc(t *testing.T) {
+	for i, tt := range desctests {
+		if idx := SearchBigIntsDesc(idataDesc, tt.x); idx != tt.i {
+			t.Errorf("test %d: index mismatch for %v: have %d, want %d.", i, tt.x, idx, tt.i)
+		}
+	}
+	if idx := SearchBigIntsDesc(nil, big.NewInt(0)); idx != 0 {
+		t.Errorf("empty slice index mismatch: have %d, want %d.", idx, 0)
+	}
+}
+
+func TestSearchBigRatsDesc(t *testing.T) {
+	tests := []struct {
+		x *big.Rat
+		i int
+	}{
+		{big.NewRat(2000, 1), 0}, // Missing high
+		{big.NewRat(3, 2), 2},
+		{big.NewRat(0, 1), 3},
+		{big.NewRat(-4, 1), 5}, // Missing low
+	}
+	for i, tt := range tests {
+		if idx := SearchBigRatsDesc(rdataDesc, tt.x); idx != tt.i {
+			t.Errorf("test %d: index mismatch for %v: have %d, want %d.", i, tt.x, idx, tt.i)
+		}
+	}
+}
+
+func TestSearchBigFloatsDesc(t *testing.T) {
+	tests := []struct {
+		x *big.Float
+		i int
+	}{
+		{big.NewFloat(2000), 0}, // Missing high
+		{big.NewFloat(1.5), 2},
+		{big.NewFloat(0), 3},
+		{big.NewFloat(-4), 5}, // Missing low
+	}
+	for i, tt := range tests {
+		if idx := SearchBigFloatsDesc(fdataDesc, tt.x); idx != tt.i {
+			t.Errorf("test %d: index mismatch for %v: have %d, want %d.", i, tt.x, idx, tt.i)
+		}
+	}
+}
+
+var rangetests = []struct {
+	lo, hi     *big.Int
+	start, end int
+}{
+	{big.NewInt(-100), big.NewInt(-10), 0, 0}, // Entirely below
+	{big.NewInt(200), big.NewInt(300), 4, 4},  // Entirely above
+	{big.NewInt(1), big.NewInt(10), 2, 2},     // Empty gap in between
+	{big.NewInt(11), big.NewInt(5), 2, 2},     // Inverted bounds
+	{big.NewInt(0), big.NewInt(0), 1, 1},      // Empty bounds
+	{big.NewInt(0), big.NewInt(11), 1, 2},     // Exact boundary hits
+	{big.NewInt(0), big.NewInt(12), 1, 3},
+	{big.NewInt(-5), big.NewInt(101), 0, 4}, // Whole slice
+	{big.NewInt(-1000), big.NewInt(1000), 0, 4},
+}
+
+func TestRangeBigInts(t *testing.T) {
+	for i, tt := range rangetests {
+		if start, end := RangeBigInts(idata, tt.lo, tt.hi); start != tt.start || end != tt.end {
+			t.Errorf("test %d: range mismatch for [%v, %v): have [%d, %d), want [%d, %d).", i, tt.lo, tt.hi, start, end, tt.start, tt.end)
+		}
+	}
+	if start, end := RangeBigInts(nil, big.NewInt(0), big.NewInt(10)); start != 0 || end != 0 {
+		t.Errorf("empty slice range mismatch: have [%d, %d), want [%d, %d).", start, end, 0, 0)
+	}
+}
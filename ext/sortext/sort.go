@@ -45,14 +45,97 @@ func (b BigRatSlice) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
 // Sort is a convenience method.
 func (b BigRatSlice) Sort() { sort.Sort(b) }
 
+// BigFloatSlice attaches the methods of Interface to []*big.Float, sorting in
+// increasing order. Elements are compared by value via (*big.Float).Cmp, so the
+// precisions are irrelevant, but rounding is not: the same literal parsed with
+// different precisions may yield unequal values. Infinities sort to the ends and
+// signed zeros are equal; NaNs cannot occur as big.Float has no representation
+// for them.
+type BigFloatSlice []*big.Float
+
+func (b BigFloatSlice) Len() int           { return len(b) }
+func (b BigFloatSlice) Less(i, j int) bool { return b[i].Cmp(b[j]) < 0 }
+func (b BigFloatSlice) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Sort is a convenience method.
+func (b BigFloatSlice) Sort() { sort.Sort(b) }
+
+// BigIntRingSlice attaches the methods of Interface to []*big.Int, sorting in
+// increasing order of the signed distance from Center on a ring of size Modulus,
+// i.e. predecessors first (farthest to nearest), followed by the successors.
+type BigIntRingSlice struct {
+	Center  *big.Int
+	Modulus *big.Int
+	Data    []*big.Int
+}
+
+func (b BigIntRingSlice) Len() int           { return len(b.Data) }
+func (b BigIntRingSlice) Less(i, j int) bool { return b.offset(b.Data[i]).Cmp(b.offset(b.Data[j])) < 0 }
+func (b BigIntRingSlice) Swap(i, j int)      { b.Data[i], b.Data[j] = b.Data[j], b.Data[i] }
+
+// Calculates the signed distance of x from the center, going the shorter way
+// around the ring. Both must be within [0, Modulus).
+func (b BigIntRingSlice) offset(x *big.Int) *big.Int {
+	half := new(big.Int).Rsh(b.Modulus, 1)
+
+	d := new(big.Int).Sub(x, b.Center)
+	if d.Cmp(half) > 0 {
+		d.Sub(d, b.Modulus)
+	} else if d.Cmp(half.Neg(half)) < 0 {
+		d.Add(d, b.Modulus)
+	}
+	return d
+}
+
 // BigInts sorts a slice of *big.Ints in increasing order.
 func BigInts(a []*big.Int) { sort.Sort(BigIntSlice(a)) }
 
 // BigRats sorts a slice of *big.Rats in increasing order.
 func BigRats(a []*big.Rat) { sort.Sort(BigRatSlice(a)) }
 
+// BigFloats sorts a slice of *big.Floats in increasing order.
+func BigFloats(a []*big.Float) { sort.Sort(BigFloatSlice(a)) }
+
+// BigIntsDesc sorts a slice of *big.Ints in decreasing order.
+func BigIntsDesc(a []*big.Int) { sort.Sort(sort.Reverse(BigIntSlice(a))) }
+
+// BigRatsDesc sorts a slice of *big.Rats in decreasing order.
+func BigRatsDesc(a []*big.Rat) { sort.Sort(sort.Reverse(BigRatSlice(a))) }
+
+// BigFloatsDesc sorts a slice of *big.Floats in decreasing order.
+func BigFloatsDesc(a []*big.Float) { sort.Sort(sort.Reverse(BigFloatSlice(a))) }
+
+// SortBigIntsAround sorts a slice of *big.Ints by their signed ring distance from
+// center, on a ring of the given modulus.
+func SortBigIntsAround(a []*big.Int, center, modulus *big.Int) {
+	sort.Sort(BigIntRingSlice{center, modulus, a})
+}
+
+// RotateBigIntsAround converts a slice of *big.Ints sorted in ascending order into
+// the order produced by SortBigIntsAround, by rotating it (into a new slice) at
+// the point farthest from center. Compared to sorting, it avoids the expensive
+// ring distance calculations. The slice must be sorted in ascending order.
+func RotateBigIntsAround(a []*big.Int, center, modulus *big.Int) []*big.Int {
+	half := new(big.Int).Rsh(modulus, 1)
+	bound := new(big.Int).Sub(center, half)
+	bound.Mod(bound, modulus)
+
+	// On even rings the bound is also a successor if it's above the center
+	start := SearchBigInts(a, bound)
+	if modulus.Bit(0) == 0 && bound.Cmp(center) > 0 {
+		for start < len(a) && a[start].Cmp(bound) == 0 {
+			start++
+		}
+	}
+	res := make([]*big.Int, 0, len(a))
+	return append(append(res, a[start:]...), a[:start]...)
+}
+
 // BigIntsAreSorted tests whether a slice of *big.Ints is sorted in increasing order.
 func BigIntsAreSorted(a []*big.Int) bool { return sort.IsSorted(BigIntSlice(a)) }
 
 // BigRatsAreSorted tests whether a slice of *big.Rats is sorted in increasing order.
 func BigRatsAreSorted(a []*big.Rat) bool { return sort.IsSorted(BigRatSlice(a)) }
+
+// BigFloatsAreSorted tests whether a slice of *big.Floats is sorted in increasing order.
+func BigFloatsAreSorted(a []*big.Float) bool { return sort.IsSorted(BigFloatSlice(a)) }
@@ -57,6 +57,22 @@ var bigrats = []*big.Rat{
 	big.NewRat(7586, 314),
 }
 
+var bigfloats = []*big.Float{
+	big.NewFloat(74.314),
+	big.NewFloat(59.314),
+	big.NewFloat(238.314),
+	big.NewFloat(-784.314),
+	big.NewFloat(9845.314),
+	big.NewFloat(959.314),
+	big.NewFloat(905.314),
+	big.NewFloat(0),
+	big.NewFloat(0),
+	big.NewFloat(42.314),
+	big.NewFloat(7586.314),
+	big.NewFloat(-5467984.314),
+	big.NewFloat(7586.314),
+}
+
 func TestSortBigIntSlice(t *testing.T) {
 	data := bigints
 	a := BigIntSlice(data[0:])
@@ -77,6 +93,16 @@ func TestSortBigRatSlice(t *testing.T) {
 	}
 }
 
+func TestSortBigFloatSlice(t *testing.T) {
+	data := bigfloats
+	a := BigFloatSlice(data[0:])
+	sort.Sort(a)
+	if !sort.IsSorted(a) {
+		t.Errorf("sorted %v", bigfloats)
+		t.Errorf("   got %v", data)
+	}
+}
+
 func TestBigInts(t *testing.T) {
 	data := bigints
 	BigInts(data[0:])
@@ -94,3 +120,116 @@ func TestBigRats(t *testing.T) {
 		t.Errorf("   got %v", data)
 	}
 }
+
+func TestBigFloats(t *testing.T) {
+	data := bigfloats
+	BigFloats(data[0:])
+	if !BigFloatsAreSorted(data[0:]) {
+		t.Errorf("sorted %v", bigfloats)
+		t.Errorf("   got %v", data)
+	}
+}
+
+func TestBigIntsDesc(t *testing.T) {
+	data := append([]*big.Int{}, bigints...)
+	BigIntsDesc(data)
+	if !sort.IsSorted(sort.Reverse(BigIntSlice(data))) {
+		t.Errorf("sorted %v", bigints)
+		t.Errorf("   got %v", data)
+	}
+}
+
+func TestBigRatsDesc(t *testing.T) {
+	data := append([]*big.Rat{}, bigrats...)
+	BigRatsDesc(data)
+	if !sort.IsSorted(sort.Reverse(BigRatSlice(data))) {
+		t.Errorf("sorted %v", bigrats)
+		t.Errorf("   got %v", data)
+	}
+}
+
+func TestBigFloatsDesc(t *testing.T) {
+	data := append([]*big.Float{}, bigfloats...)
+	BigFloatsDesc(data)
+	if !sort.IsSorted(sort.Reverse(BigFloatSlice(data))) {
+		t.Errorf("sorted %v", bigfloats)
+		t.Errorf("   got %v", data)
+	}
+}
+
+func TestBigFloatsSpecial(t *testing.T) {
+	// Infinities sort to the ends, signed zeros are equal
+	data := []*big.Float{
+		big.NewFloat(1),
+		new(big.Float).SetInf(false),
+		big.NewFloat(0),
+		new(big.Float).SetInf(true),
+		new(big.Float).Neg(big.NewFloat(0)),
+		big.NewFloat(-1),
+	}
+	BigFloats(data)
+	if !data[0].IsInf() || data[0].Sign() > 0 || !data[5].IsInf() || data[5].Sign() < 0 {
+		t.Errorf("infinities misplaced: %v", data)
+	}
+	if data[2].Cmp(data[3]) != 0 {
+		t.Errorf("signed zeros unequal: %v, %v", data[2], data[3])
+	}
+	// Values are compared after rounding, independent of the precision
+	lo, _, _ := big.ParseFloat("0.1", 10, 24, big.ToNearestEven)
+	hi, _, _ := big.ParseFloat("0.1", 10, 53, big.ToNearestEven)
+	if lo.Cmp(hi) == 0 {
+		t.Errorf("differently rounded values equal: %v, %v", lo, hi)
+	}
+	if x := new(big.Float).SetPrec(200).Set(hi); BigFloatSlice([]*big.Float{hi, x}).Less(0, 1) || BigFloatSlice([]*big.Float{hi, x}).Less(1, 0) {
+		t.Errorf("equal values of different precisions ordered: %v, %v", hi, x)
+	}
+}
+
+func TestSortBigIntsAround(t *testing.T) {
+	// Ring of 100 centered at 90: ids ordered by signed distance, wrapping at 0
+	modulus, center := big.NewInt(100), big.NewInt(90)
+	data := []*big.Int{
+		big.NewInt(10), // +20
+		big.NewInt(45), // -45
+		big.NewInt(90), // 0
+		big.NewInt(0),  // +10
+		big.NewInt(60), // -30
+		big.NewInt(99), // +9
+		big.NewInt(89), // -1
+		big.NewInt(39), // +49
+	}
+	want := []int64{45, 60, 89, 90, 99, 0, 10, 39}
+
+	SortBigIntsAround(data, center, modulus)
+	for i, x := range data {
+		if x.Int64() != want[i] {
+			t.Fatalf("ring order mismatch: have %v, want %v.", data, want)
+		}
+	}
+	if !sort.IsSorted(BigIntRingSlice{center, modulus, data}) {
+		t.Errorf("ring slice not sorted: %v.", data)
+	}
+}
+
+func TestRotateBigIntsAround(t *testing.T) {
+	// Exhaustively check small even and odd rings against the ring sort
+	for _, mod := range []int64{10, 11} {
+		modulus := big.NewInt(mod)
+		data := make([]*big.Int, mod)
+		for i := range data {
+			data[i] = big.NewInt(int64(i))
+		}
+		for c := int64(0); c < mod; c++ {
+			center := big.NewInt(c)
+
+			want := append([]*big.Int{}, data...)
+			SortBigIntsAround(want, center, modulus)
+			have := RotateBigIntsAround(data, center, modulus)
+			for i := range want {
+				if have[i].Cmp(want[i]) != 0 {
+					t.Fatalf("ring %d, center %d: order mismatch: have %v, want %v.", mod, c, have, want)
+				}
+			}
+		}
+	}
+}
@@ -40,3 +40,24 @@ func Unique(data sort.Interface) int {
 	}
 	return u + 1
 }
+
+// UniqueReport gathers the first occurance of each element to the front, like
+// Unique, additionally returning the indices (in the original sorted data) of
+// the duplicates that were collapsed. Data must be sorted in ascending order.
+func UniqueReport(data sort.Interface) (int, []int) {
+	n, u, i := data.Len(), 0, 1
+	if n < 2 {
+		return n, nil
+	}
+	dups := []int{}
+	for i < n {
+		if data.Less(u, i) {
+			u++
+			data.Swap(u, i)
+		} else {
+			dups = append(dups, i)
+		}
+		i++
+	}
+	return u + 1, dups
+}
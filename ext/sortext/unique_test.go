@@ -20,6 +20,7 @@
 package sortext
 
 import (
+	"math/big"
 	"sort"
 	"testing"
 )
@@ -27,11 +28,13 @@ import (
 type uniqueTest struct {
 	data []int
 	num  int
+	dups []int
 }
 
 var uniqueTests = []uniqueTest{
-	{[]int{}, 0},
-	{[]int{1}, 1},
+	{[]int{}, 0, nil},
+	{[]int{1}, 1, nil},
+	{[]int{1, 2, 3}, 3, []int{}},
 	{
 		[]int{
 			1,
@@ -42,21 +45,66 @@ var uniqueTests = []uniqueTest{
 			6, 6, 6, 6, 6, 6,
 		},
 		6,
+		[]int{2, 4, 5, 7, 8, 9, 11, 12, 13, 14, 16, 17, 18, 19, 20},
 	},
 }
 
 func TestUnique(t *testing.T) {
 	for i, tt := range uniqueTests {
-		n := Unique(sort.IntSlice(tt.data))
+		data := append([]int{}, tt.data...)
+		n := Unique(sort.IntSlice(data))
 		if n != tt.num {
 			t.Errorf("test %d: unique count mismatch: have %v, want %v.", i, n, tt.num)
 		}
 		for j := 0; j < n; j++ {
 			for k := j + 1; k < n; k++ {
-				if tt.data[j] >= tt.data[k] {
-					t.Errorf("test %d: uniqueness violation: (%d, %d) in %v.", i, j, k, tt.data[:n])
+				if data[j] >= data[k] {
+					t.Errorf("test %d: uniqueness violation: (%d, %d) in %v.", i, j, k, data[:n])
 				}
 			}
 		}
 	}
 }
+
+func TestUniqueReport(t *testing.T) {
+	for i, tt := range uniqueTests {
+		data := append([]int{}, tt.data...)
+		n, dups := UniqueReport(sort.IntSlice(data))
+		if n != tt.num {
+			t.Errorf("test %d: unique count mismatch: have %v, want %v.", i, n, tt.num)
+		}
+		for j := 0; j < n; j++ {
+			for k := j + 1; k < n; k++ {
+				if data[j] >= data[k] {
+					t.Errorf("test %d: uniqueness violation: (%d, %d) in %v.", i, j, k, data[:n])
+				}
+			}
+		}
+		if len(dups) != len(tt.dups) {
+			t.Errorf("test %d: duplicate count mismatch: have %v, want %v.", i, len(dups), len(tt.dups))
+			continue
+		}
+		for j, idx := range dups {
+			if idx != tt.dups[j] {
+				t.Errorf("test %d: duplicate indices mismatch: have %v, want %v.", i, dups, tt.dups)
+				break
+			}
+		}
+	}
+}
+
+func TestUniqueBigFloats(t *testing.T) {
+	// Equal values of different precisions and signed zeros should collapse
+	data := []*big.Float{
+		big.NewFloat(-1),
+		new(big.Float).Neg(big.NewFloat(0)),
+		big.NewFloat(0),
+		big.NewFloat(0.5),
+		new(big.Float).SetPrec(200).SetFloat64(0.5),
+		new(big.Float).SetInf(false),
+	}
+	BigFloats(data)
+	if n := Unique(BigFloatSlice(data)); n != 4 {
+		t.Errorf("unique count mismatch: have %v, want %v.", n, 4)
+	}
+}
@@ -0,0 +1,105 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the phi accrual failure detector, an alternative to the
+// fixed missed tick count for deciding the liveliness of the entities.
+
+package heart
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Number of inter-arrival samples kept per entity by the accrual detector.
+var accrualWindow = 64
+
+// Ping arrival history of an entity, used by the accrual failure detector.
+type arrivals struct {
+	seen  time.Time // Time of the last recorded ping
+	samps []float64 // Recent inter-arrival times (secs), used as a ring buffer
+	next  int       // Position of the next sample to overwrite
+}
+
+// Records a ping arrival, updating the inter-arrival samples.
+func (a *arrivals) record(now time.Time) {
+	if !a.seen.IsZero() {
+		gap := now.Sub(a.seen).Seconds()
+		if len(a.samps) < accrualWindow {
+			a.samps = append(a.samps, gap)
+		} else {
+			a.samps[a.next] = gap
+			a.next = (a.next + 1) % accrualWindow
+		}
+	}
+	a.seen = now
+}
+
+// Calculates the suspicion level of an entity at the given time, assuming that
+// the inter-arrival times are normally distributed. Until samples are gathered,
+// the beat interval is used as the expected mean. The deviation is kept at least
+// half the mean to tolerate the occasional late ping on steady links.
+func (a *arrivals) phi(now time.Time, beat time.Duration) float64 {
+	mean, dev := beat.Seconds(), 0.0
+	if n := len(a.samps); n > 0 {
+		sum := 0.0
+		for _, s := range a.samps {
+			sum += s
+		}
+		mean = sum / float64(n)
+		for _, s := range a.samps {
+			dev += (s - mean) * (s - mean)
+		}
+		dev = math.Sqrt(dev / float64(n))
+	}
+	dev = math.Max(dev, mean/2)
+
+	y := (now.Sub(a.seen).Seconds() - mean) / dev
+	if p := math.Erfc(y/math.Sqrt2) / 2; p > 0 {
+		return -math.Log10(p)
+	}
+	return math.Inf(1)
+}
+
+// Creates and returns a new heartbeat mechanism beating once every beat, which
+// uses a phi accrual failure detector instead of a fixed missed beat count: the
+// inter-arrival times of the pings are recorded per entity, and the entities are
+// reported dead if their suspicion level reaches threshold, which must be positive.
+func NewAccrual(beat time.Duration, threshold float64, handler Callback) *Heart {
+	if !(threshold > 0) {
+		panic(fmt.Sprintf("invalid accrual threshold: %v", threshold))
+	}
+	h := New(beat, 0, handler)
+	h.phi = threshold
+	return h
+}
+
+// Checks whether an entity is to be reported dead: either it missed its kill
+// count of ticks, or in accrual mode its suspicion level reached the threshold.
+// Entities never pinged are measured from their first beat cycle.
+func (h *Heart) expired(m *entity, now time.Time) bool {
+	if h.phi > 0 {
+		if m.arr.seen.IsZero() {
+			m.arr.seen = now
+		}
+		return m.arr.phi(now, h.period(m)) >= h.phi
+	}
+	return h.current(m)-m.tick >= h.limit(m)
+}
@@ -0,0 +1,100 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package heart
+
+import (
+	"math"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestAccrualThreshold(t *testing.T) {
+	for _, threshold := range []float64{0, -1, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("threshold %v: accrual detector created.", threshold)
+				}
+			}()
+			NewAccrual(time.Second, threshold, new(testCallback))
+		}()
+	}
+}
+
+func TestAccrual(t *testing.T) {
+	alice := big.NewInt(314)
+	beat := 20 * time.Millisecond
+
+	// Create a fixed and an accrual detector, monitoring the same entity
+	fixed := New(beat, 2, new(testCallback))
+	accrual := NewAccrual(beat, 8, new(testCallback))
+	for _, h := range []*Heart{fixed, accrual} {
+		if err := h.Monitor(alice); err != nil {
+			t.Fatalf("failed to monitor alice: %v.", err)
+		}
+	}
+	// Manually step a beat cycle, optionally pinging beforehand
+	step := func(ping bool) (bool, bool) {
+		time.Sleep(beat)
+		dead := []bool{}
+		for _, h := range []*Heart{fixed, accrual} {
+			if ping {
+				h.Ping(alice)
+			}
+			h.lock.Lock()
+			ids, _, _ := h.advance()
+			h.lock.Unlock()
+			dead = append(dead, len(ids) > 0)
+		}
+		return dead[0], dead[1]
+	}
+	// Ping regularly to gather the arrival statistics
+	for i := 0; i < 16; i++ {
+		if fd, ad := step(true); fd || ad {
+			t.Fatalf("cycle %d: regular entity reported dead: fixed %v, accrual %v.", i, fd, ad)
+		}
+	}
+	// Delay a ping by a few beats: the fixed detector should kill, accrual not
+	killed := false
+	for i := 0; i < 2; i++ {
+		fd, ad := step(false)
+		if ad {
+			t.Fatalf("late ping %d: accrual detector reported death.", i)
+		}
+		killed = killed || fd
+	}
+	if !killed {
+		t.Fatalf("fixed detector didn't report late ping.")
+	}
+	time.Sleep(beat / 2)
+	if _, ad := step(true); ad {
+		t.Fatalf("accrual detector reported death after late ping.")
+	}
+	// Stop pinging altogether, the accrual detector should eventually kill
+	for i := 0; ; i++ {
+		if _, ad := step(false); ad {
+			break
+		}
+		if i > 10 {
+			t.Fatalf("accrual detector didn't report silent entity.")
+		}
+	}
+}
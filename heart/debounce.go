@@ -0,0 +1,66 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains a callback wrapper to rate limit the beat events.
+
+package heart
+
+import (
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Callback wrapper forwarding beats at most once per a minimum interval.
+type debouncer struct {
+	call Callback      // Wrapped application callback
+	min  time.Duration // Minimum interval between forwarded beats
+	last time.Time     // Time of the last forwarded beat
+	lock sync.Mutex
+}
+
+// Wraps a heartbeat callback so that Beat is forwarded at most once every min
+// interval, dropping the beats arriving in between. Dead events are always
+// passed through immediately.
+func Debounce(cb Callback, min time.Duration) Callback {
+	return &debouncer{
+		call: cb,
+		min:  min,
+	}
+}
+
+// Forwards the beat if enough time passed since the last one.
+func (d *debouncer) Beat() {
+	d.lock.Lock()
+	now := time.Now()
+	fire := d.last.IsZero() || now.Sub(d.last) >= d.min
+	if fire {
+		d.last = now
+	}
+	d.lock.Unlock()
+
+	if fire {
+		d.call.Beat()
+	}
+}
+
+// Forwards the death event unconditionally.
+func (d *debouncer) Dead(id *big.Int) {
+	d.call.Dead(id)
+}
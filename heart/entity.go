@@ -29,8 +29,37 @@ import (
 
 // Entity and related information.
 type entity struct {
-	id   *big.Int // Unique identifier of the entity
-	tick int      // Tick of the last recorded activity
+	id     *big.Int      // Unique identifier of the entity
+	tick   int           // Tick of the last recorded activity
+	parent *big.Int      // Entity this one depends on (nil if independent)
+	kill   int           // Missed ticks before reported dead (0 = heart-wide default)
+	group  *group        // Group whose beat cycles the entity follows (nil = heart-wide)
+	stop   chan struct{} // Closed on removal to terminate the context watcher (nil if none)
+
+	pinged bool   // Whether the entity pinged during the current cycle
+	hist   uint64 // Ping history of the recent cycles (bit 0 = last cycle)
+	cycles int    // Number of cycles recorded in the history
+	flaky  bool   // Whether the entity was reported unreliable
+	dead   bool   // Whether the entity was reported dead (and not revived since)
+
+	arr arrivals // Ping arrival history for the accrual detector
+}
+
+// Calculates the fraction of the recent cycles (at most window) in which the
+// entity pinged. Entities without any recorded cycles are deemed reliable.
+func (e *entity) reliability(window int) float64 {
+	n := e.cycles
+	if n > window {
+		n = window
+	}
+	if n == 0 {
+		return 1
+	}
+	hits := 0
+	for i := 0; i < n; i++ {
+		hits += int(e.hist >> uint(i) & 1)
+	}
+	return float64(hits) / float64(n)
 }
 
 // Entity slice implementing sort.Interface.
@@ -55,3 +84,43 @@ func (s entitySlice) Swap(i, j int) {
 func (s entitySlice) Search(x *big.Int) int {
 	return sort.Search(len(s), func(i int) bool { return s[i].id.Cmp(x) >= 0 })
 }
+
+// Inserts an entity into the sorted slice, keeping it sorted, and returns the
+// resulting slice.
+func (s entitySlice) Insert(e *entity) entitySlice {
+	i := s.Search(e.id)
+	s = append(s, nil)
+	copy(s[i+1:], s[i:])
+	s[i] = e
+	return s
+}
+
+// Searches the slice for an id and returns its index, or -1 if not found.
+func (s entitySlice) Index(x *big.Int) int {
+	if i := s.Search(x); i < len(s) && s[i].id.Cmp(x) == 0 {
+		return i
+	}
+	return -1
+}
+
+// Entity ids slice sortable by their dependency depths.
+type depthSlice struct {
+	ids    []*big.Int
+	depths []int
+}
+
+// Required for sort.Sort.
+func (s depthSlice) Len() int {
+	return len(s.ids)
+}
+
+// Required for sort.Sort.
+func (s depthSlice) Less(i, j int) bool {
+	return s.depths[i] < s.depths[j]
+}
+
+// Required for sort.Sort.
+func (s depthSlice) Swap(i, j int) {
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+	s.depths[i], s.depths[j] = s.depths[j], s.depths[i]
+}
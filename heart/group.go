@@ -0,0 +1,132 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the named entity groups, each beating with its own cadence
+// and kill threshold independently of the heart-wide defaults.
+
+package heart
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Beat cycle configuration and state of a named entity group.
+type group struct {
+	name string        // Name the group was registered with
+	beat time.Duration // Time duration of the group's beat cycle
+	kill int           // Number of missed group beats before an entity is reported dead
+	tick int           // Current group monitoring cycle tick
+	next time.Time     // Time of the group's next beat cycle
+}
+
+// Registers a new entity group beating once every beat, reporting its members as
+// dead if not seen in kill of the group's beats. Entities not assigned to any
+// group remain on the heart-wide beat and kill defaults. Group beats are neither
+// jittered nor signaled through Beat, only the deaths are reported.
+func (h *Heart) NewGroup(name string, beat time.Duration, kill int) error {
+	if beat <= 0 {
+		return fmt.Errorf("invalid beat interval")
+	}
+	if kill < 1 {
+		return fmt.Errorf("invalid kill threshold")
+	}
+	h.lock.Lock()
+	if _, ok := h.groups[name]; ok {
+		h.lock.Unlock()
+		return fmt.Errorf("duplicate group")
+	}
+	h.groups[name] = &group{name: name, beat: beat, kill: kill, next: time.Now().Add(beat)}
+	h.lock.Unlock()
+
+	h.retune()
+	return nil
+}
+
+// Registers a new entity for the beater to monitor within a group, following the
+// group's beat cycles and kill threshold.
+func (h *Heart) MonitorGroup(name string, id *big.Int) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	g, ok := h.groups[name]
+	if !ok {
+		return fmt.Errorf("non-existent group")
+	}
+	// Make sure no duplicate entries are specified
+	if h.mems.Index(id) >= 0 {
+		return fmt.Errorf("duplicate entry")
+	}
+	h.mems = h.mems.Insert(&entity{id: id, tick: g.tick, group: g})
+	return nil
+}
+
+// Returns the current tick of the cycles an entity is monitored in. The lock must
+// be held by the caller.
+func (h *Heart) current(m *entity) int {
+	if m.group != nil {
+		return m.group.tick
+	}
+	return h.tick
+}
+
+// Returns the beat interval of the cycles an entity is monitored in. The lock must
+// be held by the caller.
+func (h *Heart) period(m *entity) time.Duration {
+	if m.group != nil {
+		return m.group.beat
+	}
+	return h.beat
+}
+
+// Calculates the time until the earliest group beat cycle is due, and whether any
+// groups exist at all. The lock must be held by the caller.
+func (h *Heart) untilGroups(now time.Time) (time.Duration, bool) {
+	var next time.Time
+	for _, g := range h.groups {
+		if next.IsZero() || g.next.Before(next) {
+			next = g.next
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	if wait := next.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// Advances the beat cycles of all the groups due, collecting the dead, revived
+// and unreliable entities within them. A group which fell behind by multiple
+// beats steps only a single tick. The lock must be held by the caller.
+func (h *Heart) advanceGroups(now time.Time) ([]*big.Int, []*big.Int, flakes) {
+	due := make(map[*group]bool)
+	for _, g := range h.groups {
+		if !g.next.After(now) {
+			g.tick++
+			if g.next = g.next.Add(g.beat); !g.next.After(now) {
+				g.next = now.Add(g.beat)
+			}
+			due[g] = true
+		}
+	}
+	return h.cycle(now, func(m *entity) bool { return m.group != nil && due[m.group] })
+}
@@ -22,28 +22,84 @@
 package heart
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"fmt"
+	"github.com/karalabe/iris/ext/mathext"
+	"github.com/karalabe/iris/ext/sortext"
 	"math/big"
 	"sort"
 	"sync"
 	"time"
 )
 
-// Heartbeat callback interface to get notified of events.
+// Heartbeat callback interface to get notified of events. The notifications are
+// delivered sequentially on a dedicated dispatcher, in beat cycle order: within
+// a cycle Beat is always signaled first, followed by the revived, unreliable and
+// dead entities. A slow callback delays the later notifications, but not the beat
+// cycles (and death detections) themselves, unless the pending queue fills up.
 type Callback interface {
 	Beat()
 	Dead(id *big.Int)
 }
 
+// Optional heartbeat callback interface to get notified of all the entities
+// dying in a beat cycle at once, instead of one by one through Dead.
+type BatchCallback interface {
+	BatchDead(ids []*big.Int)
+}
+
+// Optional heartbeat callback interface to get notified of entities previously
+// reported dead, which started pinging again before being unmonitored.
+type RevivalCallback interface {
+	Revived(id *big.Int)
+}
+
+// Optional heartbeat callback interface to get notified of entities whose ping
+// reliability dropped below the configured threshold (see TrackReliability).
+type ReliabilityCallback interface {
+	Unreliable(id *big.Int, reliability float64)
+}
+
+// Number of beat cycles whose notifications may be queued pending dispatch.
+var notifyBuffer = 16
+
+// Upper bounds (in seconds) of the beat cycle duration histogram buckets.
+var durationBuckets = []float64{0.0001, 0.001, 0.01, 0.1, 1}
+
 // Heartbeat mechanism to monitor the liveliness of some entities.
 type Heart struct {
 	mems entitySlice   // List of entities monitored
 	tick int           // Current monitoring cycle tick
 	beat time.Duration // Time duration of a beat cycle
 	kill int           // Number of missed ticks before and entity is reported dead
+	phi  float64       // Suspicion threshold of the accrual detector (0 = use kill)
+
+	jitter time.Duration // Maximum randomization of the beat cycle lengths
+	prev   time.Time     // Time of the previous beat cycle (jittered mode)
+	carry  time.Duration // Elapsed time not yet accounted in ticks (jittered mode)
+
+	groups map[string]*group // Named entity groups beating with their own cadence
 
 	call Callback // Application callback to notify of events
+	hide bool     // Whether to suppress dependents of dead entities
 
+	win int     // Number of recent cycles to calculate ping reliability over
+	low float64 // Reliability threshold to report entities below (0 = off)
+
+	last time.Duration // Processing time of the last beat cycle
+	avg  time.Duration // Smoothed processing time of the beat cycles
+	runs int           // Number of beat cycles measured
+
+	durs *mathext.Histogram // Distribution of the beat cycle processing times (secs)
+
+	waits map[string][]chan error // Waiters for the death of specific entities
+
+	notes chan func() // Queue of beat cycle notifications pending dispatch
+	drop  bool        // Whether to drop notifications instead of blocking if the queue is full
+
+	tune chan struct{} // Signals the beater of a beat interval change
 	quit chan struct{}
 	lock sync.Mutex
 }
@@ -55,14 +111,93 @@ func New(beat time.Duration, kill int, handler Callback) *Heart {
 		mems: []*entity{},
 		beat: beat,
 		kill: kill,
+		win:  16,
 		call: handler,
-		quit: make(chan struct{}),
+		durs: mathext.NewHistogram(durationBuckets...),
+
+		groups: make(map[string]*group),
+
+		waits: make(map[string][]chan error),
+		notes: make(chan func(), notifyBuffer),
+		tune:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
 	}
 }
 
+// Creates a new, not yet started heartbeat mechanism with a deep copy of the
+// monitored entities (including their death countdowns) and configuration. The
+// clone doesn't share the beater with the original: it needs to be started and
+// terminated on its own. The callback is shared until replaced via SetCallback.
+func (h *Heart) Clone() *Heart {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	groups := make(map[string]*group, len(h.groups))
+	for name, g := range h.groups {
+		c := *g
+		groups[name] = &c
+	}
+	mems := make(entitySlice, len(h.mems))
+	for i, m := range h.mems {
+		c := *m
+		c.id = new(big.Int).Set(m.id)
+		if m.parent != nil {
+			c.parent = new(big.Int).Set(m.parent)
+		}
+		if m.group != nil {
+			c.group = groups[m.group.name]
+		}
+		c.arr.samps = append([]float64(nil), m.arr.samps...)
+		c.stop = nil // Context watchers stay bound to the original
+		mems[i] = &c
+	}
+	return &Heart{
+		mems: mems,
+		tick: h.tick,
+		beat: h.beat,
+		kill: h.kill,
+		phi:  h.phi,
+		call: h.call,
+
+		jitter: h.jitter,
+		groups: groups,
+
+		hide: h.hide,
+		win:  h.win,
+		low:  h.low,
+		durs: mathext.NewHistogram(durationBuckets...),
+
+		waits: make(map[string][]chan error),
+		notes: make(chan func(), notifyBuffer),
+		drop:  h.drop,
+		tune:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Replaces the callback notified of the heartbeat events.
+func (h *Heart) SetCallback(handler Callback) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.call = handler
+}
+
 // Starts the beater and event notifier.
 func (h *Heart) Start() {
 	go h.beater()
+	go h.notifier()
+}
+
+// Sets whether the notifications of a beat cycle should be dropped if the queue
+// of pending ones is full (i.e. a callback is stalling), instead of blocking the
+// beater until the queue frees up. Only the Beat is lost: the dead, revived and
+// unreliable entities are carried over into the next queued notification.
+func (h *Heart) SetDropNotifications(drop bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.drop = drop
 }
 
 // Terminates the heartbeat mechanism.
@@ -70,82 +205,762 @@ func (h *Heart) Terminate() {
 	close(h.quit)
 }
 
+// Sets the number of recent beat cycles (at most 64) over which the reliability
+// of the entities is calculated, and the threshold below which the callback (if
+// it implements ReliabilityCallback) is notified. A zero threshold disables the
+// notifications.
+func (h *Heart) TrackReliability(window int, threshold float64) error {
+	if window < 1 || window > 64 {
+		return fmt.Errorf("invalid window")
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.win, h.low = window, threshold
+	return nil
+}
+
+// Returns the fraction (0-1) of the recent beat cycles in which an entity was
+// pinged, or zero if the entity is not monitored.
+func (h *Heart) Reliability(id *big.Int) float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if idx := h.mems.Index(id); idx >= 0 {
+		return h.mems[idx].reliability(h.win)
+	}
+	return 0
+}
+
+// Returns a copy of the ids of the monitored entities, in ascending order.
+func (h *Heart) Monitored() []*big.Int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ids := make([]*big.Int, len(h.mems))
+	for i, m := range h.mems {
+		ids[i] = new(big.Int).Set(m.id)
+	}
+	return ids
+}
+
+// Returns the number of beat cycles (of its group, if any) elapsed since an entity
+// was last pinged (or started being monitored), and whether the entity is
+// monitored at all.
+func (h *Heart) LastSeen(id *big.Int) (int, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if idx := h.mems.Index(id); idx >= 0 {
+		return h.current(h.mems[idx]) - h.mems[idx].tick, true
+	}
+	return 0, false
+}
+
+// Changes the beat interval. The entity timeouts remain specified in beats, so
+// the real time until an entity is reported dead scales with the interval. Group
+// members are unaffected. Non-positive intervals are rejected.
+func (h *Heart) SetBeat(beat time.Duration) error {
+	if beat <= 0 {
+		return fmt.Errorf("invalid beat interval")
+	}
+	h.lock.Lock()
+	h.beat = beat
+	h.lock.Unlock()
+
+	h.retune()
+	return nil
+}
+
+// Changes the beat interval, rescaling the kill threshold and the age of every
+// monitored entity so that their real time until being reported dead remains
+// unchanged (up to a beat of rounding, never reporting earlier). Group members
+// are unaffected. Non-positive intervals are rejected.
+func (h *Heart) Rescale(beat time.Duration) error {
+	if beat <= 0 {
+		return fmt.Errorf("invalid beat interval")
+	}
+	h.lock.Lock()
+	for _, m := range h.mems {
+		if m.group != nil {
+			continue
+		}
+		m.tick = h.tick - int(time.Duration(h.tick-m.tick)*h.beat/beat)
+		if m.kill > 0 {
+			m.kill = int((time.Duration(m.kill)*h.beat + beat - 1) / beat)
+		}
+	}
+	h.kill = int((time.Duration(h.kill)*h.beat + beat - 1) / beat)
+	h.beat = beat
+	h.lock.Unlock()
+
+	h.retune()
+	return nil
+}
+
+// Notifies the beater of a beat interval change, if not already pending.
+func (h *Heart) retune() {
+	select {
+	case h.tune <- struct{}{}:
+	default:
+	}
+}
+
 // Registers a new entity for the beater to monitor.
 func (h *Heart) Monitor(id *big.Int) error {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
 	// Make sure no duplicate entries are specified
-	idx := h.mems.Search(id)
-	if idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
+	if h.mems.Index(id) >= 0 {
 		return fmt.Errorf("duplicate entry")
 	}
 
-	h.mems = append(h.mems, &entity{id: id, tick: h.tick})
-	sort.Sort(h.mems)
+	h.mems = h.mems.Insert(&entity{id: id, tick: h.tick})
+	return nil
+}
+
+// Registers a new entity for the beater to monitor, overriding the heart-wide
+// number of missed beats after which it is reported dead.
+func (h *Heart) MonitorWith(id *big.Int, kill int) error {
+	if kill < 1 {
+		return fmt.Errorf("invalid kill threshold")
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// Make sure no duplicate entries are specified
+	if h.mems.Index(id) >= 0 {
+		return fmt.Errorf("duplicate entry")
+	}
+
+	h.mems = h.mems.Insert(&entity{id: id, tick: h.tick, kill: kill})
+	return nil
+}
+
+// Reconciles the monitored entities against a target set: new ids are monitored
+// and the ones missing from the target are unmonitored, in a single atomic step.
+// Returns the number of entities added and removed.
+func (h *Heart) MonitorAll(ids []*big.Int) (added int, removed int) {
+	target := make([]*big.Int, len(ids))
+	copy(target, ids)
+	sortext.BigInts(target)
+	target = target[:sortext.Unique(sortext.BigIntSlice(target))]
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// Keep the entities in the target, drop the rest
+	mems := make(entitySlice, 0, len(target))
+	for _, m := range h.mems {
+		if sortext.IndexBigInt(target, m.id) >= 0 {
+			mems = append(mems, m)
+		} else {
+			h.release(m)
+			removed++
+		}
+	}
+	// Monitor all the target ids not yet present
+	kept := mems
+	for _, id := range target {
+		if kept.Index(id) < 0 {
+			mems = append(mems, &entity{id: id, tick: h.tick})
+			added++
+		}
+	}
+	sort.Sort(mems)
+	h.mems = mems
+	return
+}
+
+// Registers a new entity for the beater to monitor, which depends on an already
+// monitored parent. If both die, the parent is reported first, followed by the
+// dependents (or the dependents are suppressed, see SuppressDependents).
+func (h *Heart) MonitorDependent(child, parent *big.Int) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// Make sure the parent exists and the child is not a duplicate
+	if h.mems.Index(parent) < 0 {
+		return fmt.Errorf("non-monitored parent")
+	}
+	if h.mems.Index(child) >= 0 {
+		return fmt.Errorf("duplicate entry")
+	}
+	h.mems = h.mems.Insert(&entity{id: child, tick: h.tick, parent: parent})
 	return nil
 }
 
+// Sets whether the deaths of dependent entities should be suppressed if their
+// parent is also dead, instead of reporting them after the parent.
+func (h *Heart) SuppressDependents(suppress bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.hide = suppress
+}
+
 // Unregisters an entity from the possible balancing destinations.
 func (h *Heart) Unmonitor(id *big.Int) error {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
-	idx := h.mems.Search(id)
-	if idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
-		// Swap with last element
-		last := len(h.mems) - 1
-		h.mems[idx] = h.mems[last]
-		h.mems = h.mems[:last]
-
-		// Get back to sorted order
-		sort.Sort(h.mems)
+	if idx := h.mems.Index(id); idx >= 0 {
+		h.remove(idx)
 		return nil
 	}
 	return fmt.Errorf("non-monitored entity")
 }
 
+// Registers a new entity for the beater to monitor until the context is done,
+// after which a watcher removes it automatically. Unmonitoring the entity in the
+// mean time terminates the watcher.
+func (h *Heart) MonitorContext(ctx context.Context, id *big.Int) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// Make sure no duplicate entries are specified
+	if h.mems.Index(id) >= 0 {
+		return fmt.Errorf("duplicate entry")
+	}
+	ent := &entity{id: id, tick: h.tick, stop: make(chan struct{})}
+	h.mems = h.mems.Insert(ent)
+
+	go func() {
+		select {
+		case <-h.quit:
+		case <-ent.stop:
+		case <-ctx.Done():
+			h.lock.Lock()
+			defer h.lock.Unlock()
+
+			if idx := h.mems.Index(id); idx >= 0 && h.mems[idx] == ent {
+				h.remove(idx)
+			}
+		}
+	}()
+	return nil
+}
+
+// Removes the idx-th monitored entity. The lock is assumed to be held.
+func (h *Heart) remove(idx int) {
+	h.release(h.mems[idx])
+
+	// Swap with last element
+	last := len(h.mems) - 1
+	h.mems[idx] = h.mems[last]
+	h.mems = h.mems[:last]
+
+	// Get back to sorted order
+	sort.Sort(h.mems)
+}
+
+// Releases anyone waiting for the death of a removed entity with an error, and
+// terminates its context watcher if any. The lock is assumed to be held.
+func (h *Heart) release(m *entity) {
+	if m.stop != nil {
+		close(m.stop)
+	}
+	key := m.id.String()
+	for _, wait := range h.waits[key] {
+		wait <- fmt.Errorf("entity unmonitored")
+	}
+	delete(h.waits, key)
+}
+
+// Blocks until a monitored entity is reported dead, returning an error if it is
+// not monitored, gets unmonitored or if the context is cancelled before its death.
+func (h *Heart) Await(ctx context.Context, id *big.Int) error {
+	h.lock.Lock()
+	if h.mems.Index(id) < 0 {
+		h.lock.Unlock()
+		return fmt.Errorf("non-monitored entity")
+	}
+	key, wait := id.String(), make(chan error, 1)
+	h.waits[key] = append(h.waits[key], wait)
+	h.lock.Unlock()
+
+	select {
+	case err := <-wait:
+		return err
+	case <-ctx.Done():
+		// Unregister the waiter if it hasn't been signaled meanwhile
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		waits := h.waits[key]
+		for i, w := range waits {
+			if w == wait {
+				waits = append(waits[:i], waits[i+1:]...)
+				break
+			}
+		}
+		if len(waits) == 0 {
+			delete(h.waits, key)
+		} else {
+			h.waits[key] = waits
+		}
+		return ctx.Err()
+	}
+}
+
+// Portable liveness state of a monitored entity. Absolute ticks are local to a
+// heartbeat instance, so the freshness is carried as beats remaining until death.
+type exportedEntity struct {
+	Id     *big.Int
+	Parent *big.Int
+	Left   int
+	Kill   int
+}
+
+// Serializes the monitored entities along with their remaining beats until being
+// reported dead, so that a restarted heartbeat can resume their countdowns. The
+// ping arrival histories of the accrual detector are not exported: imported
+// entities gather their statistics anew, starting from the beat interval.
+func (h *Heart) Export() ([]byte, error) {
+	h.lock.Lock()
+	ents := make([]exportedEntity, len(h.mems))
+	for i, m := range h.mems {
+		ents[i] = exportedEntity{Id: m.id, Parent: m.parent, Left: h.limit(m) - (h.current(m) - m.tick), Kill: m.kill}
+	}
+	h.lock.Unlock()
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(ents); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restores the entities serialized by Export, monitoring the new ones and resuming
+// the death countdowns of all from the exported remaining beats (capped at the
+// kill threshold of the entity). Already monitored entities are overwritten.
+func (h *Heart) Import(data []byte) error {
+	ents := []exportedEntity{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&ents); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, e := range ents {
+		if e.Id == nil {
+			return fmt.Errorf("invalid entity")
+		}
+		if e.Kill < 0 {
+			return fmt.Errorf("invalid kill threshold")
+		}
+		m := &entity{id: e.Id, parent: e.Parent, kill: e.Kill}
+		idx := h.mems.Index(e.Id)
+		if idx >= 0 {
+			m.group = h.mems[idx].group
+		}
+		m.tick = h.current(m) - h.limit(m) + mathext.MinInt(e.Left, h.limit(m))
+		if idx >= 0 {
+			h.mems[idx].tick, h.mems[idx].parent, h.mems[idx].kill = m.tick, m.parent, m.kill
+		} else {
+			h.mems = h.mems.Insert(m)
+		}
+	}
+	return nil
+}
+
 // Updates the life tick of an entity.
 func (h *Heart) Ping(id *big.Int) error {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
-	idx := h.mems.Search(id)
-	if idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
-		h.mems[idx].tick = h.tick
+	if idx := h.mems.Index(id); idx >= 0 {
+		h.mems[idx].tick = h.current(h.mems[idx])
+		h.mems[idx].pinged = true
+		if h.phi > 0 {
+			h.mems[idx].arr.record(time.Now())
+		}
 		return nil
 	}
 	return fmt.Errorf("non-monitored entity")
 }
 
+// Updates the life tick of an entity if it's monitored, returning whether the
+// ping succeeded. Unlike Ping, no error is allocated for unknown entities.
+func (h *Heart) PingIfMonitored(id *big.Int) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if idx := h.mems.Index(id); idx >= 0 {
+		h.mems[idx].tick = h.current(h.mems[idx])
+		h.mems[idx].pinged = true
+		if h.phi > 0 {
+			h.mems[idx].arr.record(time.Now())
+		}
+		return true
+	}
+	return false
+}
+
+// Updates the life ticks of a batch of entities under a single lock, returning
+// an error for each non-monitored one (nil entries for the successful pings).
+func (h *Heart) PingAll(ids []*big.Int) []error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	errs := make([]error, len(ids))
+	now := time.Now()
+	for i, id := range ids {
+		if idx := h.mems.Search(id); idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
+			h.mems[idx].tick = h.current(h.mems[idx])
+			h.mems[idx].pinged = true
+			if h.phi > 0 {
+				h.mems[idx].arr.record(now)
+			}
+		} else {
+			errs[i] = fmt.Errorf("non-monitored entity")
+		}
+	}
+	return errs
+}
+
 // Beater function meant to run as a separate go routine to keep pinging each
 // monitored entity and report when some fail to respond within alloted time.
 func (h *Heart) beater() {
-	beat := time.NewTicker(h.beat)
-	defer beat.Stop()
+	// Schedules the next group beat cycle, if any groups exist (lock held)
+	var group *time.Timer
+	var gtick <-chan time.Time
+
+	regroup := func() {
+		if group != nil {
+			group.Stop()
+		}
+		group, gtick = nil, nil
+		if wait, ok := h.untilGroups(time.Now()); ok {
+			group = time.NewTimer(wait)
+			gtick = group.C
+		}
+	}
+	// Transitions of the cycles whose notifications were dropped
+	held := new(backlog)
+
+	h.lock.Lock()
+	h.prev = time.Now()
+	beat := time.NewTimer(h.interval())
+	for _, g := range h.groups {
+		g.next = h.prev.Add(g.beat)
+	}
+	regroup()
+	h.lock.Unlock()
+
+	defer func() {
+		beat.Stop()
+		if group != nil {
+			group.Stop()
+		}
+	}()
 
-	dead := []*big.Int{}
 	for {
 		select {
 		case <-h.quit:
 			return
-		case <-beat.C:
-			// Beat cycle: update tick and collect dead entries
+		case <-h.tune:
+			h.lock.Lock()
+			beat.Stop()
+			beat = time.NewTimer(h.interval())
+			regroup()
+			h.lock.Unlock()
+		case <-gtick:
+			// Group beat cycle: update the due groups and collect their dead and flaky entries
 			h.lock.Lock()
-			h.tick++
-			dead = dead[:0]
-			for _, m := range h.mems {
-				if h.tick-m.tick >= h.kill {
-					dead = append(dead, m.id)
+			dead, revived, flaky := h.advanceGroups(time.Now())
+			regroup()
+			call, drop := h.call, h.drop
+			h.lock.Unlock()
+
+			dead, revived, flaky = held.merge(dead, revived, flaky)
+			if len(dead) == 0 && len(revived) == 0 && len(flaky.ids) == 0 {
+				continue
+			}
+			note := func() { h.notify(call, false, dead, revived, flaky) }
+			if drop {
+				select {
+				case h.notes <- note:
+					held = new(backlog)
+				default:
+					held = &backlog{dead, revived, flaky}
+				}
+			} else {
+				select {
+				case h.notes <- note:
+					held = new(backlog)
+				case <-h.quit:
+					return
 				}
 			}
+		case <-beat.C:
+			start := time.Now()
+
+			// Beat cycle: schedule the next, update tick and collect dead and flaky entries
+			h.lock.Lock()
+			beat.Reset(h.interval())
+			dead, revived, flaky := h.advance()
+			call, drop := h.call, h.drop
 			h.lock.Unlock()
 
-			// Signal beat and dead entities after releasing the lock
-			h.call.Beat()
-			for _, id := range dead {
-				h.call.Dead(id)
+			// Queue the cycle's notifications (and any held ones) for the dispatcher
+			dead, revived, flaky = held.merge(dead, revived, flaky)
+			elapsed := time.Since(start)
+			note := func() {
+				start := time.Now()
+				h.notify(call, true, dead, revived, flaky)
+				h.measure(elapsed + time.Since(start))
+			}
+			if drop {
+				select {
+				case h.notes <- note:
+					held = new(backlog)
+				default:
+					held = &backlog{dead, revived, flaky}
+					h.measure(elapsed)
+				}
+			} else {
+				select {
+				case h.notes <- note:
+					held = new(backlog)
+				case <-h.quit:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Dispatcher function meant to run as a separate go routine to deliver the beat
+// cycle notifications queued by the beater, so that slow callbacks can't delay
+// the death detection of the following cycles.
+func (h *Heart) notifier() {
+	for {
+		select {
+		case <-h.quit:
+			return
+		case note := <-h.notes:
+			note()
+		}
+	}
+}
+
+// Signals the beat (unless a group cycle), revived, flaky and dead entities of a
+// beat cycle.
+func (h *Heart) notify(call Callback, beat bool, dead, revived []*big.Int, flaky flakes) {
+	if beat {
+		call.Beat()
+	}
+	if rev, ok := call.(RevivalCallback); ok {
+		for _, id := range revived {
+			rev.Revived(id)
+		}
+	}
+	if rel, ok := call.(ReliabilityCallback); ok {
+		for i, id := range flaky.ids {
+			rel.Unreliable(id, flaky.rels[i])
+		}
+	}
+	if batch, ok := call.(BatchCallback); ok {
+		if len(dead) > 0 {
+			batch.BatchDead(dead)
+		}
+	} else {
+		for _, id := range dead {
+			call.Dead(id)
+		}
+	}
+}
+
+// Entities reported unreliable along with their reliabilities.
+type flakes struct {
+	ids  []*big.Int
+	rels []float64
+}
+
+// Entity transitions of beat cycles whose notifications were dropped.
+type backlog struct {
+	dead    []*big.Int
+	revived []*big.Int
+	flaky   flakes
+}
+
+// Merges the transitions of a newer cycle after the held ones and returns them.
+// A newer transition of an entity supersedes the held ones (i.e. repeated deaths
+// are reported once, and a revival replaces the held death and vice versa).
+func (b *backlog) merge(dead, revived []*big.Int, flaky flakes) ([]*big.Int, []*big.Int, flakes) {
+	if len(b.dead) == 0 && len(b.revived) == 0 && len(b.flaky.ids) == 0 {
+		return dead, revived, flaky
+	}
+	// Retains the held ids without a newer transition
+	retain := func(olds []*big.Int, news ...[]*big.Int) []*big.Int {
+		keep := []*big.Int{}
+		for _, id := range olds {
+			superseded := false
+			for _, ids := range news {
+				for _, n := range ids {
+					if n.Cmp(id) == 0 {
+						superseded = true
+					}
+				}
+			}
+			if !superseded {
+				keep = append(keep, id)
+			}
+		}
+		return keep
+	}
+	oldDead := retain(b.dead, dead, revived)
+	oldRevived := retain(b.revived, dead, revived)
+
+	flaky = flakes{
+		ids:  append(append([]*big.Int{}, b.flaky.ids...), flaky.ids...),
+		rels: append(append([]float64{}, b.flaky.rels...), flaky.rels...),
+	}
+	return append(oldDead, dead...), append(oldRevived, revived...), flaky
+}
+
+// Returns the number of missed ticks after which an entity is reported dead.
+func (h *Heart) limit(m *entity) int {
+	if m.kill > 0 {
+		return m.kill
+	}
+	if m.group != nil {
+		return m.group.kill
+	}
+	return h.kill
+}
+
+// Advances the beat cycle: updates the tick and the ping histories, collecting
+// the dead entities, the previously dead ones which pinged since and the ones
+// that just became unreliable. Group members are left to their own cycles. The
+// lock must be held by the caller.
+func (h *Heart) advance() ([]*big.Int, []*big.Int, flakes) {
+	now := time.Now()
+	h.tick += h.steps(now)
+
+	return h.cycle(now, func(m *entity) bool { return m.group == nil })
+}
+
+// Updates the ping histories of the entities selected by pick, collecting the
+// dead, revived and unreliable ones. The lock must be held by the caller.
+func (h *Heart) cycle(now time.Time, pick func(m *entity) bool) ([]*big.Int, []*big.Int, flakes) {
+	dead, revived, flaky := []*big.Int{}, []*big.Int{}, flakes{}
+	for _, m := range h.mems {
+		if !pick(m) {
+			continue
+		}
+		// Record the ping history and check for unreliability
+		m.hist <<= 1
+		if m.pinged {
+			m.hist |= 1
+		}
+		m.pinged = false
+		if m.cycles < 64 {
+			m.cycles++
+		}
+
+		if h.low > 0 && m.cycles >= h.win {
+			rel := m.reliability(h.win)
+			if rel < h.low && !m.flaky {
+				flaky.ids = append(flaky.ids, m.id)
+				flaky.rels = append(flaky.rels, rel)
+			}
+			m.flaky = rel < h.low
+		}
+
+		// Check for dead entities, releasing anyone waiting for them
+		if !h.expired(m, now) {
+			if m.dead {
+				m.dead = false
+				revived = append(revived, m.id)
+			}
+		} else {
+			m.dead = true
+			dead = append(dead, m.id)
+			if waits, ok := h.waits[m.id.String()]; ok {
+				for _, wait := range waits {
+					wait <- nil
+				}
+				delete(h.waits, m.id.String())
+			}
+		}
+	}
+	return h.order(dead), revived, flaky
+}
+
+// Records the processing time of a beat cycle, updating the running average.
+func (h *Heart) measure(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.last = d
+	if h.runs == 0 {
+		h.avg = d
+	} else {
+		h.avg = (7*h.avg + d) / 8
+	}
+	h.runs++
+	h.durs.Add(d.Seconds())
+}
+
+// Returns the wall-clock time spent processing the last beat cycle, including
+// the callback dispatch.
+func (h *Heart) LastBeatDuration() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.last
+}
+
+// Returns the running (exponentially smoothed) average of the time spent in a
+// beat cycle, including the callback dispatch.
+func (h *Heart) AverageBeatDuration() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.avg
+}
+
+// Returns a snapshot of the distribution of the time spent in the beat cycles,
+// measured in seconds.
+func (h *Heart) BeatHistogram() *mathext.Histogram {
+	return h.durs.Snapshot()
+}
+
+// Orders the dead entities so that dependents are reported after the entities
+// they depend on, or drops them if suppression is requested. The lock must be
+// held by the caller.
+func (h *Heart) order(dead []*big.Int) []*big.Int {
+	// Calculate the dead ancestor count of each entity
+	depths := make([]int, len(dead))
+	deps := false
+	for i, id := range dead {
+		for m := h.mems[h.mems.Index(id)]; m.parent != nil && depths[i] < len(h.mems); depths[i]++ {
+			idx := h.mems.Index(m.parent)
+			if idx < 0 || !h.mems[idx].dead {
+				break
+			}
+			m = h.mems[idx]
+		}
+		if depths[i] > 0 {
+			deps = true
+		}
+	}
+	if !deps {
+		return dead
+	}
+	// Filter or sort the entities based on their depths
+	if h.hide {
+		res := dead[:0]
+		for i, id := range dead {
+			if depths[i] == 0 {
+				res = append(res, id)
 			}
 		}
+		return res
 	}
+	sort.Stable(depthSlice{dead, depths})
+	return dead
 }
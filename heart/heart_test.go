@@ -20,7 +20,9 @@
 package heart
 
 import (
+	"context"
 	"math/big"
+	"sync"
 	"testing"
 	"time"
 )
@@ -115,3 +117,849 @@ func TestHeart(t *testing.T) {
 		t.Fatalf("dead event count mismatch: have %v, want %v", n, 1)
 	}
 }
+
+func TestPingIfMonitored(t *testing.T) {
+	alice := big.NewInt(314)
+	bob := big.NewInt(241)
+
+	heart := New(time.Second, 3, &testCallback{dead: []*big.Int{}})
+	if err := heart.Monitor(alice); err != nil {
+		t.Fatalf("failed to monitor alice: %v.", err)
+	}
+	if !heart.PingIfMonitored(alice) {
+		t.Errorf("failed to ping monitored alice.")
+	}
+	if heart.PingIfMonitored(bob) {
+		t.Errorf("pinged non-monitored bob.")
+	}
+	// Make sure failed pings don't allocate
+	if n := testing.AllocsPerRun(100, func() { heart.PingIfMonitored(bob) }); n != 0 {
+		t.Errorf("allocation count mismatch: have %v, want %v.", n, 0)
+	}
+}
+
+func TestPingAll(t *testing.T) {
+	beat := time.Duration(50 * time.Millisecond)
+	kill := 3
+
+	ids := []*big.Int{big.NewInt(314), big.NewInt(241), big.NewInt(271)}
+	heart := New(beat, kill, &testCallback{dead: []*big.Int{}})
+	for _, id := range ids[:2] {
+		if err := heart.Monitor(id); err != nil {
+			t.Fatalf("failed to monitor entity: %v.", err)
+		}
+	}
+	// Advance the beat ticks and ping everybody at once
+	heart.lock.Lock()
+	heart.tick += 2
+	heart.lock.Unlock()
+
+	errs := heart.PingAll(ids)
+	if len(errs) != len(ids) || errs[0] != nil || errs[1] != nil || errs[2] == nil {
+		t.Fatalf("ping errors mismatch: have %v, want [nil nil non-nil].", errs)
+	}
+	for _, id := range ids[:2] {
+		if tick, ok := heart.LastSeen(id); !ok || tick != 0 {
+			t.Errorf("entity %v: last seen mismatch: have %v/%v, want %v/%v.", id, tick, ok, 0, true)
+		}
+	}
+}
+
+// Heartbeat callback gathering the dead events in batches
+type batchCallback struct {
+	testCallback
+	batches [][]*big.Int
+}
+
+func (cb *batchCallback) BatchDead(ids []*big.Int) {
+	cb.batches = append(cb.batches, ids)
+}
+
+func TestBatchDead(t *testing.T) {
+	beat := time.Duration(50 * time.Millisecond)
+	kill := 2
+	call := &batchCallback{testCallback: testCallback{dead: []*big.Int{}}}
+
+	// Monitor a handful of entities and let them all die in the same cycle
+	heart := New(beat, kill, call)
+	for i := 0; i < 5; i++ {
+		if err := heart.Monitor(big.NewInt(int64(i))); err != nil {
+			t.Fatalf("failed to monitor entity #%d: %v.", i, err)
+		}
+	}
+	heart.Start()
+	time.Sleep(10 * time.Millisecond) // Go out of sync with beater
+	time.Sleep(time.Duration(kill) * beat)
+	heart.Terminate()
+
+	// Verify that a single batch was reported instead of individual deaths
+	if n := len(call.dead); n != 0 {
+		t.Fatalf("individual dead event count mismatch: have %v, want %v", n, 0)
+	}
+	if n := len(call.batches); n != 1 {
+		t.Fatalf("batch dead event count mismatch: have %v, want %v", n, 1)
+	}
+	if n := len(call.batches[0]); n != 5 {
+		t.Fatalf("batch size mismatch: have %v, want %v", n, 5)
+	}
+}
+
+func TestMonitorDependent(t *testing.T) {
+	// Parent sorts after the children to ensure reordering
+	parent := big.NewInt(999)
+	child := big.NewInt(1)
+	grandchild := big.NewInt(2)
+
+	beat := time.Duration(50 * time.Millisecond)
+	kill := 2
+
+	for _, suppress := range []bool{false, true} {
+		call := &testCallback{dead: []*big.Int{}}
+		heart := New(beat, kill, call)
+		heart.SuppressDependents(suppress)
+
+		if err := heart.MonitorDependent(child, parent); err == nil {
+			t.Fatalf("monitored a dependent of a non-monitored parent.")
+		}
+		if err := heart.Monitor(parent); err != nil {
+			t.Fatalf("failed to monitor parent: %v.", err)
+		}
+		if err := heart.MonitorDependent(child, parent); err != nil {
+			t.Fatalf("failed to monitor child: %v.", err)
+		}
+		if err := heart.MonitorDependent(grandchild, child); err != nil {
+			t.Fatalf("failed to monitor grandchild: %v.", err)
+		}
+		heart.Start()
+		time.Sleep(10 * time.Millisecond) // Go out of sync with beater
+		time.Sleep(time.Duration(kill) * beat)
+		heart.Terminate()
+
+		// Verify the report order (or suppression)
+		want := []*big.Int{parent, child, grandchild}
+		if suppress {
+			want = want[:1]
+		}
+		if len(call.dead) != len(want) {
+			t.Fatalf("suppress %v: dead reports mismatch: have %v, want %v.", suppress, call.dead, want)
+		}
+		for i, id := range want {
+			if call.dead[i].Cmp(id) != 0 {
+				t.Fatalf("suppress %v: dead reports mismatch: have %v, want %v.", suppress, call.dead, want)
+			}
+		}
+	}
+}
+
+type slowCallback struct {
+	testCallback
+	delay time.Duration
+}
+
+func (cb *slowCallback) Beat() {
+	time.Sleep(cb.delay)
+	cb.testCallback.Beat()
+}
+
+func TestBeatDuration(t *testing.T) {
+	beat := time.Duration(50 * time.Millisecond)
+	call := &slowCallback{testCallback{dead: []*big.Int{}}, 20 * time.Millisecond}
+
+	heart := New(beat, 2, call)
+	if d := heart.LastBeatDuration(); d != 0 {
+		t.Fatalf("non-zero duration before beating: %v.", d)
+	}
+	heart.Start()
+	time.Sleep(10 * time.Millisecond) // Go out of sync with beater
+	time.Sleep(3 * beat)
+	heart.Terminate()
+
+	// Verify that the slow callback is reflected in the metrics
+	if d := heart.LastBeatDuration(); d < call.delay || d >= beat {
+		t.Fatalf("last beat duration mismatch: have %v, want in [%v, %v).", d, call.delay, beat)
+	}
+	if d := heart.AverageBeatDuration(); d < call.delay || d >= beat {
+		t.Fatalf("average beat duration mismatch: have %v, want in [%v, %v).", d, call.delay, beat)
+	}
+	// Verify that all the beats fell into the (10ms, 100ms] bucket
+	hist := heart.BeatHistogram()
+	if n := hist.Count(); n == 0 || hist.Counts()[3] != n {
+		t.Fatalf("beat histogram mismatch: have %v, want all %v in bucket %d.", hist.Counts(), n, 3)
+	}
+}
+
+func TestRescale(t *testing.T) {
+	beat := time.Duration(50 * time.Millisecond)
+	kill := 4
+
+	for _, rescale := range []bool{false, true} {
+		call := &testCallback{dead: []*big.Int{}}
+		heart := New(beat, kill, call)
+		if err := heart.Monitor(big.NewInt(314)); err != nil {
+			t.Fatalf("failed to monitor entity: %v.", err)
+		}
+		// Invalid beat intervals should be rejected
+		for _, invalid := range []time.Duration{0, -beat} {
+			if err := heart.SetBeat(invalid); err == nil {
+				t.Fatalf("rescale %v: set invalid beat %v.", rescale, invalid)
+			}
+			if err := heart.Rescale(invalid); err == nil {
+				t.Fatalf("rescale %v: rescaled to invalid beat %v.", rescale, invalid)
+			}
+		}
+		heart.Start()
+
+		// Halve the beat interval, and check the entity after the new timeout
+		var err error
+		if rescale {
+			err = heart.Rescale(beat / 2)
+		} else {
+			err = heart.SetBeat(beat / 2)
+		}
+		if err != nil {
+			t.Fatalf("rescale %v: failed to change beat: %v.", rescale, err)
+		}
+		time.Sleep(10 * time.Millisecond) // Go out of sync with beater
+		time.Sleep(time.Duration(kill) * beat / 2)
+		if dead := len(call.dead) != 0; dead == rescale {
+			t.Fatalf("rescale %v: death report mismatch: have %v, want %v.", rescale, dead, !rescale)
+		}
+		// Ensure the entity dies after the original real time anyway
+		time.Sleep(time.Duration(kill) * beat / 2)
+		heart.Terminate()
+
+		if len(call.dead) == 0 {
+			t.Fatalf("rescale %v: entity not reported dead.", rescale)
+		}
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	beat := time.Duration(10 * time.Millisecond)
+	kill := 2
+	call := &testCallback{dead: []*big.Int{}}
+
+	// Monitor a few entities and beat fast for a while
+	heart := New(beat, kill, Debounce(call, 100*time.Millisecond))
+	for i := 0; i < 3; i++ {
+		if err := heart.Monitor(big.NewInt(int64(i))); err != nil {
+			t.Fatalf("failed to monitor entity #%d: %v.", i, err)
+		}
+	}
+	heart.Start()
+	time.Sleep(5 * time.Millisecond) // Go out of sync with beater
+	time.Sleep(25 * beat)
+	heart.Terminate()
+
+	// Verify that beats were coalesced, but no deaths dropped
+	if call.beat < 1 || call.beat > 3 {
+		t.Fatalf("forwarded beat count mismatch: have %v, want in [%v, %v].", call.beat, 1, 3)
+	}
+	if n := len(call.dead); n < 3*(25-kill)/2 {
+		t.Fatalf("dead event count mismatch: have %v, want at least %v.", n, 3*(25-kill)/2)
+	}
+}
+
+func TestMonitorWith(t *testing.T) {
+	alice := big.NewInt(314)
+	bob := big.NewInt(241)
+
+	// Monitor one entity with the default and one with a custom threshold
+	heart := New(time.Second, 4, new(testCallback))
+	if err := heart.Monitor(alice); err != nil {
+		t.Fatalf("failed to monitor alice: %v.", err)
+	}
+	if err := heart.MonitorWith(bob, 2); err != nil {
+		t.Fatalf("failed to monitor bob: %v.", err)
+	}
+	if err := heart.MonitorWith(bob, 3); err == nil {
+		t.Fatalf("duplicate monitoring succeeded.")
+	}
+	if err := heart.MonitorWith(big.NewInt(141), 0); err == nil {
+		t.Fatalf("invalid threshold accepted.")
+	}
+	// Step the beat cycles manually and record the first death of each
+	deaths := make(map[string]int)
+	for tick := 1; tick <= 5; tick++ {
+		dead, _, _ := heart.advance()
+		for _, id := range dead {
+			if _, ok := deaths[id.String()]; !ok {
+				deaths[id.String()] = tick
+			}
+		}
+	}
+	if tick := deaths[bob.String()]; tick != 2 {
+		t.Errorf("custom threshold death tick mismatch: have %v, want %v.", tick, 2)
+	}
+	if tick := deaths[alice.String()]; tick != 4 {
+		t.Errorf("default threshold death tick mismatch: have %v, want %v.", tick, 4)
+	}
+}
+
+// Heartbeat callback recording the time of the first death of each entity
+type groupCallback struct {
+	beats int
+	dead  map[string]time.Time
+	lock  sync.Mutex
+}
+
+func (cb *groupCallback) Beat() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.beats++
+}
+
+func (cb *groupCallback) Dead(id *big.Int) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if _, ok := cb.dead[id.String()]; !ok {
+		cb.dead[id.String()] = time.Now()
+	}
+}
+
+func TestMonitorGroup(t *testing.T) {
+	alice := big.NewInt(314)
+	bob := big.NewInt(241)
+
+	// Create a heart with a stalled default beat and two differently paced groups
+	call := &groupCallback{dead: make(map[string]time.Time)}
+	heart := New(time.Hour, 3, call)
+	if err := heart.NewGroup("local", 20*time.Millisecond, 2); err != nil {
+		t.Fatalf("failed to create local group: %v.", err)
+	}
+	if err := heart.NewGroup("remote", 100*time.Millisecond, 2); err != nil {
+		t.Fatalf("failed to create remote group: %v.", err)
+	}
+	if err := heart.NewGroup("local", time.Second, 2); err == nil {
+		t.Fatalf("duplicate group creation succeeded.")
+	}
+	if err := heart.NewGroup("invalid", 0, 2); err == nil {
+		t.Fatalf("invalid beat interval accepted.")
+	}
+	if err := heart.MonitorGroup("unknown", alice); err == nil {
+		t.Fatalf("monitoring in unknown group succeeded.")
+	}
+	// Monitor an entity in each group and ensure both die at their own cadence
+	if err := heart.MonitorGroup("local", alice); err != nil {
+		t.Fatalf("failed to monitor alice: %v.", err)
+	}
+	if err := heart.MonitorGroup("remote", bob); err != nil {
+		t.Fatalf("failed to monitor bob: %v.", err)
+	}
+	if err := heart.MonitorGroup("remote", alice); err == nil {
+		t.Fatalf("duplicate monitoring succeeded.")
+	}
+	start := time.Now()
+	heart.Start()
+	time.Sleep(350 * time.Millisecond)
+	heart.Terminate()
+
+	call.lock.Lock()
+	defer call.lock.Unlock()
+
+	if call.beats != 0 {
+		t.Errorf("group cycles signaled beats: %v.", call.beats)
+	}
+	for _, test := range []struct {
+		id   *big.Int
+		beat time.Duration
+	}{{alice, 20 * time.Millisecond}, {bob, 100 * time.Millisecond}} {
+		dead, ok := call.dead[test.id.String()]
+		if !ok {
+			t.Errorf("entity %v not reported dead.", test.id)
+			continue
+		}
+		if death := dead.Sub(start); death < 2*test.beat || death > 2*test.beat+test.beat/2+20*time.Millisecond {
+			t.Errorf("entity %v: death time mismatch: have %v, want %v.", test.id, death, 2*test.beat)
+		}
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	alice := big.NewInt(314)
+	bob := big.NewInt(241)
+
+	heart := New(time.Second, 4, new(testCallback))
+	heart.Monitor(alice)
+	heart.Monitor(bob)
+
+	// Ensure the monitored ids are copies, in order
+	ids := heart.Monitored()
+	if len(ids) != 2 || ids[0].Cmp(bob) != 0 || ids[1].Cmp(alice) != 0 {
+		t.Fatalf("monitored ids mismatch: have %v, want %v.", ids, []*big.Int{bob, alice})
+	}
+	ids[0].SetInt64(0)
+	if ids := heart.Monitored(); ids[0].Cmp(bob) != 0 {
+		t.Fatalf("internal id modified through copy: %v.", ids[0])
+	}
+	// Advance a few cycles, ping one and check the last seen ticks
+	for i := 0; i < 3; i++ {
+		heart.advance()
+	}
+	heart.Ping(bob)
+	heart.advance()
+
+	if ago, ok := heart.LastSeen(alice); !ok || ago != 4 {
+		t.Fatalf("alice last seen mismatch: have %v/%v, want %v/%v.", ago, ok, 4, true)
+	}
+	if ago, ok := heart.LastSeen(bob); !ok || ago != 1 {
+		t.Fatalf("bob last seen mismatch: have %v/%v, want %v/%v.", ago, ok, 1, true)
+	}
+	if _, ok := heart.LastSeen(big.NewInt(141)); ok {
+		t.Fatalf("unknown entity reported seen.")
+	}
+}
+
+func TestMonitorAll(t *testing.T) {
+	heart := New(time.Second, 2, &testCallback{dead: []*big.Int{}})
+
+	// Reconcile an empty heart to an initial set
+	initial := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)}
+	if added, removed := heart.MonitorAll(initial); added != 4 || removed != 0 {
+		t.Fatalf("initial reconciliation mismatch: have +%d/-%d, want +%d/-%d.", added, removed, 4, 0)
+	}
+	// Reconcile to a partially overlapping set (with a duplicate)
+	target := []*big.Int{big.NewInt(5), big.NewInt(3), big.NewInt(1), big.NewInt(6), big.NewInt(5)}
+	if added, removed := heart.MonitorAll(target); added != 2 || removed != 2 {
+		t.Fatalf("overlapping reconciliation mismatch: have +%d/-%d, want +%d/-%d.", added, removed, 2, 2)
+	}
+	// Verify the monitored set
+	want := []int64{1, 3, 5, 6}
+	if len(heart.mems) != len(want) {
+		t.Fatalf("monitored entity count mismatch: have %v, want %v.", len(heart.mems), len(want))
+	}
+	for i, id := range want {
+		if heart.mems[i].id.Int64() != id {
+			t.Errorf("entity #%d mismatch: have %v, want %v.", i, heart.mems[i].id, id)
+		}
+	}
+	if err := heart.Ping(big.NewInt(2)); err == nil {
+		t.Errorf("removed entity still monitored.")
+	}
+}
+
+type flakyCallback struct {
+	testCallback
+	flaky []*big.Int
+}
+
+func (cb *flakyCallback) Unreliable(id *big.Int, reliability float64) {
+	cb.flaky = append(cb.flaky, id)
+}
+
+func TestReliability(t *testing.T) {
+	steady, flapping := big.NewInt(314), big.NewInt(241)
+
+	heart := New(time.Second, 1000, &flakyCallback{})
+	if err := heart.TrackReliability(10, 0.75); err != nil {
+		t.Fatalf("failed to enable reliability tracking: %v.", err)
+	}
+	for _, id := range []*big.Int{steady, flapping} {
+		if err := heart.Monitor(id); err != nil {
+			t.Fatalf("failed to monitor entity: %v.", err)
+		}
+	}
+	// Drive the beat cycles manually, pinging the flapping entity every other one
+	flaky := flakes{}
+	for i := 0; i < 20; i++ {
+		heart.Ping(steady)
+		if i%2 == 0 {
+			heart.Ping(flapping)
+		}
+		heart.lock.Lock()
+		_, _, f := heart.advance()
+		heart.lock.Unlock()
+
+		flaky.ids = append(flaky.ids, f.ids...)
+		flaky.rels = append(flaky.rels, f.rels...)
+	}
+	if rel := heart.Reliability(steady); rel != 1 {
+		t.Errorf("steady reliability mismatch: have %v, want %v.", rel, 1)
+	}
+	if rel := heart.Reliability(flapping); rel < 0.4 || rel > 0.6 {
+		t.Errorf("flapping reliability mismatch: have %v, want ~%v.", rel, 0.5)
+	}
+	// Verify that only the flapping entity was reported, and only once
+	if len(flaky.ids) != 1 || flaky.ids[0].Cmp(flapping) != 0 {
+		t.Errorf("unreliable reports mismatch: have %v, want %v.", flaky.ids, []*big.Int{flapping})
+	}
+	if rel := heart.Reliability(big.NewInt(1)); rel != 0 {
+		t.Errorf("non-monitored reliability mismatch: have %v, want %v.", rel, 0)
+	}
+}
+
+func TestClone(t *testing.T) {
+	beat := time.Duration(50 * time.Millisecond)
+	kill := 3
+	alice, bob := big.NewInt(314), big.NewInt(241)
+
+	// Monitor two entities, and let one of them age a bit
+	heart := New(beat, kill, &testCallback{dead: []*big.Int{}})
+	heart.Monitor(alice)
+	heart.lock.Lock()
+	heart.advance()
+	heart.lock.Unlock()
+	heart.Monitor(bob)
+
+	// Clone the heart and ensure the clone is independent
+	call := &testCallback{dead: []*big.Int{}}
+	clone := heart.Clone()
+	clone.SetCallback(call)
+	heart.Unmonitor(alice)
+
+	if len(clone.mems) != 2 {
+		t.Fatalf("cloned entity count mismatch: have %v, want %v.", len(clone.mems), 2)
+	}
+	for id, age := range map[*big.Int]int{alice: 1, bob: 0} {
+		idx := clone.mems.Index(id)
+		if idx < 0 {
+			t.Fatalf("entity %v missing from clone.", id)
+		}
+		if have := clone.tick - clone.mems[idx].tick; have != age {
+			t.Errorf("entity %v age mismatch: have %v, want %v.", id, have, age)
+		}
+	}
+	// Run the clone and verify that the aged entity dies a beat earlier
+	clone.Start()
+	time.Sleep(10 * time.Millisecond) // Go out of sync with beater
+	time.Sleep(time.Duration(kill-1) * beat)
+	clone.Terminate()
+
+	if len(call.dead) != 1 || call.dead[0].Cmp(alice) != 0 {
+		t.Fatalf("clone death reports mismatch: have %v, want %v.", call.dead, []*big.Int{alice})
+	}
+}
+
+func TestAwait(t *testing.T) {
+	beat := time.Duration(50 * time.Millisecond)
+	kill := 3
+
+	heart := New(beat, kill, &testCallback{dead: []*big.Int{}})
+	id := big.NewInt(314)
+
+	// Unmonitored entities should be rejected immediately
+	if err := heart.Await(context.Background(), id); err == nil {
+		t.Fatalf("awaited non-monitored entity.")
+	}
+	if err := heart.Monitor(id); err != nil {
+		t.Fatalf("failed to monitor entity: %v.", err)
+	}
+	// Cancelled waits should return with the context error
+	ctx, cancel := context.WithTimeout(context.Background(), beat)
+	defer cancel()
+	if err := heart.Await(ctx, id); err != context.DeadlineExceeded {
+		t.Fatalf("await error mismatch: have %v, want %v.", err, context.DeadlineExceeded)
+	}
+	// Unmonitored entities should release their waiters with an error
+	gone := big.NewInt(271)
+	if err := heart.Monitor(gone); err != nil {
+		t.Fatalf("failed to monitor entity: %v.", err)
+	}
+	errc := make(chan error)
+	go func() { errc <- heart.Await(context.Background(), gone) }()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := heart.Unmonitor(gone); err != nil {
+		t.Fatalf("failed to unmonitor entity: %v.", err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("unmonitored entity await succeeded.")
+		}
+	case <-time.After(beat):
+		t.Fatalf("unmonitored entity await not released.")
+	}
+	// Start the beater and wait for the kill threshold to be crossed
+	start := time.Now()
+	heart.Start()
+	defer heart.Terminate()
+
+	if err := heart.Await(context.Background(), id); err != nil {
+		t.Fatalf("failed to await entity death: %v.", err)
+	}
+	if d := time.Since(start); d < time.Duration(kill)*beat-beat/2 || d > time.Duration(kill)*beat+beat/2 {
+		t.Fatalf("await duration mismatch: have %v, want %v.", d, time.Duration(kill)*beat)
+	}
+	heart.lock.Lock()
+	defer heart.lock.Unlock()
+	if len(heart.waits) != 0 {
+		t.Fatalf("waiters not cleaned up: %v.", heart.waits)
+	}
+}
+
+func TestMonitorContext(t *testing.T) {
+	beat := time.Duration(50 * time.Millisecond)
+	kill := 2
+
+	cb := &testCallback{dead: []*big.Int{}}
+	heart := New(beat, kill, cb)
+
+	// Monitor two entities, one bound to a cancellable context
+	ctx, cancel := context.WithCancel(context.Background())
+	scoped, kept := big.NewInt(314), big.NewInt(271)
+	if err := heart.MonitorContext(ctx, scoped); err != nil {
+		t.Fatalf("failed to monitor scoped entity: %v.", err)
+	}
+	if err := heart.MonitorContext(context.Background(), kept); err != nil {
+		t.Fatalf("failed to monitor kept entity: %v.", err)
+	}
+	if err := heart.MonitorContext(ctx, scoped); err == nil {
+		t.Fatalf("duplicate entity monitored.")
+	}
+	// Cancel the context and ensure the entity is removed
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	heart.lock.Lock()
+	if len(heart.mems) != 1 || heart.mems.Index(kept) < 0 {
+		heart.lock.Unlock()
+		t.Fatalf("monitored entities mismatch: have %v, want %v.", heart.mems, []*big.Int{kept})
+	}
+	stop := heart.mems[heart.mems.Index(kept)].stop
+	heart.lock.Unlock()
+
+	// Unmonitor the kept entity and ensure its watcher is terminated
+	if err := heart.Unmonitor(kept); err != nil {
+		t.Fatalf("failed to unmonitor kept entity: %v.", err)
+	}
+	select {
+	case <-stop:
+	default:
+		t.Fatalf("context watcher not terminated.")
+	}
+	if err := heart.Monitor(kept); err != nil {
+		t.Fatalf("failed to remonitor kept entity: %v.", err)
+	}
+	// Start the beater and ensure only the kept entity is reported
+	heart.Start()
+	time.Sleep(time.Duration(kill+1)*beat + beat/2)
+	heart.Terminate()
+
+	if len(cb.dead) == 0 {
+		t.Fatalf("kept entity not reported dead.")
+	}
+	for _, id := range cb.dead {
+		if id.Cmp(scoped) == 0 {
+			t.Fatalf("unmonitored entity reported dead: %v.", id)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	kill := 5
+	alice, bob, carol := big.NewInt(314), big.NewInt(241), big.NewInt(42)
+
+	// Monitor a few entities and age them differently
+	heart := New(time.Second, kill, &testCallback{dead: []*big.Int{}})
+	heart.Monitor(alice)
+	heart.Monitor(bob)
+	heart.lock.Lock()
+	heart.advance()
+	heart.advance()
+	heart.lock.Unlock()
+	heart.MonitorDependent(carol, alice)
+	heart.Ping(bob)
+	heart.lock.Lock()
+	heart.advance()
+	heart.lock.Unlock()
+
+	data, err := heart.Export()
+	if err != nil {
+		t.Fatalf("failed to export state: %v.", err)
+	}
+	// Import into hearts with differing ticks and kill thresholds
+	for _, limit := range []int{kill, 3} {
+		restored := New(time.Second, limit, &testCallback{dead: []*big.Int{}})
+		restored.lock.Lock()
+		for i := 0; i < 7; i++ {
+			restored.advance()
+		}
+		restored.lock.Unlock()
+
+		if err := restored.Import(data); err != nil {
+			t.Fatalf("failed to import state: %v.", err)
+		}
+		for id, left := range map[*big.Int]int{alice: 2, bob: 4, carol: 4} {
+			if left > limit {
+				left = limit
+			}
+			idx := restored.mems.Index(id)
+			if idx < 0 {
+				t.Fatalf("entity %v missing after import.", id)
+			}
+			if have := restored.kill - (restored.tick - restored.mems[idx].tick); have != left {
+				t.Errorf("kill %d, entity %v: remaining beats mismatch: have %v, want %v.", limit, id, have, left)
+			}
+		}
+		if idx := restored.mems.Index(carol); restored.mems[idx].parent.Cmp(alice) != 0 {
+			t.Errorf("dependency lost: have %v, want %v.", restored.mems[idx].parent, alice)
+		}
+	}
+	if err := New(time.Second, kill, nil).Import([]byte("garbage")); err == nil {
+		t.Fatalf("imported invalid state.")
+	}
+}
+
+// Heartbeat callback blocking in the death notification until released
+type blockingCallback struct {
+	testCallback
+	release chan struct{}
+	lock    sync.Mutex
+}
+
+func (cb *blockingCallback) Beat() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.beat++
+}
+
+func (cb *blockingCallback) Dead(id *big.Int) {
+	<-cb.release
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.dead = append(cb.dead, id)
+}
+
+func (cb *blockingCallback) beats() int {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.beat
+}
+
+func TestBlockingDead(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		beat := time.Duration(10 * time.Millisecond)
+		call := &blockingCallback{release: make(chan struct{})}
+
+		heart := New(beat, 1, call)
+		heart.SetDropNotifications(drop)
+		heart.Monitor(big.NewInt(314))
+		heart.Start()
+
+		// Let the death notification block and ensure the beat cycles progress
+		cycles := 2 * notifyBuffer
+		if !drop {
+			cycles = notifyBuffer / 2
+		}
+		time.Sleep(time.Duration(cycles) * beat)
+		heart.lock.Lock()
+		tick := heart.tick
+		heart.lock.Unlock()
+		if tick < cycles-2 {
+			t.Fatalf("drop %v: beat cycles stalled: have %v ticks, want %v.", drop, tick, cycles)
+		}
+		if n := call.beats(); n != 1 {
+			t.Fatalf("drop %v: beat notifications mismatch: have %v, want %v.", drop, n, 1)
+		}
+		// Let a short lived entity die in the dropped cycles
+		if drop {
+			heart.Monitor(big.NewInt(271))
+			time.Sleep(3 * beat)
+			heart.Unmonitor(big.NewInt(271))
+		}
+		// Release the blocked callback and ensure the queued beats are delivered
+		close(call.release)
+		time.Sleep(2 * beat)
+		if n := call.beats(); n < 3 {
+			t.Fatalf("drop %v: queued beats not delivered: have %v, want >%v.", drop, n, 2)
+		}
+		heart.Terminate()
+
+		// Ensure the deaths in dropped cycles were carried over
+		if drop {
+			call.lock.Lock()
+			found := false
+			for _, id := range call.dead {
+				found = found || id.Int64() == 271
+			}
+			call.lock.Unlock()
+			if !found {
+				t.Fatalf("death in dropped cycle not reported: have %v.", call.dead)
+			}
+		}
+	}
+}
+
+// Heartbeat callback gathering the revival events too
+type revivalCallback struct {
+	testCallback
+	revived []*big.Int
+}
+
+func (cb *revivalCallback) Revived(id *big.Int) {
+	cb.revived = append(cb.revived, id)
+}
+
+func TestRevived(t *testing.T) {
+	alice := big.NewInt(314)
+
+	beat := time.Duration(50 * time.Millisecond)
+	kill := 2
+	call := &revivalCallback{testCallback: testCallback{dead: []*big.Int{}}}
+
+	heart := New(beat, kill, call)
+	if err := heart.Monitor(alice); err != nil {
+		t.Fatalf("failed to monitor alice: %v.", err)
+	}
+	heart.Start()
+	defer heart.Terminate()
+	time.Sleep(10 * time.Millisecond) // Go out of sync with beater
+
+	// Let the entity die and ensure no revival is reported
+	time.Sleep(time.Duration(kill) * beat)
+	if n := len(call.dead); n == 0 {
+		t.Fatalf("dead event count mismatch: have %v, want >%v", n, 0)
+	}
+	if n := len(call.revived); n != 0 {
+		t.Fatalf("revival reported before ping: %v.", call.revived)
+	}
+	// Keep pinging and ensure a single revival is reported
+	for i := 0; i < 4; i++ {
+		heart.Ping(alice)
+		time.Sleep(beat)
+	}
+	if n := len(call.revived); n != 1 || call.revived[0].Cmp(alice) != 0 {
+		t.Fatalf("revival events mismatch: have %v, want %v.", call.revived, []*big.Int{alice})
+	}
+	// Kill and revive it again, ensuring the transition is reported anew
+	time.Sleep(time.Duration(kill+1) * beat)
+	heart.Ping(alice)
+	time.Sleep(beat)
+	if n := len(call.revived); n != 2 {
+		t.Fatalf("revival event count mismatch: have %v, want %v.", n, 2)
+	}
+}
+
+// Creates a heart monitoring n entities, returning it along with their ids.
+func benchmarkHeart(n int) (*Heart, []*big.Int) {
+	heart := New(time.Second, 3, &testCallback{dead: []*big.Int{}})
+	ids := make([]*big.Int, n)
+	for i := 0; i < n; i++ {
+		ids[i] = big.NewInt(int64(i))
+		heart.Monitor(ids[i])
+	}
+	return heart, ids
+}
+
+func BenchmarkPingLoop(b *testing.B) {
+	heart, ids := benchmarkHeart(256)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for _, id := range ids {
+				heart.Ping(id)
+			}
+		}
+	})
+}
+
+func BenchmarkPingAll(b *testing.B) {
+	heart, ids := benchmarkHeart(256)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			heart.PingAll(ids)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the randomized beat interval support, used to avoid many
+// simultaneously started hearts beating in lockstep.
+
+package heart
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Creates and returns a new heartbeat mechanism beating once every beat, each
+// cycle randomized by up to ±jitter. Since the cycle lengths vary, the deaths
+// are accounted in elapsed time instead of the number of cycles: entities are
+// reported dead if not seen for kill beats worth of time.
+func NewJittered(beat time.Duration, kill int, jitter time.Duration, handler Callback) *Heart {
+	h := New(beat, kill, handler)
+	h.jitter = jitter
+	return h
+}
+
+// Calculates the length of the next beat cycle, randomized by the jitter. The
+// lock must be held by the caller.
+func (h *Heart) interval() time.Duration {
+	if h.jitter <= 0 {
+		return h.beat
+	}
+	next := h.beat - h.jitter + time.Duration(rand.Int63n(int64(2*h.jitter)+1))
+	if next <= 0 {
+		next = time.Millisecond
+	}
+	return next
+}
+
+// Converts the real time elapsed since the previous beat cycle into the number
+// of whole beats the tick should advance by. Without jitter this is always one.
+// The lock must be held by the caller.
+func (h *Heart) steps(now time.Time) int {
+	if h.jitter <= 0 {
+		return 1
+	}
+	if h.prev.IsZero() {
+		h.prev = now.Add(-h.beat)
+	}
+	h.carry += now.Sub(h.prev)
+	h.prev = now
+
+	n := int(h.carry / h.beat)
+	h.carry -= time.Duration(n) * h.beat
+	return n
+}
@@ -0,0 +1,128 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package heart
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Heartbeat callback recording the time of each beat and death
+type timedCallback struct {
+	beats []time.Time
+	dead  []time.Time
+	lock  sync.Mutex
+}
+
+func (cb *timedCallback) Beat() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.beats = append(cb.beats, time.Now())
+}
+
+func (cb *timedCallback) Dead(id *big.Int) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.dead = append(cb.dead, time.Now())
+}
+
+func TestJitteredSteps(t *testing.T) {
+	h := NewJittered(100*time.Millisecond, 3, 50*time.Millisecond, new(testCallback))
+
+	// Feed cycles of varying length and ensure ticks follow the elapsed time
+	start := time.Now()
+	h.prev = start
+	cycles := []time.Duration{60, 130, 80, 150, 70, 110}
+	ticks := []int{0, 1, 2, 4, 4, 6}
+	elapsed := time.Duration(0)
+	for i, cycle := range cycles {
+		elapsed += cycle * time.Millisecond
+		h.tick += h.steps(start.Add(elapsed))
+		if h.tick != ticks[i] {
+			t.Fatalf("cycle %d: tick mismatch: have %v, want %v.", i, h.tick, ticks[i])
+		}
+	}
+	// Non jittered hearts should always step a single tick
+	if n := New(time.Second, 3, new(testCallback)).steps(time.Now()); n != 1 {
+		t.Fatalf("fixed heart step mismatch: have %v, want %v.", n, 1)
+	}
+}
+
+func TestJitteredIntervals(t *testing.T) {
+	beat, jitter := 100*time.Millisecond, 50*time.Millisecond
+	h := NewJittered(beat, 3, jitter, new(testCallback))
+
+	// Sample the cycle lengths and ensure they cover the jitter range evenly
+	samples := 10000
+	min, max, sum := time.Duration(1<<62), time.Duration(0), time.Duration(0)
+	for i := 0; i < samples; i++ {
+		next := h.interval()
+		if next < beat-jitter || next > beat+jitter {
+			t.Fatalf("sample %d: length out of bounds: %v.", i, next)
+		}
+		if next < min {
+			min = next
+		}
+		if next > max {
+			max = next
+		}
+		sum += next
+	}
+	if min > beat-jitter/2 || max < beat+jitter/2 {
+		t.Errorf("cycle lengths not spread: min %v, max %v.", min, max)
+	}
+	if mean := sum / time.Duration(samples); mean < beat-jitter/10 || mean > beat+jitter/10 {
+		t.Errorf("mean cycle length mismatch: have %v, want %v.", mean, beat)
+	}
+}
+
+func TestJittered(t *testing.T) {
+	beat, jitter, kill := 20*time.Millisecond, 10*time.Millisecond, 5
+	call := new(timedCallback)
+
+	h := NewJittered(beat, kill, jitter, call)
+	start := time.Now()
+	h.Monitor(big.NewInt(314))
+	h.Start()
+	time.Sleep(time.Duration(kill+5) * beat)
+	h.Terminate()
+
+	call.lock.Lock()
+	defer call.lock.Unlock()
+
+	// Ensure the beats kept the configured pace over the whole run (individual
+	// cycles are at the mercy of the scheduler, so only the mean is checked)
+	if len(call.beats) < 2 {
+		t.Fatalf("too few beats: have %v, want at least %v.", len(call.beats), 2)
+	}
+	mean := call.beats[len(call.beats)-1].Sub(call.beats[0]) / time.Duration(len(call.beats)-1)
+	if mean < beat-jitter || mean > beat+jitter {
+		t.Errorf("mean cycle length out of bounds: have %v, want %v-%v.", mean, beat-jitter, beat+jitter)
+	}
+	// Ensure the death was reported, but not before the kill time elapsed
+	if len(call.dead) == 0 {
+		t.Fatalf("entity not reported dead.")
+	}
+	if death := call.dead[0].Sub(start); death < time.Duration(kill)*beat {
+		t.Fatalf("death reported too early: have %v, want at least %v.", death, time.Duration(kill)*beat)
+	}
+}
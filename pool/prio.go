@@ -0,0 +1,103 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the priority queue used by the thread pool to order the
+// pending tasks: higher priorities are executed first, while tasks of the same
+// priority retain their scheduling (FIFO) order.
+
+package pool
+
+import (
+	"container/heap"
+)
+
+// A pending task with its priority and scheduling sequence number.
+type prioTask struct {
+	task Task
+	prio int
+	seq  uint64
+}
+
+// Heap of pending tasks, implementing heap.Interface.
+type taskHeap []*prioTask
+
+func (h taskHeap) Len() int {
+	return len(h)
+}
+
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].prio != h[j].prio {
+		return h[i].prio > h[j].prio
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *taskHeap) Push(x interface{}) {
+	*h = append(*h, x.(*prioTask))
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// Priority queue of tasks. Not thread safe, the pool's lock protects it.
+type taskQueue struct {
+	heap taskHeap
+	next uint64
+}
+
+// Creates a new, empty task queue.
+func newTaskQueue() *taskQueue {
+	return new(taskQueue)
+}
+
+// Pushes a task with the given priority into the queue.
+func (q *taskQueue) Push(prio int, task Task) {
+	heap.Push(&q.heap, &prioTask{task: task, prio: prio, seq: q.next})
+	q.next++
+}
+
+// Pops the highest priority (and oldest within it) task from the queue.
+func (q *taskQueue) Pop() Task {
+	return heap.Pop(&q.heap).(*prioTask).task
+}
+
+// Checks whether the queue is empty.
+func (q *taskQueue) Empty() bool {
+	return len(q.heap) == 0
+}
+
+// Returns the number of tasks in the queue.
+func (q *taskQueue) Size() int {
+	return len(q.heap)
+}
+
+// Clears out all tasks from the queue.
+func (q *taskQueue) Reset() {
+	q.heap = nil
+}
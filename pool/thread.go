@@ -25,8 +25,8 @@ package pool
 
 import (
 	"fmt"
-	"github.com/karalabe/iris/container/queue"
 	"sync"
+	"time"
 )
 
 // A task function meant to be started as a go routine.
@@ -34,42 +34,112 @@ type Task func()
 
 // A thread pool to place a hard limit on the number of go-routines doing some
 // type of (possibly too consuming) work.
+//
+// A pool may also be bounded in the number of tasks waiting for a free worker.
+// Once the backlog reaches the bound, further tasks are rejected (instead of
+// blocking the caller), leaving it up to the scheduler to drop or coalesce the
+// excess work.
 type ThreadPool struct {
 	mutex sync.Mutex
-	tasks *queue.Queue
+	tasks *taskQueue
+	limit int // Maximum number of pending tasks (0 = unbounded)
 
-	idle  int
-	total int
+	idle    int
+	total   int
+	excess  int  // Number of workers to retire after a shrink
+	started bool // Whether the workers were already started
 
-	quit chan struct{}
+	freed chan struct{} // Closed (and replaced) whenever a worker becomes idle
+	quit  chan struct{}
 }
 
 // Creates a thread pool with the given concurrent thread capacity.
 func NewThreadPool(cap int) *ThreadPool {
 	return &ThreadPool{
-		tasks: queue.New(),
+		tasks: newTaskQueue(),
 		idle:  0,
 		total: cap,
+		freed: make(chan struct{}),
 		quit:  make(chan struct{}),
 	}
 }
 
+// Creates a thread pool with the given concurrent thread capacity, accepting at
+// most limit tasks waiting for execution. A zero limit means unbounded.
+func NewBoundedThreadPool(cap int, limit int) *ThreadPool {
+	pool := NewThreadPool(cap)
+	pool.limit = limit
+	return pool
+}
+
 // Starts the thread pool and workers.
 func (t *ThreadPool) Start() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
 	// Although we could check to start min(tasks, total), but this way is simpler
+	t.started = true
 	for i := 0; i < t.total; i++ {
 		go t.runner()
 	}
 }
 
+// Changes the concurrent thread capacity of the pool. Growing starts the new
+// workers immediately, whereas shrinking lets the excess ones finish their
+// current task before exiting. Queued tasks are retained in both cases.
+func (t *ThreadPool) Resize(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid pool size: %v", n)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	diff := n - t.total
+	t.total = n
+
+	// If the pool's not running yet, Start will take care of it
+	if !t.started {
+		return nil
+	}
+	if diff > 0 {
+		// Cancel any pending retirements first, start new workers for the rest
+		cancel := diff
+		if cancel > t.excess {
+			cancel = t.excess
+		}
+		t.excess -= cancel
+		for i := cancel; i < diff; i++ {
+			go t.runner()
+		}
+	} else {
+		// Drop idle slots first, retire running workers for the rest
+		diff = -diff
+		drop := diff
+		if drop > t.idle {
+			drop = t.idle
+		}
+		t.idle -= drop
+		t.excess += diff - drop
+	}
+	return nil
+}
+
 // Waits for all threads to finish, terminating the whole pool afterwards. No
 // new tasks are accepted in the meanwhile.
 func (t *ThreadPool) Terminate() {
 	close(t.quit)
 }
 
-// Schedules a new task into the thread pool.
+// Schedules a new task into the thread pool. If the pool is bounded and its
+// backlog is full, the task is rejected with an error and never executed.
 func (t *ThreadPool) Schedule(task Task) error {
+	return t.SchedulePrio(0, task)
+}
+
+// Schedules a new task into the thread pool with the given priority. Pending
+// tasks with higher priority are started before lower ones, equal priorities
+// are started in scheduling order.
+func (t *ThreadPool) SchedulePrio(prio int, task Task) error {
 	// If terminating, return so
 	select {
 	case <-t.quit:
@@ -79,16 +149,81 @@ func (t *ThreadPool) Schedule(task Task) error {
 	}
 	// Schedule the task and start execution if threads available
 	t.mutex.Lock()
-	t.tasks.Push(task)
+	defer t.mutex.Unlock()
+
+	if t.limit > 0 && t.tasks.Size() >= t.limit {
+		return fmt.Errorf("queue full")
+	}
+	t.tasks.Push(prio, task)
 	if t.idle > 0 {
 		t.idle--
 		go t.runner()
 	}
-	t.mutex.Unlock()
-
 	return nil
 }
 
+// Schedules a new task into the thread pool if a worker is available to start
+// it right away, otherwise waits at most timeout for one to free up. Returns
+// whether the task was accepted.
+func (t *ThreadPool) ScheduleBlocking(task Task, timeout time.Duration) bool {
+	limit := time.After(timeout)
+	for {
+		// Schedule the task if there's an idle worker
+		t.mutex.Lock()
+		select {
+		case <-t.quit:
+			t.mutex.Unlock()
+			return false
+		default:
+		}
+		if t.idle > 0 {
+			t.tasks.Push(0, task)
+			t.idle--
+			go t.runner()
+			t.mutex.Unlock()
+			return true
+		}
+		freed := t.freed
+		t.mutex.Unlock()
+
+		// Wait for a worker to free up, or give up
+		select {
+		case <-freed:
+		case <-limit:
+			return false
+		case <-t.quit:
+			return false
+		}
+	}
+}
+
+// Schedules fn to be executed over all the items using the pool's workers, and
+// blocks until the whole batch completes. Clearing the pool while a batch is in
+// progress leaves it waiting for the discarded tasks.
+func (t *ThreadPool) Map(items []interface{}, fn func(interface{})) error {
+	var pend sync.WaitGroup
+	for _, item := range items {
+		arg := item // Copy for closure!
+		pend.Add(1)
+		if err := t.Schedule(func() { defer pend.Done(); fn(arg) }); err != nil {
+			pend.Done()
+			return err
+		}
+	}
+	// Wait for the batch to complete or the pool to terminate
+	done := make(chan struct{})
+	go func() {
+		pend.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-t.quit:
+		return fmt.Errorf("pool terminating")
+	}
+}
+
 // Dumps the waiting tasks from the pool.
 func (t *ThreadPool) Clear() {
 	t.mutex.Lock()
@@ -98,10 +233,13 @@ func (t *ThreadPool) Clear() {
 
 func (t *ThreadPool) runner() {
 	// Make sure the idle count is incremented bask even if we die
+	exited := false
 	defer func() {
-		t.mutex.Lock()
-		t.idle++
-		t.mutex.Unlock()
+		if !exited {
+			t.mutex.Lock()
+			t.release()
+			t.mutex.Unlock()
+		}
 	}()
 	// Execute jobs until all's done
 	var task Task
@@ -112,12 +250,16 @@ func (t *ThreadPool) runner() {
 			return
 		default:
 		}
-		// Fetch a new task or terminate if all's done
+		// Retire if the pool shrunk, or fetch a new task or terminate if all's done
 		t.mutex.Lock()
-		if t.tasks.Empty() {
-			done = true
+		if t.excess > 0 {
+			t.excess--
+			exited, done = true, true
+		} else if t.tasks.Empty() {
+			t.release()
+			exited, done = true, true
 		} else {
-			task = t.tasks.Pop().(Task)
+			task = t.tasks.Pop()
 		}
 		t.mutex.Unlock()
 
@@ -127,3 +269,10 @@ func (t *ThreadPool) runner() {
 		}
 	}
 }
+
+// Marks a worker slot idle and notifies any waiters. The lock must be held.
+func (t *ThreadPool) release() {
+	t.idle++
+	close(t.freed)
+	t.freed = make(chan struct{})
+}
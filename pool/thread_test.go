@@ -110,3 +110,256 @@ func TestThreadPool(t *testing.T) {
 		t.Errorf("task scheduling succeeded, shouldn't have.")
 	}
 }
+
+func TestThreadPoolMap(t *testing.T) {
+	pool := NewThreadPool(3)
+	pool.Start()
+	defer pool.Terminate()
+
+	// Create a task tracking the concurrency and the processed items
+	var mutex sync.Mutex
+	running, peak := 0, 0
+	seen := make(map[int]bool)
+	fn := func(item interface{}) {
+		mutex.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(25 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		seen[item.(int)] = true
+		mutex.Unlock()
+	}
+	items := make([]interface{}, 10)
+	for i := 0; i < len(items); i++ {
+		items[i] = i
+	}
+	if err := pool.Map(items, fn); err != nil {
+		t.Fatalf("failed to map items: %v.", err)
+	}
+	// Verify that all items were processed by the time Map returned
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(seen) != len(items) {
+		t.Errorf("processed item count mismatch: have %v, want %v.", len(seen), len(items))
+	}
+	if running != 0 {
+		t.Errorf("tasks still running after map returned: %v.", running)
+	}
+	if peak > 3 {
+		t.Errorf("concurrency limit exceeded: have %v, want at most %v.", peak, 3)
+	}
+}
+
+func TestThreadPoolScheduleBlocking(t *testing.T) {
+	pool := NewThreadPool(2)
+	pool.Start()
+	defer pool.Terminate()
+
+	time.Sleep(10 * time.Millisecond) // Let the workers idle
+
+	// Saturate the pool with long running tasks
+	block := make(chan struct{})
+	task := func() { <-block }
+	for i := 0; i < 2; i++ {
+		if !pool.ScheduleBlocking(task, 10*time.Millisecond) {
+			t.Fatalf("task #%d rejected from non-saturated pool.", i)
+		}
+	}
+	// Verify that scheduling times out while saturated
+	start := time.Now()
+	if pool.ScheduleBlocking(task, 50*time.Millisecond) {
+		t.Fatalf("task accepted into saturated pool.")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("scheduling gave up too early: %v.", elapsed)
+	}
+	// Free up capacity in the meanwhile and verify acceptance
+	go func() {
+		time.Sleep(25 * time.Millisecond)
+		close(block)
+	}()
+	done := make(chan struct{})
+	if !pool.ScheduleBlocking(func() { close(done) }, time.Second) {
+		t.Fatalf("task rejected after capacity freed.")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("accepted task not executed.")
+	}
+}
+
+func TestThreadPoolBounded(t *testing.T) {
+	pool := NewBoundedThreadPool(1, 2)
+
+	// Fill up the backlog of the non-started pool and check rejection
+	for i := 0; i < 2; i++ {
+		if err := pool.Schedule(func() {}); err != nil {
+			t.Fatalf("task #%d rejected from non-full queue: %v.", i, err)
+		}
+	}
+	if err := pool.Schedule(func() {}); err == nil {
+		t.Fatalf("task accepted into full queue.")
+	}
+	// Drain the queue and verify that new tasks are accepted again
+	pool.Start()
+	defer pool.Terminate()
+
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	if err := pool.Schedule(func() { close(done) }); err != nil {
+		t.Fatalf("task rejected from drained queue: %v.", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("accepted task not executed.")
+	}
+}
+
+func TestThreadPoolPriority(t *testing.T) {
+	pool := NewThreadPool(1)
+	pool.Start()
+	defer pool.Terminate()
+
+	time.Sleep(10 * time.Millisecond) // Let the workers idle
+
+	// Saturate the pool with a blocked task
+	block := make(chan struct{})
+	if err := pool.Schedule(func() { <-block }); err != nil {
+		t.Fatalf("failed to schedule blocker: %v.", err)
+	}
+	// Schedule tasks of mixed priorities, recording their execution order
+	var mutex sync.Mutex
+	order := []int{}
+	done := make(chan struct{})
+
+	prios := []int{0, 2, 1, 0, 2, -1, 1}
+	for i, prio := range prios {
+		id := i
+		task := func() {
+			mutex.Lock()
+			order = append(order, id)
+			if len(order) == len(prios) {
+				close(done)
+			}
+			mutex.Unlock()
+		}
+		if err := pool.SchedulePrio(prio, task); err != nil {
+			t.Fatalf("failed to schedule task #%d: %v.", i, err)
+		}
+	}
+	// Release the pool and verify priority (and FIFO within priority) order
+	close(block)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("scheduled tasks not executed.")
+	}
+	want := []int{1, 4, 2, 6, 0, 3, 5}
+	for i, id := range want {
+		if order[i] != id {
+			t.Fatalf("execution order mismatch: have %v, want %v.", order, want)
+		}
+	}
+}
+
+func TestThreadPoolResize(t *testing.T) {
+	pool := NewThreadPool(2)
+	pool.Start()
+	defer pool.Terminate()
+
+	// Schedule a batch of tasks, counting the executions of each
+	var mutex sync.Mutex
+	runs := make([]int, 500)
+	running, peak := 0, 0
+
+	var pend sync.WaitGroup
+	for i := 0; i < len(runs); i++ {
+		id := i
+		pend.Add(1)
+		task := func() {
+			defer pend.Done()
+
+			mutex.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mutex.Lock()
+			running--
+			runs[id]++
+			mutex.Unlock()
+		}
+		if err := pool.Schedule(task); err != nil {
+			t.Fatalf("failed to schedule task #%d: %v.", i, err)
+		}
+	}
+	// Resize the pool back and forth while the tasks are running
+	for _, size := range []int{8, 1, 0, 4, 2, 16, 1} {
+		if err := pool.Resize(size); err != nil {
+			t.Fatalf("failed to resize pool to %d: %v.", size, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Wait for completion and verify each task ran exactly once
+	done := make(chan struct{})
+	go func() {
+		pend.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("scheduled tasks not executed.")
+	}
+	for i, count := range runs {
+		if count != 1 {
+			t.Errorf("task #%d execution count mismatch: have %v, want %v.", i, count, 1)
+		}
+	}
+	if peak < 8 {
+		t.Errorf("pool didn't grow: peak %v, want at least %v.", peak, 8)
+	}
+	// Verify that the shrunk pool respects its new limit
+	mutex.Lock()
+	running, peak = 0, 0
+	mutex.Unlock()
+
+	for i := 0; i < 10; i++ {
+		pend.Add(1)
+		pool.Schedule(func() {
+			defer pend.Done()
+
+			mutex.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		})
+	}
+	pend.Wait()
+	if peak != 1 {
+		t.Errorf("concurrency limit mismatch: have %v, want %v.", peak, 1)
+	}
+	if err := pool.Resize(-1); err == nil {
+		t.Errorf("negative resize accepted.")
+	}
+}
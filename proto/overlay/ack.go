@@ -0,0 +1,97 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the delivery acknowledgement mechanism: messages sent in ack mode are
+// tagged with a sequence number, which the destination node routes back to the
+// originator after passing the message up to its application.
+
+package overlay
+
+import (
+	"fmt"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"math/big"
+	"sync/atomic"
+	"time"
+)
+
+// Sends a message to the closest node to the given destination, and waits until
+// that node acknowledges the delivery to its application layer. An error is
+// returned if no acknowledgement arrives within the timeout.
+func (o *Overlay) SendAcked(dest *big.Int, msg *proto.Message, timeout time.Duration) error {
+	// Register a new pending acknowledgement
+	o.ackLock.Lock()
+	o.ackSeq++
+	seq, done := o.ackSeq, make(chan struct{})
+	o.acks[seq] = done
+	o.ackLock.Unlock()
+
+	defer func() {
+		o.ackLock.Lock()
+		delete(o.acks, seq)
+		o.ackLock.Unlock()
+	}()
+	// Package into an overlay envelope requesting acknowledgement and send
+	msg.Head.Meta = &header{
+		Meta: msg.Head.Meta,
+		Dest: dest,
+		TTL:  config.OverlayMaxHops,
+		Seq:  seq,
+		Src:  o.Self(),
+	}
+	o.route(nil, msg)
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("delivery acknowledgement timed out")
+	}
+}
+
+// Routes a delivery acknowledgement back to the originator of a message.
+func (o *Overlay) sendAck(dest *big.Int, seq uint64) {
+	msg := &proto.Message{
+		Head: proto.Header{
+			Meta: &header{
+				Op:   opAck,
+				Dest: dest,
+				Seq:  seq,
+			},
+		},
+	}
+	atomic.AddUint64(&o.msgs, 1)
+	o.route(nil, msg)
+}
+
+// Signals the sender waiting on an acknowledged delivery, if still pending and
+// the acknowledgement is indeed addressed to the local node.
+func (o *Overlay) acked(head *header) {
+	if head.Dest == nil || o.nodeId.Cmp(head.Dest) != 0 {
+		return
+	}
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	if done, ok := o.acks[head.Seq]; ok {
+		close(done)
+		delete(o.acks, head.Seq)
+	}
+}
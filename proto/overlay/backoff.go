@@ -0,0 +1,124 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the re-dial backoff of unreachable nodes: each failed dial doubles the
+// interval before the node is discovered again (up to a cap), whilst too many
+// failures in a short window blacklist it for a cooldown. Nodes can also be
+// banned manually.
+
+package overlay
+
+import (
+	"github.com/karalabe/iris/config"
+	"math/big"
+	"time"
+)
+
+// Re-dial backoff state of a remote node that failed to connect.
+type backoff struct {
+	fails  int           // Number of consecutive failed dials
+	wait   time.Duration // Current minimum interval between dials
+	until  time.Time     // Time before which the node should not be dialed
+	start  time.Time     // Start of the current blacklist failure window
+	strike int           // Number of failures within the blacklist window
+}
+
+// Checks whether a node is still within its re-dial backoff window, or has been
+// blacklisted. The caller is expected to hold at least a read lock.
+func (o *Overlay) backedOff(id string) bool {
+	now := o.clock.Now()
+	if b, ok := o.backs[id]; ok && now.Before(b.until) {
+		return true
+	}
+	if until, ok := o.bans[id]; ok && now.Before(until) {
+		return true
+	}
+	return false
+}
+
+// Blacklists a remote node for duration d, suppressing it from discovery. The
+// existing connection (if any) is kept, so that the leaf set can still rely on
+// it during self repair. A non-positive duration lifts the ban.
+func (o *Overlay) Blacklist(id *big.Int, d time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if id.Cmp(o.nodeId) == 0 {
+		return
+	}
+	if d <= 0 {
+		delete(o.bans, id.String())
+		return
+	}
+	o.bans[id.String()] = o.clock.Now().Add(d)
+}
+
+// Collects the unconnected members of routing table t which are within their
+// re-dial backoff window.
+func (o *Overlay) held(t *table) []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	ids := []*big.Int{}
+	for _, id := range t.members(o.nodeId) {
+		if _, ok := o.pool[id.String()]; !ok && o.backedOff(id.String()) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Records the outcome of a dial attempt to a remote node. Failures double the
+// re-dial interval up to the configured cap, whereas a success resets it. Too
+// many failures within the blacklist window suppress the node for a cooldown.
+func (o *Overlay) dialed(id *big.Int, ok bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	// Drop expired manual bans to keep the map bounded
+	now := o.clock.Now()
+	for node, until := range o.bans {
+		if !now.Before(until) {
+			delete(o.bans, node)
+		}
+	}
+	if ok {
+		delete(o.backs, id.String())
+		return
+	}
+	b, exists := o.backs[id.String()]
+	if !exists {
+		b = &backoff{wait: time.Duration(config.OverlayDialBackoff) * time.Millisecond}
+		o.backs[id.String()] = b
+	} else if b.wait *= 2; b.wait > time.Duration(config.OverlayDialBackoffMax)*time.Millisecond {
+		b.wait = time.Duration(config.OverlayDialBackoffMax) * time.Millisecond
+	}
+	b.fails++
+	b.until = now.Add(b.wait)
+
+	// Count the failure towards the blacklist, starting a new window if expired
+	if now.Sub(b.start) > time.Duration(config.OverlayBlacklistWindow)*time.Millisecond {
+		b.start, b.strike = now, 0
+	}
+	if b.strike++; b.strike >= config.OverlayBlacklistFails {
+		o.log.Infof("overlay: blacklisting unreachable node %v.", id)
+		b.until = now.Add(time.Duration(config.OverlayBlacklistCooldown) * time.Millisecond)
+		b.start, b.strike = time.Time{}, 0
+	}
+}
@@ -0,0 +1,158 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"github.com/karalabe/iris/config"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestDialBackoff(t *testing.T) {
+	// Override the backoff intervals for faster tests
+	defer func(base, max int) {
+		config.OverlayDialBackoff, config.OverlayDialBackoffMax = base, max
+	}(config.OverlayDialBackoff, config.OverlayDialBackoffMax)
+	config.OverlayDialBackoff, config.OverlayDialBackoffMax = 50, 150
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	clock := newFakeClock()
+	o := New(appId, key, new(nopCallback), WithClock(clock))
+
+	id := new(big.Int).Add(o.nodeId, big.NewInt(1))
+	tab := newTable(o.nodeId)
+	tab.leaves = append(tab.leaves, id)
+
+	// Consecutive failures should double the interval up to the cap
+	waits := []time.Duration{50, 100, 150, 150}
+	for i, wait := range waits {
+		o.dialed(id, false)
+		if b := o.backs[id.String()]; b.fails != i+1 || b.wait != wait*time.Millisecond {
+			t.Fatalf("failure %d: backoff mismatch: have %v/%v, want %v/%v.", i, b.fails, b.wait, i+1, wait*time.Millisecond)
+		}
+	}
+	// Nodes within the backoff window should not be discovered, but should be held
+	if ids := o.discover(tab); len(ids) != 0 {
+		t.Fatalf("backed off node discovered: %v.", ids)
+	}
+	if ids := o.held(tab); len(ids) != 1 || ids[0].Cmp(id) != 0 {
+		t.Fatalf("held nodes mismatch: have %v, want %v.", ids, []*big.Int{id})
+	}
+	// After the window expires, the node should be dialable again
+	clock.advance(200 * time.Millisecond)
+	if ids := o.discover(tab); len(ids) != 1 || ids[0].Cmp(id) != 0 {
+		t.Fatalf("expired node not discovered: have %v, want %v.", ids, []*big.Int{id})
+	}
+	// A successful dial should reset the backoff
+	o.dialed(id, false)
+	o.dialed(id, true)
+	if _, ok := o.backs[id.String()]; ok {
+		t.Fatalf("backoff not reset on success.")
+	}
+	if ids := o.held(tab); len(ids) != 0 {
+		t.Fatalf("node held after successful dial: %v.", ids)
+	}
+}
+
+func TestDialBlacklist(t *testing.T) {
+	// Override the backoff and blacklist parameters for faster tests
+	defer func(base, max, fails, window, cooldown int) {
+		config.OverlayDialBackoff, config.OverlayDialBackoffMax = base, max
+		config.OverlayBlacklistFails, config.OverlayBlacklistWindow, config.OverlayBlacklistCooldown = fails, window, cooldown
+	}(config.OverlayDialBackoff, config.OverlayDialBackoffMax, config.OverlayBlacklistFails, config.OverlayBlacklistWindow, config.OverlayBlacklistCooldown)
+	config.OverlayDialBackoff, config.OverlayDialBackoffMax = 10, 10
+	config.OverlayBlacklistFails, config.OverlayBlacklistWindow, config.OverlayBlacklistCooldown = 3, 1000, 60000
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	clock := newFakeClock()
+	o := New(appId, key, new(nopCallback), WithClock(clock))
+
+	id := new(big.Int).Add(o.nodeId, big.NewInt(1))
+	tab := newTable(o.nodeId)
+	tab.leaves = append(tab.leaves, id)
+
+	// Failures below the threshold should only back off
+	o.dialed(id, false)
+	o.dialed(id, false)
+	clock.advance(50 * time.Millisecond)
+	if ids := o.discover(tab); len(ids) != 1 {
+		t.Fatalf("node blacklisted below the failure threshold.")
+	}
+	// Reaching the threshold should blacklist the node
+	o.dialed(id, false)
+	clock.advance(50 * time.Millisecond)
+	if ids := o.discover(tab); len(ids) != 0 {
+		t.Fatalf("blacklisted node discovered: %v.", ids)
+	}
+	// A successful dial should clear the blacklist counters
+	o.dialed(id, true)
+	o.dialed(id, false)
+	o.dialed(id, false)
+	clock.advance(50 * time.Millisecond)
+	if ids := o.discover(tab); len(ids) != 1 {
+		t.Fatalf("failure counter not reset on success.")
+	}
+	// Manual bans should suppress discovery until lifted
+	o.dialed(id, true)
+	o.Blacklist(id, time.Minute)
+	if ids := o.discover(tab); len(ids) != 0 {
+		t.Fatalf("manually blacklisted node discovered: %v.", ids)
+	}
+	clock.advance(time.Minute)
+	if ids := o.discover(tab); len(ids) != 1 {
+		t.Fatalf("node still blacklisted after the ban expired.")
+	}
+	o.Blacklist(id, time.Minute)
+	o.Blacklist(id, 0)
+	if ids := o.discover(tab); len(ids) != 1 {
+		t.Fatalf("node still blacklisted after lifting the ban.")
+	}
+}
+
+func TestBlacklistRepair(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	// Connect a blacklisted peer and revoke an unreachable leaf
+	live := new(big.Int).Add(o.nodeId, big.NewInt(1))
+	dead := new(big.Int).Add(o.nodeId, big.NewInt(2))
+	o.pool[live.String()] = newTestPeer(o, live)
+	o.Blacklist(live, time.Minute)
+
+	tab := newTable(o.nodeId)
+	tab.leaves = append(tab.leaves, dead)
+	o.revoke(tab, []*big.Int{dead})
+
+	// The leaf set should still be repaired from the blacklisted connection
+	found := false
+	for _, leaf := range tab.leaves {
+		if leaf.Cmp(dead) == 0 {
+			t.Fatalf("revoked leaf still present: %v.", dead)
+		}
+		if leaf.Cmp(live) == 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("leaf set not repaired from blacklisted connection: %v.", tab.leaves)
+	}
+}
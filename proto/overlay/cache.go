@@ -0,0 +1,115 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the read-through cache of the next hops towards recently routed keys,
+// sparing the routing table walk for hot keys. The cache is flushed whenever the
+// routing table is swapped out, so it never serves stale routes.
+
+package overlay
+
+import (
+	"container/list"
+	"math/big"
+	"sync"
+)
+
+// Cached next hop towards a key.
+type cacheEntry struct {
+	key string
+	hop *big.Int
+}
+
+// Bounded least recently used cache of next hops (a zero size disables it).
+type routeCache struct {
+	size  int                      // Maximum number of entries retained
+	hops  map[string]*list.Element // Cached entries indexed by their keys
+	order *list.List               // Entries ordered by recency of use
+
+	hits   uint64 // Number of lookups served from the cache
+	misses uint64 // Number of lookups requiring a table walk
+
+	lock sync.Mutex
+}
+
+// Creates a new route cache retaining at most size entries.
+func newRouteCache(size int) *routeCache {
+	return &routeCache{
+		size:  size,
+		hops:  make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Returns the cached next hop towards a key, or nil if not cached.
+func (c *routeCache) get(key *big.Int) *big.Int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.size == 0 {
+		return nil
+	}
+	if elem, ok := c.hops[key.String()]; ok {
+		c.hits++
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).hop
+	}
+	c.misses++
+	return nil
+}
+
+// Caches the next hop towards a key, evicting the least recently used entry if
+// the capacity is exceeded.
+func (c *routeCache) put(key, hop *big.Int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.size == 0 {
+		return
+	}
+	skey := key.String()
+	if elem, ok := c.hops[skey]; ok {
+		elem.Value.(*cacheEntry).hop = hop
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.hops[skey] = c.order.PushFront(&cacheEntry{key: skey, hop: hop})
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.hops, last.Value.(*cacheEntry).key)
+	}
+}
+
+// Drops all the cached entries.
+func (c *routeCache) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.hops = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Sets the maximum number of next hops cached for recently routed keys. A zero
+// size disables the cache (the default). Any previously cached entries are lost.
+func (o *Overlay) SetRouteCacheSize(n int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.cache = newRouteCache(n)
+}
@@ -0,0 +1,109 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestRouteCache(t *testing.T) {
+	c := newRouteCache(2)
+
+	// Fill the cache and check hits and least recently used eviction
+	keys := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)}
+	c.put(keys[0], big.NewInt(10))
+	c.put(keys[1], big.NewInt(20))
+	if hop := c.get(keys[0]); hop == nil || hop.Int64() != 10 {
+		t.Fatalf("cached hop mismatch: have %v, want %v.", hop, 10)
+	}
+	c.put(keys[2], big.NewInt(30))
+	if hop := c.get(keys[1]); hop != nil {
+		t.Fatalf("least recently used entry not evicted: %v.", hop)
+	}
+	if hop := c.get(keys[2]); hop == nil || hop.Int64() != 30 {
+		t.Fatalf("cached hop mismatch: have %v, want %v.", hop, 30)
+	}
+	if c.hits != 2 || c.misses != 1 {
+		t.Fatalf("cache stats mismatch: have %v/%v hits/misses, want %v/%v.", c.hits, c.misses, 2, 1)
+	}
+	// Ensure a zero sized cache stores nothing
+	c = newRouteCache(0)
+	c.put(keys[0], big.NewInt(10))
+	if hop := c.get(keys[0]); hop != nil {
+		t.Fatalf("disabled cache returned hop: %v.", hop)
+	}
+}
+
+func TestRouteCacheInvalidation(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+	o.SetRouteCacheSize(16)
+
+	// Route towards a key through a far away peer
+	far := newTestPeer(o, big.NewInt(0x3000000000))
+	o.routes.routes[0][3] = far.nodeId
+
+	dest := big.NewInt(0x3100000000)
+	for i := 0; i < 2; i++ {
+		o.lock.RLock()
+		hop := o.hop(dest)
+		o.lock.RUnlock()
+		if hop.Cmp(far.nodeId) != 0 {
+			t.Fatalf("next hop mismatch: have %v, want %v.", hop, far.nodeId)
+		}
+	}
+	if o.cache.hits != 1 || o.cache.misses != 1 {
+		t.Fatalf("cache stats mismatch: have %v/%v hits/misses, want %v/%v.", o.cache.hits, o.cache.misses, 1, 1)
+	}
+	// Start the manager and feed it a closer node
+	go o.manager()
+	defer close(o.quit)
+
+	near := newTestPeer(o, dest)
+	o.upSink <- &state{Addrs: map[string][]string{near.nodeId.String(): nil}, Updated: 1}
+
+	// Wait for the table swap and verify the cache got invalidated
+	for i := 0; ; i++ {
+		o.lock.RLock()
+		swapped := o.time > 1
+		o.lock.RUnlock()
+		if swapped {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("routing table not swapped.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.lock.RLock()
+	hop := o.hop(dest)
+	o.lock.RUnlock()
+	if hop.Cmp(near.nodeId) != 0 {
+		t.Fatalf("stale next hop: have %v, want %v.", hop, near.nodeId)
+	}
+	if o.cache.hits != 1 || o.cache.misses != 2 {
+		t.Fatalf("cache stats mismatch: have %v/%v hits/misses, want %v/%v.", o.cache.hits, o.cache.misses, 1, 2)
+	}
+}
@@ -0,0 +1,50 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the pluggable time source of the overlay, so that the maintenance
+// timers can be driven through virtual time instead of the wall clock.
+
+package overlay
+
+import (
+	"time"
+)
+
+// Source of time for the overlay maintenance routines, allowing tests to drive
+// the convergence, heartbeat, read deadline and idle timers through virtual time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Tick(d time.Duration) <-chan time.Time
+}
+
+// Clock forwarding all calls to the standard time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Tick(d time.Duration) <-chan time.Time  { return time.Tick(d) }
+
+// Sets the clock driving the manager, beater and link timers (defaults to the
+// wall clock).
+func WithClock(clock Clock) Option {
+	return func(o *Overlay) {
+		o.clock = clock
+	}
+}
@@ -0,0 +1,253 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"context"
+	"crypto/x509"
+	"github.com/karalabe/iris/config"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Timer registered with the virtual clock, periodic if period is non-zero.
+type fakeTimer struct {
+	at     time.Time
+	period time.Duration
+	sink   chan time.Time
+}
+
+// Virtual clock only advancing when explicitly requested, firing the timers
+// that expired in between.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	cond   *sync.Cond
+	lock   sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.schedule(d, 0)
+}
+
+func (c *fakeClock) Tick(d time.Duration) <-chan time.Time {
+	return c.schedule(d, d)
+}
+
+// Registers a new timer and notifies anyone waiting for it.
+func (c *fakeClock) schedule(d, period time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTimer{at: c.now.Add(d), period: period, sink: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t.sink
+}
+
+// Blocks until a one-shot timer expiring d after the current virtual time is
+// registered.
+func (c *fakeClock) wait(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for {
+		for _, t := range c.timers {
+			if t.period == 0 && t.at.Equal(c.now.Add(d)) {
+				return
+			}
+		}
+		c.cond.Wait()
+	}
+}
+
+// Moves the virtual time forward, firing all the expired timers.
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		for !t.at.After(c.now) {
+			select {
+			case t.sink <- t.at:
+			default:
+			}
+			if t.period == 0 {
+				break
+			}
+			t.at = t.at.Add(t.period)
+		}
+		if t.period != 0 || t.at.After(c.now) {
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock()
+
+	after := clock.After(time.Second)
+	tick := clock.Tick(300 * time.Millisecond)
+
+	// Advance below the one-shot timer and ensure only the ticker fires
+	clock.advance(500 * time.Millisecond)
+	select {
+	case <-after:
+		t.Fatalf("timer fired before expiry.")
+	default:
+	}
+	select {
+	case <-tick:
+	default:
+		t.Fatalf("ticker didn't fire after expiry.")
+	}
+	// Advance past the timer and ensure it fires exactly once
+	clock.advance(500 * time.Millisecond)
+	if at := <-after; !at.Equal(time.Unix(1, 0)) {
+		t.Fatalf("timer fire time mismatch: have %v, want %v.", at, time.Unix(1, 0))
+	}
+	clock.advance(time.Second)
+	select {
+	case <-after:
+		t.Fatalf("one-shot timer fired twice.")
+	default:
+	}
+}
+
+func TestManagerClock(t *testing.T) {
+	clock := newFakeClock()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback), WithClock(clock), WithBootTimeout(time.Second), WithConvTimeout(200*time.Millisecond))
+	o.auther.Start()
+	defer o.auther.Terminate()
+
+	go o.manager()
+	defer close(o.quit)
+
+	// Advance the virtual time right before the boot timeout and ensure no convergence
+	clock.wait(time.Second)
+	clock.advance(time.Second - time.Millisecond)
+	if o.Stable() {
+		t.Fatalf("overlay converged before the boot timeout.")
+	}
+	// Cross the timeout and ensure convergence is reached in exactly the boot time
+	clock.advance(time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := o.WaitStable(ctx); err != nil {
+		t.Fatalf("failed to wait for stability: %v.", err)
+	}
+	if m := o.Metrics(); m.Convergence != time.Second {
+		t.Fatalf("convergence time mismatch: have %v, want %v.", m.Convergence, time.Second)
+	}
+	// Feed an update and ensure the reduced timeout is used for reconvergence
+	o.upSink <- &state{Addrs: make(map[string][]string)}
+	clock.wait(200 * time.Millisecond)
+	if o.Stable() {
+		t.Fatalf("overlay stable after routing update.")
+	}
+	clock.advance(200 * time.Millisecond)
+	if err := o.WaitStable(ctx); err != nil {
+		t.Fatalf("failed to wait for reconvergence: %v.", err)
+	}
+	if m := o.Metrics(); m.Convergence != 200*time.Millisecond {
+		t.Fatalf("reconvergence time mismatch: have %v, want %v.", m.Convergence, 200*time.Millisecond)
+	}
+}
+
+func TestPeerClock(t *testing.T) {
+	// Override the heartbeat parameters for a short read deadline
+	defer func(beat, kill int) {
+		config.OverlayBeatPeriod, config.OverlayKillCount = beat, kill
+	}(config.OverlayBeatPeriod, config.OverlayKillCount)
+	config.OverlayBeatPeriod, config.OverlayKillCount = 50, 2
+	limit := 100 * time.Millisecond
+
+	clock := newFakeClock()
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback), WithClock(clock))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Start a silent link and ensure it's only dropped at the virtual read deadline
+	p := newTestPeer(o, big.NewInt(0x2000000000))
+	p.init = true
+	go p.receiver()
+	defer p.Close()
+
+	clock.wait(limit)
+	clock.advance(limit - time.Millisecond)
+	select {
+	case req := <-o.dropSink:
+		t.Fatalf("link dropped before the read deadline: %v.", req.peer.nodeId)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.advance(time.Millisecond)
+	select {
+	case req := <-o.dropSink:
+		if req.peer != p || req.reason != NetworkError {
+			t.Fatalf("drop request mismatch: have %v/%v, want %v/%v.", req.peer.nodeId, req.reason, p.nodeId, NetworkError)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("half-open link not dropped.")
+	}
+	delete(o.pool, p.nodeId.String())
+
+	// Connect an idle peer and ensure it's only reaped after the virtual idle timeout
+	idle := newTestPeer(o, big.NewInt(0x2100000000))
+	o.SetIdleTimeout(time.Minute)
+
+	o.reap()
+	select {
+	case req := <-o.dropSink:
+		t.Fatalf("connection reaped prematurely: %v.", req.peer.nodeId)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.advance(time.Minute + time.Millisecond)
+	o.reap()
+	select {
+	case req := <-o.dropSink:
+		if req.peer != idle || req.reason != Idle {
+			t.Fatalf("reaped connection mismatch: have %v/%v, want %v/%v.", req.peer.nodeId, req.reason, idle.nodeId, Idle)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection not reaped.")
+	}
+}
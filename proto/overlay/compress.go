@@ -0,0 +1,163 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the compression of large state exchange messages. If both ends of a
+// link support it (negotiated during the handshake), states whose encoded size
+// exceeds a threshold are sent packed by a pluggable codec, and are transparently
+// unpacked by the receiver before routing.
+
+package overlay
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"io"
+	"io/ioutil"
+)
+
+// Compression algorithm used to pack large state exchanges. All the nodes in an
+// overlay network must use the same codec.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Default state exchange codec based on the deflate algorithm.
+type flateCodec struct{}
+
+// Compresses a data blob using deflate.
+func (c flateCodec) Compress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompresses a deflated data blob, failing if it would inflate beyond the
+// unpack limit.
+func (c flateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	limit := int64(config.OverlayUnpackLimit)
+	blob, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(blob)) > limit {
+		return nil, fmt.Errorf("decompressed state exceeds %d bytes", limit)
+	}
+	return blob, nil
+}
+
+// Sets the codec used to compress large state exchanges. A nil codec disables
+// the compression for all subsequently established links.
+func (o *Overlay) SetCodec(c Codec) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.codec = c
+	if c != nil {
+		o.feats |= featCompress
+	} else {
+		o.feats &^= featCompress
+	}
+}
+
+// Serializes and compresses a state exchange if its encoded size exceeds the
+// packing threshold. Nil is returned if the state should be sent as is.
+func packState(c Codec, s *state) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(s); err != nil {
+		return nil, err
+	}
+	if buf.Len() <= config.OverlayPackThreshold {
+		return nil, nil
+	}
+	return c.Compress(buf.Bytes())
+}
+
+// Decompresses and deserializes a packed state exchange.
+func unpackState(c Codec, data []byte) (*state, error) {
+	blob, err := c.Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) > config.OverlayUnpackLimit {
+		return nil, fmt.Errorf("decompressed state exceeds %d bytes", config.OverlayUnpackLimit)
+	}
+	s := new(state)
+	if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Packs the state exchange of an outbound message if the link supports it and
+// the state is large enough to be worth it.
+func (o *Overlay) pack(p *peer, head *header) {
+	if p.feats&featCompress == 0 || head.State == nil {
+		return
+	}
+	o.lock.RLock()
+	codec := o.codec
+	o.lock.RUnlock()
+
+	if codec == nil {
+		return
+	}
+	if data, err := packState(codec, head.State); err != nil {
+		o.log.Errorf("overlay: failed to pack state: %v.", err)
+	} else if data != nil {
+		head.State, head.Packed = nil, data
+	}
+}
+
+// Unpacks the state exchange of an inbound message, if it was sent packed.
+func (o *Overlay) unpack(msg *proto.Message) error {
+	head, ok := msg.Head.Meta.(*header)
+	if !ok || head.Packed == nil {
+		return nil
+	}
+	o.lock.RLock()
+	codec := o.codec
+	o.lock.RUnlock()
+
+	if codec == nil {
+		return fmt.Errorf("no codec for packed state")
+	}
+	s, err := unpackState(codec, head.Packed)
+	if err != nil {
+		return err
+	}
+	head.State, head.Packed = s, nil
+	return nil
+}
@@ -0,0 +1,164 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/gob"
+	"fmt"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Generates a state exchange with the given number of address entries.
+func makeTestState(entries int) *state {
+	rng := rand.New(rand.NewSource(0))
+	s := &state{Addrs: make(map[string][]string), Updated: 314}
+	for i := 0; i < entries; i++ {
+		id := new(big.Int).Rand(rng, new(big.Int).Lsh(big.NewInt(1), 40))
+		s.Addrs[id.String()] = []string{
+			fmt.Sprintf("10.0.%d.%d:%d", i/256, i%256, 30000+rng.Intn(10000)),
+			fmt.Sprintf("192.168.%d.%d:%d", i/256, i%256, 30000+rng.Intn(10000)),
+		}
+	}
+	return s
+}
+
+func TestStatePacking(t *testing.T) {
+	codec := flateCodec{}
+
+	// Small states should be left as is
+	if data, err := packState(codec, makeTestState(1)); err != nil {
+		t.Fatalf("failed to pack small state: %v.", err)
+	} else if data != nil {
+		t.Fatalf("small state packed: %d bytes.", len(data))
+	}
+	// Large states should be packed and unpacked intact
+	orig := makeTestState(256)
+	data, err := packState(codec, orig)
+	if err != nil {
+		t.Fatalf("failed to pack large state: %v.", err)
+	} else if data == nil {
+		t.Fatalf("large state not packed.")
+	}
+	s, err := unpackState(codec, data)
+	if err != nil {
+		t.Fatalf("failed to unpack state: %v.", err)
+	}
+	if !reflect.DeepEqual(s, orig) {
+		t.Fatalf("unpacked state mismatch: have %v, want %v.", s, orig)
+	}
+	// Corrupt packets should be rejected
+	if _, err := unpackState(codec, data[:len(data)/2]); err == nil {
+		t.Fatalf("truncated state unpacked.")
+	}
+}
+
+func TestStateUnpackLimit(t *testing.T) {
+	// Save the previous config values
+	limit := config.OverlayUnpackLimit
+	defer func() { config.OverlayUnpackLimit = limit }()
+
+	codec := flateCodec{}
+
+	// Compress a highly redundant blob, inflating way beyond its packed size
+	bomb, err := codec.Compress(make([]byte, 1024*1024))
+	if err != nil {
+		t.Fatalf("failed to compress blob: %v.", err)
+	}
+	config.OverlayUnpackLimit = 64 * 1024
+	if _, err := codec.Decompress(bomb); err == nil {
+		t.Fatalf("oversized blob decompressed.")
+	}
+	if _, err := unpackState(codec, bomb); err == nil {
+		t.Fatalf("oversized state unpacked.")
+	}
+	// Blobs right at the limit should still pass
+	config.OverlayUnpackLimit = 1024 * 1024
+	if blob, err := codec.Decompress(bomb); err != nil || len(blob) != 1024*1024 {
+		t.Fatalf("blob at limit rejected: %v.", err)
+	}
+}
+
+func TestStatePackingLink(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	p := &peer{feats: featCompress}
+
+	// Packing should replace the state in the header and unpacking restore it
+	orig := makeTestState(256)
+	head := &header{State: orig}
+	o.pack(p, head)
+	if head.State != nil || head.Packed == nil {
+		t.Fatalf("state not packed: %v.", head)
+	}
+	msg := &proto.Message{Head: proto.Header{Meta: head}}
+	if err := o.unpack(msg); err != nil {
+		t.Fatalf("failed to unpack message: %v.", err)
+	}
+	if head.Packed != nil || !reflect.DeepEqual(head.State, orig) {
+		t.Fatalf("state not unpacked: %v.", head)
+	}
+	// Links without compression support should get the state as is
+	p.feats = 0
+	head = &header{State: orig}
+	o.pack(p, head)
+	if head.State != orig || head.Packed != nil {
+		t.Fatalf("state packed for unsupported link: %v.", head)
+	}
+}
+
+// Benchmarks the wire size of a 256 entry state exchange, with and without
+// compression (see the bytes/msg metric).
+func BenchmarkStateRaw256(b *testing.B) {
+	s := makeTestState(256)
+	b.ResetTimer()
+
+	size := 0
+	for i := 0; i < b.N; i++ {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(s); err != nil {
+			b.Fatalf("failed to encode state: %v.", err)
+		}
+		size = buf.Len()
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
+
+func BenchmarkStatePacked256(b *testing.B) {
+	s := makeTestState(256)
+	codec := flateCodec{}
+	b.ResetTimer()
+
+	size := 0
+	for i := 0; i < b.N; i++ {
+		data, err := packState(codec, s)
+		if err != nil {
+			b.Fatalf("failed to pack state: %v.", err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
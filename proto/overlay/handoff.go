@@ -0,0 +1,93 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the routing state handoff between a node and its replacement taking
+// over the same id, allowing the incoming node to start with a warm table.
+
+package overlay
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Routing state handed over from an outgoing node to its same-id replacement.
+type Handoff struct {
+	Id     *big.Int            // Node id being handed over
+	Leaves []*big.Int          // Leaf set of the outgoing node (including self)
+	Routes [][]*big.Int        // Routing table of the outgoing node
+	Addrs  map[string][]string // Cached addresses of the connected peers
+}
+
+// Exports the full routing table and the addresses of all the connected peers,
+// meant to be imported by a replacement node assuming the same id.
+func (o *Overlay) ExportForHandoff() *Handoff {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	t := o.routes.Copy()
+	h := &Handoff{
+		Id:     new(big.Int).Set(o.nodeId),
+		Leaves: t.leaves,
+		Routes: t.routes,
+		Addrs:  make(map[string][]string),
+	}
+	for id, p := range o.pool {
+		h.Addrs[id] = append([]string(nil), p.addrs...)
+	}
+	return h
+}
+
+// Imports a routing state exported by ExportForHandoff, assuming the node id of
+// the outgoing node and its routing table. The cached addresses are dialed when
+// the overlay is booted. Importing is only allowed before booting.
+func (o *Overlay) ImportHandoff(h *Handoff) error {
+	// Make sure the handoff is usable
+	if h.Id == nil || !o.space.contains(h.Id) {
+		return fmt.Errorf("id outside of the id space")
+	}
+	id := new(big.Int).Set(h.Id)
+	t := o.space.newTable(id)
+	if len(h.Routes) != len(t.routes) {
+		return fmt.Errorf("routing table dimension mismatch")
+	}
+	for i, row := range h.Routes {
+		if len(row) != len(t.routes[i]) {
+			return fmt.Errorf("routing table dimension mismatch")
+		}
+		copy(t.routes[i], row)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.mgrUp {
+		return fmt.Errorf("overlay already booted")
+	}
+	// Assume the handed over id and routing state
+	o.nodeId = id
+	t.leaves = o.mergeLeaves(t.leaves, h.Leaves)
+	o.routes = t
+	o.cache.flush()
+
+	o.warm = make(map[string][]string)
+	for id, addrs := range h.Addrs {
+		o.warm[id] = append([]string(nil), addrs...)
+	}
+	return nil
+}
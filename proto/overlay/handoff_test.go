@@ -0,0 +1,76 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestHandoff(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create an outgoing node with a few connected peers
+	out := New(appId, key, new(nopCallback))
+	out.nodeId = big.NewInt(0x1000000000)
+	out.routes = newTable(out.nodeId)
+
+	for i := 2; i <= 5; i++ {
+		id := big.NewInt(int64(i) << 32)
+		p := newTestPeer(out, id)
+		p.addrs = []string{fmt.Sprintf("127.0.0.%d:%d", i, 1000+i)}
+		out.routes.routes[0][i] = id
+	}
+	out.routes.leaves = out.mergeLeaves(out.routes.leaves, []*big.Int{big.NewInt(0x1000000001), big.NewInt(0x0fffffffff)})
+
+	// Hand the state over to a fresh node and verify it's identical
+	in := New(appId, key, new(nopCallback))
+	if err := in.ImportHandoff(out.ExportForHandoff()); err != nil {
+		t.Fatalf("failed to import handoff: %v.", err)
+	}
+	if in.Self().Cmp(out.Self()) != 0 {
+		t.Fatalf("node id mismatch: have %v, want %v.", in.Self(), out.Self())
+	}
+	if have, want := in.LeafRing(), out.LeafRing(); !reflect.DeepEqual(have, want) {
+		t.Errorf("leaf ring mismatch: have %v, want %v.", have, want)
+	}
+	for i := 0; i < 8; i++ {
+		key := big.NewInt(int64(i)<<32 + 0x12345)
+		if have, want := in.NextHops(key, 4), out.NextHops(key, 4); !reflect.DeepEqual(have, want) {
+			t.Errorf("key %v: next hops mismatch: have %v, want %v.", key, have, want)
+		}
+	}
+	if len(in.warm) != len(out.pool) {
+		t.Fatalf("cached address count mismatch: have %v, want %v.", len(in.warm), len(out.pool))
+	}
+	for id, p := range out.pool {
+		if !reflect.DeepEqual(in.warm[id], p.addrs) {
+			t.Errorf("peer %v: cached addresses mismatch: have %v, want %v.", id, in.warm[id], p.addrs)
+		}
+	}
+	// Ensure a running overlay cannot be replaced
+	in.mgrUp = true
+	if err := in.ImportHandoff(out.ExportForHandoff()); err == nil {
+		t.Fatalf("handoff imported into running overlay.")
+	}
+}
@@ -30,17 +30,31 @@ import (
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/bootstrap"
 	"github.com/karalabe/iris/proto/session"
-	"log"
 	"math/big"
 	"net"
 	"sort"
+	"strings"
 	"time"
 )
 
+// Optional protocol feature flags negotiated during the handshake.
+type feature uint32
+
+// Optional protocol features.
+const (
+	featCompress feature = 1 << iota // State exchange compression
+	featEncrypt                      // Message level encryption
+)
+
 // The initialization packet when the connection is set up.
 type initPacket struct {
 	Id    *big.Int
 	Addrs []string
+	Feats feature
+	Share *big.Int // Public key share of the link encryption (nil if unsupported)
+	Bits  int      // Bit length of the node ids
+	Base  int      // Bits per routing table digit
+	Vers  uint16   // Wire protocol version of the sender
 }
 
 // Make sure the init packet is registered with gob.
@@ -49,13 +63,12 @@ func init() {
 }
 
 // Starts up the overlay networking on a specified interface and fans in all the
-// inbound connections into the overlay-global channels.
-func (o *Overlay) acceptor(ip net.IP) {
+// inbound connections into the overlay-global channels. The zone is needed for
+// link-local IPv6 addresses only. Bootstrapping runs on IPv4 interfaces only, the
+// IPv6 addresses are advertised through the state exchanges.
+func (o *Overlay) acceptor(ip net.IP, zone string) {
 	// Listen for incomming session on the given interface and random port.
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip.String(), "0"))
-	if err != nil {
-		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ip, err))
-	}
+	addr := &net.TCPAddr{IP: ip, Zone: zone}
 	sesSink, quit, err := session.Listen(addr, o.lkey, o.rkeys)
 	if err != nil {
 		panic(fmt.Sprintf("failed to start session listener: %v.", err))
@@ -69,20 +82,27 @@ func (o *Overlay) acceptor(ip net.IP) {
 	o.lock.Unlock()
 
 	// Start the bootstrapper on the specified interface
-	booter, bootSink, err := bootstrap.New(ip, []byte(o.overId), o.nodeId, addr.Port)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
+	var booter *bootstrap.Bootstrapper
+	var bootSink chan *bootstrap.Event
+	var migrated chan struct{}
+	if ip.To4() != nil {
+		booter, bootSink, migrated = o.bootstrap(ip, addr.Port)
 	}
-	if err := booter.Boot(); err != nil {
-		panic(fmt.Sprintf("failed to boot bootstrapper: %v.", err))
-	}
-	defer booter.Terminate()
+	defer func() {
+		if booter != nil {
+			booter.Terminate()
+		}
+	}()
 
 	// Processes the incoming connections
 	for {
 		select {
 		case <-o.quit:
 			return
+		case <-migrated:
+			// Node id changed, restart the bootstrapper to advertise the new one
+			booter.Terminate()
+			booter, bootSink, migrated = o.bootstrap(ip, addr.Port)
 		case boot := <-bootSink:
 			// Discard bootstrap requests (prevent simultaneous double connecting)
 			if !boot.Resp {
@@ -90,7 +110,7 @@ func (o *Overlay) acceptor(ip net.IP) {
 			}
 			// If the peer id is desirable, dial and authenticate
 			if !o.filter(boot.Peer) {
-				o.auther.Schedule(func() { o.dial([]*net.TCPAddr{boot.Addr}) })
+				o.auther.Schedule(func() { o.dialOnce(boot.Peer, []*net.TCPAddr{boot.Addr}) })
 			}
 		case ses := <-sesSink:
 			// Agree upon overlay states
@@ -99,6 +119,23 @@ func (o *Overlay) acceptor(ip net.IP) {
 	}
 }
 
+// Starts a bootstrapper on the specified interface, advertising the current node
+// id. The returned channel is closed when the id migrates.
+func (o *Overlay) bootstrap(ip net.IP, port int) (*bootstrap.Bootstrapper, chan *bootstrap.Event, chan struct{}) {
+	o.lock.RLock()
+	id, migrated := o.nodeId, o.migCh
+	o.lock.RUnlock()
+
+	booter, bootSink, err := bootstrap.New(ip, []byte(o.overId), id, port)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
+	}
+	if err := booter.Boot(); err != nil {
+		panic(fmt.Sprintf("failed to boot bootstrapper: %v.", err))
+	}
+	return booter, bootSink, migrated
+}
+
 // Checks whether a bootstrap-located peer fits into the local routing table or
 // will be just discarded anyway.
 func (o *Overlay) filter(id *big.Int) bool {
@@ -115,22 +152,22 @@ func (o *Overlay) filter(id *big.Int) bool {
 	// Check for empty slot in leaf set
 	for i, leaf := range table.leaves {
 		if leaf.Cmp(o.nodeId) == 0 {
-			if delta(id, leaf).Sign() >= 0 && i < config.OverlayLeaves/2 {
+			if o.space.delta(id, leaf).Sign() >= 0 && i < config.OverlayLeaves/2 {
 				return false
 			}
-			if delta(leaf, id).Sign() >= 0 && len(table.leaves)-i < config.OverlayLeaves/2 {
+			if o.space.delta(leaf, id).Sign() >= 0 && len(table.leaves)-i < config.OverlayLeaves/2 {
 				return false
 			}
 			break
 		}
 	}
 	// Check for better leaf set
-	if delta(table.leaves[0], id).Sign() >= 0 && delta(id, table.leaves[len(table.leaves)-1]).Sign() >= 0 {
+	if o.space.delta(table.leaves[0], id).Sign() >= 0 && o.space.delta(id, table.leaves[len(table.leaves)-1]).Sign() >= 0 {
 		return false
 	}
 	// Check place in routing table
-	pre, col := prefix(o.nodeId, id)
-	if prev := table.routes[pre][col]; prev == nil {
+	pre, col := o.space.prefix(o.nodeId, id)
+	if table.contains(pre, col) && table.routes[pre][col] == nil {
 		return false
 	}
 	// Nowhere to insert, bin it
@@ -143,22 +180,170 @@ func (o *Overlay) dial(addrs []*net.TCPAddr) {
 	for _, ownAddr := range o.addrs {
 		for _, peerAddr := range addrs {
 			if peerAddr.String() == ownAddr {
-				log.Printf("overlay: self connection not allowed: %v.", o.nodeId)
+				o.log.Errorf("overlay: self connection not allowed: %v.", o.nodeId)
 				return
 			}
 		}
 	}
 	// Dial away, trying interfaces one after the other until connection succeeds
-	for _, addr := range addrs {
-		if ses, err := session.Dial(addr.IP.String(), addr.Port, o.overId, o.lkey, o.rkeys[o.overId]); err == nil {
+	for _, addr := range o.orderAddrs(addrs) {
+		start := time.Now()
+		if ses, err := session.Dial(dialHost(addr), addr.Port, o.overId, o.lkey, o.rkeys[o.overId]); err == nil {
+			o.recordDial(addr, true, time.Since(start))
 			o.shake(ses)
 			return
 		} else {
-			log.Printf("overlay: failed to dial remote peer %v, at %v: %v.", o.overId, addr, err)
+			o.recordDial(addr, false, 0)
+			o.log.Debugf("overlay: failed to dial remote peer %v, at %v: %v.", o.overId, addr, err)
 		}
 	}
 }
 
+// Dials a remote node unless a dial to the same target is already in progress,
+// in which case it waits for that one to finish instead. The target is the node
+// id if known (nil otherwise), falling back to the sorted address tuple.
+func (o *Overlay) dialOnce(id *big.Int, addrs []*net.TCPAddr) {
+	key := dialTarget(id, addrs)
+
+	o.lock.Lock()
+	if done, ok := o.inflight[key]; ok {
+		o.lock.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	o.inflight[key] = done
+	o.lock.Unlock()
+
+	defer func() {
+		o.lock.Lock()
+		delete(o.inflight, key)
+		o.lock.Unlock()
+		close(done)
+	}()
+	o.dial(addrs)
+}
+
+// Generates the key identifying a dial target: the node id if known, or else the
+// sorted list of addresses.
+func dialTarget(id *big.Int, addrs []*net.TCPAddr) string {
+	if id != nil {
+		return id.String()
+	}
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ",")
+}
+
+// Returns the host part of a TCP address in a form suitable for dialing, keeping
+// any IPv6 zone (e.g. fe80::1%eth0) that IP.String would drop.
+func dialHost(addr *net.TCPAddr) string {
+	if addr.Zone != "" {
+		return addr.IP.String() + "%" + addr.Zone
+	}
+	return addr.IP.String()
+}
+
+// Dial statistics of a remote address, used to prefer historically good ones.
+type addrStat struct {
+	success int           // Number of successful dials
+	failure int           // Number of failed dials
+	latency time.Duration // Smoothed latency of the successful dials
+}
+
+// Address slice sortable by the historical dial statistics.
+type addrSlice struct {
+	addrs []*net.TCPAddr
+	stats []*addrStat
+}
+
+// Required for sort.Sort.
+func (s addrSlice) Len() int {
+	return len(s.addrs)
+}
+
+// Required for sort.Sort (fewer net failures first, then lower latency).
+func (s addrSlice) Less(i, j int) bool {
+	si, sj := s.stats[i], s.stats[j]
+	if di, dj := si.failure-si.success, sj.failure-sj.success; di != dj {
+		return di < dj
+	}
+	return si.latency < sj.latency
+}
+
+// Required for sort.Sort.
+func (s addrSlice) Swap(i, j int) {
+	s.addrs[i], s.addrs[j] = s.addrs[j], s.addrs[i]
+	s.stats[i], s.stats[j] = s.stats[j], s.stats[i]
+}
+
+// Enables or disables the address learning dial policy: the success rate and
+// latency of each dialed address is tracked, and subsequent dials to the same
+// peer try the historically best address first, falling back to the others.
+func (o *Overlay) SetAddressLearning(enabled bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if enabled && o.dials == nil {
+		o.dials = make(map[string]*addrStat)
+	} else if !enabled {
+		o.dials = nil
+	}
+}
+
+// Orders a peer's addresses according to the dial statistics if address
+// learning is enabled. Otherwise the original order is retained.
+func (o *Overlay) orderAddrs(addrs []*net.TCPAddr) []*net.TCPAddr {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	if o.dials == nil || len(addrs) < 2 {
+		return addrs
+	}
+	res := addrSlice{
+		addrs: make([]*net.TCPAddr, len(addrs)),
+		stats: make([]*addrStat, len(addrs)),
+	}
+	copy(res.addrs, addrs)
+	for i, addr := range addrs {
+		if stat, ok := o.dials[addr.String()]; ok {
+			res.stats[i] = stat
+		} else {
+			res.stats[i] = new(addrStat)
+		}
+	}
+	sort.Stable(res)
+	return res.addrs
+}
+
+// Records the outcome of a dial attempt if address learning is enabled.
+func (o *Overlay) recordDial(addr *net.TCPAddr, success bool, latency time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.dials == nil {
+		return
+	}
+	stat, ok := o.dials[addr.String()]
+	if !ok {
+		stat = new(addrStat)
+		o.dials[addr.String()] = stat
+	}
+	if !success {
+		stat.failure++
+		return
+	}
+	if stat.success == 0 {
+		stat.latency = latency
+	} else {
+		stat.latency = (7*stat.latency + latency) / 8
+	}
+	stat.success++
+}
+
 // Executes a two way overlay handshake where both peers exchange their server
 // addresses and virtual ids to enable them both to filter out multiple
 // connections. To prevent resource exhaustion, a timeout is attached to the
@@ -166,13 +351,26 @@ func (o *Overlay) dial(addrs []*net.TCPAddr) {
 func (o *Overlay) shake(ses *session.Session) {
 	p, err := o.newPeer(ses)
 	if err != nil {
-		log.Printf("overlay: failed to create peer: %v.", err)
+		o.log.Errorf("overlay: failed to create peer: %v.", err)
 		return
 	}
 	// Send an init packet to the remote peer
 	pkt := new(initPacket)
-	pkt.Id = new(big.Int).Set(o.nodeId)
+	pkt.Id = o.Id()
+	pkt.Feats = o.feats
+	pkt.Bits, pkt.Base = o.space.bits, o.space.base
+	pkt.Vers = o.version
 
+	var exp *big.Int
+	if o.feats&featEncrypt != 0 {
+		if exp, pkt.Share, err = newKeyShare(); err != nil {
+			o.log.Errorf("overlay: failed to generate key share: %v.", err)
+			if err := p.Close(); err != nil {
+				o.log.Errorf("overlay: failed to close peer connection: %v.", err)
+			}
+			return
+		}
+	}
 	o.lock.RLock()
 	pkt.Addrs = make([]string, len(o.addrs))
 	copy(pkt.Addrs, o.addrs)
@@ -181,9 +379,9 @@ func (o *Overlay) shake(ses *session.Session) {
 	msg := new(proto.Message)
 	msg.Head.Meta = pkt
 	if err := p.send(msg); err != nil {
-		log.Printf("overlay: failed to send init packet: %v.", err)
+		o.log.Errorf("overlay: failed to send init packet: %v.", err)
 		if err := p.Close(); err != nil {
-			log.Printf("overlay: failed to close peer connection: %v.", err)
+			o.log.Errorf("overlay: failed to close peer connection: %v.", err)
 		}
 		return
 	}
@@ -191,15 +389,34 @@ func (o *Overlay) shake(ses *session.Session) {
 	success := false
 	select {
 	case <-time.After(time.Duration(config.OverlayInitTimeout) * time.Millisecond):
-		log.Printf("overlay: session initialization timed out.")
+		o.log.Errorf("overlay: session initialization timed out.")
 	case msg, ok := <-p.netIn:
 		if ok {
 			success = true
 
 			pkt = msg.Head.Meta.(*initPacket)
+			if pkt.Bits != o.space.bits || pkt.Base != o.space.base {
+				o.log.Errorf("overlay: id space mismatch: have %d/%d, want %d/%d.", pkt.Bits, pkt.Base, o.space.bits, o.space.base)
+				success = false
+				break
+			}
+			if !o.supports(pkt.Vers) {
+				o.log.Errorf("overlay: protocol version mismatch: have %d, want %d±1.", pkt.Vers, o.version)
+				success = false
+				break
+			}
 			p.nodeId = pkt.Id
 			p.addrs = pkt.Addrs
+			p.feats = o.feats & pkt.Feats
 
+			// Set up the link encryption if both sides support it
+			if p.feats&featEncrypt != 0 {
+				if err := o.secure(p, exp, pkt.Share); err != nil {
+					o.log.Errorf("overlay: failed to secure link: %v.", err)
+					success = false
+					break
+				}
+			}
 			// Everything ok, accept connection
 			o.dedup(p)
 		}
@@ -207,7 +424,7 @@ func (o *Overlay) shake(ses *session.Session) {
 	// Make sure we release anything associated with a failed connection
 	if !success {
 		if err := p.Close(); err != nil {
-			log.Printf("overlay: failed to close peer connection: %v.", err)
+			o.log.Errorf("overlay: failed to close peer connection: %v.", err)
 		}
 	}
 }
@@ -246,7 +463,7 @@ func (o *Overlay) dedup(p *peer) {
 		if keep {
 			o.lock.Unlock() // There's one more release point!
 			if err := p.Close(); err != nil {
-				log.Printf("overlay: failed to close peer connection: %v.", err)
+				o.log.Errorf("overlay: failed to close peer connection: %v.", err)
 			}
 			return
 		}
@@ -256,19 +473,26 @@ func (o *Overlay) dedup(p *peer) {
 	for _, addr := range p.addrs {
 		o.trans[addr] = p.nodeId
 	}
+	o.recordClass(p.nodeId.String(), p.addrs)
+	if o.classify != nil {
+		// Skipped leaf candidates take part in deliveries, cached routes may be stale
+		o.cache.flush()
+	}
 	if err := p.Start(); err != nil {
-		log.Printf("overlay: failed to start peer receiver: %v.", err)
+		o.log.Errorf("overlay: failed to start peer receiver: %v.", err)
 	}
 	// If we swapped, terminate the old directly
 	if old != nil {
 		if err := old.Close(); err != nil {
-			log.Printf("overlay: failed to close peer connection: %v.", err)
+			o.log.Errorf("overlay: failed to close peer connection: %v.", err)
 		}
+		defer o.dropped(old.nodeId, DuplicateId)
 	}
 	// Decide whether to send a join request or a state exchange
 	status := o.stat
 	if o.stat == none {
 		o.stat = join
+		o.boot = p.nodeId
 	}
 	// Release lock before proceeding with state exchanges
 	o.lock.Unlock() // There's one more release point!
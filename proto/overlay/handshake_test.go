@@ -21,6 +21,13 @@ package overlay
 
 import (
 	"crypto/x509"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto/session"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -144,3 +151,362 @@ func TestHandshake(t *testing.T) {
 		t.Errorf("mallory (%v) found in the pool of bob: %v.", mallory.nodeId, bob.pool)
 	}
 }
+
+func TestFeatureNegotiation(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes, one lacking compression support
+	alice := New(appId, key, new(nopCallback))
+	alice.feats = featCompress | featEncrypt
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bob := New(appId, key, new(nopCallback))
+	bob.feats = featEncrypt
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	// Verify that both ends agreed on the common feature set
+	alice.lock.RLock()
+	defer alice.lock.RUnlock()
+	bob.lock.RLock()
+	defer bob.lock.RUnlock()
+
+	if p, ok := alice.pool[bob.nodeId.String()]; !ok {
+		t.Errorf("bob (%v) missing from the pool of alice: %v.", bob.nodeId, alice.pool)
+	} else if p.feats != featEncrypt {
+		t.Errorf("alice feature mismatch: have %v, want %v.", p.feats, featEncrypt)
+	}
+	if p, ok := bob.pool[alice.nodeId.String()]; !ok {
+		t.Errorf("alice (%v) missing from the pool of bob: %v.", alice.nodeId, bob.pool)
+	} else if p.feats != featEncrypt {
+		t.Errorf("bob feature mismatch: have %v, want %v.", p.feats, featEncrypt)
+	}
+}
+
+func TestIdSpaceMismatch(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes with different id spaces
+	alice := New(appId, key, new(nopCallback), WithIdSpace(16, 4))
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bob := New(appId, key, new(nopCallback))
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	// Verify that neither accepted the other
+	alice.lock.RLock()
+	defer alice.lock.RUnlock()
+	bob.lock.RLock()
+	defer bob.lock.RUnlock()
+
+	if len(alice.pool) != 0 {
+		t.Errorf("alice connected to mismatching peers: %v.", alice.pool)
+	}
+	if len(bob.pool) != 0 {
+		t.Errorf("bob connected to mismatching peers: %v.", bob.pool)
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes two protocol versions apart
+	alice := New(appId, key, new(nopCallback))
+	alice.version = protoVersion + 2
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bob := New(appId, key, new(nopCallback))
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	// Verify that neither accepted the other
+	alice.lock.RLock()
+	defer alice.lock.RUnlock()
+	bob.lock.RLock()
+	defer bob.lock.RUnlock()
+
+	if len(alice.pool) != 0 {
+		t.Errorf("alice connected to incompatible peers: %v.", alice.pool)
+	}
+	if len(bob.pool) != 0 {
+		t.Errorf("bob connected to incompatible peers: %v.", bob.pool)
+	}
+}
+
+func TestAddressLearning(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	// Find a closed local port to dial into and a supposedly working one
+	sock, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open local socket: %v.", err)
+	}
+	bad := sock.Addr().(*net.TCPAddr)
+	sock.Close()
+	good := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: bad.Port + 1}
+
+	// Without learning, the original order should be retained
+	o.dial([]*net.TCPAddr{bad})
+	if addrs := o.orderAddrs([]*net.TCPAddr{bad, good}); addrs[0] != bad {
+		t.Fatalf("address order changed without learning: %v.", addrs)
+	}
+	// Enable learning, fail the first address and ensure the good is preferred
+	o.SetAddressLearning(true)
+	o.dial([]*net.TCPAddr{bad})
+	o.recordDial(good, true, time.Millisecond)
+
+	if addrs := o.orderAddrs([]*net.TCPAddr{bad, good}); addrs[0] != good || addrs[1] != bad {
+		t.Fatalf("learned address order mismatch: have %v, want %v.", addrs, []*net.TCPAddr{good, bad})
+	}
+}
+
+func TestBootstrapPeer(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	defer close(o.quit)
+
+	if id, ok := o.BootstrapPeer(); ok {
+		t.Fatalf("bootstrap peer reported before joining: %v.", id)
+	}
+	// Accept a few connections, only the first of which should be the bootstrap
+	ids := []*big.Int{big.NewInt(314), big.NewInt(241), big.NewInt(141)}
+	for _, id := range ids {
+		p := newTestPeer(o, id)
+		delete(o.pool, id.String())
+		o.dedup(p)
+	}
+	if id, ok := o.BootstrapPeer(); !ok || id.Cmp(ids[0]) != 0 {
+		t.Fatalf("bootstrap peer mismatch: have %v/%v, want %v/%v.", id, ok, ids[0], true)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.addrs = []string{"10.0.0.1:1234", "10.0.0.2:1234"}
+
+	// Ensure the accessors report the correct values
+	id := o.Id()
+	if id.Cmp(o.nodeId) != 0 {
+		t.Fatalf("node id mismatch: have %v, want %v.", id, o.nodeId)
+	}
+	addrs := o.Addresses()
+	if len(addrs) != 2 || addrs[0] != o.addrs[0] || addrs[1] != o.addrs[1] {
+		t.Fatalf("address mismatch: have %v, want %v.", addrs, o.addrs)
+	}
+	// Ensure the returned values are copies
+	id.SetInt64(314)
+	addrs[0] = "modified"
+	if o.nodeId.Cmp(id) == 0 {
+		t.Fatalf("node id modified through accessor.")
+	}
+	if o.addrs[0] == "modified" {
+		t.Fatalf("addresses modified through accessor.")
+	}
+}
+
+func TestAdvertiseIPv6(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot an overlay node and look for an advertised IPv6 address
+	alice := New(appId, key, new(nopCallback))
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	var addr *net.TCPAddr
+	for _, adv := range alice.Addresses() {
+		if a, err := net.ResolveTCPAddr("tcp", adv); err == nil && a.IP.To4() == nil {
+			addr = a
+			break
+		}
+	}
+	if addr == nil {
+		t.Skipf("no IPv6 interface addresses: %v.", alice.Addresses())
+	}
+	// Dial the advertised address from a second overlay (without bootstrapping)
+	bob := New(appId, key, new(nopCallback))
+	bob.auther.Start()
+	go bob.manager()
+	defer close(bob.quit)
+
+	go bob.dial([]*net.TCPAddr{addr})
+	for i := 0; ; i++ {
+		alice.lock.RLock()
+		p, ok := alice.pool[bob.Id().String()]
+		alice.lock.RUnlock()
+		if ok {
+			if host, _, err := net.SplitHostPort(p.raddr); err != nil || net.ParseIP(strings.SplitN(host, "%", 2)[0]).To4() != nil {
+				t.Fatalf("bob connected over a non-IPv6 address: %v.", p.raddr)
+			}
+			break
+		}
+		if i > 50 {
+			t.Fatalf("bob failed to connect over IPv6 address %v.", addr)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestDialIPv6(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	defer close(o.quit)
+
+	// Find a free IPv6 loopback port and start a session listener on it
+	sock, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v.", err)
+	}
+	port := sock.Addr().(*net.TCPAddr).Port
+	sock.Close()
+
+	sink, quit, err := session.Listen(&net.TCPAddr{IP: net.IPv6loopback, Port: port}, o.lkey, o.rkeys)
+	if err != nil {
+		t.Fatalf("failed to start IPv6 session listener: %v.", err)
+	}
+	defer close(quit)
+
+	// Resolve the advertised (bracketed) address and dial it
+	adv := net.JoinHostPort("::1", strconv.Itoa(port))
+	addr, err := net.ResolveTCPAddr("tcp", adv)
+	if err != nil {
+		t.Fatalf("failed to resolve advertised address %v: %v.", adv, err)
+	}
+	if addr.String() != adv {
+		t.Fatalf("address serialization mismatch: have %v, want %v.", addr.String(), adv)
+	}
+	go o.dial([]*net.TCPAddr{addr})
+
+	select {
+	case ses := <-sink:
+		ses.Raw().Close()
+	case <-time.After(time.Second):
+		t.Fatalf("IPv6 peer not dialed.")
+	}
+}
+
+func TestDialHost(t *testing.T) {
+	tests := []struct {
+		addr *net.TCPAddr
+		host string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}, "127.0.0.1"},
+		{&net.TCPAddr{IP: net.IPv6loopback, Port: 9000}, "::1"},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 9000, Zone: "eth0"}, "fe80::1%eth0"},
+	}
+	for i, tt := range tests {
+		if host := dialHost(tt.addr); host != tt.host {
+			t.Errorf("test %d: dial host mismatch: have %v, want %v.", i, host, tt.host)
+		}
+	}
+}
+
+func TestDialOnce(t *testing.T) {
+	defer func(timeout int) { config.OverlayInitTimeout = timeout }(config.OverlayInitTimeout)
+	config.OverlayInitTimeout = 250
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	defer close(o.quit)
+
+	// Find a free loopback port and start a counting session listener on it
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find free port: %v.", err)
+	}
+	addr := sock.Addr().(*net.TCPAddr)
+	sock.Close()
+
+	sink, quit, err := session.Listen(addr, o.lkey, o.rkeys)
+	if err != nil {
+		t.Fatalf("failed to start session listener: %v.", err)
+	}
+	defer close(quit)
+
+	var lock sync.Mutex
+	sessions := 0
+	go func() {
+		for ses := range sink {
+			lock.Lock()
+			sessions++
+			lock.Unlock()
+
+			// Keep the session up a bit for the dials to overlap
+			go func(ses *session.Session) {
+				time.Sleep(100 * time.Millisecond)
+				ses.Raw().Close()
+			}(ses)
+		}
+	}()
+	// Run two overlapping discovery rounds dialing the same node
+	id := big.NewInt(314)
+	var pend sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+			o.dialOnce(id, []*net.TCPAddr{addr})
+		}()
+	}
+	pend.Wait()
+
+	lock.Lock()
+	if sessions != 1 {
+		t.Errorf("connection count mismatch: have %v, want %v.", sessions, 1)
+	}
+	lock.Unlock()
+
+	// Make sure the finished dial doesn't block new ones
+	o.dialOnce(id, []*net.TCPAddr{addr})
+	lock.Lock()
+	defer lock.Unlock()
+	if sessions != 2 {
+		t.Errorf("connection count mismatch: have %v, want %v.", sessions, 2)
+	}
+	if len(o.inflight) != 0 {
+		t.Errorf("finished dials still in flight: %v.", o.inflight)
+	}
+}
+
+func TestDialTarget(t *testing.T) {
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	b := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+
+	if dialTarget(nil, []*net.TCPAddr{a, b}) != dialTarget(nil, []*net.TCPAddr{b, a}) {
+		t.Errorf("address tuple order dependent.")
+	}
+	if dialTarget(big.NewInt(1), []*net.TCPAddr{a}) != dialTarget(big.NewInt(1), []*net.TCPAddr{b}) {
+		t.Errorf("known id target address dependent.")
+	}
+}
@@ -0,0 +1,49 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the pluggable leveled logger the overlay reports its events through.
+
+package overlay
+
+import (
+	"log"
+)
+
+// Minimal leveled logging interface the overlay reports its events through,
+// allowing them to be routed into an application's structured logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Logger forwarding all levels to the standard log package.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) Infof(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// Sets the logger to report the overlay events through (defaults to the standard
+// log package).
+func WithLogger(logger Logger) Option {
+	return func(o *Overlay) {
+		o.log = logger
+	}
+}
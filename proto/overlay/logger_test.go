@@ -0,0 +1,88 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Logger recording the reported messages per level.
+type testLogger struct {
+	lock sync.Mutex
+	logs map[string][]string
+}
+
+func (l *testLogger) record(level, format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.logs[level] = append(l.logs[level], fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) { l.record("debug", format, args...) }
+func (l *testLogger) Infof(format string, args ...interface{})  { l.record("info", format, args...) }
+func (l *testLogger) Errorf(format string, args ...interface{}) { l.record("error", format, args...) }
+
+func TestLogger(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Make sure the default logger is the standard library backed one
+	if o := New(appId, key, new(nopCallback)); o.log != (stdLogger{}) {
+		t.Fatalf("default logger mismatch: have %v, want %v.", o.log, stdLogger{})
+	}
+	// Feed an invalid state into an overlay with a custom logger
+	logger := &testLogger{logs: make(map[string][]string)}
+	o := New(appId, key, new(nopCallback), WithLogger(logger))
+
+	s := &state{Addrs: map[string][]string{"not-an-id": nil}}
+	o.merge(o.routes, make(map[string][]string), s)
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if errs := logger.logs["error"]; len(errs) != 1 || !strings.Contains(errs[0], "invalid node id") {
+		t.Fatalf("error logs mismatch: have %v, want invalid node id.", errs)
+	}
+}
+
+func TestDiscoverDuplicates(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	logger := &testLogger{logs: make(map[string][]string)}
+	o := New(appId, key, new(nopCallback), WithLogger(logger))
+
+	// Reference the same unconnected node from the leaf set and the neighborhood
+	id := new(big.Int).Add(o.nodeId, big.NewInt(1))
+	tab := newTable(o.nodeId)
+	tab.leaves = append(tab.leaves, id)
+	tab.neighbors = append(tab.neighbors, id)
+
+	if ids := o.discover(tab); len(ids) != 1 || ids[0].Cmp(id) != 0 {
+		t.Fatalf("discovered nodes mismatch: have %v, want %v.", ids, []*big.Int{id})
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if logs := logger.logs["debug"]; len(logs) != 1 || !strings.Contains(logs[0], "suppressed 1 duplicate") {
+		t.Fatalf("debug logs mismatch: have %v, want suppressed duplicate.", logs)
+	}
+}
@@ -30,15 +30,16 @@
 package overlay
 
 import (
+	"fmt"
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/ext/mathext"
 	"github.com/karalabe/iris/ext/sortext"
 	"github.com/karalabe/iris/pool"
-	"log"
 	"math/big"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -50,14 +51,79 @@ func (o *Overlay) manager() {
 	var pending sync.WaitGroup
 	var routes *table
 
-	// Start the exchange limiter
-	exchPool := pool.NewThreadPool(config.OverlayExchThreads)
+	// Flag the manager as running until termination
+	o.lock.Lock()
+	o.mgrUp = true
+	o.lock.Unlock()
+
+	defer func() {
+		o.lock.Lock()
+		o.mgrUp = false
+		o.lock.Unlock()
+	}()
+
+	// Start the exchange limiter (with extra capacity until the first convergence)
+	exchPool := pool.NewBoundedThreadPool(config.OverlayExchBootThreads, config.OverlayExchQueue)
 	exchPool.Start()
 	defer exchPool.Terminate()
 
+	// Pending state exchanges (and their repair flags) to coalesce duplicates
+	exchPend := make(map[*peer]bool)
+	exchLock := new(sync.Mutex)
+
+	// Broadcasts the current routing state to all connected peers, coalescing the
+	// sends to peers which already have one queued
+	var bcastLast time.Time
+	var bcastTimer <-chan time.Time
+	bcastRep := false
+
+	broadcast := func(rep bool) {
+		bcastLast, bcastTimer, bcastRep = o.clock.Now(), nil, false
+		atomic.AddUint64(&o.bcasts, 1)
+
+		o.lock.RLock()
+		defer o.lock.RUnlock()
+
+		leaves := make(map[string]struct{}, len(o.routes.leaves))
+		for _, id := range o.routes.leaves {
+			leaves[id.String()] = struct{}{}
+		}
+		for sid, peer := range o.pool {
+			p := peer // Copy for closure!
+
+			// If a send is already queued, it will pick up the new state too
+			exchLock.Lock()
+			pend, queued := exchPend[p]
+			exchPend[p] = pend || rep
+			exchLock.Unlock()
+			if queued {
+				continue
+			}
+			// Leaf set members are critical for convergence, send to them first
+			prio := 0
+			if _, ok := leaves[sid]; ok {
+				prio = 1
+			}
+			err := exchPool.SchedulePrio(prio, func() {
+				exchLock.Lock()
+				repair := exchPend[p]
+				delete(exchPend, p)
+				exchLock.Unlock()
+
+				o.sendState(p, repair)
+			})
+			// Backlog full, drop the send (next change will retry)
+			if err != nil {
+				exchLock.Lock()
+				delete(exchPend, p)
+				exchLock.Unlock()
+			}
+		}
+	}
 	// Mark the overlay as unstable
+	unstableAt := o.clock.Now()
 	stable := false
-	stableTime := time.Duration(config.OverlayBootTimeout)
+	stableTime := o.bootTimeout
 
 	for {
 		// Copy the existing routing table if required
@@ -67,7 +133,8 @@ func (o *Overlay) manager() {
 			o.lock.RUnlock()
 		}
 		addrs := make(map[string][]string)
-		drops := make(map[*peer]struct{})
+		drops := make(map[*peer]DropReason)
+		waits := []chan struct{}{}
 
 		// Block till an update or drop arrives
 		for idle := true; idle; {
@@ -78,42 +145,109 @@ func (o *Overlay) manager() {
 			case s := <-o.upSink:
 				o.merge(routes, addrs, s)
 			case d := <-o.dropSink:
-				drops[d] = struct{}{}
-			case <-time.After(stableTime * time.Millisecond):
+				if _, ok := drops[d.peer]; !ok {
+					drops[d.peer] = d.reason
+				}
+				if d.done != nil {
+					waits = append(waits, d.done)
+				}
+			case req := <-o.migSink:
+				if t, err := o.migrate(addrs, req.id); err != nil {
+					req.errc <- err
+				} else {
+					routes = t
+					req.errc <- nil
+				}
+			case <-bcastTimer:
+				// Deferred broadcast due, send out the coalesced state
+				broadcast(bcastRep)
+				idle = true
+			case <-o.clock.After(stableTime):
 				// No update arrived for a while, consider stable
 				idle = true
 				if !stable {
 					stable = true
-					o.stable.Done()
+					exchPool.Resize(config.OverlayExchThreads)
+
+					o.lock.Lock()
+					o.stab, o.stabAt = true, o.clock.Now()
+					o.settle = o.clock.Now().Sub(unstableAt)
+					close(o.stabCh)
+					o.lock.Unlock()
 				}
 			}
 		}
 		// Mark overlay as unstable again and set a reduced convergence timeout
+		quiet := time.Duration(0)
 		if stable {
 			stable = false
-			o.stable.Add(1)
+			unstableAt = o.clock.Now()
+
+			o.lock.Lock()
+			quiet = o.clock.Now().Sub(o.stabAt)
+			o.stab, o.stabAt = false, o.clock.Now()
+			o.stabCh = make(chan struct{})
+			o.lock.Unlock()
 		}
-		stableTime = time.Duration(config.OverlayConvTimeout)
+		stableTime = o.convTimeout
 
 		// Cascade merges, drops and new connections until nobody else wants in or out
 		for cascade := true; cascade; {
 			cascade = false
+			batch := []*state{}
 			for idle := false; !idle; {
 				select {
 				case <-o.quit:
 					return
 				case s := <-o.upSink:
-					o.merge(routes, addrs, s)
+					batch = append(batch, s)
 					cascade = true
 				case d := <-o.dropSink:
-					drops[d] = struct{}{}
+					if _, ok := drops[d.peer]; !ok {
+						drops[d.peer] = d.reason
+					}
+					if d.done != nil {
+						waits = append(waits, d.done)
+					}
 					cascade = true
+				case req := <-o.migSink:
+					if t, err := o.migrate(addrs, req.id); err != nil {
+						req.errc <- err
+					} else {
+						routes = t
+						req.errc <- nil
+						cascade = true
+					}
 				default:
 					idle = true
 				}
 			}
-			// Drop all uneeded nodes
+			// Merge the drained states at once, so dialing sees the final table
+			if len(batch) != 0 {
+				o.mergeBatch(routes, addrs, batch)
+			}
+			// Drop all uneeded nodes and evict the departed and paused ones from the routing table
+			departed := []*big.Int{}
+			for p, reason := range drops {
+				if reason == Departed {
+					departed = append(departed, p.nodeId)
+				}
+			}
 			o.drop(drops)
+			for _, done := range waits {
+				close(done)
+			}
+			waits = waits[:0]
+
+			if len(departed) != 0 {
+				o.revoke(routes, departed)
+			}
+			if paused := o.paused(); len(paused) != 0 {
+				o.revoke(routes, paused)
+			}
+			if held := o.held(routes); len(held) != 0 {
+				o.revoke(routes, held)
+			}
 
 			// Check the new table for discovered peers and dial each
 			if peers := o.discover(routes); len(peers) != 0 {
@@ -122,57 +256,119 @@ func (o *Overlay) manager() {
 					peerAddrs := make([]*net.TCPAddr, 0, len(addrs[id.String()]))
 					for _, a := range addrs[id.String()] {
 						if addr, err := net.ResolveTCPAddr("tcp", a); err != nil {
-							log.Printf("failed to resolve address %v: %v.", a, err)
+							o.log.Errorf("overlay: failed to resolve address %v: %v.", a, err)
 						} else {
 							peerAddrs = append(peerAddrs, addr)
 						}
 					}
 					// Initiate a connection to the remote peer
+					peerId := id // Copy for closure!
 					pending.Add(1)
 					o.auther.Schedule(func() {
 						defer pending.Done()
-						o.dial(peerAddrs)
+						o.dialOnce(peerId, peerAddrs)
 					})
 				}
 				// Wait till all outbound connections either complete or timeout
 				pending.Wait()
 
 				// Do another round of discovery to find broken links and revert/remove those entries
-				if downs := o.discover(routes); len(downs) != 0 {
+				downs := o.discover(routes)
+				for _, id := range peers {
+					o.dialed(id, sortext.IndexBigInt(downs, id) < 0)
+				}
+				if len(downs) != 0 {
 					o.revoke(routes, downs)
 				}
 			}
 		}
 		// Swap and broadcast if anything changed
 		if ch, rep := o.changed(routes); ch {
+			// A flood of new leaves after a long quiet period means a healed partition
+			if quiet >= time.Duration(config.OverlayHealQuiet)*time.Millisecond {
+				if joined := o.rejoined(routes); joined >= config.OverlayHealLeaves {
+					o.onPartitionHeal(joined)
+					rep = true
+				}
+			}
 			o.lock.Lock()
+			event := diffTopology(o.nodeId, o.routes, routes)
 			o.routes, routes = routes, nil
+			o.change = o.clock.Now()
+			o.cache.flush()
+			o.pruneClasses()
 			o.time++
 			o.stat = done
+			if rep {
+				o.repairs++
+			}
 			o.lock.Unlock()
 
-			// Revert to read lock (don't hold up reads) and broadcast state
-			o.lock.RLock()
-			exchPool.Clear()
-			for _, peer := range o.pool {
-				p := peer // Copy for closure!
-				exchPool.Schedule(func() { o.sendState(p, rep) })
+			// Broadcast the new state, or defer it if one went out recently (churn)
+			if wait := time.Duration(config.OverlayBcastMinInterval)*time.Millisecond - o.clock.Now().Sub(bcastLast); wait > 0 {
+				if bcastTimer == nil {
+					bcastTimer = o.clock.After(wait)
+				}
+				bcastRep = bcastRep || rep
+
+				o.lock.Lock()
+				o.defers++
+				o.lock.Unlock()
+			} else {
+				broadcast(rep || bcastRep)
 			}
+			o.lock.RLock()
+			o.publish(event)
 			o.lock.RUnlock()
 		}
+		// Trim the connection pool if it grew beyond the allowed capacity
+		o.drop(o.evict())
 	}
 }
 
-// Drops an active peer connection due to either a failure or uselessness.
-func (o *Overlay) drop(peers map[*peer]struct{}) {
+// Counts the leaf set members of routing table t not present in the current one.
+func (o *Overlay) rejoined(t *table) int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	olds := append([]*big.Int{}, o.routes.leaves...)
+	sortext.BigInts(olds)
+
+	joined := 0
+	for _, id := range t.leaves {
+		if sortext.IndexBigInt(olds, id) < 0 {
+			joined++
+		}
+	}
+	return joined
+}
+
+// Invoked by the manager when a healed network partition is detected, before
+// the new routing table is broadcast. The broadcast is flagged for repair, so
+// all peers respond with their full state instead of waiting for incremental
+// merges to fix up a routing table that went stale during the isolation.
+func (o *Overlay) onPartitionHeal(joined int) {
+	o.log.Infof("overlay: partition heal detected, %d new leaves; forcing state re-exchange.", joined)
+
+	o.lock.Lock()
+	o.heals++
+	o.lock.Unlock()
+}
+
+// Drops an active peer connection due to either a failure or uselessness. The
+// application is notified of every removed connection along with the reason.
+func (o *Overlay) drop(peers map[*peer]DropReason) {
 	// Make sure there's actually something to remove
 	if len(peers) == 0 {
 		return
 	}
-	// Close the peer connections
+	// Close the peer connections (skipping the ones already torn down)
 	for d, _ := range peers {
+		if d.closed() {
+			continue
+		}
 		if err := d.Close(); err != nil {
-			log.Printf("overlay: failed to close peer connection: %v.", err)
+			o.log.Errorf("overlay: failed to close peer connection: %v.", err)
 		}
 	}
 	// Fast track expensive write lock is possible
@@ -188,60 +384,198 @@ func (o *Overlay) drop(peers map[*peer]struct{}) {
 
 	// Remove the peers from the overlay state if needed
 	if change {
-		o.lock.Lock()
-		defer o.lock.Unlock()
+		removed := make(map[*peer]DropReason)
 
-		for d, _ := range peers {
+		o.lock.Lock()
+		for d, reason := range peers {
 			id := d.nodeId.String()
 			if p, ok := o.pool[id]; ok && p == d {
 				delete(o.pool, id)
 				for _, addr := range d.addrs {
 					delete(o.trans, addr)
 				}
+				removed[d] = reason
 			}
 		}
+		if o.classify != nil {
+			// Skipped leaf candidates take part in deliveries, cached routes may be stale
+			o.cache.flush()
+		}
+		o.lock.Unlock()
+		atomic.AddUint64(&o.drops, uint64(len(removed)))
+
+		// Notify the application outside of the lock. A link torn down while the
+		// local node is leaving also acknowledges the departure (the close notice
+		// may not have been flushed before the remote side dropped the link).
+		for d, reason := range removed {
+			o.parted(d.nodeId)
+			o.dropped(d.nodeId, reason)
+		}
 	}
 }
 
+// Swaps out the local node id and rebuilds a routing table around it from the
+// existing connections. All connected peers are notified of the new id. The
+// local routing table is reset, so that the rebuilt one will be broadcast (and
+// published to the topology subscribers as a fresh join).
+func (o *Overlay) migrate(a map[string][]string, id *big.Int) (*table, error) {
+	// Make sure the new id is valid
+	if !o.space.contains(id) {
+		return nil, fmt.Errorf("id outside of the id space")
+	}
+	o.lock.Lock()
+	if _, ok := o.pool[id.String()]; ok {
+		o.lock.Unlock()
+		return nil, fmt.Errorf("id collides with connected peer")
+	}
+	// Swap out the id, reporting the whole old routing state as removed
+	o.publish(&TopologyEvent{Added: []*big.Int{}, Removed: o.routes.members(o.nodeId)})
+
+	o.nodeId = new(big.Int).Set(id)
+	o.routes = o.space.newTable(o.nodeId)
+	o.cache.flush()
+
+	// Signal the bootstrappers to advertise the new id
+	close(o.migCh)
+	o.migCh = make(chan struct{})
+
+	// Collect the connected peers to rebuild from
+	peers := make([]*peer, 0, len(o.pool))
+	s := &state{Addrs: make(map[string][]string)}
+	for sid, p := range o.pool {
+		peers = append(peers, p)
+		s.Addrs[sid] = p.addrs
+	}
+	o.lock.Unlock()
+
+	// Notify the peers and rebuild the routing table
+	for _, p := range peers {
+		go o.sendMigrate(p)
+	}
+	t := o.space.newTable(o.nodeId)
+	o.merge(t, a, s)
+	return t, nil
+}
+
 // Merges the recieved state into the provided routing table according to the
-// pastry specs (neighborhood unimplemented for the moment). Also each peer's
-// network address is saved for later use.
+// pastry specs. Also each peer's network address is saved for later use.
 func (o *Overlay) merge(t *table, a map[string][]string, s *state) {
-	// Extract the ids from the state exchange
+	atomic.AddUint64(&o.merges, 1)
+
+	o.lock.RLock()
+	limit, seed := o.states, o.seed
+	o.lock.RUnlock()
+
+	// Extract the ids from the state exchange. If the entry limit is exceeded,
+	// keep the ones closest to the local node, so the outcome does not depend on
+	// the map iteration order
 	ids := make([]*big.Int, 0, len(s.Addrs))
-	for sid, addrs := range s.Addrs {
-		if id, ok := new(big.Int).SetString(sid, 10); ok == true {
-			// Skip loopback ids
+	names := make(map[*big.Int]string, len(s.Addrs))
+	for sid, _ := range s.Addrs {
+		if id, ok := new(big.Int).SetString(sid, 10); ok == true && o.space.contains(id) {
 			if o.nodeId.Cmp(id) != 0 {
 				ids = append(ids, id)
-				a[sid] = addrs
+				names[id] = sid
 			}
 		} else {
-			log.Printf("invalid node id received: %v.", sid)
+			o.log.Errorf("overlay: invalid node id received: %v.", sid)
+		}
+	}
+	if len(ids) > limit {
+		o.log.Infof("overlay: state entry limit reached, dropping %d entries.", len(ids)-limit)
+		sort.Sort(distSlice{o.space, o.nodeId, seed, ids})
+		ids = ids[:limit]
+	}
+	// Skip paused ids and record the addresses of the rest
+	valid := ids[:0]
+	for _, id := range ids {
+		sid := names[id]
+		if !o.isPaused(sid) {
+			valid = append(valid, id)
+			a[sid] = s.Addrs[sid]
+			o.recordClass(sid, s.Addrs[sid])
 		}
 	}
-	// Generate the new leaf set
+	ids = valid
+
+	// Generate the new leaf and neighborhood sets
 	t.leaves = o.mergeLeaves(t.leaves, ids)
+	t.neighbors = o.mergeNeighbors(t.neighbors, ids)
 
-	// Merge the received addresses into the routing table
+	// Merge the received addresses into the routing table. Conflicts between the
+	// states of the same sender are resolved in favor of the fresher one (so a node
+	// rejoining with a lagging update counter cannot overwrite newer knowledge).
+	// Update counters of different senders are unrelated, so otherwise conflicts
+	// are resolved in favor of closer peers if both latencies are known, otherwise
+	// in favor of longer lived connections, whereas between new entries they are
+	// broken deterministically, independent of the map iteration.
+	fresh := make(map[string]bool)
 	for _, id := range ids {
-		row, col := prefix(o.nodeId, id)
-		old := t.routes[row][col]
+		row, col := o.space.prefix(o.nodeId, id)
+		if !t.contains(row, col) {
+			continue
+		}
+		set := func() {
+			t.routes[row][col], t.stamps[row][col], t.origins[row][col] = id, s.Updated, s.origin
+			fresh[id.String()] = true
+		}
+		old, origin := t.routes[row][col], t.origins[row][col]
+		same := s.origin != nil && origin != nil && s.origin.Cmp(origin) == 0
+		if old != nil && old.Cmp(id) == 0 && (!same || s.Updated > t.stamps[row][col]) {
+			t.stamps[row][col], t.origins[row][col] = s.Updated, s.origin
+		}
+		if old != nil && old.Cmp(id) != 0 {
+			if stamp := t.stamps[row][col]; same && s.Updated < stamp {
+				continue
+			} else if same && s.Updated > stamp {
+				set()
+				continue
+			}
+			if closer, known := o.closer(id, old); known {
+				if closer {
+					set()
+					o.demote(old)
+				}
+				continue
+			}
+		}
 		switch {
 		case old == nil:
-			t.routes[row][col] = id
+			set()
+		case old.Cmp(id) == 0:
+			// Same entry, nothing to do
+		case o.outlives(id, old):
+			set()
+		case !o.outlives(old, id) && fresh[old.String()] && tiebreak(seed, id, old):
+			set()
 		case old.Cmp(id) != 0:
 			// Discard new entry (less disruptive)
 		}
 	}
 }
 
-// Merges two leafsets and returns the result.
+// Merges a batch of received states into the provided routing table in a single
+// pass, in their arrival order. Update counters are only comparable between the
+// states of the same sender, and those conflicts are already resolved by merge
+// in favor of the fresher state, independent of the order.
+func (o *Overlay) mergeBatch(t *table, a map[string][]string, states []*state) {
+	for _, s := range states {
+		o.merge(t, a, s)
+	}
+}
+
+// Merges two leafsets and returns the result. If the boundary nodes of the leaf
+// set tie in distance with excluded ones on the opposite side, successive merges
+// rotate among the equivalent selections to spread the responsibilities. The
+// rotation advances once per heartbeat, so merges in between agree and don't
+// report spurious changes.
 func (o *Overlay) mergeLeaves(a, b []*big.Int) []*big.Int {
-	// Append, circular sort and fetch uniques
-	res := append(a, b...)
-	sort.Sort(idSlice{o.nodeId, res})
-	res = res[:sortext.Unique(idSlice{o.nodeId, res})]
+	// Merge the uniques in ascending order (cheap comparisons), then circular sort
+	as := append([]*big.Int{}, a...)
+	bs := append([]*big.Int{}, b...)
+	sortext.BigInts(as)
+	sortext.BigInts(bs)
+	res := sortext.RotateBigIntsAround(sortext.MergeBigInts(as, bs), o.nodeId, o.space.modulo)
 
 	// Look for the origin point
 	origin := 0
@@ -251,10 +585,78 @@ func (o *Overlay) mergeLeaves(a, b []*big.Int) []*big.Int {
 	// Fetch the nearest nodes in both directions
 	min := mathext.MaxInt(0, origin-config.OverlayLeaves/2)
 	max := mathext.MinInt(len(res), origin+config.OverlayLeaves/2)
-	return res[min:max]
+	if shifts := o.leafShifts(res, origin, min, max); len(shifts) > 1 {
+		epoch := o.clock.Now().UnixNano() / int64(time.Duration(config.OverlayBeatPeriod)*time.Millisecond)
+		shift := shifts[uint64(epoch)%uint64(len(shifts))]
+		min, max = min+shift, max+shift
+	}
+	if o.classify == nil {
+		return res[min:max]
+	}
+	// Spread the leaves across address classes, keeping the ring order
+	left := make([]*big.Int, 0, origin)
+	for i := origin - 1; i >= 0; i-- {
+		left = append(left, res[i])
+	}
+	left = o.spread(left, origin-min)
+	right := o.spread(res[origin+1:], max-origin-1)
+
+	leaves := make([]*big.Int, 0, len(left)+1+len(right))
+	for i := len(left) - 1; i >= 0; i-- {
+		leaves = append(leaves, left[i])
+	}
+	leaves = append(leaves, o.nodeId)
+	return append(leaves, right...)
 }
 
-// Searches a potential routing table for nodes not yet connected.
+// Collects the offsets by which the leaf set window [min, max) of a ring ordered
+// id slice can be slid without extending its reach, i.e. by trading boundary nodes
+// for equidistant ones on the opposite side of the origin. The offsets are in an
+// ascending order, always containing zero.
+func (o *Overlay) leafShifts(res []*big.Int, origin, min, max int) []int {
+	shifts := []int{0}
+	for k := 1; min-k >= 0 && max-k > origin; k++ {
+		if o.space.distance(o.nodeId, res[min-k]).Cmp(o.space.distance(o.nodeId, res[max-k])) != 0 {
+			break
+		}
+		shifts = append([]int{-k}, shifts...)
+	}
+	for k := 1; max+k-1 < len(res) && min+k-1 < origin; k++ {
+		if o.space.distance(o.nodeId, res[max+k-1]).Cmp(o.space.distance(o.nodeId, res[min+k-1])) != 0 {
+			break
+		}
+		shifts = append(shifts, k)
+	}
+	return shifts
+}
+
+// Merges two neighborhood sets and returns the result: the nodes with the lowest
+// measured latency, followed by the not yet measured ones closest in id space.
+func (o *Overlay) mergeNeighbors(a, b []*big.Int) []*big.Int {
+	// Collect the unique candidates, excluding self
+	res := make([]*big.Int, 0, len(a)+len(b))
+	res = append(append(res, a...), b...)
+	sortext.BigInts(res)
+	res = res[:sortext.Unique(sortext.BigIntSlice(res))]
+	if idx := sortext.IndexBigInt(res, o.nodeId); idx >= 0 {
+		res = append(res[:idx], res[idx+1:]...)
+	}
+	// Order by proximity and keep the closest ones
+	lats := make([]time.Duration, len(res))
+	o.lock.RLock()
+	for i, id := range res {
+		if p, ok := o.pool[id.String()]; ok {
+			lats[i] = time.Duration(atomic.LoadInt64(&p.latency))
+		}
+	}
+	o.lock.RUnlock()
+
+	sort.Sort(proxSlice{o.space, o.nodeId, lats, res})
+	return res[:mathext.MinInt(len(res), config.OverlayNeighbors)]
+}
+
+// Searches a potential routing table for nodes not yet connected, skipping the
+// ones still within their re-dial backoff window.
 func (o *Overlay) discover(t *table) []*big.Int {
 	o.lock.RLock()
 	defer o.lock.RUnlock()
@@ -262,7 +664,7 @@ func (o *Overlay) discover(t *table) []*big.Int {
 	ids := []*big.Int{}
 	for _, id := range t.leaves {
 		if id.Cmp(o.nodeId) != 0 {
-			if _, ok := o.pool[id.String()]; !ok {
+			if _, ok := o.pool[id.String()]; !ok && !o.backedOff(id.String()) {
 				ids = append(ids, id)
 			}
 		}
@@ -270,14 +672,23 @@ func (o *Overlay) discover(t *table) []*big.Int {
 	for _, row := range t.routes {
 		for _, id := range row {
 			if id != nil {
-				if _, ok := o.pool[id.String()]; !ok {
+				if _, ok := o.pool[id.String()]; !ok && !o.backedOff(id.String()) {
 					ids = append(ids, id)
 				}
 			}
 		}
 	}
+	for _, id := range t.neighbors {
+		if _, ok := o.pool[id.String()]; !ok && !o.backedOff(id.String()) {
+			ids = append(ids, id)
+		}
+	}
 	sortext.BigInts(ids)
-	return ids[:sortext.Unique(sortext.BigIntSlice(ids))]
+	n, dups := sortext.UniqueReport(sortext.BigIntSlice(ids))
+	if len(dups) != 0 {
+		o.log.Debugf("overlay: suppressed %d duplicate discovery entries.", len(dups))
+	}
+	return ids[:n]
 }
 
 // Revokes the list of unreachable peers from routing table t.
@@ -287,8 +698,7 @@ func (o *Overlay) revoke(t *table, downs []*big.Int) {
 	// Clean up the leaf set
 	intact := true
 	for i := 0; i < len(t.leaves); i++ {
-		idx := sortext.SearchBigInts(downs, t.leaves[i])
-		if idx < len(downs) && downs[idx].Cmp(t.leaves[i]) == 0 {
+		if sortext.IndexBigInt(downs, t.leaves[i]) >= 0 {
 			t.leaves[i] = t.leaves[len(t.leaves)-1]
 			t.leaves = t.leaves[:len(t.leaves)-1]
 			intact = false
@@ -300,31 +710,146 @@ func (o *Overlay) revoke(t *table, downs []*big.Int) {
 		o.lock.RLock()
 		all := make([]*big.Int, 0, len(o.pool))
 		for _, p := range o.pool {
-			all = append(all, p.nodeId)
+			if !p.paused() {
+				all = append(all, p.nodeId)
+			}
 		}
 		o.lock.RUnlock()
 		t.leaves = o.mergeLeaves(t.leaves, all)
 	}
-	// Clean up the routing table
+	// Clean up the neighborhood set, refilling it from the active connections
+	neighbors := make([]*big.Int, 0, len(t.neighbors))
+	for _, id := range t.neighbors {
+		if sortext.IndexBigInt(downs, id) < 0 {
+			neighbors = append(neighbors, id)
+		}
+	}
+	if len(neighbors) != len(t.neighbors) {
+		o.lock.RLock()
+		all := make([]*big.Int, 0, len(o.pool))
+		for _, p := range o.pool {
+			if !p.paused() {
+				all = append(all, p.nodeId)
+			}
+		}
+		o.lock.RUnlock()
+		t.neighbors = o.mergeNeighbors(neighbors, all)
+	}
+	// Clean up the routing table, collecting the vacated cells
+	holes := make(map[[2]int][]*peer)
 	for r, row := range t.routes {
 		for i, id := range row {
-			if id != nil {
-				idx := sortext.SearchBigInts(downs, id)
-				if idx < len(downs) && downs[idx].Cmp(id) == 0 {
-					// Try and fix routing entry from connection pool
-					t.routes[r][i] = nil
-					o.lock.RLock()
-					for _, p := range o.pool {
-						if pre, dig := prefix(o.nodeId, p.nodeId); pre == r && dig == i {
-							t.routes[r][i] = p.nodeId
-							break
-						}
-					}
-					o.lock.RUnlock()
-				}
+			if id != nil && sortext.IndexBigInt(downs, id) >= 0 {
+				t.routes[r][i], t.stamps[r][i], t.origins[r][i] = nil, 0, nil
+				holes[[2]int{r, i}] = nil
 			}
 		}
 	}
+	if len(holes) == 0 {
+		return
+	}
+	// Try and fix the vacated entries from the connection pool, picking the best
+	// candidate of each cell
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	for _, p := range o.pool {
+		if p.paused() {
+			continue
+		}
+		pre, dig := o.space.prefix(o.nodeId, p.nodeId)
+		if cands, ok := holes[[2]int{pre, dig}]; ok {
+			holes[[2]int{pre, dig}] = append(cands, p)
+		}
+	}
+	for cell, cands := range holes {
+		if best := o.bestRepair(cands); best != nil {
+			t.routes[cell[0]][cell[1]] = best.nodeId
+		}
+	}
+}
+
+// Selects the best of the pooled peers fitting a vacated routing table cell: the
+// one with the lowest measured latency (unmeasured ones ranking last), equal ones
+// decided by the deterministic tie-break. Returns nil if there are no candidates.
+func (o *Overlay) bestRepair(cands []*peer) *peer {
+	var best *peer
+	var lat int64
+	for _, p := range cands {
+		l := atomic.LoadInt64(&p.latency)
+		switch {
+		case best == nil:
+			best, lat = p, l
+		case l != 0 && (lat == 0 || l < lat):
+			best, lat = p, l
+		case l == lat && tiebreak(o.seed, p.nodeId, best.nodeId):
+			best, lat = p, l
+		}
+	}
+	return best
+}
+
+// Checks whether the connection to peer a has been up longer than the one to b
+// (a non-connected peer having no uptime at all).
+func (o *Overlay) outlives(a, b *big.Int) bool {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	pa, oka := o.pool[a.String()]
+	pb, okb := o.pool[b.String()]
+	return oka && (!okb || pa.since.Before(pb.since))
+}
+
+// Compares the measured latencies of two connected peers, returning whether a is
+// closer than b, and whether both latencies are known at all.
+func (o *Overlay) closer(a, b *big.Int) (bool, bool) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	pa, oka := o.pool[a.String()]
+	pb, okb := o.pool[b.String()]
+	if !oka || !okb {
+		return false, false
+	}
+	la, lb := atomic.LoadInt64(&pa.latency), atomic.LoadInt64(&pb.latency)
+	if la == 0 || lb == 0 {
+		return false, false
+	}
+	return la < lb, true
+}
+
+// Flags a connected peer as passive, so that the connection is dropped on the
+// next mutually passive heartbeat, unless the node is still needed.
+func (o *Overlay) demote(id *big.Int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if p, ok := o.pool[id.String()]; ok {
+		p.passive = true
+	}
+}
+
+// Collects the ids of the connected peers which paused their participation.
+func (o *Overlay) paused() []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	ids := []*big.Int{}
+	for _, p := range o.pool {
+		if p.paused() {
+			ids = append(ids, p.nodeId)
+		}
+	}
+	return ids
+}
+
+// Checks whether a node is a connected peer which paused its participation.
+func (o *Overlay) isPaused(id string) bool {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	p, ok := o.pool[id]
+	return ok && p.paused()
 }
 
 // Checks whether the routing table changed and if yes, whether it needs repairs.
@@ -343,7 +868,7 @@ func (o *Overlay) changed(t *table) (ch bool, rep bool) {
 	// Check the routing table
 	for r := 0; r < len(t.routes); r++ {
 		for c := 0; c < len(t.routes[0]); c++ {
-			oldId, newId := o.routes.routes[r][c], t.routes[r][c]
+			oldId, newId := o.routes.get(r, c), t.routes[r][c]
 			switch {
 			case newId == nil && oldId != nil:
 				ch, rep = true, true
@@ -356,13 +881,39 @@ func (o *Overlay) changed(t *table) (ch bool, rep bool) {
 			}
 		}
 	}
+	// Check the neighborhood set (membership only, latency reorders are irrelevant)
+	if len(t.neighbors) != len(o.routes.neighbors) {
+		ch = true
+	} else {
+		olds := append([]*big.Int{}, o.routes.neighbors...)
+		news := append([]*big.Int{}, t.neighbors...)
+		sortext.BigInts(olds)
+		sortext.BigInts(news)
+		for i := 0; i < len(news); i++ {
+			if news[i].Cmp(olds[i]) != 0 {
+				ch = true
+				break
+			}
+		}
+	}
 	return
 }
 
 // Periodically sends a heatbeat to all existing connections, tagging them
 // whether they are active (i.e. in the routing) table or not.
 func (o *Overlay) beater() {
-	tick := time.Tick(time.Duration(config.OverlayBeatPeriod) * time.Millisecond)
+	tick := o.clock.Tick(time.Duration(config.OverlayBeatPeriod) * time.Millisecond)
+
+	// Flag the beater as running until termination
+	o.lock.Lock()
+	o.beatUp = true
+	o.lock.Unlock()
+
+	defer func() {
+		o.lock.Lock()
+		o.beatUp = false
+		o.lock.Unlock()
+	}()
 	for {
 		select {
 		case <-o.quit:
@@ -373,10 +924,31 @@ func (o *Overlay) beater() {
 				go o.sendBeat(p, !o.active(p.nodeId))
 			}
 			o.lock.RUnlock()
+			o.reap()
 		}
 	}
 }
 
+// Schedules the connections for dropping which aren't part of the routing table
+// or leaf set, and haven't seen application traffic for the idle timeout.
+func (o *Overlay) reap() {
+	o.lock.RLock()
+	idles := []*peer{}
+	if o.idle > 0 {
+		limit := o.clock.Now().Add(-o.idle).UnixNano()
+		for _, p := range o.pool {
+			if !o.active(p.nodeId) && atomic.LoadInt64(&p.lastUsed) < limit {
+				idles = append(idles, p)
+			}
+		}
+	}
+	o.lock.RUnlock()
+
+	for _, p := range idles {
+		go func(p *peer) { o.dropSink <- &dropReq{peer: p, reason: Idle} }(p)
+	}
+}
+
 // Returns whether a connection is active or passive.
 func (o *Overlay) active(p *big.Int) bool {
 	for _, id := range o.routes.leaves {
@@ -393,5 +965,58 @@ func (o *Overlay) active(p *big.Int) bool {
 			}
 		}
 	}
-	return false
+	for _, id := range o.routes.neighbors {
+		if p.Cmp(id) == 0 {
+			return true
+		}
+	}
+	return o.spared(p)
+}
+
+// Peer slice sorted by the time of the last heartbeat, longest idle first.
+type idleSlice struct {
+	beats []int64
+	data  []*peer
+}
+
+// Required for sort.Sort.
+func (p idleSlice) Len() int {
+	return len(p.data)
+}
+
+// Required for sort.Sort.
+func (p idleSlice) Less(i, j int) bool {
+	return p.beats[i] < p.beats[j]
+}
+
+// Required for sort.Sort.
+func (p idleSlice) Swap(i, j int) {
+	p.data[i], p.data[j] = p.data[j], p.data[i]
+	p.beats[i], p.beats[j] = p.beats[j], p.beats[i]
+}
+
+// Collects the passive connections to drop if the pool grew beyond the allowed
+// capacity, longest idle ones first. Routing table members are never evicted.
+func (o *Overlay) evict() map[*peer]DropReason {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	excess := len(o.pool) - config.OverlayMaxConns
+	if excess <= 0 {
+		return nil
+	}
+	idles := idleSlice{[]int64{}, []*peer{}}
+	for _, p := range o.pool {
+		if !o.active(p.nodeId) {
+			idles.beats = append(idles.beats, atomic.LoadInt64(&p.lastBeat))
+			idles.data = append(idles.data, p)
+		}
+	}
+	sort.Sort(idles)
+
+	drops := make(map[*peer]DropReason)
+	for _, p := range idles.data[:mathext.MinInt(excess, len(idles.data))] {
+		drops[p] = Overflow
+	}
+	return drops
 }
@@ -20,10 +20,13 @@
 package overlay
 
 import (
+	"context"
 	"crypto/x509"
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/ext/mathext"
+	"github.com/karalabe/iris/proto"
 	"math/big"
+	"net"
 	"sort"
 	"testing"
 	"time"
@@ -37,7 +40,7 @@ func checkRoutes(t *testing.T, nodes []*Overlay) {
 	}
 	// Assemble the leafset of each node and veirfy
 	for _, o := range nodes {
-		sort.Sort(idSlice{o.nodeId, ids})
+		sort.Sort(idSlice{o.space, o.nodeId, ids})
 		origin := 0
 		for o.nodeId.Cmp(ids[origin]) != 0 {
 			origin++
@@ -65,14 +68,14 @@ func checkRoutes(t *testing.T, nodes []*Overlay) {
 					// Check that indeed no id is valid for this entry
 					for _, id := range ids {
 						if id.Cmp(o.nodeId) != 0 {
-							if pre, dig := prefix(o.nodeId, id); pre == r && dig == c {
+							if pre, dig := o.space.prefix(o.nodeId, id); pre == r && dig == c {
 								t.Errorf("overlay %v: entry {%v, %v} missing: %v.", o.nodeId, r, c, id)
 							}
 						}
 					}
 				} else {
 					// Check that the id is valid and indeed not some leftover
-					if pre, dig := prefix(o.nodeId, p); pre != r || dig != c {
+					if pre, dig := o.space.prefix(o.nodeId, p); pre != r || dig != c {
 						t.Errorf("overlay %v: entry {%v, %v} invalid: %v.", o.nodeId, r, c, p)
 					}
 					alive := false
@@ -193,3 +196,870 @@ func TestMaintenanceDOS(t *testing.T) {
 	}
 }
 */
+
+func TestDropReason(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	app := new(dropCollector)
+	o := New(appId, key, app)
+
+	// Drop a failed connection and check the reported reason
+	failed := newTestPeer(o, big.NewInt(1))
+	o.drop(map[*peer]DropReason{failed: NetworkError})
+	if len(app.reasons) != 1 || app.reasons[0] != NetworkError || app.ids[0].Cmp(failed.nodeId) != 0 {
+		t.Fatalf("network drop mismatch: have %v/%v, want %v/%v.", app.ids, app.reasons, failed.nodeId, NetworkError)
+	}
+	// Reap an idle passive connection and check the reported reason
+	idle := newTestPeer(o, big.NewInt(2))
+	idle.passive, idle.time = true, 1
+
+	go func() {
+		o.lock.RLock()
+		defer o.lock.RUnlock()
+		o.process(idle, o.nodeId, &state{Updated: 1, Passive: true})
+	}()
+	select {
+	case req := <-o.dropSink:
+		o.drop(map[*peer]DropReason{req.peer: req.reason})
+	case <-time.After(time.Second):
+		t.Fatalf("passive connection not reaped.")
+	}
+	if len(app.reasons) != 2 || app.reasons[1] != Passive || app.ids[1].Cmp(idle.nodeId) != 0 {
+		t.Fatalf("passive drop mismatch: have %v/%v, want %v/%v.", app.ids, app.reasons, idle.nodeId, Passive)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Check that a non-started, unconnected node is unhealthy
+	alice := New(appId, key, new(nopCallback))
+	if ok, reasons := alice.HealthCheck(); ok || len(reasons) == 0 {
+		t.Errorf("fresh overlay health mismatch: have %v/%v, want %v/non-empty.", ok, reasons, false)
+	}
+	// Boot two nodes and check that both are healthy after convergence
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bob := New(appId, key, new(nopCallback))
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	time.Sleep(time.Duration(config.OverlayConvTimeout) * time.Millisecond)
+	for i, o := range []*Overlay{alice, bob} {
+		if ok, reasons := o.HealthCheck(); !ok {
+			t.Errorf("node #%d: converged overlay unhealthy: %v.", i, reasons)
+		}
+	}
+}
+
+func TestWaitStable(t *testing.T) {
+	// Shrink the convergence timeouts for faster tests
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback), WithBootTimeout(100*time.Millisecond), WithConvTimeout(100*time.Millisecond))
+
+	// Ensure a non-started overlay is unstable and waits time out
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := o.WaitStable(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wait on idle overlay mismatch: have %v, want %v.", err, context.DeadlineExceeded)
+	}
+	if o.Stable() {
+		t.Fatalf("non-started overlay reported stable.")
+	}
+	// Start the manager and ensure repeated transitions are all waitable
+	o.auther.Start()
+	go o.manager()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := o.WaitStable(ctx); err != nil {
+			t.Fatalf("transition %d: failed to wait for stability: %v.", i, err)
+		}
+		cancel()
+		if !o.Stable() {
+			t.Fatalf("transition %d: converged overlay reported unstable.", i)
+		}
+		o.upSink <- &state{Addrs: make(map[string][]string)}
+		for o.Stable() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Ensure pending waits are released on termination
+	close(o.quit)
+	if err := o.WaitStable(context.Background()); err == nil {
+		t.Fatalf("wait on terminated unstable overlay succeeded.")
+	}
+}
+
+func TestBootTimeout(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback), WithBootTimeout(200*time.Millisecond))
+
+	// Boot a lone node and ensure it converges after the short timeout
+	start := time.Now()
+	if _, err := o.Boot(); err != nil {
+		t.Fatalf("failed to boot overlay: %v.", err)
+	}
+	defer o.Shutdown()
+
+	if elapsed := time.Since(start); elapsed > time.Duration(config.OverlayBootTimeout)*time.Millisecond/2 {
+		t.Fatalf("boot timeout not applied: booted in %v.", elapsed)
+	}
+	if !o.Stable() {
+		t.Fatalf("booted overlay reported unstable.")
+	}
+	if m := o.Metrics(); m.Convergence < 200*time.Millisecond {
+		t.Fatalf("convergence time mismatch: have %v, want at least %v.", m.Convergence, 200*time.Millisecond)
+	}
+}
+
+func TestMaxStateEntries(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	if err := o.SetMaxStateEntries(-1); err == nil {
+		t.Fatalf("negative entry limit accepted.")
+	}
+	if err := o.SetMaxStateEntries(4); err != nil {
+		t.Fatalf("failed to set entry limit: %v.", err)
+	}
+
+	// Assemble an oversized state message around the local node
+	o.nodeId = big.NewInt(1000)
+	o.routes = newTable(o.nodeId)
+
+	s := &state{Addrs: make(map[string][]string)}
+	for i := 1; i <= 10; i++ {
+		s.Addrs[big.NewInt(int64(1000+i*i)).String()] = []string{}
+	}
+	// Merge it a few times and ensure the closest entries are always kept
+	for i := 0; i < 10; i++ {
+		addrs := make(map[string][]string)
+		o.merge(o.routes.Copy(), addrs, s)
+
+		if n := len(addrs); n != 4 {
+			t.Fatalf("processed entry count mismatch: have %v, want %v.", n, 4)
+		}
+		for j := 1; j <= 4; j++ {
+			if _, ok := addrs[big.NewInt(int64(1000+j*j)).String()]; !ok {
+				t.Fatalf("merge %d: closest entry %d dropped: have %v.", i, 1000+j*j, addrs)
+			}
+		}
+	}
+}
+
+func TestDropPeer(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	app := new(dropCollector)
+	o := New(appId, key, app)
+
+	// Connect a few fake peers and start the manager
+	ids := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)}
+	for _, id := range ids {
+		newTestPeer(o, id)
+	}
+	if err := o.DropPeer(ids[0]); err == nil {
+		t.Fatalf("dropped peer without running manager.")
+	}
+	go o.manager()
+	defer close(o.quit)
+
+	for up := false; !up; {
+		time.Sleep(10 * time.Millisecond)
+		o.lock.RLock()
+		up = o.mgrUp
+		o.lock.RUnlock()
+	}
+	// Drop a connected peer and verify its removal
+	if err := o.DropPeer(ids[1]); err != nil {
+		t.Fatalf("failed to drop peer: %v.", err)
+	}
+	peers := o.Peers()
+	if len(peers) != 2 || peers[0].Cmp(ids[0]) != 0 || peers[1].Cmp(ids[2]) != 0 {
+		t.Fatalf("remaining peers mismatch: have %v, want %v.", peers, []*big.Int{ids[0], ids[2]})
+	}
+	if len(app.reasons) != 1 || app.reasons[0] != Requested || app.ids[0].Cmp(ids[1]) != 0 {
+		t.Fatalf("drop notification mismatch: have %v/%v, want %v/%v.", app.ids, app.reasons, ids[1], Requested)
+	}
+	// Ensure non-connected peers cannot be dropped
+	if err := o.DropPeer(ids[1]); err == nil {
+		t.Fatalf("dropped non-connected peer.")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect a routing peer and a non-routing one
+	active := newTestPeer(o, big.NewInt(0x2000000000))
+	o.routes.routes[0][2] = active.nodeId
+	idle := newTestPeer(o, big.NewInt(0x2100000000))
+
+	// Ensure nothing's reaped while disabled or before the timeout
+	time.Sleep(50 * time.Millisecond)
+	o.reap()
+	o.SetIdleTimeout(time.Second)
+	o.reap()
+	select {
+	case req := <-o.dropSink:
+		t.Fatalf("connection reaped prematurely: %v.", req.peer.nodeId)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Lower the timeout and ensure only the idle non-routing peer is reaped
+	o.SetIdleTimeout(25 * time.Millisecond)
+	o.reap()
+	select {
+	case req := <-o.dropSink:
+		if req.peer != idle || req.reason != Idle {
+			t.Fatalf("reaped connection mismatch: have %v/%v, want %v/%v.", req.peer.nodeId, req.reason, idle.nodeId, Idle)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection not reaped.")
+	}
+	select {
+	case req := <-o.dropSink:
+		t.Fatalf("extra connection reaped: %v.", req.peer.nodeId)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Application traffic should keep the connection alive
+	idle.send(&proto.Message{Head: proto.Header{Meta: &header{Dest: idle.nodeId}}})
+	o.reap()
+	select {
+	case req := <-o.dropSink:
+		t.Fatalf("used connection reaped: %v.", req.peer.nodeId)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestEvictPassive(t *testing.T) {
+	defer func(conns int) { config.OverlayMaxConns = conns }(config.OverlayMaxConns)
+	config.OverlayMaxConns = 3
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect two routing peers, both long idle
+	for i, id := range []int64{0x2000000000, 0x3000000000} {
+		p := newTestPeer(o, big.NewInt(id))
+		p.lastBeat = int64(i)
+		o.routes.routes[0][i+2] = p.nodeId
+	}
+	// Connect a few passive peers with different heartbeat times
+	now := time.Now().UnixNano()
+	passives := []*peer{}
+	for i, id := range []int64{0x2100000000, 0x2200000000, 0x2300000000} {
+		p := newTestPeer(o, big.NewInt(id))
+		p.lastBeat = now - int64(i)*int64(time.Second)
+		passives = append(passives, p)
+	}
+	// Ensure the longest idle passive peers are evicted, but routing ones kept
+	drops := o.evict()
+	if len(drops) != 2 {
+		t.Fatalf("evicted connection count mismatch: have %v, want %v.", len(drops), 2)
+	}
+	for _, p := range passives[1:] {
+		if reason, ok := drops[p]; !ok || reason != Overflow {
+			t.Fatalf("passive peer %v not evicted: %v/%v.", p.nodeId, reason, ok)
+		}
+	}
+	// Nothing should be evicted within the capacity
+	config.OverlayMaxConns = 5
+	if drops := o.evict(); len(drops) != 0 {
+		t.Fatalf("connections evicted within capacity: %v.", drops)
+	}
+}
+
+func TestHeartbeatLatency(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	clock := newFakeClock()
+	o := New(appId, key, new(nopCallback), WithClock(clock))
+
+	p := newTestPeer(o, big.NewInt(314))
+	if rtt, ok := o.Latency(p.nodeId); ok {
+		t.Fatalf("latency reported before measurement: %v.", rtt)
+	}
+	// Route an echo of a heartbeat sent a while ago and check the measurement
+	clock.advance(time.Hour)
+	stamp := clock.Now().UnixNano()
+	clock.advance(80 * time.Millisecond)
+	o.route(p, &proto.Message{Head: proto.Header{Meta: &header{Op: opEcho, Dest: o.nodeId, State: &state{Echo: stamp}}}})
+
+	rtt, ok := o.Latency(p.nodeId)
+	if !ok || rtt != 80*time.Millisecond {
+		t.Fatalf("measured latency mismatch: have %v/%v, want %v/%v.", rtt, ok, 80*time.Millisecond, true)
+	}
+	// Further measurements should be smoothed instead of replacing the old one
+	o.processEcho(p, clock.Now().Add(-8*time.Millisecond).UnixNano())
+	if smooth, _ := o.Latency(p.nodeId); smooth != (7*rtt+8*time.Millisecond)/8 {
+		t.Fatalf("latency not smoothed: have %v, want %v.", smooth, (7*rtt+8*time.Millisecond)/8)
+	}
+	// Malformed echoes should be discarded without touching the measurement
+	before, _ := o.Latency(p.nodeId)
+	o.route(p, &proto.Message{Head: proto.Header{Meta: &header{Op: opEcho, Dest: o.nodeId}}})
+	if after, _ := o.Latency(p.nodeId); after != before {
+		t.Fatalf("latency changed by malformed echo: have %v, want %v.", after, before)
+	}
+	// Unknown peers should not report anything
+	if rtt, ok := o.Latency(big.NewInt(141)); ok {
+		t.Fatalf("latency reported for unknown peer: %v.", rtt)
+	}
+}
+
+func TestMergeUptime(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect a long lived incumbent and a short lived candidate for the same cell
+	incumbent := newTestPeer(o, big.NewInt(0x2000000000))
+	incumbent.since = time.Now().Add(-time.Hour)
+	candidate := newTestPeer(o, big.NewInt(0x2100000000))
+
+	merge := func(old, id *big.Int) *big.Int {
+		tab := o.routes.Copy()
+		tab.routes[0][2] = old
+		o.merge(tab, make(map[string][]string), &state{Addrs: map[string][]string{id.String(): nil}})
+		return tab.routes[0][2]
+	}
+	// The candidate should lose against the incumbent, but replace a younger one
+	if have := merge(incumbent.nodeId, candidate.nodeId); have.Cmp(incumbent.nodeId) != 0 {
+		t.Errorf("short lived candidate replaced incumbent: have %v, want %v.", have, incumbent.nodeId)
+	}
+	candidate.since = time.Now().Add(-2 * time.Hour)
+	if have := merge(incumbent.nodeId, candidate.nodeId); have.Cmp(candidate.nodeId) != 0 {
+		t.Errorf("long lived candidate didn't replace incumbent: have %v, want %v.", have, candidate.nodeId)
+	}
+}
+
+func TestMergeProximity(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect a long lived incumbent and a short lived candidate for the same cell
+	incumbent := newTestPeer(o, big.NewInt(0x2000000000))
+	incumbent.since = time.Now().Add(-time.Hour)
+	candidate := newTestPeer(o, big.NewInt(0x2100000000))
+
+	merge := func(old, id *big.Int) *big.Int {
+		tab := o.routes.Copy()
+		tab.routes[0][2] = old
+		o.merge(tab, make(map[string][]string), &state{Addrs: map[string][]string{id.String(): nil}})
+		return tab.routes[0][2]
+	}
+	// Without latencies, uptime should decide
+	incumbent.latency = int64(50 * time.Millisecond)
+	if have := merge(incumbent.nodeId, candidate.nodeId); have.Cmp(incumbent.nodeId) != 0 {
+		t.Fatalf("unmeasured candidate replaced incumbent: have %v, want %v.", have, incumbent.nodeId)
+	}
+	// A slower candidate should be discarded, a closer one swapped in
+	candidate.latency = int64(100 * time.Millisecond)
+	if have := merge(incumbent.nodeId, candidate.nodeId); have.Cmp(incumbent.nodeId) != 0 {
+		t.Fatalf("slower candidate replaced incumbent: have %v, want %v.", have, incumbent.nodeId)
+	}
+	if incumbent.passive || candidate.passive {
+		t.Fatalf("peer demoted without replacement: incumbent %v, candidate %v.", incumbent.passive, candidate.passive)
+	}
+	candidate.latency = int64(10 * time.Millisecond)
+	if have := merge(incumbent.nodeId, candidate.nodeId); have.Cmp(candidate.nodeId) != 0 {
+		t.Fatalf("closer candidate didn't replace incumbent: have %v, want %v.", have, candidate.nodeId)
+	}
+	if !incumbent.passive {
+		t.Fatalf("replaced incumbent not demoted.")
+	}
+}
+
+func TestMergeFreshness(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect a short lived incumbent and a long lived candidate for the same cell
+	incumbent := newTestPeer(o, big.NewInt(0x2000000000))
+	candidate := newTestPeer(o, big.NewInt(0x2100000000))
+	candidate.since = time.Now().Add(-time.Hour)
+
+	// Learn the incumbent from a fresh state
+	sender, other := big.NewInt(0x3000000000), big.NewInt(0x4000000000)
+	learn := func(tab *table, id, origin *big.Int, updated uint64) {
+		o.merge(tab, make(map[string][]string), &state{Addrs: map[string][]string{id.String(): nil}, Updated: updated, origin: origin})
+	}
+	tab := o.routes.Copy()
+	learn(tab, incumbent.nodeId, sender, 100)
+	if have := tab.routes[0][2]; have == nil || have.Cmp(incumbent.nodeId) != 0 {
+		t.Fatalf("incumbent not merged: have %v, want %v.", have, incumbent.nodeId)
+	}
+	// A rejoining node with a lagging counter should not overwrite it
+	learn(tab, candidate.nodeId, sender, 3)
+	if have := tab.routes[0][2]; have.Cmp(incumbent.nodeId) != 0 {
+		t.Fatalf("stale state overwrote fresh entry: have %v, want %v.", have, incumbent.nodeId)
+	}
+	// Once the counter catches up, the fresher state should win
+	learn(tab, candidate.nodeId, sender, 101)
+	if have := tab.routes[0][2]; have.Cmp(candidate.nodeId) != 0 {
+		t.Fatalf("fresher state didn't replace entry: have %v, want %v.", have, candidate.nodeId)
+	}
+	if stamp := tab.stamps[0][2]; stamp != 101 {
+		t.Fatalf("entry freshness mismatch: have %v, want %v.", stamp, 101)
+	}
+	// Counters of different senders should not be compared (longer lived wins)
+	tab = o.routes.Copy()
+	learn(tab, incumbent.nodeId, sender, 100)
+	learn(tab, candidate.nodeId, other, 3)
+	if have := tab.routes[0][2]; have.Cmp(candidate.nodeId) != 0 {
+		t.Fatalf("foreign counter compared: have %v, want %v.", have, candidate.nodeId)
+	}
+	if origin := tab.origins[0][2]; origin.Cmp(other) != 0 {
+		t.Fatalf("entry origin mismatch: have %v, want %v.", origin, other)
+	}
+}
+
+func TestMergeBatch(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Assemble a burst of states from a sender competing for the same cell and the leaf set
+	id := func(n int64) string { return big.NewInt(n).String() }
+	sender := big.NewInt(0x3000000000)
+	states := []*state{
+		&state{Addrs: map[string][]string{id(0x2100000000): nil, id(0x1000000001): nil}, Updated: 7, origin: sender},
+		&state{Addrs: map[string][]string{id(0x2000000000): nil}, Updated: 5, origin: sender},
+		&state{Addrs: map[string][]string{id(0x0ffffffffe): nil}, Updated: 6, origin: sender},
+	}
+	// Merge the burst in both arrival orders and ensure the same outcome
+	tabs := []*table{}
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}} {
+		batch := []*state{}
+		for _, i := range order {
+			batch = append(batch, states[i])
+		}
+		tab := o.routes.Copy()
+		o.mergeBatch(tab, make(map[string][]string), batch)
+		tabs = append(tabs, tab)
+	}
+	for i, tab := range tabs {
+		if have := tab.routes[0][2]; have == nil || have.Int64() != 0x2100000000 {
+			t.Errorf("order %d: fresher entry not kept: have %v, want %v.", i, have, 0x2100000000)
+		}
+		if len(tab.leaves) != 5 {
+			t.Errorf("order %d: leaf set mismatch: have %v, want 5 entries.", i, tab.leaves)
+		}
+	}
+	if m := o.Metrics(); m.Merges != uint64(2*len(states)) {
+		t.Fatalf("merge count mismatch: have %v, want %v.", m.Merges, 2*len(states))
+	}
+}
+
+func TestSimulateFailure(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	app := new(dropCollector)
+	o := New(appId, key, app)
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect two routing peers, with a transport that can fail
+	failed := newTestPeer(o, big.NewInt(0x2000000000))
+	failed.abort = func() error { close(failed.netIn); return nil }
+	failed.Start()
+	o.routes.routes[0][2] = failed.nodeId
+
+	graceful := newTestPeer(o, big.NewInt(0x3000000000))
+	o.routes.routes[0][3] = graceful.nodeId
+
+	if err := o.SimulateFailure(failed.nodeId); err == nil {
+		t.Fatalf("failure simulated without chaos mode.")
+	}
+	o.SetChaos(true)
+
+	// Start the overlay maintenance
+	o.auther.Start()
+	go o.manager()
+	defer close(o.quit)
+
+	for up := false; !up; {
+		time.Sleep(10 * time.Millisecond)
+		o.lock.RLock()
+		up = o.mgrUp
+		o.lock.RUnlock()
+	}
+	// Fail one peer and gracefully drop the other
+	if err := o.SimulateFailure(failed.nodeId); err != nil {
+		t.Fatalf("failed to simulate failure: %v.", err)
+	}
+	if err := o.DropPeer(graceful.nodeId); err != nil {
+		t.Fatalf("failed to drop peer: %v.", err)
+	}
+	// Wait for the failure detection and table repair
+	for i := 0; ; i++ {
+		o.lock.RLock()
+		repaired := len(o.pool) == 0 && o.routes.routes[0][2] == nil && o.routes.routes[0][3] == nil
+		o.lock.RUnlock()
+		if repaired {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("routing table not repaired.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Verify that the failure was detected as such, distinct from the graceful drop
+	reasons := make(map[string]DropReason)
+	for i, id := range app.ids {
+		reasons[id.String()] = app.reasons[i]
+	}
+	if reason, ok := reasons[failed.nodeId.String()]; !ok || reason != NetworkError {
+		t.Errorf("failed peer drop reason mismatch: have %v/%v, want %v.", reason, ok, NetworkError)
+	}
+	if reason, ok := reasons[graceful.nodeId.String()]; !ok || reason != Requested {
+		t.Errorf("graceful peer drop reason mismatch: have %v/%v, want %v.", reason, ok, Requested)
+	}
+}
+
+func TestMergeLeavesRotation(t *testing.T) {
+	// Use a small leaf set: two slots on the predecessor side, one on the successor
+	defer func(leaves int) { config.OverlayLeaves = leaves }(config.OverlayLeaves)
+	config.OverlayLeaves = 4
+
+	clock := newFakeClock()
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback), WithClock(clock))
+	o.nodeId = big.NewInt(1000)
+
+	// Merge candidates where the boundaries tie in distance (980 and 1020)
+	cands := []*big.Int{big.NewInt(970), big.NewInt(980), big.NewInt(990), big.NewInt(1010), big.NewInt(1020), big.NewInt(1040)}
+	wants := map[int64][]int64{
+		980: []int64{980, 990, 1000, 1010},
+		990: []int64{990, 1000, 1010, 1020},
+	}
+	seen := make(map[int64]int)
+	for i := 0; i < 10; i++ {
+		leaves := o.mergeLeaves([]*big.Int{o.nodeId}, cands)
+
+		want, ok := wants[leaves[0].Int64()]
+		if !ok || len(leaves) != len(want) {
+			t.Fatalf("merge %d: leaf set mismatch: have %v, want one of %v.", i, leaves, wants)
+		}
+		for j, id := range want {
+			if leaves[j].Int64() != id {
+				t.Fatalf("merge %d: leaf set mismatch: have %v, want %v.", i, leaves, want)
+			}
+		}
+		seen[leaves[0].Int64()]++
+
+		// Ensure repeated merges within the same heartbeat report no change
+		o.routes = newTable(o.nodeId)
+		o.routes.leaves = leaves
+		for j := 0; j < 4; j++ {
+			tab := o.routes.Copy()
+			tab.leaves = o.mergeLeaves(tab.leaves, cands)
+			if ch, _ := o.changed(tab); ch {
+				t.Fatalf("merge %d/%d: leaf set changed: have %v, want %v.", i, j, tab.leaves, leaves)
+			}
+		}
+		clock.advance(time.Duration(config.OverlayBeatPeriod) * time.Millisecond)
+	}
+	// Ensure the boundary rotated evenly among the equidistant candidates
+	for id, _ := range wants {
+		if seen[id] != 5 {
+			t.Errorf("boundary %v selection count mismatch: have %v, want %v.", id, seen[id], 5)
+		}
+	}
+	// Ensure no rotation happens without ties
+	cands[4] = big.NewInt(1030)
+	for i := 0; i < 4; i++ {
+		if leaves := o.mergeLeaves([]*big.Int{o.nodeId}, cands); leaves[0].Int64() != 980 {
+			t.Fatalf("merge %d: untied boundary rotated: have %v, want %v.", i, leaves[0], 980)
+		}
+	}
+}
+
+func TestMergeNeighbors(t *testing.T) {
+	// Limit the neighborhood size
+	olds := config.OverlayNeighbors
+	defer func() { config.OverlayNeighbors = olds }()
+	config.OverlayNeighbors = 4
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect a few peers with various latencies, numerically far from self
+	lats := map[int64]time.Duration{0x8000000000: 30, 0x9000000000: 10, 0xa000000000: 20}
+	for id, lat := range lats {
+		p := newTestPeer(o, big.NewInt(id))
+		p.latency = int64(lat * time.Millisecond)
+	}
+	// Merge in the connected peers along with a few unmeasured (close) ones
+	ids := []*big.Int{o.nodeId, big.NewInt(0x1000000002), big.NewInt(0x1000000001)}
+	for id, _ := range lats {
+		ids = append(ids, big.NewInt(id))
+	}
+	neighbors := o.mergeNeighbors(nil, ids)
+
+	want := []int64{0x9000000000, 0xa000000000, 0x8000000000, 0x1000000001}
+	if len(neighbors) != len(want) {
+		t.Fatalf("neighborhood size mismatch: have %v, want %v.", len(neighbors), len(want))
+	}
+	for i, id := range neighbors {
+		if id.Int64() != want[i] {
+			t.Fatalf("neighborhood mismatch: have %v, want %v.", neighbors, want)
+		}
+	}
+	// Ensure the neighborhood is checked for changes and maintained on revokes
+	tab := o.routes.Copy()
+	tab.neighbors = neighbors
+	if ch, rep := o.changed(tab); !ch || rep {
+		t.Fatalf("neighborhood change mismatch: have %v/%v, want %v/%v.", ch, rep, true, false)
+	}
+	down := big.NewInt(0x9000000000)
+	delete(o.pool, down.String())
+	o.revoke(tab, []*big.Int{down})
+
+	want = []int64{0xa000000000, 0x8000000000, 0x1000000001}
+	if len(tab.neighbors) != len(want) {
+		t.Fatalf("revoked neighborhood mismatch: have %v, want %v.", tab.neighbors, want)
+	}
+	for i, id := range tab.neighbors {
+		if id.Int64() != want[i] {
+			t.Fatalf("revoked neighborhood mismatch: have %v, want %v.", tab.neighbors, want)
+		}
+	}
+	o.routes = tab
+	if !o.active(big.NewInt(0x8000000000)) {
+		t.Fatalf("neighbor not considered active.")
+	}
+}
+
+func TestRevokeRepair(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Insert a routing entry and connect a few peers fitting the same cell
+	down := big.NewInt(0x8000000000)
+	row, col := o.space.prefix(o.nodeId, down)
+
+	lats := map[int64]time.Duration{0x8100000000: 20, 0x8200000000: 10, 0x8300000000: 0}
+	for id, lat := range lats {
+		p := newTestPeer(o, big.NewInt(id))
+		p.latency = int64(lat * time.Millisecond)
+	}
+	// Revoke the entry and ensure the lowest latency candidate is reinstated
+	tab := o.routes.Copy()
+	tab.routes[row][col] = down
+	o.revoke(tab, []*big.Int{down})
+	if id := tab.routes[row][col]; id == nil || id.Int64() != 0x8200000000 {
+		t.Fatalf("repaired entry mismatch: have %v, want %v.", id, big.NewInt(0x8200000000))
+	}
+	// Revoke the repaired entry too and ensure measured peers are preferred
+	delete(o.pool, big.NewInt(0x8200000000).String())
+	o.revoke(tab, []*big.Int{big.NewInt(0x8200000000)})
+	if id := tab.routes[row][col]; id == nil || id.Int64() != 0x8100000000 {
+		t.Fatalf("repaired entry mismatch: have %v, want %v.", id, big.NewInt(0x8100000000))
+	}
+	// Ensure unmeasured candidates are selected deterministically
+	p := o.pool[big.NewInt(0x8100000000).String()]
+	p.latency = 0
+	newTestPeer(o, big.NewInt(0x8400000000))
+
+	winner := big.NewInt(0x8100000000)
+	if tiebreak(o.seed, big.NewInt(0x8300000000), winner) {
+		winner = big.NewInt(0x8300000000)
+	}
+	if tiebreak(o.seed, big.NewInt(0x8400000000), winner) {
+		winner = big.NewInt(0x8400000000)
+	}
+	for i := 0; i < 10; i++ {
+		tab.routes[row][col] = down
+		o.revoke(tab, []*big.Int{down})
+		if id := tab.routes[row][col]; id == nil || id.Cmp(winner) != 0 {
+			t.Fatalf("run %d: repaired entry mismatch: have %v, want %v.", i, id, winner)
+		}
+	}
+}
+
+func TestLeave(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes and wait for them to converge
+	alice := New(appId, key, new(nopCallback))
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	bobApp := new(dropCollector)
+	bob := New(appId, key, bobApp)
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	for i := 0; ; i++ {
+		bob.lock.RLock()
+		ok := bob.active(alice.nodeId)
+		bob.lock.RUnlock()
+		if ok {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("alice not in bob's routing table.")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Gracefully leave with alice and ensure bob repairs instantly
+	if err := alice.Leave(); err != nil {
+		t.Fatalf("failed to leave: %v.", err)
+	}
+	for i := 0; ; i++ {
+		bob.lock.RLock()
+		_, connected := bob.pool[alice.nodeId.String()]
+		routed := bob.active(alice.nodeId)
+		bob.lock.RUnlock()
+		if !connected && !routed {
+			break
+		}
+		if i > 10 {
+			t.Fatalf("departed node not revoked: connected %v, routed %v.", connected, routed)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(bobApp.ids) != 1 || bobApp.ids[0].Cmp(alice.nodeId) != 0 || bobApp.reasons[0] != Departed {
+		t.Fatalf("drop notification mismatch: have %v/%v, want %v/%v.", bobApp.ids, bobApp.reasons, alice.nodeId, Departed)
+	}
+}
+
+func TestPartitionHeal(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	// Override the heal detection parameters for faster tests
+	defer func(quiet, leaves int) {
+		config.OverlayHealQuiet, config.OverlayHealLeaves = quiet, leaves
+	}(config.OverlayHealQuiet, config.OverlayHealLeaves)
+	config.OverlayHealQuiet, config.OverlayHealLeaves = 1000, 2
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 3; i++ {
+		config.BootPorts = append(config.BootPorts, 65520+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a lone node invisible to the bootstrappers of the others (but accepting
+	// their sessions), followed by a network of two
+	lone := New(appId+"-isolated", key, new(nopCallback))
+	lone.rkeys[appId] = &key.PublicKey
+	if _, err := lone.Boot(); err != nil {
+		t.Fatalf("failed to boot isolated node: %v.", err)
+	}
+	defer lone.Shutdown()
+
+	nodes := []*Overlay{}
+	for i := 0; i < 2; i++ {
+		o := New(appId, key, new(nopCallback))
+		o.rkeys[appId+"-isolated"] = &key.PublicKey
+		if _, err := o.Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer o.Shutdown()
+		nodes = append(nodes, o)
+	}
+	checkRoutes(t, nodes)
+	if stats := lone.Stats(); stats.Peers != 0 {
+		t.Fatalf("isolated node connected: %d peers.", stats.Peers)
+	}
+	// Heal the partition and ensure the lone node converges to the merged table
+	addrs := []*net.TCPAddr{}
+	for _, a := range lone.Addresses() {
+		addr, _ := net.ResolveTCPAddr("tcp", a)
+		addrs = append(addrs, addr)
+	}
+	nodes[0].dialOnce(lone.nodeId, addrs)
+
+	all := append(nodes, lone)
+	timeout := time.After(2 * time.Duration(config.OverlayConvTimeout) * time.Millisecond)
+	for !converged(all) {
+		select {
+		case <-timeout:
+			t.Fatalf("healed network failed to converge.")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if stats := lone.Stats(); stats.Heals == 0 {
+		t.Fatalf("partition heal not detected.")
+	}
+	if stats := nodes[0].Stats(); stats.Heals != 0 {
+		t.Fatalf("single join detected as partition heal.")
+	}
+}
+
+func TestBroadcastRateLimit(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	// Use a long broadcast interval to force coalescing during boot
+	defer func(interval int) { config.OverlayBcastMinInterval = interval }(config.OverlayBcastMinInterval)
+	config.OverlayBcastMinInterval = 1000
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 3; i++ {
+		config.BootPorts = append(config.BootPorts, 65520+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a few nodes concurrently and ensure the deferred broadcasts converge
+	nodes := []*Overlay{}
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, New(appId, key, new(nopCallback)))
+		defer nodes[i].Shutdown()
+	}
+	errc := make(chan error, len(nodes))
+	for _, o := range nodes {
+		go func(o *Overlay) {
+			_, err := o.Boot()
+			errc <- err
+		}(o)
+	}
+	for i := 0; i < len(nodes); i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+	}
+	if !waitConverged(nodes) {
+		t.Fatalf("network failed to converge.")
+	}
+
+	defers := uint64(0)
+	for _, o := range nodes {
+		defers += o.Stats().Suppressed
+	}
+	if defers == 0 {
+		t.Fatalf("no broadcasts deferred during churn.")
+	}
+}
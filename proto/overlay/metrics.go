@@ -0,0 +1,275 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the overlay statistics and their export in the Prometheus text
+// exposition format, allowing a node to be scraped without any dependencies.
+
+package overlay
+
+import (
+	"fmt"
+	"github.com/karalabe/iris/ext/mathext"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the heartbeat round trip (seconds) and state size (entries) buckets.
+var (
+	rttBuckets  = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+	sizeBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128}
+)
+
+// Snapshot of the overlay state counters.
+type Stats struct {
+	Peers      int     // Number of active peer connections
+	Leaves     int     // Number of leaf set entries (excluding self)
+	Routes     int     // Number of filled routing table slots
+	Fill       float64 // Ratio of the filled routing table slots (bar the own digits)
+	Version    uint64  // Version of the local routing state
+	Repairs    uint64  // Number of routing updates requesting repairs
+	Heals      uint64  // Number of detected partition heals
+	Suppressed uint64  // Number of state broadcasts deferred by the rate limiter
+	Messages   uint64  // Number of system messages sent
+
+	RTTs  map[string]*mathext.Histogram // Distributions of the heartbeat round trips per peer (secs)
+	Sizes *mathext.Histogram            // Distribution of the received state update sizes (entries)
+}
+
+// Returns a snapshot of the overlay state counters.
+func (o *Overlay) Stats() *Stats {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	s := &Stats{
+		Peers:      len(o.pool),
+		Leaves:     len(o.routes.leaves) - 1,
+		Version:    o.time,
+		Repairs:    o.repairs,
+		Heals:      o.heals,
+		Suppressed: o.defers,
+		Messages:   atomic.LoadUint64(&o.msgs),
+		RTTs:       make(map[string]*mathext.Histogram, len(o.pool)),
+		Sizes:      o.sizes.Snapshot(),
+	}
+	for id, p := range o.pool {
+		s.RTTs[id] = p.rtts.Snapshot()
+	}
+	// Count the slots, excluding the ones of the local id's own digits
+	slots := 0
+	for _, row := range o.routes.routes {
+		for _, id := range row {
+			if id != nil {
+				s.Routes++
+			}
+		}
+		slots += len(row) - 1
+	}
+	if slots > 0 {
+		s.Fill = float64(s.Routes) / float64(slots)
+	}
+	return s
+}
+
+// Snapshot of the overlay health metrics, as a plain struct so that callers can
+// map it to whatever monitoring system they use.
+type Metrics struct {
+	Connections int           // Number of peer connections
+	Active      int           // Number of connections used by the routing table
+	Passive     int           // Number of connections outside the routing table
+	TableSize   int           // Number of distinct nodes in the routing table
+	Merges      uint64        // Number of state merges processed
+	Drops       uint64        // Number of peer connections dropped
+	Broadcasts  uint64        // Number of state broadcasts sent out
+	Convergence time.Duration // Time needed by the last convergence
+	SinceChange time.Duration // Time since the last routing table change (0 if none)
+}
+
+// Returns a snapshot of the overlay health metrics.
+func (o *Overlay) Metrics() Metrics {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	m := Metrics{
+		Connections: len(o.pool),
+		Merges:      atomic.LoadUint64(&o.merges),
+		Drops:       atomic.LoadUint64(&o.drops),
+		Broadcasts:  atomic.LoadUint64(&o.bcasts),
+		Convergence: o.settle,
+	}
+	m.Active, m.Passive = o.connCounts()
+
+	nodes := make(map[string]struct{})
+	for _, id := range o.routes.leaves {
+		nodes[id.String()] = struct{}{}
+	}
+	for _, row := range o.routes.routes {
+		for _, id := range row {
+			if id != nil {
+				nodes[id.String()] = struct{}{}
+			}
+		}
+	}
+	for _, id := range o.routes.neighbors {
+		nodes[id.String()] = struct{}{}
+	}
+	delete(nodes, o.nodeId.String())
+	m.TableSize = len(nodes)
+
+	if !o.change.IsZero() {
+		m.SinceChange = o.clock.Now().Sub(o.change)
+	}
+	return m
+}
+
+// Coordinates of a routing table cell.
+type Cell struct {
+	Row int // Length of the prefix shared with the local node id
+	Col int // Next digit of the ids belonging to the cell
+}
+
+// Returns the coordinates of all the empty cells in the routing table, row by
+// row, in ascending column order. The cells of the local id's own digits can't
+// ever be filled, so they are not reported.
+func (o *Overlay) RoutingHoles() []Cell {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	holes := []Cell{}
+	for row, ids := range o.routes.routes {
+		own := o.space.digit(o.nodeId, row)
+		for col, id := range ids {
+			if id == nil && col != own {
+				holes = append(holes, Cell{Row: row, Col: col})
+			}
+		}
+	}
+	return holes
+}
+
+// Writes the overlay statistics and the per peer traffic counters into w in the
+// Prometheus text exposition format.
+func (o *Overlay) WriteMetrics(w io.Writer) error {
+	s, h := o.Stats(), o.Metrics()
+
+	// Collect the per peer byte counters in a deterministic order
+	o.lock.RLock()
+	ids := make([]string, 0, len(o.pool))
+	for id, _ := range o.pool {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	sent := make([]uint64, len(ids))
+	recv := make([]uint64, len(ids))
+	for i, id := range ids {
+		sent[i] = atomic.LoadUint64(&o.pool[id].sentBytes)
+		recv[i] = atomic.LoadUint64(&o.pool[id].recvBytes)
+	}
+	o.lock.RUnlock()
+
+	// Emit the overlay wide metrics
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value interface{}
+	}{
+		{"overlay_peers", "gauge", "Number of active peer connections.", s.Peers},
+		{"overlay_leaves", "gauge", "Number of leaf set entries.", s.Leaves},
+		{"overlay_routes", "gauge", "Number of filled routing table slots.", s.Routes},
+		{"overlay_routing_fill", "gauge", "Ratio of the filled routing table slots.", s.Fill},
+		{"overlay_state_version", "gauge", "Version of the local routing state.", s.Version},
+		{"overlay_repairs_total", "counter", "Number of routing updates requesting repairs.", s.Repairs},
+		{"overlay_heals_total", "counter", "Number of detected partition heals.", s.Heals},
+		{"overlay_broadcasts_suppressed_total", "counter", "Number of state broadcasts deferred by the rate limiter.", s.Suppressed},
+		{"overlay_messages_total", "counter", "Number of system messages sent.", s.Messages},
+		{"overlay_passive_peers", "gauge", "Number of peer connections outside the routing table.", h.Passive},
+		{"overlay_table_size", "gauge", "Number of distinct nodes in the routing table.", h.TableSize},
+		{"overlay_merges_total", "counter", "Number of state merges processed.", h.Merges},
+		{"overlay_drops_total", "counter", "Number of peer connections dropped.", h.Drops},
+		{"overlay_broadcasts_total", "counter", "Number of state broadcasts sent out.", h.Broadcasts},
+		{"overlay_convergence_seconds", "gauge", "Time needed by the last convergence.", h.Convergence.Seconds()},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.kind, m.name, m.value); err != nil {
+			return err
+		}
+	}
+	// Emit the per peer traffic counters
+	peers := []struct {
+		name   string
+		help   string
+		values []uint64
+	}{
+		{"overlay_peer_sent_bytes_total", "Payload bytes sent to a peer.", sent},
+		{"overlay_peer_received_bytes_total", "Payload bytes received from a peer.", recv},
+	}
+	for _, m := range peers {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name); err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if _, err := fmt.Fprintf(w, "%s{peer=\"%s\"} %d\n", m.name, id, m.values[i]); err != nil {
+				return err
+			}
+		}
+	}
+	// Emit the traffic distributions (peers missing from the snapshot are skipped)
+	labels, rtts := []string{}, []*mathext.Histogram{}
+	for _, id := range ids {
+		if h, ok := s.RTTs[id]; ok {
+			labels = append(labels, fmt.Sprintf("peer=\"%s\"", id))
+			rtts = append(rtts, h)
+		}
+	}
+	if err := writeHistogram(w, "overlay_peer_heartbeat_rtt_seconds", "Round trip time of the heartbeats to a peer.", labels, rtts); err != nil {
+		return err
+	}
+	return writeHistogram(w, "overlay_state_entries", "Number of entries in the received state updates.", []string{""}, []*mathext.Histogram{s.Sizes})
+}
+
+// Writes a histogram into w in the Prometheus text exposition format, with a
+// series for each label set (empty for an unlabeled series).
+func writeHistogram(w io.Writer, name, help string, labels []string, hists []*mathext.Histogram) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name); err != nil {
+		return err
+	}
+	for i, h := range hists {
+		bounds, counts := h.Bounds(), h.Counts()
+
+		// Separate the series labels from the bucket bound
+		label, suffix := labels[i], ""
+		if label != "" {
+			label, suffix = label+",", "{"+label+"}"
+		}
+		total := uint64(0)
+		for j, bound := range bounds {
+			total += counts[j]
+			if _, err := fmt.Fprintf(w, "%s_bucket{%sle=\"%v\"} %d\n", name, label, bound, total); err != nil {
+				return err
+			}
+		}
+		total += counts[len(bounds)]
+		if _, err := fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n%s_sum%s %v\n%s_count%s %d\n", name, label, total, name, suffix, h.Sum(), name, suffix, total); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"bytes"
+	"crypto/x509"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Insert a few fake peers into the routing table
+	for i := 1; i <= 3; i++ {
+		id := big.NewInt(int64(i) << 32)
+		newTestPeer(o, id)
+		o.routes.routes[0][i] = id
+	}
+	o.routes.leaves = append(o.routes.leaves, big.NewInt(0x1000000001))
+
+	buf := new(bytes.Buffer)
+	if err := o.WriteMetrics(buf); err != nil {
+		t.Fatalf("failed to write metrics: %v.", err)
+	}
+	// Verify that each line conforms to the exposition format
+	comment := regexp.MustCompile(`^# (HELP [a-zA-Z_:][a-zA-Z0-9_:]* .*|TYPE [a-zA-Z_:][a-zA-Z0-9_:]* (counter|gauge|histogram))$`)
+	sample := regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"]*"(,[a-zA-Z_][a-zA-Z0-9_]*="[^"]*")*\})? [-+0-9.eE]+$`)
+
+	names := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if comment.MatchString(line) {
+			continue
+		}
+		match := sample.FindStringSubmatch(line)
+		if match == nil {
+			t.Fatalf("invalid exposition line: %q.", line)
+		}
+		names[match[1]]++
+	}
+	// Verify that all the expected metrics are present
+	want := map[string]int{
+		"overlay_peers":                             1,
+		"overlay_leaves":                            1,
+		"overlay_routes":                            1,
+		"overlay_routing_fill":                      1,
+		"overlay_state_version":                     1,
+		"overlay_repairs_total":                     1,
+		"overlay_heals_total":                       1,
+		"overlay_broadcasts_suppressed_total":       1,
+		"overlay_messages_total":                    1,
+		"overlay_passive_peers":                     1,
+		"overlay_table_size":                        1,
+		"overlay_merges_total":                      1,
+		"overlay_drops_total":                       1,
+		"overlay_broadcasts_total":                  1,
+		"overlay_convergence_seconds":               1,
+		"overlay_peer_sent_bytes_total":             3,
+		"overlay_peer_received_bytes_total":         3,
+		"overlay_peer_heartbeat_rtt_seconds_bucket": 24,
+		"overlay_peer_heartbeat_rtt_seconds_sum":    3,
+		"overlay_peer_heartbeat_rtt_seconds_count":  3,
+		"overlay_state_entries_bucket":              9,
+		"overlay_state_entries_sum":                 1,
+		"overlay_state_entries_count":               1,
+	}
+	for name, count := range want {
+		if names[name] != count {
+			t.Errorf("metric %s sample count mismatch: have %d, want %d.", name, names[name], count)
+		}
+	}
+	if !strings.Contains(buf.String(), "overlay_routes 3\n") {
+		t.Errorf("routing table fill not reported: %s", buf.String())
+	}
+}
+
+func TestTrafficHistograms(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Feed a few state updates and outdated heartbeats through the state processor
+	p := newTestPeer(o, big.NewInt(0x2000000000))
+	p.time = 10
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			<-o.upSink
+		}
+	}()
+	addrs := map[string][]string{"1": nil, "2": nil, "3": nil}
+	o.lock.RLock()
+	for i := 0; i < 4; i++ {
+		o.process(p, o.nodeId, &state{Addrs: addrs, Updated: uint64(11 + i)})
+		o.process(p, o.nodeId, &state{Addrs: addrs, Updated: 1})
+	}
+	o.lock.RUnlock()
+
+	// Answer a few heartbeats of the peer
+	for i := 0; i < 4; i++ {
+		o.processEcho(p, time.Now().Add(-20*time.Millisecond).UnixNano())
+	}
+	// Verify that the samples fell into the expected buckets
+	s := o.Stats()
+	if h := s.RTTs[p.nodeId.String()]; h == nil || h.Counts()[3] != 4 || h.Count() != 4 {
+		t.Errorf("round trip buckets mismatch: have %v, want 4 samples in bucket %d.", h, 3)
+	}
+	if c := s.Sizes.Counts(); c[2] != 4 || s.Sizes.Count() != 4 {
+		t.Errorf("size buckets mismatch: have %v, want 4 samples in bucket %d.", c, 2)
+	}
+	buf := new(bytes.Buffer)
+	if err := o.WriteMetrics(buf); err != nil {
+		t.Fatalf("failed to write metrics: %v.", err)
+	}
+	for _, line := range []string{
+		`overlay_peer_heartbeat_rtt_seconds_bucket{peer="137438953472",le="0.01"} 0`,
+		`overlay_peer_heartbeat_rtt_seconds_bucket{peer="137438953472",le="0.05"} 4`,
+		`overlay_peer_heartbeat_rtt_seconds_bucket{peer="137438953472",le="+Inf"} 4`,
+		`overlay_peer_heartbeat_rtt_seconds_count{peer="137438953472"} 4`,
+		`overlay_state_entries_bucket{le="2"} 0`,
+		`overlay_state_entries_bucket{le="4"} 4`,
+		`overlay_state_entries_sum 12`,
+		`overlay_state_entries_count 4`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("histogram sample missing: %s.", line)
+		}
+	}
+}
+
+func TestRoutingHoles(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Fill a few cells of the routing table
+	filled := map[Cell]bool{{0, 2}: true, {0, 3}: true, {2, 1}: true}
+	for cell := range filled {
+		o.routes.routes[cell.Row][cell.Col] = big.NewInt(int64(cell.Row<<8 + cell.Col))
+	}
+	holes := o.RoutingHoles()
+
+	// Verify that exactly the empty cells are reported (bar the own digits), in order
+	slots := 0
+	for _, row := range o.routes.routes {
+		slots += len(row) - 1
+	}
+	if len(holes) != slots-len(filled) {
+		t.Fatalf("hole count mismatch: have %v, want %v.", len(holes), slots-len(filled))
+	}
+	for i, hole := range holes {
+		if filled[hole] || o.routes.routes[hole.Row][hole.Col] != nil {
+			t.Fatalf("filled cell reported as hole: %v.", hole)
+		}
+		if hole.Col == o.space.digit(o.nodeId, hole.Row) {
+			t.Fatalf("own digit cell reported as hole: %v.", hole)
+		}
+		if i > 0 {
+			prev := holes[i-1]
+			if prev.Row > hole.Row || (prev.Row == hole.Row && prev.Col >= hole.Col) {
+				t.Fatalf("hole order mismatch: %v before %v.", prev, hole)
+			}
+		}
+	}
+	if fill, want := o.Stats().Fill, float64(len(filled))/float64(slots); fill != want {
+		t.Fatalf("fill ratio mismatch: have %v, want %v.", fill, want)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Fill a few cells, leaves and addresses
+	o.routes.routes[0][2] = big.NewInt(0x2000000000)
+	o.routes.routes[1][3] = big.NewInt(0x1300000000)
+	o.routes.leaves = append(o.routes.leaves, big.NewInt(0x1000000001))
+	o.trans["127.0.0.1:1000"] = big.NewInt(0x2000000000)
+
+	s := o.Snapshot()
+	if s.Self.Cmp(o.nodeId) != 0 {
+		t.Fatalf("self id mismatch: have %v, want %v.", s.Self, o.nodeId)
+	}
+	if len(s.Leaves) != 2 || s.Leaves[1].Int64() != 0x1000000001 {
+		t.Fatalf("leaf set mismatch: have %v, want %v.", s.Leaves, o.routes.leaves)
+	}
+	want := []Route{{Cell{0, 2}, big.NewInt(0x2000000000)}, {Cell{1, 3}, big.NewInt(0x1300000000)}}
+	if len(s.Routes) != len(want) {
+		t.Fatalf("route count mismatch: have %v, want %v.", len(s.Routes), len(want))
+	}
+	for i, r := range s.Routes {
+		if r.Cell != want[i].Cell || r.Id.Cmp(want[i].Id) != 0 {
+			t.Errorf("route %d mismatch: have %v, want %v.", i, r, want[i])
+		}
+	}
+	if id, ok := s.Addrs["127.0.0.1:1000"]; !ok || id.Int64() != 0x2000000000 {
+		t.Fatalf("address mismatch: have %v, want %v.", id, 0x2000000000)
+	}
+	// Ensure the snapshot is detached from the internal state
+	s.Self.SetInt64(0)
+	s.Leaves[1].SetInt64(0)
+	s.Routes[0].Id.SetInt64(0)
+	s.Addrs["127.0.0.1:1000"].SetInt64(0)
+
+	if o.nodeId.Int64() != 0x1000000000 || o.routes.leaves[1].Int64() != 0x1000000001 ||
+		o.routes.routes[0][2].Int64() != 0x2000000000 || o.trans["127.0.0.1:1000"].Int64() != 0x2000000000 {
+		t.Fatalf("internal state mutated through snapshot.")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect an active and a passive peer
+	active, passive := big.NewInt(0x2000000000), big.NewInt(0x3000000000)
+	newTestPeer(o, active)
+	idle := newTestPeer(o, passive)
+	o.routes.routes[0][2] = active
+
+	if m := o.Metrics(); m.Connections != 2 || m.Active != 1 || m.Passive != 1 || m.TableSize != 1 {
+		t.Fatalf("connection metrics mismatch: have %+v.", m)
+	}
+	// Process a merge and a drop, and verify the counters
+	o.merge(newTable(o.nodeId), make(map[string][]string), &state{Addrs: map[string][]string{active.String(): nil}})
+	o.drop(map[*peer]DropReason{idle: Passive})
+
+	m := o.Metrics()
+	if m.Connections != 1 || m.Passive != 0 {
+		t.Fatalf("connection metrics mismatch after drop: have %+v.", m)
+	}
+	if m.Merges != 1 || m.Drops != 1 || m.Broadcasts != 0 {
+		t.Fatalf("counter metrics mismatch: have %+v, want 1/1/0 merges/drops/broadcasts.", m)
+	}
+	if m.Convergence != 0 || m.SinceChange != 0 {
+		t.Fatalf("timing metrics of idle overlay mismatch: have %+v.", m)
+	}
+}
+
+func TestPassivePeers(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Connect a routing table member and a few unused peers
+	active := big.NewInt(0x2000000000)
+	passives := []*big.Int{big.NewInt(0x3000000000), big.NewInt(0x3100000000)}
+	newTestPeer(o, active)
+	for i := len(passives) - 1; i >= 0; i-- {
+		newTestPeer(o, passives[i])
+	}
+	o.routes.routes[0][2] = active
+
+	if s := o.Snapshot(); s.Active != 1 || s.Passive != 2 {
+		t.Fatalf("connection counts mismatch: have %v/%v, want %v/%v.", s.Active, s.Passive, 1, 2)
+	}
+	ids := o.PassivePeers()
+	if len(ids) != len(passives) {
+		t.Fatalf("passive peers mismatch: have %v, want %v.", ids, passives)
+	}
+	for i, id := range ids {
+		if id.Cmp(passives[i]) != 0 {
+			t.Fatalf("passive peers mismatch: have %v, want %v.", ids, passives)
+		}
+	}
+}
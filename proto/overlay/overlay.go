@@ -18,21 +18,29 @@
 // Author: peterke@gmail.com (Peter Szilagyi)
 
 // Package overlay contains the peer-to-peer virtual transport network. It is
-// currently based on a simplified version of Pastry, where proximity is not
-// taken into consideration (i.e. no neighbor set).
+// currently based on a simplified version of Pastry: besides the leaf set and the
+// routing table, a neighbor set tracks the peers with the lowest heartbeat round
+// trip times. Proximity is only used to pick between routing table candidates,
+// the next hops themselves are chosen by id alone.
 package overlay
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/ext/mathext"
+	"github.com/karalabe/iris/ext/sortext"
 	"github.com/karalabe/iris/pool"
 	"github.com/karalabe/iris/proto"
 	"io"
 	"math/big"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Different status types in which the node can be.
@@ -50,8 +58,84 @@ type Callback interface {
 	Forward(msg *proto.Message, key *big.Int) bool
 }
 
+// Reasons for which a peer connection may be dropped.
+type DropReason uint8
+
+const (
+	NetworkError DropReason = iota // The connection failed
+	Passive                        // Neither side needs the connection
+	Shutdown                       // The local node is terminating
+	DuplicateId                    // A better connection exists to the same node
+	Requested                      // The application requested the drop
+	Idle                           // No traffic on a non-routing connection
+	Departed                       // The remote peer gracefully left the network
+	Overflow                       // The connection pool exceeded its capacity
+	Incompatible                   // The remote peer speaks an incompatible protocol version
+)
+
+// Returns the textual representation of a drop reason.
+func (r DropReason) String() string {
+	switch r {
+	case NetworkError:
+		return "network error"
+	case Passive:
+		return "passive"
+	case Shutdown:
+		return "shutdown"
+	case DuplicateId:
+		return "duplicate id"
+	case Requested:
+		return "requested"
+	case Idle:
+		return "idle"
+	case Departed:
+		return "departed"
+	case Overflow:
+		return "overflow"
+	case Incompatible:
+		return "incompatible"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint8(r))
+	}
+}
+
+// Optional callback interface to get notified of dropped peer connections.
+type DropCallback interface {
+	PeerDropped(id *big.Int, reason DropReason)
+}
+
+// Optional callback interface to get notified of application messages dropped
+// due to exceeding the maximum hop count (e.g. routing loops).
+type ExpireCallback interface {
+	Expired(msg *proto.Message, key *big.Int)
+}
+
+// Optional callback interface to get notified of connected peers whose clocks
+// differ from the local one beyond the configured threshold (remote - local).
+type SkewCallback interface {
+	ClockSkew(id *big.Int, delta time.Duration)
+}
+
+// Peer drop request with the reason and an optional completion signal attached.
+type dropReq struct {
+	peer   *peer
+	reason DropReason
+	done   chan struct{}
+}
+
+// Node id migration request with the result channel attached.
+type migrateReq struct {
+	id   *big.Int
+	errc chan error
+}
+
 // Internal structure for the overlay state information.
 type Overlay struct {
+	msgs   uint64 // Number of system messages sent (first for atomic alignment)
+	merges uint64 // Number of state merges processed
+	bcasts uint64 // Number of state broadcasts sent out
+	drops  uint64 // Number of peer connections dropped
+
 	app Callback
 
 	// Local and remote keys to authorize
@@ -62,84 +146,277 @@ type Overlay struct {
 	overId string
 	nodeId *big.Int
 	addrs  []string
+	space  *space // Id space and routing table digit size
+
+	// Optional leaf set spreading across address classes (nil classifier if off)
+	classify  Classifier
+	classes   map[string]string
+	classLock sync.Mutex
+
+	// Node id derivation parameters (used during construction only)
+	hasher func([]byte) *big.Int
+	ident  []byte
 
 	// The active connection pool, ip to id translations and routing table with modification timestamp
 	pool  map[string]*peer
 	trans map[string]*big.Int
 
-	routes *table
-	time   uint64
-	stat   status
+	routes  *table
+	time    uint64
+	repairs uint64 // Number of routing table updates requesting repairs
+	heals   uint64 // Number of detected partition heals
+	defers  uint64 // Number of state broadcasts deferred by the rate limiter
+	stat    status
+	feats   feature         // Optional protocol features supported locally
+	codec   Codec           // Compression algorithm of large state exchanges
+	ciph    LinkCipherMaker // Constructor of the link message ciphers
+	states  int             // Maximum number of entries processed per state message
+	pause   bool            // Whether the local node refuses routing responsibilities
+	seed    []byte          // Seed of the tie-break between equivalent ids
+	boot    *big.Int        // Id of the peer the overlay joined through
+	idle    time.Duration   // Inactivity after which non-routing peers are dropped
+	chaos   bool            // Whether failure simulation is permitted
+	version uint16          // Wire protocol version advertised in the joins
 
-	// Fan-in sinks for state update and connection drop events + quit channel
+	// Fan-in sinks for state update, connection drop and migration events + quit channel
 	upSink   chan *state
-	dropSink chan *peer
+	dropSink chan *dropReq
+	migSink  chan *migrateReq
+	migCh    chan struct{} // Closed when the node id migrates, then replaced
 	quit     chan struct{}
 
+	// Dial statistics per remote address (nil if address learning is disabled)
+	dials map[string]*addrStat
+
+	// Re-dial backoff of recently unreachable nodes
+	backs map[string]*backoff
+
+	// Manually blacklisted nodes and the end of their bans
+	bans map[string]time.Time
+
+	// Dials in progress, keyed by target (node id or address tuple)
+	inflight map[string]chan struct{}
+
+	// Peer addresses imported from a handoff, dialed on boot
+	warm map[string][]string
+
+	// DNS seeds resolved into bootstrap candidates
+	seeds []string
+
+	// Next hops towards recently routed keys, flushed on routing table changes
+	cache *routeCache
+
+	// Subscribers to the routing topology changes
+	subs []chan TopologyEvent
+
+	// Pending delivery and leave acknowledgements (by sequence number and peer id)
+	acks    map[uint64]chan struct{}
+	ackSeq  uint64
+	parts   map[string]chan struct{}
+	ackLock sync.Mutex
+
+	// Health and convergence tracking fields
+	mgrUp  bool          // Whether the manager routine is running
+	beatUp bool          // Whether the beater routine is running
+	stab   bool          // Whether the overlay is currently converged
+	stabAt time.Time     // Time of the last stability transition
+	stabCh chan struct{} // Closed when the overlay converges, replaced when not
+	settle time.Duration // Time needed by the last convergence
+	change time.Time     // Time of the last routing table change
+
+	// Leveled logger to report the overlay events through
+	log Logger
+
+	// Time source of the maintenance routines
+	clock Clock
+
+	// Idle times to consider the overlay converged after booting and after changes
+	bootTimeout time.Duration
+	convTimeout time.Duration
+
+	// Distribution of the received state update sizes (entries)
+	sizes *mathext.Histogram
+
 	// Miscellaneous fields
 	auther *pool.ThreadPool // Limits thread proliferation
-	stable sync.WaitGroup   // Syncer for reaching convergence
 	lock   sync.RWMutex     // Syncer for state mods after booting
 }
 
+// Optional construction parameter of an overlay.
+type Option func(o *Overlay)
+
+// Sets the bit length of the node ids and the number of bits per routing table
+// digit, overriding the global configuration. All nodes in a network must agree
+// on these, mismatching peers are refused during the handshake. The ids cannot
+// be longer than the output of config.OverlayResolver.
+func WithIdSpace(bits, base int) Option {
+	if bits <= 0 || bits > config.OverlayResolver().Size()*8 || base <= 0 || base > bits || base > 16 {
+		panic(fmt.Sprintf("invalid id space: %d bits, %d bit digits", bits, base))
+	}
+	return func(o *Overlay) {
+		o.space = newSpace(bits, base)
+	}
+}
+
+// Sets the idle time after booting to consider the overlay a single node in the
+// network (defaults to config.OverlayBootTimeout).
+func WithBootTimeout(d time.Duration) Option {
+	return func(o *Overlay) {
+		o.bootTimeout = d
+	}
+}
+
+// Sets the idle time after routing changes to consider the overlay converged
+// (defaults to config.OverlayConvTimeout).
+func WithConvTimeout(d time.Duration) Option {
+	return func(o *Overlay) {
+		o.convTimeout = d
+	}
+}
+
+// Sets the hash function deriving the node id from the node identity. The result
+// is reduced into the id space. By default the identity is used as is.
+func WithHasher(hasher func([]byte) *big.Int) Option {
+	return func(o *Overlay) {
+		o.hasher = hasher
+	}
+}
+
+// Sets the identity the node id is derived from, instead of a random one.
+func WithIdentity(ident []byte) Option {
+	return func(o *Overlay) {
+		o.ident = append([]byte{}, ident...)
+	}
+}
+
+// Derives the node id from the node identity (random if none was set) using
+// the configured hash function, reduced into the id space.
+func (o *Overlay) deriveId() (*big.Int, error) {
+	ident := o.ident
+	if ident == nil {
+		ident = make([]byte, (o.space.bits+7)/8)
+		if _, err := io.ReadFull(rand.Reader, ident); err != nil {
+			return nil, err
+		}
+	}
+	hasher := o.hasher
+	if hasher == nil {
+		hasher = func(data []byte) *big.Int { return new(big.Int).SetBytes(data) }
+	}
+	id := hasher(ident)
+	return id.Mod(id, o.space.modulo), nil
+}
+
 // Creates a new overlay structure with all internal state initialized, ready to
 // be booted. Self is used as the id used for discovering similar peers, and key
 // for the security.
-func New(self string, key *rsa.PrivateKey, app Callback) *Overlay {
+func New(self string, key *rsa.PrivateKey, app Callback, opts ...Option) *Overlay {
 	o := new(Overlay)
 	o.app = app
 
+	o.space = configSpace()
+	o.log = stdLogger{}
+	o.clock = realClock{}
+	o.bootTimeout = time.Duration(config.OverlayBootTimeout) * time.Millisecond
+	o.convTimeout = time.Duration(config.OverlayConvTimeout) * time.Millisecond
+	for _, opt := range opts {
+		opt(o)
+	}
 	o.lkey = key
 	o.rkeys = make(map[string]*rsa.PublicKey)
 	o.rkeys[self] = &key.PublicKey
 
-	id := make([]byte, config.OverlaySpace/8)
-	if n, err := io.ReadFull(rand.Reader, id); n < len(id) || err != nil {
+	id, err := o.deriveId()
+	if err != nil {
 		panic(fmt.Sprintf("failed to generate node id: %v", err))
 	}
-	o.nodeId = new(big.Int).SetBytes(id)
+	o.nodeId = id
 	o.overId = self
 	o.addrs = []string{}
 
 	o.pool = make(map[string]*peer)
 	o.trans = make(map[string]*big.Int)
+	o.backs = make(map[string]*backoff)
+	o.bans = make(map[string]time.Time)
+	o.inflight = make(map[string]chan struct{})
 
-	o.routes = newTable(o.nodeId)
+	o.routes = o.space.newTable(o.nodeId)
 	o.time = 1
+	o.states = config.OverlayStateEntries
+	o.version = protoVersion
+	o.feats = featCompress
+	o.codec = flateCodec{}
+	o.ciph = newGcmCipher
+	if config.OverlayEncryption {
+		o.feats |= featEncrypt
+	}
+	o.seed = []byte(self)
+	o.sizes = mathext.NewHistogram(sizeBuckets...)
+	o.cache = newRouteCache(0)
+	o.acks = make(map[uint64]chan struct{})
+	o.parts = make(map[string]chan struct{})
 
 	o.upSink = make(chan *state)
-	o.dropSink = make(chan *peer)
+	o.dropSink = make(chan *dropReq)
+	o.migSink = make(chan *migrateReq)
+	o.migCh = make(chan struct{})
 	o.quit = make(chan struct{})
+	o.stabCh = make(chan struct{})
 
 	o.auther = pool.NewThreadPool(config.OverlayAuthThreads)
 
 	return o
 }
 
-// Boots the overlay network: it starts up boostrappers and connection acceptors
-// on all local IPv4 interfaces, after which the overlay management is booted.
-// The method returns the number of remote peers after convergence is reached.
+// Boots the overlay network: it starts up connection acceptors on all local non
+// loopback interfaces (and boostrappers on the IPv4 ones), after which the overlay
+// management is booted. The method returns the number of remote peers after
+// convergence is reached.
 func (o *Overlay) Boot() (int, error) {
-	// Start the individual acceptors
-	addrs, err := net.InterfaceAddrs()
+	// Start the individual acceptors, keeping the zones of link-local IPv6 addresses
+	ifaces, err := net.Interfaces()
 	if err != nil {
 		return 0, err
 	}
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok {
-			if !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-				go o.acceptor(ipnet.IP)
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return 0, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				zone := ""
+				if ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+					zone = iface.Name
+				}
+				go o.acceptor(ipnet.IP, zone)
 			}
 		}
 	}
 	// Start the overlay processes
-	o.stable.Add(1)
 	go o.manager()
 	go o.beater()
 	o.auther.Start()
 
+	// Feed any handed over peers to the manager for dialing
+	o.lock.RLock()
+	if warm := o.warm; warm != nil {
+		go func() {
+			select {
+			case o.upSink <- &state{Addrs: warm}:
+			case <-o.quit:
+			}
+		}()
+	}
+	if seeds := o.seeds; len(seeds) != 0 {
+		go o.seeder(seeds)
+	}
+	o.lock.RUnlock()
+
 	// Wait for convergence and report remote connections
-	o.stable.Wait()
+	if err := o.WaitStable(context.Background()); err != nil {
+		return 0, err
+	}
 
 	o.lock.RLock()
 	defer o.lock.RUnlock()
@@ -157,22 +434,474 @@ func (o *Overlay) Boot() (int, error) {
 func (o *Overlay) Shutdown() {
 	close(o.quit)
 	o.auther.Terminate()
+
+	// Notify the application of the connections being torn down
+	o.lock.Lock()
+	ids := make([]*big.Int, 0, len(o.pool))
+	for _, p := range o.pool {
+		ids = append(ids, p.nodeId)
+	}
+	o.unsubscribeAll()
+	o.lock.Unlock()
+
+	for _, id := range ids {
+		o.dropped(id, Shutdown)
+	}
+}
+
+// Gracefully leaves the overlay network: all connected peers are notified of the
+// departure, so they can repair their routing tables instantly instead of waiting
+// for the connection failures. After all the peers acknowledged, or the leave
+// timeout expired, the connections are torn down and the overlay is shut down.
+func (o *Overlay) Leave() error {
+	// Register the acknowledgements to wait for
+	o.lock.RLock()
+	peers := make([]*peer, 0, len(o.pool))
+	for _, p := range o.pool {
+		peers = append(peers, p)
+	}
+	o.lock.RUnlock()
+
+	o.ackLock.Lock()
+	waits := make([]chan struct{}, len(peers))
+	for i, p := range peers {
+		waits[i] = make(chan struct{})
+		o.parts[p.nodeId.String()] = waits[i]
+	}
+	o.ackLock.Unlock()
+
+	// Notify all the peers and wait for their acknowledgements
+	for _, p := range peers {
+		go o.sendClose(p)
+	}
+	timeout := time.After(time.Duration(config.OverlayLeaveTimeout) * time.Millisecond)
+	missing := len(waits)
+	for _, wait := range waits {
+		select {
+		case <-wait:
+			missing--
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	// Tear down the connections and the overlay
+	for _, p := range peers {
+		if err := p.Close(); err != nil {
+			o.log.Errorf("overlay: failed to close peer connection: %v.", err)
+		}
+	}
+	o.Shutdown()
+
+	if missing > 0 {
+		return fmt.Errorf("leave unacknowledged by %d peers", missing)
+	}
+	return nil
+}
+
+// Notifies the application of a dropped peer connection, if it is interested.
+func (o *Overlay) dropped(id *big.Int, reason DropReason) {
+	if cb, ok := o.app.(DropCallback); ok {
+		cb.PeerDropped(id, reason)
+	}
+}
+
+// Enables or disables the chaos testing operations (e.g. SimulateFailure). They
+// are disabled by default to prevent accidental use in production.
+func (o *Overlay) SetChaos(enabled bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.chaos = enabled
+}
+
+// Simulates a network failure of a peer connection by abruptly closing the
+// underlying socket without any graceful termination. The failure is detected
+// and repaired by the same mechanisms as a real one. Chaos mode must be enabled.
+func (o *Overlay) SimulateFailure(id *big.Int) error {
+	o.lock.RLock()
+	p, ok := o.pool[id.String()]
+	chaos := o.chaos
+	o.lock.RUnlock()
+
+	if !chaos {
+		return fmt.Errorf("chaos mode disabled")
+	}
+	if !ok {
+		return fmt.Errorf("non-connected peer")
+	}
+	return p.abort()
+}
+
+// Converts a string id into an id of the overlay's id space.
+func (o *Overlay) Resolve(id string) *big.Int {
+	return resolve(id, o.space.bits)
 }
 
 // Returns the overlay node's identifier.
 func (o *Overlay) Self() *big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
 	return o.nodeId
 }
 
+// Returns a copy of the overlay node's identifier, safe to retain and modify.
+func (o *Overlay) Id() *big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return new(big.Int).Set(o.nodeId)
+}
+
+// Returns whether the overlay is currently considered converged, i.e. no routing
+// updates arrived for the convergence timeout.
+func (o *Overlay) Stable() bool {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.stab
+}
+
+// Blocks until the overlay is considered converged, the context is cancelled or
+// the overlay is shut down.
+func (o *Overlay) WaitStable(ctx context.Context) error {
+	o.lock.RLock()
+	stab, signal := o.stab, o.stabCh
+	o.lock.RUnlock()
+
+	if stab {
+		return nil
+	}
+	select {
+	case <-signal:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-o.quit:
+		return fmt.Errorf("overlay terminated")
+	}
+}
+
+// Returns a copy of the addresses the local node advertises to its peers.
+func (o *Overlay) Addresses() []string {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return append([]string{}, o.addrs...)
+}
+
+// Returns the id of the first peer connected during bootstrap, through which the
+// local node joined the overlay network, and whether such a peer exists yet.
+func (o *Overlay) BootstrapPeer() (*big.Int, bool) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	if o.boot == nil {
+		return nil, false
+	}
+	return new(big.Int).Set(o.boot), true
+}
+
+// Returns the ids of the currently connected peers, in ascending order.
+func (o *Overlay) Peers() []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	ids := make([]*big.Int, 0, len(o.pool))
+	for _, p := range o.pool {
+		ids = append(ids, new(big.Int).Set(p.nodeId))
+	}
+	sortext.BigInts(ids)
+	return ids
+}
+
+// Returns the smoothed round trip time to a connected peer, measured through the
+// heartbeats, and whether such a measurement exists.
+func (o *Overlay) Latency(id *big.Int) (time.Duration, bool) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	p, ok := o.pool[id.String()]
+	if !ok {
+		return 0, false
+	}
+	rtt := atomic.LoadInt64(&p.latency)
+	return time.Duration(rtt), rtt != 0
+}
+
+// Returns the leaf set in ring order: starting from the local node's successor
+// and proceeding clockwise, wrapping around through the predecessors. The local
+// node itself is not included.
+func (o *Overlay) LeafRing() []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	ring := make([]*big.Int, 0, len(o.routes.leaves))
+	for _, id := range o.routes.leaves {
+		if id.Cmp(o.nodeId) != 0 {
+			ring = append(ring, new(big.Int).Set(id))
+		}
+	}
+	sort.Sort(ringSlice{o.space, o.nodeId, ring})
+	return ring
+}
+
+// Read-only copy of the local routing state, detached from the overlay.
+type Snapshot struct {
+	Self    *big.Int            // Id of the local node
+	Leaves  []*big.Int          // Leaf set, including the local node
+	Routes  []Route             // Populated routing table cells
+	Addrs   map[string]*big.Int // Resolved peer addresses and their node ids
+	Active  int                 // Number of connections used by the routing table
+	Passive int                 // Number of connections outside the routing table
+}
+
+// Populated routing table cell.
+type Route struct {
+	Cell
+	Id *big.Int // Node id stored in the cell
+}
+
+// Returns a deep copy of the local routing state: the leaf set, the populated
+// routing table cells and the resolved peer addresses.
+func (o *Overlay) Snapshot() Snapshot {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	s := Snapshot{
+		Self:   new(big.Int).Set(o.nodeId),
+		Leaves: make([]*big.Int, len(o.routes.leaves)),
+		Routes: []Route{},
+		Addrs:  make(map[string]*big.Int, len(o.trans)),
+	}
+	for i, id := range o.routes.leaves {
+		s.Leaves[i] = new(big.Int).Set(id)
+	}
+	for row, ids := range o.routes.routes {
+		for col, id := range ids {
+			if id != nil {
+				s.Routes = append(s.Routes, Route{Cell{Row: row, Col: col}, new(big.Int).Set(id)})
+			}
+		}
+	}
+	for addr, id := range o.trans {
+		s.Addrs[addr] = new(big.Int).Set(id)
+	}
+	s.Active, s.Passive = o.connCounts()
+	return s
+}
+
+// Returns the ids of the connected peers not used by the routing table, sorted
+// in ascending order. Useful to diagnose connection build-ups.
+func (o *Overlay) PassivePeers() []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	ids := []*big.Int{}
+	for _, p := range o.pool {
+		if !o.active(p.nodeId) {
+			ids = append(ids, new(big.Int).Set(p.nodeId))
+		}
+	}
+	sortext.BigInts(ids)
+	return ids
+}
+
+// Counts the active and passive peer connections. The read lock must be held.
+func (o *Overlay) connCounts() (active int, passive int) {
+	for _, p := range o.pool {
+		if o.active(p.nodeId) {
+			active++
+		} else {
+			passive++
+		}
+	}
+	return
+}
+
+// Drops the connection to a specific peer, returning once it has been removed
+// from the connection pool (or an error if no such peer is connected).
+func (o *Overlay) DropPeer(id *big.Int) error {
+	o.lock.RLock()
+	p, ok := o.pool[id.String()]
+	up := o.mgrUp
+	o.lock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("non-connected peer")
+	}
+	if !up {
+		return fmt.Errorf("manager not running")
+	}
+	req := &dropReq{peer: p, reason: Requested, done: make(chan struct{})}
+	select {
+	case o.dropSink <- req:
+	case <-o.quit:
+		return fmt.Errorf("overlay terminating")
+	}
+	select {
+	case <-req.done:
+		return nil
+	case <-o.quit:
+		return fmt.Errorf("overlay terminating")
+	}
+}
+
 // Sends a message to the closest node to the given destination.
 func (o *Overlay) Send(dest *big.Int, msg *proto.Message) {
 	// Package into overlay envelope
 	head := &header{
 		Meta: msg.Head.Meta,
 		Dest: dest,
+		TTL:  config.OverlayMaxHops,
 	}
 	msg.Head.Meta = head
 
 	// Assemble and send an internal message with overlay state included
 	o.route(nil, msg)
 }
+
+// Verifies that the routing table row shared with a connected peer is consistent
+// on both sides, triggering a targeted state exchange of that row on mismatch.
+func (o *Overlay) ProbeConsistency(id *big.Int) error {
+	o.lock.RLock()
+	p, ok := o.pool[id.String()]
+	self := o.nodeId
+	o.lock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("non-connected peer")
+	}
+	row, _ := o.space.prefix(self, id)
+	o.sendProbe(p, row, false, false)
+	return nil
+}
+
+// Migrates the local node to a new overlay id, whilst keeping the existing
+// connections alive. The connected peers are notified of the change, and the
+// overlay reconverges around the new position. The id must be inside the id
+// space and not collide with any connected peer.
+func (o *Overlay) Migrate(id *big.Int) error {
+	o.lock.RLock()
+	up := o.mgrUp
+	o.lock.RUnlock()
+
+	if !up {
+		return fmt.Errorf("manager not running")
+	}
+	req := &migrateReq{
+		id:   id,
+		errc: make(chan error, 1),
+	}
+	select {
+	case <-o.quit:
+		return fmt.Errorf("overlay terminating")
+	case o.migSink <- req:
+		return <-req.errc
+	}
+}
+
+// Reports whether the overlay node is healthy: both the manager and beater are
+// running, there is at least one live connection, the routing table is not
+// empty and the overlay converged recently. If not, the reasons are returned.
+func (o *Overlay) HealthCheck() (bool, []string) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	reasons := []string{}
+	if !o.mgrUp {
+		reasons = append(reasons, "manager not running")
+	}
+	if !o.beatUp {
+		reasons = append(reasons, "beater not running")
+	}
+	if len(o.pool) == 0 {
+		reasons = append(reasons, "no peer connections")
+	}
+	empty := len(o.routes.leaves) <= 1
+	for _, row := range o.routes.routes {
+		for _, id := range row {
+			if id != nil {
+				empty = false
+			}
+		}
+	}
+	if empty {
+		reasons = append(reasons, "routing table empty")
+	}
+	switch {
+	case o.stabAt.IsZero():
+		reasons = append(reasons, "never converged")
+	case !o.stab && o.clock.Now().Sub(o.stabAt) > 10*o.convTimeout:
+		reasons = append(reasons, fmt.Sprintf("not converged for %v", o.clock.Now().Sub(o.stabAt)))
+	}
+	return len(reasons) == 0, reasons
+}
+
+// Sets the seed used to deterministically break ties between equivalent ids in
+// routing and table maintenance decisions. It defaults to the overlay id, so it
+// only needs to be set if all nodes agree on a different one.
+func (o *Overlay) SetTieBreakSeed(seed []byte) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.seed = append([]byte{}, seed...)
+	o.cache.flush()
+}
+
+// Sets the duration of no application traffic after which connections not part
+// of the routing table or leaf set are dropped. Zero disables the reaping.
+func (o *Overlay) SetIdleTimeout(d time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.idle = d
+}
+
+// Sets the maximum number of address entries processed from a single state
+// message. Anything beyond is discarded, bounding the work a peer can inflict.
+// Negative limits are rejected.
+func (o *Overlay) SetMaxStateEntries(n int) error {
+	if n < 0 {
+		return fmt.Errorf("negative state entry limit: %d", n)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.states = n
+	return nil
+}
+
+// Pauses the participation of the local node in the overlay: it stops being
+// advertised as routable, and peers are requested to remove it from their
+// routing tables. Existing connections are kept alive.
+func (o *Overlay) Pause() {
+	o.setPause(true)
+}
+
+// Resumes the participation of a paused node in the overlay.
+func (o *Overlay) Resume() {
+	o.setPause(false)
+}
+
+// Sets the local participation state and notifies all connected peers.
+func (o *Overlay) setPause(pause bool) {
+	o.lock.Lock()
+	if o.pause == pause {
+		o.lock.Unlock()
+		return
+	}
+	o.pause = pause
+	o.time++
+
+	peers := make([]*peer, 0, len(o.pool))
+	for _, p := range o.pool {
+		peers = append(peers, p)
+	}
+	o.lock.Unlock()
+
+	for _, p := range peers {
+		go o.sendState(p, false)
+	}
+}
@@ -19,6 +19,7 @@
 package overlay
 
 import (
+	"github.com/karalabe/iris/ext/mathext"
 	"github.com/karalabe/iris/proto"
 	"math/big"
 )
@@ -80,3 +81,51 @@ func (cb *nopCallback) Deliver(msg *proto.Message, key *big.Int) {
 func (cb *nopCallback) Forward(msg *proto.Message, key *big.Int) bool {
 	return true
 }
+
+// Creates a fake, never started peer connection to the given node, inserting
+// it into the connection pool of the overlay.
+func newTestPeer(o *Overlay, id *big.Int) *peer {
+	p := &peer{
+		owner:  o,
+		nodeId: id,
+		addrs:  []string{},
+		netIn:  make(chan *proto.Message, 1),
+		netOut: make(chan *proto.Message, 1),
+		sysOut: make(chan *proto.Message, 1),
+		appOut: make(chan *proto.Message, 1),
+		sent:   make(chan struct{}),
+		quit:   make(chan chan error),
+		term:   make(chan struct{}),
+
+		since:    o.clock.Now(),
+		lastUsed: o.clock.Now().UnixNano(),
+		rtts:     mathext.NewHistogram(rttBuckets...),
+	}
+	go p.sender(p.netOut)
+
+	o.pool[id.String()] = p
+	return p
+}
+
+// Overlay callback recording the dropped peer notifications
+type dropCollector struct {
+	nopCallback
+	ids     []*big.Int
+	reasons []DropReason
+}
+
+func (c *dropCollector) PeerDropped(id *big.Int, reason DropReason) {
+	c.ids = append(c.ids, id)
+	c.reasons = append(c.reasons, reason)
+}
+
+// Generates n ids evenly distributed around a ring of the given size, starting
+// from zero. If the modulus isn't divisible by n, gaps may differ by one.
+func EvenlySpacedIds(n int, modulus *big.Int) []*big.Int {
+	ids := make([]*big.Int, n)
+	for i := 0; i < n; i++ {
+		ids[i] = new(big.Int).Mul(modulus, big.NewInt(int64(i)))
+		ids[i].Div(ids[i], big.NewInt(int64(n)))
+	}
+	return ids
+}
@@ -25,16 +25,26 @@ package overlay
 import (
 	"fmt"
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/ext/mathext"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/session"
 	"math/big"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Peer state information.
 type peer struct {
+	sentBytes uint64 // Payload bytes sent (first for atomic alignment)
+	recvBytes uint64 // Payload bytes received
+	lastUsed  int64  // Time of the last application traffic (unix nanos)
+	lastBeat  int64  // Time of the last heartbeat received (unix nanos)
+	latency   int64  // Smoothed heartbeat round trip time (nanos), zero until the first echo
+
+	rtts *mathext.Histogram // Distribution of the heartbeat round trip times (secs)
+
 	owner *Overlay
 
 	// Virtual id and reachable addresses
@@ -49,24 +59,40 @@ type peer struct {
 
 	netIn  chan *proto.Message // Inbound transport channel
 	netOut chan *proto.Message // Outbound transport channel
+	abort  func() error        // Abruptly terminates the underlying transport
+
+	sysOut chan *proto.Message // Outbound system lane (handshake, state, probes)
+	appOut chan *proto.Message // Outbound application lane
+	sent   chan struct{}       // Closed when the lane multiplexer terminates
 
 	// Overlay state infos
+	since   time.Time // Time when the connection was established
 	time    uint64
 	passive bool
+	feats   feature    // Optional features supported by both ends
+	cipher  LinkCipher // Message encryption of the link (nil if disabled)
+	pause   uint32     // Whether the remote node paused participation (atomic)
 
 	// Maintenance fields
 	init bool            // Specifies whether the receiver was started
 	quit chan chan error // Quit channe to synchronize peer termination
 	term chan struct{}   // Termination signaller to prevent new operations
+	done uint32          // Whether the peer was already closed (atomic)
 
 	busy     sync.WaitGroup // Maintains whether sends are in progress or not
 	quitLock sync.Mutex     // Protect concurrent closes
+	quitOnce sync.Once      // Ensures the connection is torn down only once
 }
 
 // Creates a new peer structure, ready to begin communicating
 func (o *Overlay) newPeer(ses *session.Session) (*peer, error) {
+	now := o.clock.Now()
 	p := &peer{
-		owner: o,
+		owner:    o,
+		since:    now,
+		lastUsed: now.UnixNano(),
+		lastBeat: now.UnixNano(),
+		rtts:     mathext.NewHistogram(rttBuckets...),
 
 		// Connection details
 		laddr: ses.Raw().LocalAddr().String(),
@@ -75,12 +101,24 @@ func (o *Overlay) newPeer(ses *session.Session) (*peer, error) {
 		rhost: ses.Raw().LocalAddr().(*net.TCPAddr).IP.String(),
 
 		// Transport and maintenance channels
-		netIn: make(chan *proto.Message, config.OverlayNetBuffer),
-		quit:  make(chan chan error),
-		term:  make(chan struct{}),
+		netIn:  make(chan *proto.Message, config.OverlayNetBuffer),
+		sysOut: make(chan *proto.Message, config.OverlayNetBuffer),
+		appOut: make(chan *proto.Message, config.OverlayNetBuffer),
+		sent:   make(chan struct{}),
+		quit:   make(chan chan error),
+		term:   make(chan struct{}),
 	}
-	// Set up the outbound data channel
+	// Enable TCP keepalives to catch half-open links on the transport level too
+	if err := ses.Raw().SetKeepAlive(true); err != nil {
+		return nil, err
+	}
+	if err := ses.Raw().SetKeepAlivePeriod(time.Duration(config.OverlayKeepAlive) * time.Millisecond); err != nil {
+		return nil, err
+	}
+	// Set up the outbound data channel and the lane multiplexer feeding it
 	p.netOut = ses.Communicate(p.netIn, nil)
+	p.abort = ses.Raw().Close
+	go p.sender(p.netOut)
 
 	return p, nil
 }
@@ -104,9 +142,39 @@ func (p *peer) Start() error {
 	return nil
 }
 
+// Terminates a peer connection. Only the first close tears the link down and
+// reports its result, repeated ones are no-ops returning nil.
+func (p *peer) Close() error {
+	var err error
+	p.quitOnce.Do(func() {
+		err = p.close()
+		atomic.StoreUint32(&p.done, 1)
+	})
+	return err
+}
+
+// Returns whether the peer connection was already closed.
+func (p *peer) closed() bool {
+	return atomic.LoadUint32(&p.done) == 1
+}
+
+// Returns whether the remote node paused its participation in the overlay.
+func (p *peer) paused() bool {
+	return atomic.LoadUint32(&p.pause) == 1
+}
+
+// Updates the participation state of the remote node, returning whether it changed.
+func (p *peer) setPaused(paused bool) bool {
+	val := uint32(0)
+	if paused {
+		val = 1
+	}
+	return atomic.SwapUint32(&p.pause, val) != val
+}
+
 // Terminates a peer connection and sets the quit channel to nil to prevent
 // double close.
-func (p *peer) Close() error {
+func (p *peer) close() error {
 	// Sync between concurrent closes
 	p.quitLock.Lock()
 	defer p.quitLock.Unlock()
@@ -115,6 +183,7 @@ func (p *peer) Close() error {
 	if !p.init {
 		p.quit = nil
 		close(p.term)
+		<-p.sent
 		close(p.netOut)
 		return nil
 	}
@@ -131,26 +200,87 @@ func (p *peer) Close() error {
 	}
 }
 
-// Sends a message to the remote peer.
+// Sends a message to the remote peer, queuing it into the system or the
+// application lane based on its contents.
 func (p *peer) send(msg *proto.Message) error {
 	// Ensure sends aren't caught midpoint
 	p.busy.Add(1)
 	defer p.busy.Done()
 
+	lane := p.appOut
+	if system(msg) {
+		lane = p.sysOut
+	}
+	// Encrypt the message if the link requires it (accounting the plain payload)
+	size := uint64(len(msg.Data))
+	if p.cipher != nil {
+		sealed, err := p.seal(msg)
+		if err != nil {
+			return err
+		}
+		msg = sealed
+	}
 	// Send the message or time out
 	select {
 	case <-p.term:
 		return fmt.Errorf("closed")
 	case <-time.After(time.Duration(config.OverlaySendTimeout) * time.Millisecond):
 		return fmt.Errorf("timeout")
-	case p.netOut <- msg:
+	case lane <- msg:
+		atomic.AddUint64(&p.sentBytes, size)
+		if lane == p.appOut {
+			atomic.StoreInt64(&p.lastUsed, p.owner.clock.Now().UnixNano())
+		}
 		return nil
 	}
 }
 
+// Checks whether a message is overlay system traffic (i.e. anything besides
+// plain application payloads).
+func system(msg *proto.Message) bool {
+	head, ok := msg.Head.Meta.(*header)
+	if !ok {
+		return true
+	}
+	return head.Op != opNop || head.State != nil || head.Probe != nil || head.Packed != nil
+}
+
+// Multiplexes the outbound lanes into the transport channel, always preferring
+// pending system messages over application ones, so that bulk application data
+// cannot delay heartbeats and state exchanges.
+func (p *peer) sender(out chan *proto.Message) {
+	defer close(p.sent)
+
+	for {
+		// Fetch a system message if available, otherwise anything
+		var msg *proto.Message
+		select {
+		case msg = <-p.sysOut:
+		default:
+			select {
+			case <-p.term:
+				return
+			case msg = <-p.sysOut:
+			case msg = <-p.appOut:
+			}
+		}
+		// Push it towards the network or abort on termination
+		select {
+		case <-p.term:
+			return
+		case out <- msg:
+		}
+	}
+}
+
 // Listens for inbound messages from the peer and routes them into the overlay
-// network.
+// network. Since heartbeats flow periodically on every link, a peer silent for
+// too long is considered to be behind a half-open connection and is dropped.
 func (p *peer) receiver() {
+	clock := p.owner.clock
+	limit := time.Duration(config.OverlayBeatPeriod*config.OverlayKillCount) * time.Millisecond
+	last, deadline := clock.Now(), clock.After(limit)
+
 	// Retrieve messages until termination is requested or the connection fails
 	var errc chan error
 	for closed := false; !closed && errc == nil; {
@@ -160,18 +290,49 @@ func (p *peer) receiver() {
 			closed = true
 			break
 		case errc = <-p.quit:
-			//go func() { p.owner.dropSink <- p }()
+			//go func() { p.owner.dropSink <- &dropReq{peer: p, reason: Shutdown} }()
+			break
+		case <-deadline:
+			// Rearm the deadline if traffic arrived since it was set
+			if silent := clock.Now().Sub(last); silent < limit {
+				deadline = clock.After(limit - silent)
+				break
+			}
+			// Read deadline expired, tear down the transport and signal the overlay
+			p.owner.log.Infof("overlay: no traffic from %v for %v, dropping half-open link.", p.nodeId, limit)
+			if p.abort != nil {
+				p.abort()
+			}
+			go func() { p.owner.dropSink <- &dropReq{peer: p, reason: NetworkError} }()
+			closed = true
 			break
 		case msg, ok := <-p.netIn:
 			// Signal the owning overlay in case of a remote error
 			if !ok {
 				// TODO: Is this go routine really necessary?
 				// TODO: Sync this up with overlay close logic!
-				go func() { p.owner.dropSink <- p }()
+				go func() { p.owner.dropSink <- &dropReq{peer: p, reason: NetworkError} }()
 				closed = true
 				break
 			}
+			last = clock.Now()
+
+			// Decrypt the message if the link requires it
+			if p.cipher != nil {
+				if err := p.open(msg); err != nil {
+					p.owner.log.Errorf("overlay: failed to open sealed message: %v.", err)
+					break
+				}
+			}
 			// Check whether it's a close request
+			atomic.AddUint64(&p.recvBytes, uint64(len(msg.Data)))
+			if !system(msg) {
+				atomic.StoreInt64(&p.lastUsed, last.UnixNano())
+			}
+			if err := p.owner.unpack(msg); err != nil {
+				p.owner.log.Errorf("overlay: failed to unpack state: %v.", err)
+				break
+			}
 			p.owner.route(p, msg)
 		}
 	}
@@ -182,6 +343,7 @@ func (p *peer) receiver() {
 	out := p.netOut
 	p.netOut = nil
 	p.busy.Wait()
+	<-p.sent
 	close(out)
 
 	// Report termination result
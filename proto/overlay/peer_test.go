@@ -0,0 +1,152 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLaneMultiplexing(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	p := newTestPeer(o, big.NewInt(314))
+
+	// Saturate the application lane with large payloads
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.send(&proto.Message{Head: proto.Header{Meta: &header{Dest: p.nodeId}}, Data: make([]byte, 1024*1024)})
+			}
+		}
+	}()
+	// Simulate a slow network link, draining a message every few milliseconds
+	drain := func() *proto.Message {
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case msg := <-p.netOut:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatalf("no message sent.")
+		}
+		return nil
+	}
+	for i := 0; i < 5; i++ {
+		if msg := drain(); system(msg) {
+			t.Fatalf("unexpected system message: %v.", msg)
+		}
+	}
+	// Send a heartbeat and ensure it's not queued behind the bulk data
+	start := time.Now()
+	o.sendBeat(p, false)
+	for i := 0; ; i++ {
+		if i > 3 {
+			t.Fatalf("heartbeat delayed by more than %d app messages.", i)
+		}
+		if msg := drain(); system(msg) {
+			break
+		}
+	}
+	if delay := time.Since(start); delay > 100*time.Millisecond {
+		t.Fatalf("heartbeat delayed too much: have %v, want below %v.", delay, 100*time.Millisecond)
+	}
+}
+
+func TestHalfOpenLink(t *testing.T) {
+	// Override the heartbeat parameters for faster tests
+	defer func(beat, kill int) {
+		config.OverlayBeatPeriod, config.OverlayKillCount = beat, kill
+	}(config.OverlayBeatPeriod, config.OverlayKillCount)
+	config.OverlayBeatPeriod, config.OverlayKillCount = 50, 2
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	p := newTestPeer(o, big.NewInt(314))
+
+	// Attach a transport which stalls without ever closing (remote crashed)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	p.abort = local.Close
+
+	p.init = true
+	start := time.Now()
+	go p.receiver()
+
+	// Ensure the stalled link is reported and torn down after the read deadline
+	select {
+	case req := <-o.dropSink:
+		if req.peer != p || req.reason != NetworkError {
+			t.Fatalf("drop request mismatch: have %v/%v, want %v/%v.", req.peer, req.reason, p, NetworkError)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("link dropped before the read deadline: %v.", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("half-open link not dropped.")
+	}
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("stalled transport not aborted.")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("failed to close peer: %v.", err)
+	}
+}
+
+func TestDoubleClose(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	logger := &testLogger{logs: make(map[string][]string)}
+	o := New(appId, key, new(nopCallback), WithLogger(logger))
+	p := newTestPeer(o, big.NewInt(314))
+
+	// Start the peer receiver and close it multiple times
+	p.init = true
+	go p.receiver()
+
+	for i := 0; i < 3; i++ {
+		if err := p.Close(); err != nil {
+			t.Fatalf("close %d: failed to close peer: %v.", i, err)
+		}
+		if !p.closed() {
+			t.Fatalf("close %d: peer not flagged closed.", i)
+		}
+	}
+	// Drop the already closed peer repeatedly and ensure no errors are logged
+	for i := 0; i < 2; i++ {
+		o.drop(map[*peer]DropReason{p: Passive})
+	}
+	if _, ok := o.pool[p.nodeId.String()]; ok {
+		t.Fatalf("dropped peer still pooled.")
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if errs := logger.logs["error"]; len(errs) != 0 {
+		t.Fatalf("errors logged on repeated close: %v.", errs)
+	}
+}
@@ -26,9 +26,12 @@
 package overlay
 
 import (
+	"crypto/sha1"
 	"encoding/gob"
+	"github.com/karalabe/iris/ext/sortext"
 	"github.com/karalabe/iris/proto"
 	"math/big"
+	"sync/atomic"
 )
 
 // Overlay connection operation code type.
@@ -36,24 +39,52 @@ type opcode uint8
 
 // Overlay connection operation types.
 const (
-	opNop   opcode = iota // No-operation, placeholder for refactor
-	opClose               // Signal peer connection termination
+	opNop     opcode = iota // No-operation, placeholder for refactor
+	opClose                 // Signal peer connection termination
+	opMigrate               // Signal the remote node id changed
+	opAck                   // Acknowledge the delivery of a message
+	opEcho                  // Echo a heartbeat stamp for latency measurement
 )
 
+// Wire protocol version of the local node, advertised in the join requests.
+const protoVersion uint16 = 1
+
 // Routing state exchange message (leaves, neighbors and common row).
 type state struct {
 	Addrs   map[string][]string
-	Updated uint64
+	Updated uint64 // Routing table version of the sender, monotonic (only comparable per sender)
 	Repair  bool
 	Passive bool
+	Paused  bool
+	Stamp   int64  // Wall clock of the sender (unix nanos), set in heartbeats
+	Echo    int64  // Stamp of the heartbeat being answered, set in echoes
+	Version uint16 // Wire protocol version of the sender, set in joins
+
+	origin *big.Int // Peer the state was received from (local only, nil if unknown)
+}
+
+// Routing table consistency probe of the row shared by two peers. If the row
+// contents mismatch, the addresses are exchanged to reconcile the two.
+type probe struct {
+	Row   int                 // Routing table row being verified
+	Hash  []byte              // Digest of the row contents (and the sender)
+	Time  uint64              // Routing table version of the sender
+	Addrs map[string][]string // Row contents in case of a mismatch
+	Sync  bool                // Whether the remote row is requested back
 }
 
 // Extra headers for the overlay.
 type header struct {
-	Meta  interface{} // Additional upper layer headers
-	Op    opcode      // The operation to execute
-	Dest  *big.Int    // Destination id
-	State *state      // Routing table state exchange
+	Meta   interface{} // Additional upper layer headers
+	Op     opcode      // The operation to execute
+	Dest   *big.Int    // Destination id
+	State  *state      // Routing table state exchange
+	Probe  *probe      // Routing table consistency probe
+	TTL    int         // Remaining hops of application messages (0 = unset)
+	Seq    uint64      // Sequence number of a delivery to acknowledge (0 = none)
+	Src    *big.Int    // Originator awaiting the delivery acknowledgement
+	Packed []byte      // Compressed routing state, replacing State if set
+	Sealed []byte      // Encrypted message, replacing everything but Op and Dest
 }
 
 // Make sure the header struct is registered with gob.
@@ -64,7 +95,7 @@ func init() {
 // Simple wrapper around the peer send method, to handle errors by dropping.
 func (o *Overlay) send(msg *proto.Message, p *peer) {
 	if err := p.send(msg); err != nil {
-		go func() { o.dropSink <- p }()
+		go func() { o.dropSink <- &dropReq{peer: p, reason: NetworkError} }()
 	}
 }
 
@@ -79,6 +110,9 @@ func (o *Overlay) sendWrap(s *state, dest *big.Int, p *peer) {
 			},
 		},
 	}
+	o.pack(p, msg.Head.Meta.(*header))
+
+	atomic.AddUint64(&o.msgs, 1)
 	o.send(msg, p)
 }
 
@@ -90,10 +124,26 @@ func (o *Overlay) sendJoin(p *peer) {
 
 	// Ensure nodes can contact joining peer
 	o.lock.RLock()
-	s.Addrs[o.nodeId.String()] = o.addrs
+	self := o.nodeId
+	s.Addrs[self.String()] = o.addrs
+	s.Version = o.version
 	o.lock.RUnlock()
 
-	o.sendWrap(s, o.nodeId, p)
+	o.sendWrap(s, self, p)
+}
+
+// Checks whether a state message is acceptable protocol version wise. Only joins
+// carry versions, the rest were already vetted by the handshake.
+func (o *Overlay) compatible(s *state) bool {
+	return s.Updated != 0 || o.supports(s.Version)
+}
+
+// Checks whether a remote protocol version is compatible with the local one, i.e.
+// at most one apart, permitting rolling upgrades (unversioned legacy nodes count
+// as version zero).
+func (o *Overlay) supports(version uint16) bool {
+	diff := int(o.version) - int(version)
+	return diff >= -1 && diff <= 1
 }
 
 // Sends an overlay state message to the remote peer and optionally may request a
@@ -104,12 +154,16 @@ func (o *Overlay) sendState(p *peer, repair bool) {
 	s.Repair = repair
 
 	o.lock.RLock()
+	self := o.nodeId
 	s.Updated = o.time
+	s.Paused = o.pause
 
 	// Serialize the leaf set, common row and neighbor list into the address map.
 	// Make sure all entries are checked for existence to avoid a race condition
-	// with node dropping vs. table updates.
-	s.Addrs[o.nodeId.String()] = o.addrs
+	// with node dropping vs. table updates. Paused nodes don't advertise self.
+	if !o.pause {
+		s.Addrs[o.nodeId.String()] = o.addrs
+	}
 	for _, id := range o.routes.leaves {
 		if id.Cmp(o.nodeId) != 0 {
 			sid := id.String()
@@ -118,18 +172,63 @@ func (o *Overlay) sendState(p *peer, repair bool) {
 			}
 		}
 	}
-	idx, _ := prefix(o.nodeId, p.nodeId)
-	for _, id := range o.routes.routes[idx] {
-		if id != nil {
-			sid := id.String()
-			if node, ok := o.pool[sid]; ok {
-				s.Addrs[sid] = node.addrs
+	if idx, _ := o.space.prefix(o.nodeId, p.nodeId); idx < len(o.routes.routes) {
+		for _, id := range o.routes.routes[idx] {
+			if id != nil {
+				sid := id.String()
+				if node, ok := o.pool[sid]; ok {
+					s.Addrs[sid] = node.addrs
+				}
 			}
 		}
 	}
+	for _, id := range o.routes.neighbors {
+		sid := id.String()
+		if node, ok := o.pool[sid]; ok {
+			s.Addrs[sid] = node.addrs
+		}
+	}
+	o.lock.RUnlock()
+
+	o.sendWrap(s, self, p)
+}
+
+// Sends a migration notice to the remote peer, announcing the new local id and
+// the addresses it is reachable on.
+func (o *Overlay) sendMigrate(p *peer) {
+	s := new(state)
+	s.Addrs = make(map[string][]string)
+
+	o.lock.RLock()
+	s.Addrs[o.nodeId.String()] = o.addrs
 	o.lock.RUnlock()
 
-	o.sendWrap(s, o.nodeId, p)
+	msg := &proto.Message{
+		Head: proto.Header{
+			Meta: &header{
+				Op:    opMigrate,
+				Dest:  p.nodeId,
+				State: s,
+			},
+		},
+	}
+	atomic.AddUint64(&o.msgs, 1)
+	o.send(msg, p)
+}
+
+// Sends a graceful close notice to a directly connected peer, either announcing
+// the local departure or acknowledging the remote one.
+func (o *Overlay) sendClose(p *peer) {
+	msg := &proto.Message{
+		Head: proto.Header{
+			Meta: &header{
+				Op:   opClose,
+				Dest: p.nodeId,
+			},
+		},
+	}
+	atomic.AddUint64(&o.msgs, 1)
+	o.send(msg, p)
 }
 
 // Sends a heartbeat message, tagging whether the connection is an active route
@@ -137,10 +236,82 @@ func (o *Overlay) sendState(p *peer, repair bool) {
 func (o *Overlay) sendBeat(p *peer, passive bool) {
 	s := new(state)
 	s.Passive = passive
+	s.Stamp = o.clock.Now().UnixNano()
 
 	o.lock.RLock()
 	s.Updated = o.time
+	s.Paused = o.pause
 	o.lock.RUnlock()
 
 	o.sendWrap(s, p.nodeId, p)
 }
+
+// Sends back the stamp of a received heartbeat, allowing the remote peer to
+// measure the round trip time of the link.
+func (o *Overlay) sendEcho(p *peer, stamp int64) {
+	msg := &proto.Message{
+		Head: proto.Header{
+			Meta: &header{
+				Op:    opEcho,
+				Dest:  p.nodeId,
+				State: &state{Echo: stamp},
+			},
+		},
+	}
+	atomic.AddUint64(&o.msgs, 1)
+	o.send(msg, p)
+}
+
+// Sends a routing table consistency probe for the row shared with the remote
+// peer. If addrs is requested, the row contents are also included.
+func (o *Overlay) sendProbe(p *peer, row int, contents bool, sync bool) {
+	pr := &probe{Row: row, Sync: sync}
+
+	o.lock.RLock()
+	pr.Time = o.time
+	pr.Hash = o.rowHash(row)
+	if contents {
+		pr.Addrs = make(map[string][]string)
+		pr.Addrs[o.nodeId.String()] = o.addrs
+		for _, id := range o.routes.routes[row] {
+			if id != nil {
+				sid := id.String()
+				if node, ok := o.pool[sid]; ok {
+					pr.Addrs[sid] = node.addrs
+				}
+			}
+		}
+	}
+	o.lock.RUnlock()
+
+	msg := &proto.Message{
+		Head: proto.Header{
+			Meta: &header{
+				Dest:  p.nodeId,
+				Probe: pr,
+			},
+		},
+	}
+	atomic.AddUint64(&o.msgs, 1)
+	o.send(msg, p)
+}
+
+// Calculates the digest of a routing table row, including the local node too,
+// so that two peers sharing the row can compare their views. The caller must
+// hold the read lock.
+func (o *Overlay) rowHash(row int) []byte {
+	ids := []*big.Int{o.nodeId}
+	for _, id := range o.routes.routes[row] {
+		if id != nil {
+			ids = append(ids, id)
+		}
+	}
+	sortext.BigInts(ids)
+
+	h := sha1.New()
+	for _, id := range ids {
+		h.Write([]byte(id.String()))
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
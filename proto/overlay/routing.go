@@ -26,10 +26,14 @@
 package overlay
 
 import (
+	"bytes"
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
-	"log"
 	"math/big"
 	"net"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 // Pastry routing algorithm.
@@ -38,68 +42,156 @@ func (o *Overlay) route(src *peer, msg *proto.Message) {
 	o.lock.RLock()
 	defer o.lock.RUnlock()
 
-	// Extract some vars for easier access
+	// Close notices and echoes concern the link itself, they are never routed
+	if head := msg.Head.Meta.(*header); head.Op == opClose {
+		o.processClose(src)
+		return
+	} else if head.Op == opEcho {
+		// Discard malformed echoes without a state
+		if head.State != nil {
+			o.processEcho(src, head.State.Echo)
+		}
+		return
+	}
+	// Deliver locally if no better node is known, otherwise forward
+	if best := o.hop(msg.Head.Meta.(*header).Dest); o.nodeId.Cmp(best) == 0 {
+		o.deliver(src, msg)
+	} else {
+		o.forward(src, msg, best)
+	}
+}
+
+// Returns the next hop towards a destination (the local node if the message is
+// to be delivered locally), consulting the route cache before walking the table.
+// The read lock must be held by the caller.
+func (o *Overlay) hop(dst *big.Int) *big.Int {
+	if best := o.cache.get(dst); best != nil {
+		return best
+	}
+	best := o.walk(dst)
+	o.cache.put(dst, best)
+	return best
+}
+
+// Walks the routing table to find the next hop towards a destination, or the
+// local node if none is closer. The read lock must be held by the caller.
+func (o *Overlay) walk(dst *big.Int) *big.Int {
 	tab := o.routes
-	dst := msg.Head.Meta.(*header).Dest
 
 	// Check the leaf set for direct delivery
 	// TODO: corner cases with if only handful of nodes
 	// TODO: binary search with idSlice could be used (worthwhile?)
-	if delta(tab.leaves[0], dst).Sign() >= 0 && delta(dst, tab.leaves[len(tab.leaves)-1]).Sign() >= 0 {
+	if o.space.delta(tab.leaves[0], dst).Sign() >= 0 && o.space.delta(dst, tab.leaves[len(tab.leaves)-1]).Sign() >= 0 {
 		best := tab.leaves[0]
-		dist := distance(best, dst)
+		dist := o.space.distance(best, dst)
 		for _, leaf := range tab.leaves[1:] {
-			if d := distance(leaf, dst); d.Cmp(dist) < 0 {
+			if d := o.space.distance(leaf, dst); d.Cmp(dist) < 0 || (d.Cmp(dist) == 0 && tiebreak(o.seed, leaf, best)) {
 				best, dist = leaf, d
 			}
 		}
-		// If self, deliver, otherwise forward
-		if o.nodeId.Cmp(best) == 0 {
-			o.deliver(src, msg)
-		} else {
-			o.forward(src, msg, best)
-		}
-		return
+		return o.spareHop(dst, best, dist)
 	}
 	// Check the routing table for indirect delivery
-	pre, col := prefix(o.nodeId, dst)
-	if best := tab.routes[pre][col]; best != nil {
-		o.forward(src, msg, best)
-		return
+	pre, col := o.space.prefix(o.nodeId, dst)
+	if best := tab.get(pre, col); best != nil {
+		return best
 	}
 	// Route to anybody closer than the local node
-	dist := distance(o.nodeId, dst)
+	dist := o.space.distance(o.nodeId, dst)
 	for _, peer := range tab.leaves {
-		if p, _ := prefix(peer, dst); p >= pre && distance(peer, dst).Cmp(dist) < 0 {
-			o.forward(src, msg, peer)
-			return
+		if p, _ := o.space.prefix(peer, dst); p >= pre && o.space.distance(peer, dst).Cmp(dist) < 0 {
+			return peer
 		}
 	}
 	for _, row := range tab.routes {
 		for _, peer := range row {
 			if peer != nil {
-				if p, _ := prefix(peer, dst); p >= pre && distance(peer, dst).Cmp(dist) < 0 {
-					o.forward(src, msg, peer)
-					return
+				if p, _ := o.space.prefix(peer, dst); p >= pre && o.space.distance(peer, dst).Cmp(dist) < 0 {
+					return peer
 				}
 			}
 		}
 	}
 	// Well, shit. Deliver locally and hope for the best.
-	o.deliver(src, msg)
+	return o.nodeId
+}
+
+// Collects up to k distinct next hop candidates towards a key, ordered by the
+// routing preference: the hop Pastry would pick first, followed by the other
+// known nodes making progress towards the key, closest first. The local node is
+// never included, so an empty result means the key is locally delivered.
+func (o *Overlay) NextHops(key *big.Int, k int) []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	tab := o.routes
+	hops := make([]*big.Int, 0, k)
+	seen := map[string]bool{o.nodeId.String(): true}
+	add := func(id *big.Int) {
+		if sid := id.String(); len(hops) < k && !seen[sid] {
+			seen[sid] = true
+			hops = append(hops, new(big.Int).Set(id))
+		}
+	}
+	// If the key is within the leaf set, the leaves closer than self are the hops
+	known := make([]*big.Int, 0, len(tab.leaves))
+	known = append(known, tab.leaves...)
+	if o.space.delta(tab.leaves[0], key).Sign() >= 0 && o.space.delta(key, tab.leaves[len(tab.leaves)-1]).Sign() >= 0 {
+		known = append(known, o.spares()...)
+		sort.Sort(distSlice{o.space, key, o.seed, known})
+		for _, id := range known {
+			if o.nodeId.Cmp(id) == 0 {
+				break
+			}
+			add(id)
+		}
+		return hops
+	}
+	// Otherwise prefer the routing table entry, followed by any closer node
+	for _, row := range tab.routes {
+		for _, id := range row {
+			if id != nil {
+				known = append(known, id)
+			}
+		}
+	}
+	sort.Sort(distSlice{o.space, key, o.seed, known})
+
+	pre, col := o.space.prefix(o.nodeId, key)
+	if best := tab.get(pre, col); best != nil {
+		add(best)
+	}
+	dist := o.space.distance(o.nodeId, key)
+	for _, id := range known {
+		if p, _ := o.space.prefix(id, key); p >= pre && o.space.distance(id, key).Cmp(dist) < 0 {
+			add(id)
+		}
+	}
+	return hops
 }
 
 // Delivers a message to the application layer or processes it if a system message.
 func (o *Overlay) deliver(src *peer, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
-	if head.State != nil {
+	if head.Op == opMigrate {
+		o.processMigrate(src, head.State)
+	} else if head.Op == opAck {
+		o.acked(head)
+	} else if head.State != nil {
 		o.process(src, head.Dest, head.State)
+	} else if head.Probe != nil {
+		o.processProbe(src, head.Probe)
 	} else {
 		// Remove all overlay infos from the message and send upwards
 		o.lock.RUnlock()
 		msg.Head.Meta = head.Meta
 		o.app.Deliver(msg, head.Dest)
 		o.lock.RLock()
+
+		// Acknowledge the delivery if requested by the originator
+		if head.Seq != 0 && head.Src != nil {
+			go o.sendAck(head.Src, head.Seq)
+		}
 	}
 }
 
@@ -107,15 +199,40 @@ func (o *Overlay) deliver(src *peer, msg *proto.Message) {
 // if it's a system message.
 func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
 	head := msg.Head.Meta.(*header)
-	if head.State != nil {
+	if head.State != nil || head.Probe != nil || head.Op == opAck {
 		// Overlay system message, process and forward
-		o.process(src, head.Dest, head.State)
+		if head.State != nil {
+			o.process(src, head.Dest, head.State)
+
+			// Don't propagate refused joins any further
+			if !o.compatible(head.State) {
+				return
+			}
+		}
 		if p, ok := o.pool[id.String()]; ok {
 			o.send(msg, p)
 		}
 		return
 	}
-	// Upper layer message, pass up and check if forward is needed
+	// Upper layer message, drop if out of hops. Peers predating the hop limit don't
+	// set it, so zero means unset and hops only count down to one on arrival.
+	if head.TTL == 0 {
+		head.TTL = config.OverlayMaxHops
+	}
+	if src != nil {
+		if head.TTL <= 1 {
+			o.lock.RUnlock()
+			msg.Head.Meta = head.Meta
+			if cb, ok := o.app.(ExpireCallback); ok {
+				cb.Expired(msg, head.Dest)
+			}
+			o.lock.RLock()
+			return
+		}
+		head.TTL--
+	}
+
+	// Pass up and check if forward is needed
 	o.lock.RUnlock()
 	msg.Head.Meta = head.Meta
 	allow := o.app.Forward(msg, head.Dest)
@@ -141,18 +258,26 @@ func (o *Overlay) process(src *peer, dst *big.Int, s *state) {
 		if o.nodeId.Cmp(dst) == 0 {
 			return
 		}
+		// Refuse nodes speaking an incompatible protocol, dropping direct links
+		if !o.compatible(s) {
+			o.log.Errorf("overlay: protocol version mismatch with %v: have %d, want %d±1.", dst, s.Version, o.version)
+			if src.nodeId.Cmp(dst) == 0 {
+				go func() { o.dropSink <- &dropReq{peer: src, reason: Incompatible} }()
+			}
+			return
+		}
 		// Node joining into current's responsability list
 		if p, ok := o.pool[dst.String()]; !ok {
 			// Connect new peers and let the handshake do the state exchange
 			peerAddrs := make([]*net.TCPAddr, 0, len(s.Addrs[dst.String()]))
 			for _, a := range s.Addrs[dst.String()] {
 				if addr, err := net.ResolveTCPAddr("tcp", a); err != nil {
-					log.Printf("failed to resolve address %v: %v.", a, err)
+					o.log.Errorf("overlay: failed to resolve address %v: %v.", a, err)
 				} else {
 					peerAddrs = append(peerAddrs, addr)
 				}
 			}
-			o.auther.Schedule(func() { o.dial(peerAddrs) })
+			o.auther.Schedule(func() { o.dialOnce(dst, peerAddrs) })
 		} else {
 			// Handshake should have already sent state, unless local isn't joined either
 			if o.stat != done {
@@ -160,9 +285,20 @@ func (o *Overlay) process(src *peer, dst *big.Int, s *state) {
 			}
 		}
 	} else {
-		// State update, merge into local if new
+		// Echo the heartbeat and check the remote clock if a timestamp was included
+		if s.Stamp != 0 {
+			atomic.StoreInt64(&src.lastBeat, o.clock.Now().UnixNano())
+			go o.sendEcho(src, s.Stamp)
+			o.checkSkew(src, time.Duration(s.Stamp-o.clock.Now().UnixNano()))
+		}
+		// Track the remote participation state
+		pause := src.setPaused(s.Paused)
+
+		// State update, merge into local if new (or force a merge if paused)
 		if s.Updated > src.time {
 			src.time = s.Updated
+			s.origin = src.nodeId
+			o.sizes.Add(float64(len(s.Addrs)))
 
 			// Respond to any repair requests
 			if s.Repair {
@@ -172,11 +308,15 @@ func (o *Overlay) process(src *peer, dst *big.Int, s *state) {
 			o.lock.RUnlock()
 			o.upSink <- s
 			o.lock.RLock()
+		} else if pause {
+			o.lock.RUnlock()
+			o.upSink <- &state{Addrs: make(map[string][]string)}
+			o.lock.RLock()
 		}
 		// Connection filtering: drop after two requests and if local is idle too
-		if src.passive && s.Passive && !o.active(src.nodeId) {
+		if src.passive && s.Passive && !src.paused() && !o.pause && !o.active(src.nodeId) {
 			o.lock.RUnlock()
-			o.dropSink <- src
+			o.dropSink <- &dropReq{peer: src, reason: Passive}
 			o.lock.RLock()
 		} else {
 			// Save passive state for next beat
@@ -184,3 +324,140 @@ func (o *Overlay) process(src *peer, dst *big.Int, s *state) {
 		}
 	}
 }
+
+// Reports a remote peer if its clock differs from the local one beyond the
+// configured threshold. The read lock must be held by the caller.
+func (o *Overlay) checkSkew(src *peer, delta time.Duration) {
+	limit := time.Duration(config.OverlayClockSkew) * time.Millisecond
+	if delta <= limit && delta >= -limit {
+		return
+	}
+	o.log.Infof("overlay: clock skew of %v detected with peer %v.", delta, src.nodeId)
+	if cb, ok := o.app.(SkewCallback); ok {
+		o.lock.RUnlock()
+		cb.ClockSkew(src.nodeId, delta)
+		o.lock.RLock()
+	}
+}
+
+// Processes a graceful close notice: if the local node is leaving and awaits the
+// acknowledgement from the peer, it is signaled. Otherwise the departure of the
+// peer is acknowledged and the connection scheduled for dropping, which in turn
+// instantly revokes it from the routing table. The read lock must be held.
+func (o *Overlay) processClose(src *peer) {
+	if src == nil {
+		return
+	}
+	if !o.parted(src.nodeId) {
+		go func() {
+			o.sendClose(src)
+			select {
+			case o.dropSink <- &dropReq{peer: src, reason: Departed}:
+			case <-o.quit:
+			}
+		}()
+	}
+}
+
+// Signals the acknowledgement of the local departure by a remote peer, returning
+// whether one was awaited at all.
+func (o *Overlay) parted(id *big.Int) bool {
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	done, ok := o.parts[id.String()]
+	if ok {
+		close(done)
+		delete(o.parts, id.String())
+	}
+	return ok
+}
+
+// Processes a heartbeat echo, folding the measured round trip time into the
+// smoothed latency of the link.
+func (o *Overlay) processEcho(src *peer, stamp int64) {
+	if src == nil || stamp == 0 {
+		return
+	}
+	rtt := o.clock.Now().UnixNano() - stamp
+	if rtt < 0 {
+		return
+	}
+	src.rtts.Add(time.Duration(rtt).Seconds())
+	if old := atomic.LoadInt64(&src.latency); old != 0 {
+		rtt = (7*old + rtt) / 8
+	}
+	atomic.StoreInt64(&src.latency, rtt)
+}
+
+// Processes a routing table consistency probe: if the digests of the shared row
+// mismatch, the local row contents are sent over, whilst received contents are
+// merged into the local state irrespective of their version.
+func (o *Overlay) processProbe(src *peer, pr *probe) {
+	// Discard probes from unknown connections or for invalid rows
+	if src == nil || pr.Row < 0 || pr.Row >= len(o.routes.routes) {
+		return
+	}
+	// Merge the received row contents, and send back the local if requested
+	if pr.Addrs != nil {
+		if pr.Sync {
+			go o.sendProbe(src, pr.Row, true, false)
+		}
+		o.lock.RUnlock()
+		o.upSink <- &state{Addrs: pr.Addrs, Updated: pr.Time, origin: src.nodeId}
+		o.lock.RLock()
+		return
+	}
+	// Otherwise compare the digests and initiate a reconciliation on mismatch
+	if !bytes.Equal(pr.Hash, o.rowHash(pr.Row)) {
+		go o.sendProbe(src, pr.Row, true, true)
+	}
+}
+
+// Processes a migration notice from a connected peer: the connection is rekeyed
+// to the new id, and the new id merged into the routing state. The old id will
+// be revoked by the manager, since no connection is associated with it any more.
+func (o *Overlay) processMigrate(src *peer, s *state) {
+	// Discard notices from unknown connections or with invalid contents
+	if src == nil || s == nil || len(s.Addrs) != 1 {
+		return
+	}
+	var id *big.Int
+	var addrs []string
+	for sid, a := range s.Addrs {
+		if i, ok := new(big.Int).SetString(sid, 10); ok {
+			id, addrs = i, a
+		}
+	}
+	if id == nil || !o.space.contains(id) || id.Cmp(o.nodeId) == 0 {
+		o.log.Errorf("overlay: invalid migration notice: %v.", s.Addrs)
+		return
+	}
+	// Rekey the connection (upgrading the lock meanwhile), unless the new id is
+	// already claimed by another connection
+	o.lock.RUnlock()
+	o.lock.Lock()
+	if p, ok := o.pool[id.String()]; ok && p != src {
+		o.lock.Unlock()
+		o.log.Errorf("overlay: migration onto connected peer id: %v.", id)
+		o.lock.RLock()
+		return
+	}
+	if p, ok := o.pool[src.nodeId.String()]; ok && p == src {
+		delete(o.pool, src.nodeId.String())
+		for _, addr := range src.addrs {
+			delete(o.trans, addr)
+		}
+		src.nodeId, src.addrs = id, addrs
+		o.pool[id.String()] = src
+		for _, addr := range src.addrs {
+			o.trans[addr] = id
+		}
+		o.recordClass(id.String(), src.addrs)
+	}
+	o.lock.Unlock()
+
+	// Merge the new id into the routing state
+	o.upSink <- s
+	o.lock.RLock()
+}
@@ -27,6 +27,8 @@ import (
 	"github.com/karalabe/iris/proto"
 	"io"
 	"math/big"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -290,3 +292,565 @@ func benchmarkThroughput(b *testing.B, block int) {
 	go sender()
 	<-wait.quit
 }
+
+func TestProbeConsistency(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create two overlays sharing the second routing row, and a remote third
+	alice := New(appId, key, new(nopCallback))
+	alice.nodeId = big.NewInt(0x1000000000)
+	alice.routes = newTable(alice.nodeId)
+
+	bob := New(appId, key, new(nopCallback))
+	bob.nodeId = big.NewInt(0x1100000000)
+	bob.routes = newTable(bob.nodeId)
+
+	carol := big.NewInt(0x1200000000)
+
+	// Link them up with fake connections and diverge their routing tables
+	a2b := newTestPeer(alice, bob.nodeId)
+	b2a := newTestPeer(bob, alice.nodeId)
+	newTestPeer(bob, carol).addrs = []string{"127.0.0.1:65535"}
+
+	alice.routes.routes[1][1] = bob.nodeId
+	bob.routes.routes[1][0] = alice.nodeId
+	bob.routes.routes[1][2] = carol
+
+	// Relays a message from a link to the remote overlay
+	relay := func(link *peer, dest *Overlay, src *peer) {
+		select {
+		case msg := <-link.netOut:
+			go func() {
+				dest.route(src, msg)
+			}()
+		case <-time.After(time.Second):
+			t.Fatalf("probe message not sent.")
+		}
+	}
+	// Waits for a state update and merges it into the routing table
+	update := func(o *Overlay) {
+		select {
+		case s := <-o.upSink:
+			o.merge(o.routes, make(map[string][]string), s)
+		case <-time.After(time.Second):
+			t.Fatalf("state update not received.")
+		}
+	}
+	// Execute the probe and the reconciliation
+	if err := alice.ProbeConsistency(bob.nodeId); err != nil {
+		t.Fatalf("failed to probe bob: %v.", err)
+	}
+	relay(a2b, bob, b2a)
+	relay(b2a, alice, a2b)
+	update(alice)
+	relay(a2b, bob, b2a)
+	update(bob)
+
+	if id := alice.routes.routes[1][2]; id == nil || id.Cmp(carol) != 0 {
+		t.Errorf("routing entry mismatch: have %v, want %v.", id, carol)
+	}
+	if a, b := alice.rowHash(1), bob.rowHash(1); !bytes.Equal(a, b) {
+		t.Errorf("row digest mismatch after reconciliation: %x != %x.", a, b)
+	}
+	// Probing non-connected nodes should fail
+	if err := alice.ProbeConsistency(carol); err == nil {
+		t.Errorf("probed a non-connected node.")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes and wait for them to converge
+	aliceApp := &collector{[]*proto.Message{}}
+	alice := New(appId, key, aliceApp)
+	if err := alice.Migrate(big.NewInt(1)); err == nil {
+		t.Errorf("migrated before booting.")
+	}
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bobApp := &collector{[]*proto.Message{}}
+	bob := New(appId, key, bobApp)
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	// Invalid migrations should be rejected
+	if err := alice.Migrate(alice.space.modulo); err == nil {
+		t.Errorf("migrated outside the id space.")
+	}
+	if err := alice.Migrate(bob.nodeId); err == nil {
+		t.Errorf("migrated onto a connected peer.")
+	}
+	// Migrate alice right next to bob, and wait for bob to pick it up
+	id := new(big.Int).Add(bob.nodeId, big.NewInt(1))
+	id.Mod(id, alice.space.modulo)
+
+	alice.lock.RLock()
+	migrated := alice.migCh
+	alice.lock.RUnlock()
+
+	if err := alice.Migrate(id); err != nil {
+		t.Fatalf("failed to migrate alice: %v.", err)
+	}
+	if self := alice.Self(); self.Cmp(id) != 0 {
+		t.Fatalf("self id mismatch: have %v, want %v.", self, id)
+	}
+	select {
+	case <-migrated:
+	default:
+		t.Fatalf("bootstrappers not signalled of the migration.")
+	}
+	for i := 0; ; i++ {
+		bob.lock.RLock()
+		_, ok := bob.pool[id.String()]
+		known := ok && bob.active(id)
+		bob.lock.RUnlock()
+		if known {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("bob failed to pick up the migration.")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Send a message to the new id and ensure alice receives it
+	msg := &proto.Message{Head: proto.Header{Meta: []byte{0x00}}, Data: []byte{0x01}}
+	bob.Send(id, msg)
+	time.Sleep(time.Second)
+
+	if n := len(aliceApp.delivs); n != 1 {
+		t.Errorf("alice delivery count mismatch: have %v, want %v.", n, 1)
+	}
+	if n := len(bobApp.delivs); n != 0 {
+		t.Errorf("bob delivery count mismatch: have %v, want %v.", n, 0)
+	}
+}
+
+func TestMigrateNotice(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	// Connect two fake peers, one of which attempts to take over the other's id
+	mallory := &peer{nodeId: big.NewInt(1)}
+	victim := &peer{nodeId: big.NewInt(2)}
+	o.pool[mallory.nodeId.String()] = mallory
+	o.pool[victim.nodeId.String()] = victim
+
+	for _, id := range []*big.Int{victim.nodeId, o.space.modulo, big.NewInt(-1)} {
+		o.lock.RLock()
+		o.processMigrate(mallory, &state{Addrs: map[string][]string{id.String(): nil}})
+		o.lock.RUnlock()
+
+		if p := o.pool[victim.nodeId.String()]; p != victim {
+			t.Errorf("id %v: victim connection replaced.", id)
+		}
+		if p := o.pool[mallory.nodeId.String()]; p != mallory || mallory.nodeId.Int64() != 1 {
+			t.Errorf("id %v: invalid migration accepted.", id)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes and wait for them to converge
+	aliceApp := &collector{[]*proto.Message{}}
+	alice := New(appId, key, aliceApp)
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bobApp := &collector{[]*proto.Message{}}
+	bob := New(appId, key, bobApp)
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	// Waits until bob's routing view of alice reaches the expected state
+	waitActive := func(active bool) {
+		for i := 0; ; i++ {
+			bob.lock.RLock()
+			ok := bob.active(alice.nodeId)
+			bob.lock.RUnlock()
+			if ok == active {
+				return
+			}
+			if i > 100 {
+				t.Fatalf("alice activity mismatch: have %v, want %v.", ok, active)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	waitActive(true)
+
+	// Pause alice and ensure bob stops routing through it, but stays connected
+	alice.Pause()
+	waitActive(false)
+
+	bob.Send(alice.nodeId, &proto.Message{Head: proto.Header{Meta: []byte{0x00}}, Data: []byte{0x01}})
+	time.Sleep(time.Second)
+	if n := len(aliceApp.delivs); n != 0 {
+		t.Errorf("paused delivery count mismatch: have %v, want %v.", n, 0)
+	}
+	if n := len(bobApp.delivs); n != 1 {
+		t.Errorf("paused fallback delivery count mismatch: have %v, want %v.", n, 1)
+	}
+	bob.lock.RLock()
+	if _, ok := bob.pool[alice.nodeId.String()]; !ok {
+		t.Errorf("connection to paused alice dropped.")
+	}
+	bob.lock.RUnlock()
+
+	// Resume alice and ensure routing is restored
+	alice.Resume()
+	waitActive(true)
+
+	bob.Send(alice.nodeId, &proto.Message{Head: proto.Header{Meta: []byte{0x00}}, Data: []byte{0x01}})
+	time.Sleep(time.Second)
+	if n := len(aliceApp.delivs); n != 1 {
+		t.Errorf("resumed delivery count mismatch: have %v, want %v.", n, 1)
+	}
+}
+
+func TestTieBreak(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Two candidates symmetric around a key
+	dest := big.NewInt(0x1000000000)
+	left := new(big.Int).Sub(dest, big.NewInt(5))
+	right := new(big.Int).Add(dest, big.NewInt(5))
+
+	// Find two seeds preferring different candidates
+	seeds := make(map[bool][]byte)
+	for i := 0; len(seeds) < 2; i++ {
+		seed := []byte{byte(i)}
+		seeds[tiebreak(seed, left, right)] = seed
+	}
+	for _, seed := range seeds {
+		want := right
+		if tiebreak(seed, left, right) {
+			want = left
+		}
+		// Route through two nodes on opposite sides, ensuring both agree
+		for _, self := range []*big.Int{new(big.Int).Sub(dest, big.NewInt(100)), new(big.Int).Add(dest, big.NewInt(100))} {
+			o := New(appId, key, new(nopCallback))
+			o.nodeId = self
+			o.routes = newTable(self)
+			o.routes.leaves = o.mergeLeaves(o.routes.leaves, []*big.Int{left, right})
+			o.SetTieBreakSeed(seed)
+
+			links := map[*big.Int]*peer{left: newTestPeer(o, left), right: newTestPeer(o, right)}
+			for i := 0; i < 10; i++ {
+				o.Send(dest, &proto.Message{})
+				select {
+				case <-links[want].netOut:
+				case <-time.After(time.Second):
+					t.Fatalf("message not routed to preferred candidate %v.", want)
+				}
+			}
+		}
+		// Merge two candidates into the same empty slot, ensuring a stable choice
+		first, second := dest, right
+		want = second
+		if tiebreak(seed, first, second) {
+			want = first
+		}
+		for i := 0; i < 10; i++ {
+			o := New(appId, key, new(nopCallback))
+			o.nodeId = big.NewInt(0)
+			o.routes = newTable(o.nodeId)
+			o.SetTieBreakSeed(seed)
+
+			s := &state{Addrs: map[string][]string{first.String(): nil, second.String(): nil}}
+			o.merge(o.routes, make(map[string][]string), s)
+
+			row, col := o.space.prefix(o.nodeId, first)
+			if have := o.routes.routes[row][col]; have.Cmp(want) != 0 {
+				t.Fatalf("merge conflict resolution mismatch: have %v, want %v.", have, want)
+			}
+		}
+	}
+}
+
+func TestNextHops(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+
+	// Populate the routing table with a spread of ids
+	for _, id := range EvenlySpacedIds(64, o.space.modulo) {
+		if row, col := o.space.prefix(o.nodeId, id); o.routes.contains(row, col) && o.routes.routes[row][col] == nil && id.Cmp(o.nodeId) != 0 {
+			o.routes.routes[row][col] = id
+		}
+	}
+	o.routes.leaves = o.mergeLeaves(o.routes.leaves, []*big.Int{
+		big.NewInt(0x0ffffffff0), big.NewInt(0x0ffffffff8), big.NewInt(0x1000000008), big.NewInt(0x1000000010),
+	})
+	dest := big.NewInt(0x9876543210)
+	hops := o.NextHops(dest, 4)
+	if len(hops) != 4 {
+		t.Fatalf("hop count mismatch: have %v, want %v.", len(hops), 4)
+	}
+	// The first hop must be the routing table choice, the rest ordered and distinct
+	row, col := o.space.prefix(o.nodeId, dest)
+	if hops[0].Cmp(o.routes.routes[row][col]) != 0 {
+		t.Errorf("primary hop mismatch: have %v, want %v.", hops[0], o.routes.routes[row][col])
+	}
+	seen := make(map[string]bool)
+	for i, hop := range hops {
+		if seen[hop.String()] {
+			t.Errorf("duplicate hop #%d: %v.", i, hop)
+		}
+		seen[hop.String()] = true
+		if o.space.distance(hop, dest).Cmp(o.space.distance(o.nodeId, dest)) >= 0 {
+			t.Errorf("hop #%d doesn't make progress: %v.", i, hop)
+		}
+		if i > 1 && o.space.distance(hops[i-1], dest).Cmp(o.space.distance(hop, dest)) > 0 {
+			t.Errorf("hop #%d out of order: %v after %v.", i, hop, hops[i-1])
+		}
+	}
+	// Keys inside the leaf set should only return the closer leaves
+	hops = o.NextHops(big.NewInt(0x1000000009), 4)
+	if len(hops) != 2 || hops[0].Cmp(big.NewInt(0x1000000008)) != 0 || hops[1].Cmp(big.NewInt(0x1000000010)) != 0 {
+		t.Errorf("leaf hops mismatch: have %v, want %v.", hops, []*big.Int{big.NewInt(0x1000000008), big.NewInt(0x1000000010)})
+	}
+}
+
+// Overlay callback recording the expired messages
+type expireCollector struct {
+	nopCallback
+	expired []*big.Int
+}
+
+func (c *expireCollector) Expired(msg *proto.Message, key *big.Int) {
+	c.expired = append(c.expired, key)
+}
+
+func TestMessageTTL(t *testing.T) {
+	// Limit the hop count for the test
+	hops := config.OverlayMaxHops
+	defer func() { config.OverlayMaxHops = hops }()
+	config.OverlayMaxHops = 5
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create two overlays with inconsistent tables, each routing to the other
+	aliceApp, bobApp := new(expireCollector), new(expireCollector)
+
+	alice := New(appId, key, aliceApp)
+	alice.nodeId = big.NewInt(0x1000000000)
+	alice.routes = newTable(alice.nodeId)
+
+	bob := New(appId, key, bobApp)
+	bob.nodeId = big.NewInt(0x2000000000)
+	bob.routes = newTable(bob.nodeId)
+
+	a2b := newTestPeer(alice, bob.nodeId)
+	b2a := newTestPeer(bob, alice.nodeId)
+
+	dest := big.NewInt(0x3000000000)
+	alice.routes.routes[0][3] = bob.nodeId
+	bob.routes.routes[0][3] = alice.nodeId
+
+	// Bounces messages between the two until dropped, counting the forwards
+	links := []*peer{a2b, b2a}
+	nodes := []*Overlay{bob, alice}
+	bounce := func() int {
+		forwards := 0
+		for i := 0; ; i++ {
+			select {
+			case msg := <-links[i%2].netOut:
+				forwards++
+				nodes[i%2].route(links[(i+1)%2], msg)
+				continue
+			case <-time.After(100 * time.Millisecond):
+			}
+			return forwards
+		}
+	}
+	// Send a message and ensure it's dropped after the maximum hops
+	alice.Send(dest, &proto.Message{})
+	if forwards := bounce(); forwards != config.OverlayMaxHops {
+		t.Fatalf("forward count mismatch: have %v, want %v.", forwards, config.OverlayMaxHops)
+	}
+	if n := len(aliceApp.expired) + len(bobApp.expired); n != 1 {
+		t.Fatalf("expired message count mismatch: have %v, want %v.", n, 1)
+	}
+	// Ensure messages from peers not setting a hop limit are forwarded too
+	alice.route(a2b, &proto.Message{Head: proto.Header{Meta: &header{Dest: dest}}})
+	if forwards := 1 + bounce(); forwards != config.OverlayMaxHops {
+		t.Fatalf("unset hop limit forward count mismatch: have %v, want %v.", forwards, config.OverlayMaxHops)
+	}
+	if n := len(aliceApp.expired) + len(bobApp.expired); n != 2 {
+		t.Fatalf("expired message count mismatch: have %v, want %v.", n, 2)
+	}
+}
+
+// Overlay callback recording the clock skew reports
+type skewCollector struct {
+	nopCallback
+	ids    []*big.Int
+	deltas []time.Duration
+}
+
+func (c *skewCollector) ClockSkew(id *big.Int, delta time.Duration) {
+	c.ids = append(c.ids, id)
+	c.deltas = append(c.deltas, delta)
+}
+
+func TestClockSkew(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	app := new(skewCollector)
+	clock := newFakeClock()
+	o := New(appId, key, app, WithClock(clock))
+	p := newTestPeer(o, big.NewInt(314))
+	p.time = 1
+
+	// Move away from the epoch, a zero stamp means no timestamp
+	clock.advance(time.Hour)
+
+	// Feed heartbeats with a correct, a far future and a far past timestamp
+	skew := 2 * time.Duration(config.OverlayClockSkew) * time.Millisecond
+	for _, offset := range []time.Duration{0, skew, -skew} {
+		s := &state{Updated: 1, Stamp: clock.Now().Add(offset).UnixNano()}
+
+		o.lock.RLock()
+		o.process(p, o.nodeId, s)
+		o.lock.RUnlock()
+	}
+	// Verify that only the skewed beats were reported, with the correct signs
+	if len(app.ids) != 2 {
+		t.Fatalf("skew report count mismatch: have %v, want %v.", len(app.ids), 2)
+	}
+	if app.ids[0].Cmp(p.nodeId) != 0 || app.deltas[0] != skew {
+		t.Errorf("future skew mismatch: have %v/%v, want %v/%v.", app.ids[0], app.deltas[0], p.nodeId, skew)
+	}
+	if app.ids[1].Cmp(p.nodeId) != 0 || app.deltas[1] != -skew {
+		t.Errorf("past skew mismatch: have %v/%v, want %v/%v.", app.ids[1], app.deltas[1], p.nodeId, -skew)
+	}
+}
+
+// Overlay callback collecting deliveries, optionally refusing to forward.
+type filterCollector struct {
+	collector
+	block bool
+	lock  sync.Mutex
+}
+
+func (c *filterCollector) Deliver(msg *proto.Message, key *big.Int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.collector.Deliver(msg, key)
+}
+
+func (c *filterCollector) Forward(msg *proto.Message, key *big.Int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return !c.block
+}
+
+func TestAckedDelivery(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes and wait for them to converge
+	aliceApp := &filterCollector{collector: collector{[]*proto.Message{}}}
+	alice := New(appId, key, aliceApp)
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bobApp := &filterCollector{collector: collector{[]*proto.Message{}}}
+	bob := New(appId, key, bobApp)
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	// Send an acknowledged message and verify its delivery
+	msg := &proto.Message{Head: proto.Header{Meta: []byte{0x00}}, Data: []byte{0x01}}
+	if err := bob.SendAcked(alice.nodeId, msg, 3*time.Second); err != nil {
+		t.Fatalf("failed to deliver acknowledged message: %v.", err)
+	}
+	aliceApp.lock.Lock()
+	if n := len(aliceApp.delivs); n != 1 {
+		t.Errorf("delivery count mismatch: have %v, want %v.", n, 1)
+	}
+	aliceApp.lock.Unlock()
+
+	// Drop the message on the way and verify the timeout
+	bobApp.lock.Lock()
+	bobApp.block = true
+	bobApp.lock.Unlock()
+
+	msg = &proto.Message{Head: proto.Header{Meta: []byte{0x00}}, Data: []byte{0x02}}
+	if err := bob.SendAcked(alice.nodeId, msg, time.Second); err == nil {
+		t.Fatalf("dropped message acknowledged.")
+	}
+	bob.ackLock.Lock()
+	if n := len(bob.acks); n != 0 {
+		t.Errorf("pending acknowledgements not cleaned up: %v.", n)
+	}
+	bob.ackLock.Unlock()
+}
+
+func TestProtocolVersion(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	app := new(dropCollector)
+	logger := &testLogger{logs: make(map[string][]string)}
+	o := New(appId, key, app, WithLogger(logger))
+
+	// Feed joins of various versions from directly connected peers
+	join := func(p *peer, version uint16) {
+		o.lock.RLock()
+		defer o.lock.RUnlock()
+		o.process(p, p.nodeId, &state{Addrs: map[string][]string{p.nodeId.String(): nil}, Version: version})
+	}
+	// Ensure adjacent (and unversioned) protocol versions are accepted
+	for i, version := range []uint16{o.version, o.version + 1, o.version - 1} {
+		join(newTestPeer(o, big.NewInt(int64(100+i))), version)
+	}
+	select {
+	case req := <-o.dropSink:
+		t.Fatalf("compatible peer dropped: %v.", req.peer.nodeId)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Ensure a peer two versions ahead is refused and dropped
+	newer := newTestPeer(o, big.NewInt(200))
+	join(newer, o.version+2)
+
+	select {
+	case req := <-o.dropSink:
+		if req.peer != newer || req.reason != Incompatible {
+			t.Fatalf("drop request mismatch: have %v/%v, want %v/%v.", req.peer.nodeId, req.reason, newer.nodeId, Incompatible)
+		}
+		o.drop(map[*peer]DropReason{req.peer: req.reason})
+	case <-time.After(time.Second):
+		t.Fatalf("incompatible peer not dropped.")
+	}
+	if len(app.reasons) != 1 || app.reasons[0] != Incompatible || app.reasons[0].String() != "incompatible" {
+		t.Fatalf("reported drop mismatch: have %v, want %v.", app.reasons, []DropReason{Incompatible})
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if errs := logger.logs["error"]; len(errs) != 1 || !strings.Contains(errs[0], "protocol version mismatch") {
+		t.Fatalf("error logs mismatch: have %v, want protocol version mismatch.", errs)
+	}
+}
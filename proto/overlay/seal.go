@@ -0,0 +1,182 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the message level encryption of overlay links. If both ends of a link
+// support it (negotiated during the handshake), a per-link key is agreed on via
+// Diffie-Hellman over the STS group, and every subsequent message is sealed as a
+// whole, leaving only the operation and destination in the clear.
+
+package overlay
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/crypto/hkdf"
+	"github.com/karalabe/iris/proto"
+	"hash"
+	"io"
+	"math/big"
+)
+
+// Info value for the HKDF expansion of the link keys.
+var linkKeyInfo = []byte("iris.proto.overlay.link.key")
+
+// Authenticated symmetric cipher sealing the messages of a single link. Open
+// must reject any tampered data.
+type LinkCipher interface {
+	Seal(frame []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
+
+// Creates a link cipher from the agreed upon symmetric key.
+type LinkCipherMaker func(key []byte) (LinkCipher, error)
+
+// Default link cipher: the session block cipher in Galois counter mode, with a
+// random nonce prepended to each sealed frame.
+type gcmCipher struct {
+	aead cipher.AEAD
+}
+
+// Creates a GCM link cipher based on the configured session block cipher.
+func newGcmCipher(key []byte) (LinkCipher, error) {
+	block, err := config.SessionCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmCipher{aead}, nil
+}
+
+// Encrypts and authenticates a frame.
+func (c *gcmCipher) Seal(frame []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(frame)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, frame, nil), nil
+}
+
+// Verifies and decrypts a sealed frame.
+func (c *gcmCipher) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("sealed frame too short")
+	}
+	nonce := sealed[:c.aead.NonceSize()]
+	return c.aead.Open(nil, nonce, sealed[len(nonce):], nil)
+}
+
+// Sets the constructor of the link ciphers used for message encryption. All the
+// nodes in an overlay network must use the same cipher.
+func (o *Overlay) SetLinkCipher(maker LinkCipherMaker) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.ciph = maker
+}
+
+// Generates a private exponent and the public key share for a link handshake.
+func newKeyShare() (*big.Int, *big.Int, error) {
+	exp, err := rand.Int(rand.Reader, config.StsGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	return exp, new(big.Int).Exp(config.StsGenerator, exp, config.StsGroup), nil
+}
+
+// Derives the symmetric link key from the local private exponent and the remote
+// public key share.
+func deriveLinkKey(exp, share *big.Int) ([]byte, error) {
+	// Reject degenerate shares forcing a known secret
+	bound := new(big.Int).Sub(config.StsGroup, big.NewInt(1))
+	if share.Cmp(big.NewInt(1)) <= 0 || share.Cmp(bound) >= 0 {
+		return nil, fmt.Errorf("invalid key share")
+	}
+	secret := new(big.Int).Exp(share, exp, config.StsGroup)
+
+	hasher := func() hash.Hash { return config.HkdfHash.New() }
+	kdf := hkdf.New(hasher, secret.Bytes(), config.HkdfSalt, linkKeyInfo)
+
+	key := make([]byte, config.SessionCipherBits/8)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Seals an outbound message into a new one, carrying only the operation and the
+// destination in the clear.
+func (p *peer) seal(msg *proto.Message) (*proto.Message, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	sealed, err := p.cipher.Seal(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	head := &header{Sealed: sealed}
+	if inner, ok := msg.Head.Meta.(*header); ok {
+		head.Op, head.Dest = inner.Op, inner.Dest
+	}
+	return &proto.Message{Head: proto.Header{Meta: head}}, nil
+}
+
+// Opens a sealed inbound message in place. Unsealed messages on an encrypted
+// link are rejected.
+func (p *peer) open(msg *proto.Message) error {
+	head, ok := msg.Head.Meta.(*header)
+	if !ok || head.Sealed == nil {
+		return fmt.Errorf("unsealed message on encrypted link")
+	}
+	frame, err := p.cipher.Open(head.Sealed)
+	if err != nil {
+		return err
+	}
+	inner := new(proto.Message)
+	if err := gob.NewDecoder(bytes.NewReader(frame)).Decode(inner); err != nil {
+		return err
+	}
+	*msg = *inner
+	return nil
+}
+
+// Derives the link key from the exchanged key shares and sets up the message
+// encryption of the peer connection.
+func (o *Overlay) secure(p *peer, exp, share *big.Int) error {
+	if share == nil {
+		return fmt.Errorf("missing key share")
+	}
+	key, err := deriveLinkKey(exp, share)
+	if err != nil {
+		return err
+	}
+	o.lock.RLock()
+	maker := o.ciph
+	o.lock.RUnlock()
+
+	p.cipher, err = maker(key)
+	return err
+}
@@ -0,0 +1,166 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"bytes"
+	"crypto/x509"
+	"github.com/karalabe/iris/proto"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLinkKeyAgreement(t *testing.T) {
+	aExp, aShare, err := newKeyShare()
+	if err != nil {
+		t.Fatalf("failed to generate first key share: %v.", err)
+	}
+	bExp, bShare, err := newKeyShare()
+	if err != nil {
+		t.Fatalf("failed to generate second key share: %v.", err)
+	}
+	aKey, err := deriveLinkKey(aExp, bShare)
+	if err != nil {
+		t.Fatalf("failed to derive first link key: %v.", err)
+	}
+	bKey, err := deriveLinkKey(bExp, aShare)
+	if err != nil {
+		t.Fatalf("failed to derive second link key: %v.", err)
+	}
+	if !bytes.Equal(aKey, bKey) {
+		t.Fatalf("link key mismatch: %x != %x.", aKey, bKey)
+	}
+	// Degenerate shares should be rejected
+	for _, share := range []*big.Int{big.NewInt(0), big.NewInt(1)} {
+		if _, err := deriveLinkKey(aExp, share); err == nil {
+			t.Errorf("degenerate share %v accepted.", share)
+		}
+	}
+}
+
+func TestSealedRoundTrip(t *testing.T) {
+	key := make([]byte, 16)
+	ciph, err := newGcmCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create link cipher: %v.", err)
+	}
+	p := &peer{cipher: ciph}
+
+	// Seal a message and make sure only the routing fields remain visible
+	msg := &proto.Message{
+		Head: proto.Header{Meta: &header{Op: opAck, Dest: big.NewInt(314), Seq: 15}},
+		Data: []byte("secret payload"),
+	}
+	sealed, err := p.seal(msg)
+	if err != nil {
+		t.Fatalf("failed to seal message: %v.", err)
+	}
+	head := sealed.Head.Meta.(*header)
+	if head.Op != opAck || head.Dest.Cmp(big.NewInt(314)) != 0 || head.Seq != 0 || sealed.Data != nil {
+		t.Fatalf("sealed message leaks contents: %v / %v.", head, sealed.Data)
+	}
+	if bytes.Contains(head.Sealed, msg.Data) {
+		t.Fatalf("payload in the clear within sealed frame.")
+	}
+	// Tamper with a copy of the frame and ensure it's rejected
+	tampered := &proto.Message{Head: proto.Header{Meta: &header{Sealed: append([]byte{}, head.Sealed...)}}}
+	tampered.Head.Meta.(*header).Sealed[len(head.Sealed)/2] ^= 0x01
+	if err := p.open(tampered); err == nil {
+		t.Fatalf("tampered message opened: %v.", tampered)
+	}
+	// Unsealed messages should be rejected too
+	if err := p.open(msg); err == nil {
+		t.Fatalf("unsealed message accepted.")
+	}
+	// Open the original and verify the contents
+	if err := p.open(sealed); err != nil {
+		t.Fatalf("failed to open sealed message: %v.", err)
+	}
+	head = sealed.Head.Meta.(*header)
+	if head.Op != opAck || head.Dest.Cmp(big.NewInt(314)) != 0 || head.Seq != 15 {
+		t.Fatalf("opened header mismatch: have %v, want %v.", head, msg.Head.Meta)
+	}
+	if !bytes.Equal(sealed.Data, msg.Data) {
+		t.Fatalf("opened payload mismatch: have %s, want %s.", sealed.Data, msg.Data)
+	}
+}
+
+func TestSealedByteCounters(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	p := newTestPeer(o, big.NewInt(314))
+	defer close(p.term)
+
+	ciph, err := newGcmCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatalf("failed to create link cipher: %v.", err)
+	}
+	p.cipher = ciph
+
+	// Send a sealed message and ensure the plain payload is accounted
+	msg := &proto.Message{Head: proto.Header{Meta: &header{Dest: p.nodeId}}, Data: []byte("secret payload")}
+	if err := p.send(msg); err != nil {
+		t.Fatalf("failed to send message: %v.", err)
+	}
+	if sent := atomic.LoadUint64(&p.sentBytes); sent != uint64(len(msg.Data)) {
+		t.Fatalf("sent byte count mismatch: have %v, want %v.", sent, len(msg.Data))
+	}
+}
+
+func TestLinkEncryption(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two overlay nodes, both supporting encryption
+	alice := New(appId, key, new(nopCallback))
+	alice.feats |= featEncrypt
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	bob := New(appId, key, new(nopCallback))
+	bob.feats |= featEncrypt
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	// Verify that the link got encrypted on both ends
+	alice.lock.RLock()
+	defer alice.lock.RUnlock()
+	bob.lock.RLock()
+	defer bob.lock.RUnlock()
+
+	if p, ok := alice.pool[bob.nodeId.String()]; !ok {
+		t.Errorf("bob (%v) missing from the pool of alice: %v.", bob.nodeId, alice.pool)
+	} else if p.cipher == nil {
+		t.Errorf("alice link not encrypted.")
+	}
+	if p, ok := bob.pool[alice.nodeId.String()]; !ok {
+		t.Errorf("alice (%v) missing from the pool of bob: %v.", alice.nodeId, bob.pool)
+	} else if p.cipher == nil {
+		t.Errorf("bob link not encrypted.")
+	}
+}
@@ -0,0 +1,123 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the DNS seeding of the bootstrap process. Seed hostnames are resolved
+// into candidate addresses which are dialed the same way as discovered peers.
+// Resolution is repeated periodically while the overlay is not converged, so
+// newly added seed addresses are picked up too.
+
+package overlay
+
+import (
+	"fmt"
+	"github.com/karalabe/iris/config"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DNS lookup functions, replaceable for testing.
+var (
+	lookupHost = net.LookupHost
+	lookupSRV  = net.LookupSRV
+)
+
+// Sets the DNS seeds to bootstrap from. Seeds in host:port form are resolved
+// through their A/AAAA records, whereas bare names are looked up as SRV records
+// (e.g. _iris._tcp.example.com). Must be called before booting.
+func (o *Overlay) SetSeeds(seeds []string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.seeds = append([]string(nil), seeds...)
+}
+
+// Resolves a single DNS seed into its candidate TCP addresses.
+func resolveSeed(seed string) ([]*net.TCPAddr, error) {
+	// Collect the host/port pairs to resolve, via SRV if no port was given
+	type target struct {
+		host string
+		port int
+	}
+	targets := []target{}
+	if host, port, err := net.SplitHostPort(seed); err == nil {
+		num, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed port: %v", port)
+		}
+		targets = append(targets, target{host, num})
+	} else {
+		_, srvs, err := lookupSRV("", "", seed)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			targets = append(targets, target{srv.Target, int(srv.Port)})
+		}
+	}
+	// Resolve all the hosts into addresses
+	addrs := []*net.TCPAddr{}
+	for _, t := range targets {
+		ips, err := lookupHost(t.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				addrs = append(addrs, &net.TCPAddr{IP: parsed, Port: t.port})
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// Resolves the configured DNS seeds and dials any addresses not yet seen, until
+// the overlay is terminated. Re-resolution is skipped while converged.
+func (o *Overlay) seeder(seeds []string) {
+	seen := make(map[string]struct{})
+	for {
+		o.lock.RLock()
+		stable := o.stab
+		o.lock.RUnlock()
+
+		if !stable {
+			for _, seed := range seeds {
+				addrs, err := resolveSeed(seed)
+				if err != nil {
+					o.log.Errorf("overlay: failed to resolve seed %v: %v.", seed, err)
+					continue
+				}
+				for _, addr := range addrs {
+					if _, ok := seen[addr.String()]; ok {
+						continue
+					}
+					seen[addr.String()] = struct{}{}
+
+					dst := []*net.TCPAddr{addr} // Copy for closure!
+					o.auther.Schedule(func() { o.dialOnce(nil, dst) })
+				}
+			}
+		}
+		select {
+		case <-o.quit:
+			return
+		case <-time.After(time.Duration(config.OverlaySeedInterval) * time.Millisecond):
+		}
+	}
+}
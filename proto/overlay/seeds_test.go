@@ -0,0 +1,136 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/karalabe/iris/config"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolveSeed(t *testing.T) {
+	defer func(host func(string) ([]string, error), srv func(string, string, string) (string, []*net.SRV, error)) {
+		lookupHost, lookupSRV = host, srv
+	}(lookupHost, lookupSRV)
+
+	hosts := map[string][]string{
+		"seed.iris":  {"10.0.0.1", "::1"},
+		"node1.iris": {"10.0.0.2"},
+		"node2.iris": {"10.0.0.3"},
+	}
+	lookupHost = func(host string) ([]string, error) {
+		if ips, ok := hosts[host]; ok {
+			return ips, nil
+		}
+		return nil, fmt.Errorf("unknown host")
+	}
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_iris._tcp.iris" {
+			return "", nil, fmt.Errorf("unknown service")
+		}
+		return name, []*net.SRV{{Target: "node1.iris", Port: 1111}, {Target: "node2.iris", Port: 2222}}, nil
+	}
+	tests := []struct {
+		seed  string
+		addrs []string
+		fail  bool
+	}{
+		{seed: "seed.iris:14142", addrs: []string{"10.0.0.1:14142", "[::1]:14142"}},
+		{seed: "_iris._tcp.iris", addrs: []string{"10.0.0.2:1111", "10.0.0.3:2222"}},
+		{seed: "missing.iris:14142", fail: true},
+		{seed: "seed.iris:port", fail: true},
+		{seed: "missing.iris", fail: true},
+	}
+	for i, tt := range tests {
+		addrs, err := resolveSeed(tt.seed)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: invalid seed resolved: %v.", i, addrs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to resolve seed: %v.", i, err)
+			continue
+		}
+		if len(addrs) != len(tt.addrs) {
+			t.Errorf("test %d: address count mismatch: have %v, want %v.", i, addrs, tt.addrs)
+			continue
+		}
+		for j, addr := range addrs {
+			if addr.String() != tt.addrs[j] {
+				t.Errorf("test %d, addr %d: address mismatch: have %v, want %v.", i, j, addr, tt.addrs[j])
+			}
+		}
+	}
+}
+
+func TestSeederReresolve(t *testing.T) {
+	defer func(host func(string) ([]string, error), interval int) {
+		lookupHost, config.OverlaySeedInterval = host, interval
+	}(lookupHost, config.OverlaySeedInterval)
+
+	// Count the seed resolutions
+	var lock sync.Mutex
+	resolves := 0
+	lookupHost = func(host string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		resolves++
+		return []string{fmt.Sprintf("10.0.0.%d", resolves)}, nil
+	}
+	config.OverlaySeedInterval = 10
+
+	// Start seeding an unstable overlay (dials are never executed)
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	defer close(o.quit)
+
+	go o.seeder([]string{"seed.iris:14142"})
+	time.Sleep(100 * time.Millisecond)
+
+	lock.Lock()
+	unstable := resolves
+	lock.Unlock()
+	if unstable < 2 {
+		t.Fatalf("seeds not re-resolved while unstable: %d resolutions.", unstable)
+	}
+	// Converge the overlay and make sure resolution stops
+	o.lock.Lock()
+	o.stab = true
+	o.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	converged := resolves
+	lock.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if resolves != converged {
+		t.Fatalf("seeds re-resolved while stable: have %d, want %d.", resolves, converged)
+	}
+}
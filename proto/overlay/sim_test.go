@@ -0,0 +1,191 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/ext/mathext"
+	"math/big"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Churn to apply to a simulated network after the initial convergence.
+type ChurnProfile struct {
+	Joins int // Number of fresh nodes to join the network
+	Fails int // Number of original nodes to abruptly shut down
+}
+
+// Convergence statistics gathered during a simulation run.
+type ConvergenceStats struct {
+	Boot      time.Duration // Time needed by the initial network to converge
+	Churn     time.Duration // Time needed to reconverge after the churn
+	Messages  uint64        // Number of system messages sent in total
+	Converged bool          // Whether the network converged within the limits
+}
+
+// Spins up a network of local overlay nodes, waits for it to converge, applies
+// the churn profile and measures the time needed to reconverge. All started
+// nodes are torn down before returning.
+func SimulateConvergence(nodes int, churn ChurnProfile) ConvergenceStats {
+	stats := ConvergenceStats{}
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < nodes+churn.Joins; i++ {
+		config.BootPorts = append(config.BootPorts, 65520+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot the initial network and measure the convergence time
+	live, all := []*Overlay{}, []*Overlay{}
+	defer func() {
+		for _, o := range all {
+			o.Shutdown()
+		}
+	}()
+	start := time.Now()
+	for i := 0; i < nodes; i++ {
+		o := New(appId, key, new(nopCallback))
+		if _, err := o.Boot(); err != nil {
+			return stats
+		}
+		live, all = append(live, o), append(all, o)
+	}
+	if !waitConverged(live) {
+		return stats
+	}
+	stats.Boot = time.Since(start)
+
+	// Apply the churn profile and measure the reconvergence time
+	start = time.Now()
+	for i := 0; i < churn.Fails && len(live) > 0; i++ {
+		live[0].Shutdown()
+		live, all = live[1:], all[1:]
+	}
+	for i := 0; i < churn.Joins; i++ {
+		o := New(appId, key, new(nopCallback))
+		if _, err := o.Boot(); err != nil {
+			return stats
+		}
+		live, all = append(live, o), append(all, o)
+	}
+	if !waitConverged(live) {
+		return stats
+	}
+	stats.Churn = time.Since(start)
+	stats.Converged = true
+
+	// Collect the message counts and return
+	for _, o := range all {
+		stats.Messages += atomic.LoadUint64(&o.msgs)
+	}
+	return stats
+}
+
+// Polls the nodes until their leaf sets and routing tables are consistent with
+// the set of live nodes, or a generous timeout is reached.
+func waitConverged(nodes []*Overlay) bool {
+	timeout := time.After(time.Duration(config.OverlayBootTimeout+10*config.OverlayConvTimeout) * time.Millisecond)
+	for !converged(nodes) {
+		select {
+		case <-timeout:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// Checks whether the routing state of each node is the ideal one given the set
+// of live nodes (same conditions as checkRoutes, without the error reporting).
+func converged(nodes []*Overlay) bool {
+	ids := make([]*big.Int, len(nodes))
+	for i, o := range nodes {
+		ids[i] = o.nodeId
+	}
+	for _, o := range nodes {
+		o.lock.RLock()
+		routes := o.routes.Copy()
+		o.lock.RUnlock()
+
+		// Verify the leaf set
+		sort.Sort(idSlice{o.space, o.nodeId, ids})
+		origin := 0
+		for o.nodeId.Cmp(ids[origin]) != 0 {
+			origin++
+		}
+		min := mathext.MaxInt(0, origin-config.OverlayLeaves/2)
+		max := mathext.MinInt(len(ids), origin+config.OverlayLeaves/2)
+		leaves := ids[min:max]
+
+		if len(leaves) != len(routes.leaves) {
+			return false
+		}
+		for i, leaf := range leaves {
+			if leaf.Cmp(routes.leaves[i]) != 0 {
+				return false
+			}
+		}
+		// Verify that the routing table has no missing or dead entries
+		for r, row := range routes.routes {
+			for c, p := range row {
+				if p == nil {
+					for _, id := range ids {
+						if id.Cmp(o.nodeId) != 0 {
+							if pre, dig := o.space.prefix(o.nodeId, id); pre == r && dig == c {
+								return false
+							}
+						}
+					}
+				} else {
+					alive := false
+					for _, id := range ids {
+						if id.Cmp(p) == 0 {
+							alive = true
+							break
+						}
+					}
+					if !alive {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+func TestSimulateConvergence(t *testing.T) {
+	// Make sure cleanups terminate before returning
+	defer time.Sleep(3 * time.Second)
+
+	stats := SimulateConvergence(3, ChurnProfile{Joins: 1, Fails: 1})
+	if !stats.Converged {
+		t.Fatalf("network failed to converge: %+v.", stats)
+	}
+	if stats.Messages == 0 {
+		t.Errorf("no system messages counted: %+v.", stats)
+	}
+}
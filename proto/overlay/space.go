@@ -24,17 +24,58 @@
 package overlay
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/ext/sortext"
 	"io"
 	"math/big"
+	"time"
 )
 
-var modulo = new(big.Int).SetBit(new(big.Int), config.OverlaySpace, 1)
-var posmid = new(big.Int).Rsh(modulo, 1)
-var negmid = new(big.Int).Mul(posmid, big.NewInt(-1))
+// Identifier space of an overlay network: the bit length of the ids and the
+// number of bits per routing table digit. All nodes in a network must agree.
+type space struct {
+	bits int // Bit length of the node ids
+	base int // Bits per routing table digit
+
+	modulo *big.Int // Size of the circular id space
+	posmid *big.Int // Largest positive delta in the circular id space
+	negmid *big.Int // Largest negative delta in the circular id space
+}
+
+// Creates an id space of the given bit length and digit size.
+func newSpace(bits, base int) *space {
+	s := &space{bits: bits, base: base}
+	s.modulo = new(big.Int).SetBit(new(big.Int), bits, 1)
+	s.posmid = new(big.Int).Rsh(s.modulo, 1)
+	s.negmid = new(big.Int).Neg(s.posmid)
+	return s
+}
+
+// Creates the default id space, as currently set in the global configuration.
+func configSpace() *space {
+	return newSpace(config.OverlaySpace, config.OverlayBase)
+}
+
+// Returns the number of rows in a routing table of the id space.
+func (s *space) rows() int {
+	return (s.bits + s.base - 1) / s.base
+}
+
+// Returns the number of columns in a routing table of the id space.
+func (s *space) cols() int {
+	return 1 << uint(s.base)
+}
+
+// Checks whether an id is inside the id space.
+func (s *space) contains(id *big.Int) bool {
+	return id.Sign() >= 0 && id.Cmp(s.modulo) < 0
+}
 
 // Special id slice implementing sort.Interface.
 type idSlice struct {
+	space  *space
 	origin *big.Int
 	data   []*big.Int
 }
@@ -46,9 +87,7 @@ func (p idSlice) Len() int {
 
 // Required for sort.Sort.
 func (p idSlice) Less(i, j int) bool {
-	di := delta(p.origin, p.data[i])
-	dj := delta(p.origin, p.data[j])
-	return di.Cmp(dj) < 0
+	return sortext.BigIntRingSlice{Center: p.origin, Modulus: p.space.modulo, Data: p.data}.Less(i, j)
 }
 
 // Required for sort.Sort.
@@ -56,49 +95,162 @@ func (p idSlice) Swap(i, j int) {
 	p.data[i], p.data[j] = p.data[j], p.data[i]
 }
 
+// Id slice sorted by proximity: nodes with measured latencies first (lowest
+// first), followed by the unmeasured ones ordered by their distance from origin.
+type proxSlice struct {
+	space  *space
+	origin *big.Int
+	lats   []time.Duration
+	data   []*big.Int
+}
+
+// Required for sort.Sort.
+func (p proxSlice) Len() int {
+	return len(p.data)
+}
+
+// Required for sort.Sort.
+func (p proxSlice) Less(i, j int) bool {
+	li, lj := p.lats[i], p.lats[j]
+	switch {
+	case li > 0 && lj > 0 && li != lj:
+		return li < lj
+	case li > 0 && lj == 0:
+		return true
+	case li == 0 && lj > 0:
+		return false
+	}
+	return p.space.distance(p.origin, p.data[i]).Cmp(p.space.distance(p.origin, p.data[j])) < 0
+}
+
+// Required for sort.Sort.
+func (p proxSlice) Swap(i, j int) {
+	p.data[i], p.data[j] = p.data[j], p.data[i]
+	p.lats[i], p.lats[j] = p.lats[j], p.lats[i]
+}
+
+// Id slice sorted clockwise around the ring, starting after the origin.
+type ringSlice struct {
+	space  *space
+	origin *big.Int
+	data   []*big.Int
+}
+
+// Required for sort.Sort.
+func (p ringSlice) Len() int {
+	return len(p.data)
+}
+
+// Required for sort.Sort.
+func (p ringSlice) Less(i, j int) bool {
+	oi := new(big.Int).Sub(p.data[i], p.origin)
+	oj := new(big.Int).Sub(p.data[j], p.origin)
+	return oi.Mod(oi, p.space.modulo).Cmp(oj.Mod(oj, p.space.modulo)) < 0
+}
+
+// Required for sort.Sort.
+func (p ringSlice) Swap(i, j int) {
+	p.data[i], p.data[j] = p.data[j], p.data[i]
+}
+
+// Id slice sorted by the distance from a key, breaking ties deterministically.
+type distSlice struct {
+	space *space
+	key   *big.Int
+	seed  []byte
+	data  []*big.Int
+}
+
+// Required for sort.Sort.
+func (p distSlice) Len() int {
+	return len(p.data)
+}
+
+// Required for sort.Sort.
+func (p distSlice) Less(i, j int) bool {
+	c := p.space.distance(p.data[i], p.key).Cmp(p.space.distance(p.data[j], p.key))
+	return c < 0 || (c == 0 && tiebreak(p.seed, p.data[i], p.data[j]))
+}
+
+// Required for sort.Sort.
+func (p distSlice) Swap(i, j int) {
+	p.data[i], p.data[j] = p.data[j], p.data[i]
+}
+
 // Calculates the signed distance between two ids on the circular ID space
-func delta(a, b *big.Int) *big.Int {
+func (s *space) delta(a, b *big.Int) *big.Int {
 	d := new(big.Int).Sub(b, a)
 	switch {
-	case posmid.Cmp(d) < 0:
-		d.Sub(d, modulo)
-	case negmid.Cmp(d) > 0:
-		d.Add(d, modulo)
+	case s.posmid.Cmp(d) < 0:
+		d.Sub(d, s.modulo)
+	case s.negmid.Cmp(d) > 0:
+		d.Add(d, s.modulo)
 	}
 	return d
 }
 
 // Calculates the absolute distance between two ids on the circular ID space
-func distance(a, b *big.Int) *big.Int {
-	return new(big.Int).Abs(delta(a, b))
+func (s *space) distance(a, b *big.Int) *big.Int {
+	return new(big.Int).Abs(s.delta(a, b))
+}
+
+// Deterministically decides whether id a should be preferred over id b when the
+// two are otherwise equivalent (e.g. symmetric around a key). The ids are ranked
+// by their seeded hashes, falling back to numerical order on collisions, so all
+// nodes sharing the seed agree on the choice.
+func tiebreak(seed []byte, a, b *big.Int) bool {
+	ha, hb := sha1.New(), sha1.New()
+	ha.Write(seed)
+	ha.Write(a.Bytes())
+	hb.Write(seed)
+	hb.Write(b.Bytes())
+
+	if c := bytes.Compare(ha.Sum(nil), hb.Sum(nil)); c != 0 {
+		return c < 0
+	}
+	return a.Cmp(b) < 0
 }
 
 // Calculate the length of the common prefix of two ids and the differing digit.
-func prefix(a, b *big.Int) (int, int) {
+func (s *space) prefix(a, b *big.Int) (int, int) {
 	p := 0
-	for bit := config.OverlaySpace - 1; bit >= 0; bit-- {
+	for bit := s.bits - 1; bit >= 0; bit-- {
 		if a.Bit(bit) != b.Bit(bit) {
-			p = (config.OverlaySpace - 1 - bit) / config.OverlayBase
+			p = (s.bits - 1 - bit) / s.base
 			break
 		}
 	}
+	return p, s.digit(b, p)
+}
+
+// Extracts the digit of an id at a routing table row (the last one may be partial
+// if the base doesn't divide the space).
+func (s *space) digit(id *big.Int, row int) int {
 	d := uint(0)
-	for bit := 0; bit < config.OverlayBase; bit++ {
-		d |= b.Bit(config.OverlaySpace-(p+1)*config.OverlayBase+bit) << uint(bit)
+	for bit := 0; bit < s.base; bit++ {
+		if pos := s.bits - (row+1)*s.base + bit; pos >= 0 {
+			d |= id.Bit(pos) << uint(bit)
+		}
 	}
-	return p, int(d)
+	return int(d)
 }
 
-// Converts a string id into an overlay id.
+// Converts a string id into an overlay id of the default ID space. Overlays with
+// a custom id space should use Overlay.Resolve instead.
 func Resolve(id string) *big.Int {
+	return resolve(id, config.OverlaySpace)
+}
+
+// Converts a string id into an id of the given bit length.
+func resolve(id string, bits int) *big.Int {
 	// Hash the textual id
 	h := config.OverlayResolver()
 	io.WriteString(h, id)
 	sum := h.Sum(nil)
 
 	// Extract enough bits, and clear overflows
-	raw := sum[:(config.OverlaySpace+7)/8]
-	for i := 0; i < len(raw)*8-config.OverlaySpace; i++ {
+	raw := sum[:(bits+7)/8]
+	for i := 0; i < len(raw)*8-bits; i++ {
 		raw[0] &= ^byte(1 << (7 - uint(i)))
 	}
 	// Return the new id
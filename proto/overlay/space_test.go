@@ -23,9 +23,11 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/x509"
 	"github.com/karalabe/iris/config"
 	"hash"
 	"math/big"
+	"sort"
 	"testing"
 )
 
@@ -40,6 +42,9 @@ type spaceTest struct {
 
 var one = big.NewInt(1)
 
+// Default id space the static test cases are expressed in.
+var defSpace = configSpace()
+
 // The tests assume the default 4 bit digits!
 var spaceTests = []spaceTest{
 	// Simple startup cases
@@ -55,29 +60,30 @@ var spaceTests = []spaceTest{
 	{big.NewInt(262144), big.NewInt(65536), big.NewInt(-196608), big.NewInt(196608), config.OverlaySpace/config.OverlayBase - 5, 1},
 
 	// Circular wrapping
-	{new(big.Int).Sub(modulo, one), big.NewInt(0), big.NewInt(1), big.NewInt(1), 0, 0},
-	{big.NewInt(0), new(big.Int).Sub(modulo, one), big.NewInt(-1), big.NewInt(1), 0, 15},
-	{new(big.Int).Sub(modulo, one), big.NewInt(1), big.NewInt(2), big.NewInt(2), 0, 0},
-	{big.NewInt(1), new(big.Int).Sub(modulo, one), big.NewInt(-2), big.NewInt(2), 0, 15},
+	{new(big.Int).Sub(defSpace.modulo, one), big.NewInt(0), big.NewInt(1), big.NewInt(1), 0, 0},
+	{big.NewInt(0), new(big.Int).Sub(defSpace.modulo, one), big.NewInt(-1), big.NewInt(1), 0, 15},
+	{new(big.Int).Sub(defSpace.modulo, one), big.NewInt(1), big.NewInt(2), big.NewInt(2), 0, 0},
+	{big.NewInt(1), new(big.Int).Sub(defSpace.modulo, one), big.NewInt(-2), big.NewInt(2), 0, 15},
 
 	// Half splits
-	{big.NewInt(0), posmid, posmid, posmid, 0, 8},
-	{posmid, big.NewInt(0), negmid, posmid, 0, 0},
-	{big.NewInt(0), new(big.Int).Sub(posmid, one), new(big.Int).Sub(posmid, one), new(big.Int).Sub(posmid, one), 0, 7},
-	{new(big.Int).Sub(posmid, one), big.NewInt(0), new(big.Int).Add(negmid, one), new(big.Int).Sub(posmid, one), 0, 0},
-	{big.NewInt(0), new(big.Int).Add(posmid, one), new(big.Int).Add(negmid, one), new(big.Int).Sub(posmid, one), 0, 8},
-	{new(big.Int).Add(posmid, one), big.NewInt(0), new(big.Int).Sub(posmid, one), new(big.Int).Sub(posmid, one), 0, 0},
+	{big.NewInt(0), defSpace.posmid, defSpace.posmid, defSpace.posmid, 0, 8},
+	{defSpace.posmid, big.NewInt(0), defSpace.negmid, defSpace.posmid, 0, 0},
+	{big.NewInt(0), new(big.Int).Sub(defSpace.posmid, one), new(big.Int).Sub(defSpace.posmid, one), new(big.Int).Sub(defSpace.posmid, one), 0, 7},
+	{new(big.Int).Sub(defSpace.posmid, one), big.NewInt(0), new(big.Int).Add(defSpace.negmid, one), new(big.Int).Sub(defSpace.posmid, one), 0, 0},
+	{big.NewInt(0), new(big.Int).Add(defSpace.posmid, one), new(big.Int).Add(defSpace.negmid, one), new(big.Int).Sub(defSpace.posmid, one), 0, 8},
+	{new(big.Int).Add(defSpace.posmid, one), big.NewInt(0), new(big.Int).Sub(defSpace.posmid, one), new(big.Int).Sub(defSpace.posmid, one), 0, 0},
 }
 
 func TestSpace(t *testing.T) {
+	s := configSpace()
 	for i, tt := range spaceTests {
-		if d := delta(tt.idA, tt.idB); tt.delta.Cmp(d) != 0 {
+		if d := s.delta(tt.idA, tt.idB); tt.delta.Cmp(d) != 0 {
 			t.Errorf("test %d: delta mismatch: have %v, want %v.", i, d, tt.delta)
 		}
-		if d := distance(tt.idA, tt.idB); tt.dist.Cmp(d) != 0 {
+		if d := s.distance(tt.idA, tt.idB); tt.dist.Cmp(d) != 0 {
 			t.Errorf("test %d: dist mismatch: have %v, want %v.", i, d, tt.dist)
 		}
-		if p, d := prefix(tt.idA, tt.idB); tt.prefix != p || tt.digit != d {
+		if p, d := s.prefix(tt.idA, tt.idB); tt.prefix != p || tt.digit != d {
 			t.Errorf("test %d: prefix/digit mismatch: have %v/%v, want %v/%v.", i, p, d, tt.prefix, tt.digit)
 		}
 	}
@@ -127,3 +133,249 @@ func TestResolve(t *testing.T) {
 		}
 	}
 }
+
+func TestEvenlySpacedIds(t *testing.T) {
+	for _, n := range []int{1, 2, 8, 16} {
+		ids := EvenlySpacedIds(n, defSpace.modulo)
+		if len(ids) != n {
+			t.Errorf("n=%d: id count mismatch: have %v, want %v.", n, len(ids), n)
+			continue
+		}
+		// Make sure all gaps (including the wrap around) are the same
+		gap := new(big.Int).Div(defSpace.modulo, big.NewInt(int64(n)))
+		for i := 0; i < n; i++ {
+			next := new(big.Int).Add(ids[(i+1)%n], defSpace.modulo)
+			next.Sub(next, ids[i]).Mod(next, defSpace.modulo)
+			if next.Sign() == 0 {
+				next.Set(defSpace.modulo)
+			}
+			if next.Cmp(gap) != 0 {
+				t.Errorf("n=%d: gap #%d mismatch: have %v, want %v.", n, i, next, gap)
+			}
+		}
+	}
+}
+
+func TestTableDimensions(t *testing.T) {
+	// Save the previous config values
+	b := config.OverlayBase
+	defer func() { config.OverlayBase = b }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	ids := EvenlySpacedIds(64, defSpace.modulo)
+
+	tables := []*table{}
+	for _, base := range []int{1, 2, 3, 4, 5, 7, 8} {
+		config.OverlayBase = base
+
+		// Construct an overlay and verify the routing table dimensions
+		o := New(appId, key, new(nopCallback))
+		rows := (config.OverlaySpace + base - 1) / base
+		if len(o.routes.routes) != rows {
+			t.Errorf("base %d: row count mismatch: have %v, want %v.", base, len(o.routes.routes), rows)
+		}
+		if len(o.routes.routes[0]) != 1<<uint(base) {
+			t.Errorf("base %d: column count mismatch: have %v, want %v.", base, len(o.routes.routes[0]), 1<<uint(base))
+		}
+		// Merge a batch of ids, ensuring all land inside the table
+		s := &state{Addrs: make(map[string][]string)}
+		for _, id := range ids {
+			s.Addrs[id.String()] = nil
+		}
+		o.merge(o.routes, make(map[string][]string), s)
+		for _, id := range ids {
+			if row, col := o.space.prefix(o.nodeId, id); !o.routes.contains(row, col) {
+				t.Errorf("base %d: id %v outside table: row %d, col %d.", base, id, row, col)
+			}
+		}
+		tables = append(tables, o.routes)
+	}
+	// Merge into tables constructed with different bases than the active one
+	for _, base := range []int{1, 3, 8} {
+		config.OverlayBase = base
+		o := New(appId, key, new(nopCallback))
+		for _, tab := range tables {
+			o.nodeId = tab.leaves[0]
+			s := &state{Addrs: map[string][]string{ids[1].String(): nil, ids[63].String(): nil}}
+			o.merge(tab, make(map[string][]string), s)
+		}
+	}
+}
+
+func TestLeafRing(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+
+	// Place the local node near the top of the space, so successors wrap around
+	top := new(big.Int).Sub(o.space.modulo, big.NewInt(1))
+	o.nodeId = new(big.Int).Sub(o.space.modulo, big.NewInt(10))
+	o.routes = newTable(o.nodeId)
+
+	succ := []*big.Int{new(big.Int).Sub(o.space.modulo, big.NewInt(5)), top, big.NewInt(0)}
+	pred := []*big.Int{new(big.Int).Sub(o.space.modulo, big.NewInt(100)), new(big.Int).Sub(o.space.modulo, big.NewInt(20))}
+
+	leaves := append(append([]*big.Int{}, pred...), succ...)
+	o.routes.leaves = o.mergeLeaves(o.routes.leaves, leaves)
+
+	ring := o.LeafRing()
+	want := append(append([]*big.Int{}, succ...), pred...)
+	if len(ring) != len(want) {
+		t.Fatalf("ring size mismatch: have %v, want %v.", len(ring), len(want))
+	}
+	for i := 0; i < len(want); i++ {
+		if ring[i].Cmp(want[i]) != 0 {
+			t.Fatalf("ring order mismatch: have %v, want %v.", ring, want)
+		}
+	}
+}
+
+func TestTinySpace(t *testing.T) {
+	s := newSpace(16, 4)
+	if s.rows() != 4 || s.cols() != 16 {
+		t.Fatalf("table dimension mismatch: have %dx%d, want %dx%d.", s.rows(), s.cols(), 4, 16)
+	}
+	// Verify the prefix, digit and distance calculations
+	tests := []struct {
+		a, b          int64
+		delta         int64
+		prefix, digit int
+	}{
+		{0x1234, 0x1294, 0x60, 2, 9},
+		{0x1234, 0x5678, 0x4444, 0, 5},
+		{0x1234, 0x1235, 1, 3, 5},
+		{0xffff, 0x0001, 2, 0, 0},
+		{0x0001, 0xffff, -2, 0, 15},
+		{0x0000, 0x8000, 0x8000, 0, 8},
+	}
+	for i, tt := range tests {
+		a, b := big.NewInt(tt.a), big.NewInt(tt.b)
+		if d := s.delta(a, b); d.Cmp(big.NewInt(tt.delta)) != 0 {
+			t.Errorf("test %d: delta mismatch: have %v, want %v.", i, d, tt.delta)
+		}
+		if p, d := s.prefix(a, b); p != tt.prefix || d != tt.digit {
+			t.Errorf("test %d: prefix mismatch: have %v/%v, want %v/%v.", i, p, d, tt.prefix, tt.digit)
+		}
+	}
+	if s.contains(big.NewInt(0x10000)) || !s.contains(big.NewInt(0xffff)) {
+		t.Errorf("id space bounds mismatch.")
+	}
+}
+
+func TestIdSpaceLimits(t *testing.T) {
+	max := config.OverlayResolver().Size() * 8
+	for _, bits := range []int{0, -1, max + 1, 256} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%d bit id space accepted.", bits)
+				}
+			}()
+			WithIdSpace(bits, 4)
+		}()
+	}
+	// The largest id space must resolve ids without overflowing the hash
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback), WithIdSpace(max, 4))
+	if id := o.Resolve("node"); !o.space.contains(id) {
+		t.Errorf("resolved id outside the id space: %x.", id)
+	}
+}
+
+func TestTinySpaceRouting(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback), WithIdSpace(16, 4))
+	if !o.space.contains(o.nodeId) {
+		t.Fatalf("node id outside the id space: %v.", o.nodeId)
+	}
+	if len(o.routes.routes) != 4 || len(o.routes.routes[0]) != 16 {
+		t.Fatalf("table dimension mismatch: have %dx%d, want %dx%d.", len(o.routes.routes), len(o.routes.routes[0]), 4, 16)
+	}
+	o.nodeId = big.NewInt(0x1234)
+	o.routes = o.space.newTable(o.nodeId)
+
+	// Merge a few ids (and an out of space one) into the routing table
+	s := &state{Addrs: make(map[string][]string)}
+	for _, id := range []int64{0x5678, 0x1294, 0x1235, 0x9abc, 0x1ffff} {
+		s.Addrs[big.NewInt(id).String()] = nil
+	}
+	o.merge(o.routes, make(map[string][]string), s)
+
+	cells := []struct {
+		row, col int
+		id       int64
+	}{
+		{0, 5, 0x5678},
+		{0, 9, 0x9abc},
+		{2, 9, 0x1294},
+		{3, 5, 0x1235},
+	}
+	for _, cell := range cells {
+		if id := o.routes.get(cell.row, cell.col); id == nil || id.Int64() != cell.id {
+			t.Errorf("cell %d/%d mismatch: have %v, want %v.", cell.row, cell.col, id, cell.id)
+		}
+	}
+	for _, id := range o.routes.leaves {
+		if !o.space.contains(id) {
+			t.Errorf("out of space id merged into leaves: %v.", id)
+		}
+	}
+	// Verify that keys are routed to the closest node
+	hops := []struct {
+		key, hop int64
+	}{
+		{0x1234, 0x1234},
+		{0x1236, 0x1235},
+		{0x5600, 0x5678},
+		{0x9000, 0x9abc},
+		{0xf000, 0x1234},
+	}
+	for _, hop := range hops {
+		if id := o.walk(big.NewInt(hop.key)); id.Int64() != hop.hop {
+			t.Errorf("key %x: next hop mismatch: have %x, want %x.", hop.key, id, hop.hop)
+		}
+	}
+	// Verify that textual ids are resolved into the id space
+	for _, text := range []string{"a", "b", "c", "d"} {
+		if id := o.Resolve(text); !o.space.contains(id) {
+			t.Errorf("resolved id %q outside the id space: %x.", text, id)
+		}
+	}
+	// Verify that leaf sets are sorted around the ring of the id space
+	ids := []*big.Int{big.NewInt(0x1235), big.NewInt(0xffff), big.NewInt(0x1233), big.NewInt(0x0001)}
+	sort.Sort(idSlice{o.space, o.nodeId, ids})
+	for i, want := range []int64{0xffff, 0x0001, 0x1233, 0x1235} {
+		if ids[i].Int64() != want {
+			t.Errorf("ring order mismatch at %d: have %x, want %x.", i, ids[i], want)
+		}
+	}
+}
+
+func TestHasher(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// An identity hasher should assign the id directly
+	ident := func(data []byte) *big.Int { return new(big.Int).SetBytes(data) }
+	o := New(appId, key, new(nopCallback), WithHasher(ident), WithIdentity([]byte{0x12, 0x34}))
+	if o.nodeId.Cmp(big.NewInt(0x1234)) != 0 {
+		t.Fatalf("node id mismatch: have %v, want %v.", o.nodeId, 0x1234)
+	}
+	// A wider hash should be reduced into the id space
+	sha := func(data []byte) *big.Int {
+		sum := sha256.Sum256(data)
+		return new(big.Int).SetBytes(sum[:])
+	}
+	a := New(appId, key, new(nopCallback), WithIdSpace(16, 4), WithHasher(sha), WithIdentity([]byte("node")))
+	b := New(appId, key, new(nopCallback), WithHasher(sha), WithIdentity([]byte("node")), WithIdSpace(16, 4))
+	if !a.space.contains(a.nodeId) {
+		t.Fatalf("node id outside the id space: %v.", a.nodeId)
+	}
+	if a.nodeId.Cmp(b.nodeId) != 0 {
+		t.Fatalf("non deterministic node id: %v != %v.", a.nodeId, b.nodeId)
+	}
+	// Without an identity, ids should remain random
+	c := New(appId, key, new(nopCallback), WithHasher(sha))
+	d := New(appId, key, new(nopCallback), WithHasher(sha))
+	if c.nodeId.Cmp(d.nodeId) == 0 {
+		t.Fatalf("random identities collided: %v.", c.nodeId)
+	}
+}
@@ -0,0 +1,185 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the optional leaf set selection policy spreading the leaves across
+// distinct address classes (e.g. subnets or availability zones), so that a few
+// correlated failures cannot wipe out a node's whole neighborhood.
+
+package overlay
+
+import (
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/ext/mathext"
+	"math/big"
+	"net"
+)
+
+// Maps the advertised addresses of a node to its failure domain (e.g. subnet).
+// An empty result means the class is unknown.
+type Classifier func(addrs []string) string
+
+// Creates a classifier grouping nodes by the leading bits of their first valid
+// IP address (e.g. 16 for /16 subnets).
+func PrefixClassifier(bits int) Classifier {
+	return func(addrs []string) string {
+		for _, addr := range addrs {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			return ip.Mask(net.CIDRMask(mathext.MinInt(bits, 8*len(ip)), 8*len(ip))).String()
+		}
+		return ""
+	}
+}
+
+// Sets a classifier to spread the leaf set across distinct address classes: on
+// each side of the local node the nearest leaf is always kept, but the rest are
+// preferably picked from classes not yet represented among the closest few
+// candidates. Connections to the skipped candidates within the leaf set range are
+// retained, and keys closer to them than to any leaf are still delivered to them.
+func WithLeafClassifier(classify Classifier) Option {
+	return func(o *Overlay) {
+		o.classify = classify
+		o.classes = make(map[string]string)
+	}
+}
+
+// Records the address class of a node if leaf spreading is enabled.
+func (o *Overlay) recordClass(id string, addrs []string) {
+	if o.classify == nil {
+		return
+	}
+	class := o.classify(addrs)
+
+	o.classLock.Lock()
+	defer o.classLock.Unlock()
+
+	if class != "" {
+		o.classes[id] = class
+	}
+}
+
+// Drops the recorded address classes of nodes neither in the leaf set nor in
+// the connection pool. The overlay lock is assumed to be held.
+func (o *Overlay) pruneClasses() {
+	if o.classify == nil {
+		return
+	}
+	keep := make(map[string]struct{}, len(o.routes.leaves)+len(o.pool))
+	for _, id := range o.routes.leaves {
+		keep[id.String()] = struct{}{}
+	}
+	for id, _ := range o.pool {
+		keep[id] = struct{}{}
+	}
+	o.classLock.Lock()
+	defer o.classLock.Unlock()
+
+	for id, _ := range o.classes {
+		if _, ok := keep[id]; !ok {
+			delete(o.classes, id)
+		}
+	}
+}
+
+// Selects n leaves from one side of the local node, the candidates ordered by
+// increasing distance. The nearest is always kept, followed by the closest ones
+// of not yet seen address classes, filling the rest with the closest remaining.
+func (o *Overlay) spread(cands []*big.Int, n int) []*big.Int {
+	if len(cands) <= n || n == 0 {
+		return cands[:mathext.MinInt(len(cands), n)]
+	}
+	window := cands[:mathext.MinInt(len(cands), n*config.OverlayLeafSpread)]
+
+	o.classLock.Lock()
+	picked := make([]bool, len(window))
+	seen := make(map[string]bool)
+	count := 0
+	for i, id := range window {
+		if count == n {
+			break
+		}
+		class, known := o.classes[id.String()]
+		if i == 0 || (known && !seen[class]) {
+			picked[i] = true
+			count++
+			if known {
+				seen[class] = true
+			}
+		}
+	}
+	o.classLock.Unlock()
+
+	for i := 0; i < len(window) && count < n; i++ {
+		if !picked[i] {
+			picked[i] = true
+			count++
+		}
+	}
+	res := make([]*big.Int, 0, n)
+	for i, id := range window {
+		if picked[i] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// Checks whether a node lies within the range of the leaf set while leaf spreading
+// is enabled, i.e. whether it may be a candidate skipped by the spreading and is
+// needed for the key delivery decisions. The read lock is assumed to be held.
+func (o *Overlay) spared(id *big.Int) bool {
+	if o.classify == nil {
+		return false
+	}
+	leaves := o.routes.leaves
+	return o.space.delta(leaves[0], id).Sign() >= 0 && o.space.delta(id, leaves[len(leaves)-1]).Sign() >= 0
+}
+
+// Collects the connected, participating peers within the leaf set range while
+// leaf spreading is enabled. The read lock is assumed to be held.
+func (o *Overlay) spares() []*big.Int {
+	ids := []*big.Int{}
+	for _, p := range o.pool {
+		if !p.paused() && o.spared(p.nodeId) {
+			ids = append(ids, p.nodeId)
+		}
+	}
+	return ids
+}
+
+// Picks the delivery target of a key within the leaf set range: the best leaf,
+// unless a skipped candidate is closer to the key. The read lock is assumed to be
+// held.
+func (o *Overlay) spareHop(dst, best, dist *big.Int) *big.Int {
+	for _, id := range o.spares() {
+		if d := o.space.distance(id, dst); d.Cmp(dist) < 0 || (d.Cmp(dist) == 0 && tiebreak(o.seed, id, best)) {
+			best, dist = id, d
+		}
+	}
+	return best
+}
@@ -0,0 +1,103 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"github.com/karalabe/iris/config"
+	"math/big"
+	"testing"
+)
+
+func TestPrefixClassifier(t *testing.T) {
+	tests := []struct {
+		bits  int
+		addrs []string
+		class string
+	}{
+		{16, []string{"10.1.2.3:14142"}, "10.1.0.0"},
+		{24, []string{"10.1.2.3:14142"}, "10.1.2.0"},
+		{16, []string{"invalid", "192.168.1.1:80"}, "192.168.0.0"},
+		{32, []string{"[fe80::1]:80"}, "fe80::"},
+		{16, []string{}, ""},
+	}
+	for i, tt := range tests {
+		if class := PrefixClassifier(tt.bits)(tt.addrs); class != tt.class {
+			t.Errorf("test %d: class mismatch: have %v, want %v.", i, class, tt.class)
+		}
+	}
+}
+
+func TestLeafSpread(t *testing.T) {
+	// Use a small leaf set: two slots on the predecessor side
+	defer func(leaves int) { config.OverlayLeaves = leaves }(config.OverlayLeaves)
+	config.OverlayLeaves = 4
+
+	// Two close same-subnet predecessors and a farther one in a distinct subnet
+	s := &state{Addrs: map[string][]string{
+		"990":  []string{"10.1.0.1:14142"},
+		"980":  []string{"10.1.0.2:14142"},
+		"970":  []string{"10.2.0.1:14142"},
+		"1010": []string{"10.1.0.3:14142"},
+	}}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	for _, spread := range []bool{false, true} {
+		opts := []Option{}
+		if spread {
+			opts = append(opts, WithLeafClassifier(PrefixClassifier(16)))
+		}
+		o := New(appId, key, new(nopCallback), opts...)
+		o.nodeId = big.NewInt(1000)
+		o.routes = newTable(o.nodeId)
+		o.merge(o.routes, make(map[string][]string), s)
+
+		want := []int64{980, 990, 1000, 1010}
+		if spread {
+			want = []int64{970, 990, 1000, 1010}
+		}
+		if len(o.routes.leaves) != len(want) {
+			t.Fatalf("spread %v: leaf set mismatch: have %v, want %v.", spread, o.routes.leaves, want)
+		}
+		for i, id := range want {
+			if o.routes.leaves[i].Int64() != id {
+				t.Fatalf("spread %v: leaf set mismatch: have %v, want %v.", spread, o.routes.leaves, want)
+			}
+		}
+		// Keys owned by a skipped but connected node should still be delivered to it
+		skipped := &peer{nodeId: big.NewInt(980)}
+		o.pool[skipped.nodeId.String()] = skipped
+
+		o.lock.RLock()
+		best := o.walk(big.NewInt(981))
+		active := o.active(skipped.nodeId)
+		o.lock.RUnlock()
+		hops := o.NextHops(big.NewInt(981), 1)
+
+		if best.Int64() != 980 {
+			t.Fatalf("spread %v: key owner mismatch: have %v, want %v.", spread, best, 980)
+		}
+		if len(hops) != 1 || hops[0].Int64() != 980 {
+			t.Fatalf("spread %v: next hops mismatch: have %v, want %v.", spread, hops, []int64{980})
+		}
+		if !active {
+			t.Fatalf("spread %v: key owner connection considered passive.", spread)
+		}
+	}
+}
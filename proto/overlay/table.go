@@ -28,26 +28,53 @@ import (
 
 // Simplified Pastry routing table.
 type table struct {
-	leaves []*big.Int
-	routes [][]*big.Int
+	leaves    []*big.Int
+	routes    [][]*big.Int
+	stamps    [][]uint64   // Update time of the states the routing entries came from
+	origins   [][]*big.Int // Senders of the states the routing entries came from
+	neighbors []*big.Int
 }
 
-// Creates a new empty routing table
+// Creates a new empty routing table in the default id space
 func newTable(origin *big.Int) *table {
+	return configSpace().newTable(origin)
+}
+
+// Creates a new empty routing table sized by the id space
+func (s *space) newTable(origin *big.Int) *table {
 	res := new(table)
 
 	// Create the leaf set with only the origin point inside
 	res.leaves = make([]*big.Int, 1, config.OverlayLeaves)
 	res.leaves[0] = origin
 
-	// Create the empty routing table of predefined size
-	res.routes = make([][]*big.Int, config.OverlaySpace/config.OverlayBase)
+	// Create the empty routing table sized by the id space and base
+	res.routes = make([][]*big.Int, s.rows())
+	res.stamps = make([][]uint64, len(res.routes))
+	res.origins = make([][]*big.Int, len(res.routes))
 	for i := 0; i < len(res.routes); i++ {
-		res.routes[i] = make([]*big.Int, 1<<uint(config.OverlayBase))
+		res.routes[i] = make([]*big.Int, s.cols())
+		res.stamps[i] = make([]uint64, len(res.routes[i]))
+		res.origins[i] = make([]*big.Int, len(res.routes[i]))
 	}
+	// Create the empty neighborhood set
+	res.neighbors = make([]*big.Int, 0, config.OverlayNeighbors)
 	return res
 }
 
+// Checks whether a routing table position is within the table dimensions.
+func (t *table) contains(row, col int) bool {
+	return row >= 0 && row < len(t.routes) && col >= 0 && col < len(t.routes[row])
+}
+
+// Returns the routing table entry at a position, or nil if out of bounds.
+func (t *table) get(row, col int) *big.Int {
+	if !t.contains(row, col) {
+		return nil
+	}
+	return t.routes[row][col]
+}
+
 // Creates a copy of the routing table
 func (t *table) Copy() *table {
 	res := new(table)
@@ -58,9 +85,22 @@ func (t *table) Copy() *table {
 
 	// Copy the routing table
 	res.routes = make([][]*big.Int, len(t.routes))
+	res.stamps = make([][]uint64, len(t.stamps))
 	for i := 0; i < len(res.routes); i++ {
 		res.routes[i] = make([]*big.Int, len(t.routes[i]))
 		copy(res.routes[i], t.routes[i])
 	}
+	for i := 0; i < len(res.stamps); i++ {
+		res.stamps[i] = make([]uint64, len(t.stamps[i]))
+		copy(res.stamps[i], t.stamps[i])
+	}
+	res.origins = make([][]*big.Int, len(t.origins))
+	for i := 0; i < len(res.origins); i++ {
+		res.origins[i] = make([]*big.Int, len(t.origins[i]))
+		copy(res.origins[i], t.origins[i])
+	}
+	// Copy the neighborhood set
+	res.neighbors = make([]*big.Int, len(t.neighbors), config.OverlayNeighbors)
+	copy(res.neighbors, t.neighbors)
 	return res
 }
@@ -0,0 +1,139 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the routing topology change notifications: whenever the manager swaps
+// in a new routing table, the node ids entering and leaving the routing state are
+// published to all the subscribers.
+
+package overlay
+
+import (
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/ext/sortext"
+	"math/big"
+)
+
+// Routing topology change, listing the nodes that entered and left the local
+// routing state (leaf set, routing table and neighborhood set).
+type TopologyEvent struct {
+	Added   []*big.Int
+	Removed []*big.Int
+}
+
+// Subscribes to the routing topology changes. Each subscriber has its own buffer
+// of config.OverlayEventBuffer events: if a slow consumer lets it fill up, the
+// oldest pending events are discarded, so the overlay is never blocked. All the
+// subscriptions are closed when the overlay is shut down.
+func (o *Overlay) Subscribe() <-chan TopologyEvent {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	sub := make(chan TopologyEvent, config.OverlayEventBuffer)
+	select {
+	case <-o.quit:
+		close(sub)
+	default:
+		o.subs = append(o.subs, sub)
+	}
+	return sub
+}
+
+// Cancels a topology subscription, closing the event channel. Unknown (or already
+// cancelled) subscriptions are silently ignored.
+func (o *Overlay) Unsubscribe(sub <-chan TopologyEvent) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for i, s := range o.subs {
+		if s == sub {
+			close(s)
+			o.subs = append(o.subs[:i], o.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Closes all the topology subscriptions. The write lock must be held by the
+// caller.
+func (o *Overlay) unsubscribeAll() {
+	for _, sub := range o.subs {
+		close(sub)
+	}
+	o.subs = nil
+}
+
+// Sends a topology event to all subscribers, discarding their oldest pending ones
+// if the buffers are full. Empty events are not published. The read lock must be
+// held by the caller.
+func (o *Overlay) publish(event *TopologyEvent) {
+	if len(event.Added) == 0 && len(event.Removed) == 0 {
+		return
+	}
+	for _, sub := range o.subs {
+		for sent := false; !sent; {
+			select {
+			case sub <- *event:
+				sent = true
+			default:
+				select {
+				case <-sub:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Collects the ids of all the nodes in the routing state, excluding self.
+func (t *table) members(self *big.Int) []*big.Int {
+	ids := append([]*big.Int{}, t.leaves...)
+	for _, row := range t.routes {
+		for _, id := range row {
+			if id != nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	ids = append(ids, t.neighbors...)
+
+	sortext.BigInts(ids)
+	ids = ids[:sortext.Unique(sortext.BigIntSlice(ids))]
+	if idx := sortext.IndexBigInt(ids, self); idx >= 0 {
+		ids = append(ids[:idx], ids[idx+1:]...)
+	}
+	return ids
+}
+
+// Calculates the nodes added and removed between two routing tables.
+func diffTopology(self *big.Int, prev, next *table) *TopologyEvent {
+	olds, news := prev.members(self), next.members(self)
+
+	event := &TopologyEvent{Added: []*big.Int{}, Removed: []*big.Int{}}
+	for _, id := range news {
+		if sortext.IndexBigInt(olds, id) < 0 {
+			event.Added = append(event.Added, id)
+		}
+	}
+	for _, id := range olds {
+		if sortext.IndexBigInt(news, id) < 0 {
+			event.Removed = append(event.Removed, id)
+		}
+	}
+	return event
+}
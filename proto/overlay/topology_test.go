@@ -0,0 +1,194 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package overlay
+
+import (
+	"crypto/x509"
+	"github.com/karalabe/iris/config"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestTopologyDiff(t *testing.T) {
+	self := big.NewInt(0x1000000000)
+	prev, next := newTable(self), newTable(self)
+
+	prev.leaves = append(prev.leaves, big.NewInt(0x1000000001))
+	prev.routes[0][2] = big.NewInt(0x2000000000)
+	prev.routes[0][3] = big.NewInt(0x3000000000)
+
+	next.leaves = append(next.leaves, big.NewInt(0x1000000001))
+	next.routes[0][3] = big.NewInt(0x3000000000)
+	next.neighbors = append(next.neighbors, big.NewInt(0x4000000000))
+
+	event := diffTopology(self, prev, next)
+	if len(event.Added) != 1 || event.Added[0].Int64() != 0x4000000000 {
+		t.Errorf("added nodes mismatch: have %v, want %v.", event.Added, []int64{0x4000000000})
+	}
+	if len(event.Removed) != 1 || event.Removed[0].Int64() != 0x2000000000 {
+		t.Errorf("removed nodes mismatch: have %v, want %v.", event.Removed, []int64{0x2000000000})
+	}
+}
+
+func TestTopologyPublish(t *testing.T) {
+	// Limit the event buffers
+	olds := config.OverlayEventBuffer
+	defer func() { config.OverlayEventBuffer = olds }()
+	config.OverlayEventBuffer = 2
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	subs := []<-chan TopologyEvent{o.Subscribe(), o.Subscribe()}
+
+	// Publish more events than buffered and ensure the oldest are dropped
+	for i := 1; i <= 3; i++ {
+		o.publish(&TopologyEvent{Added: []*big.Int{big.NewInt(int64(i))}})
+	}
+	o.publish(&TopologyEvent{})
+
+	for _, sub := range subs {
+		for _, want := range []int64{2, 3} {
+			select {
+			case event := <-sub:
+				if event.Added[0].Int64() != want {
+					t.Fatalf("event mismatch: have %v, want %v.", event.Added[0], want)
+				}
+			default:
+				t.Fatalf("event %v missing.", want)
+			}
+		}
+		select {
+		case event := <-sub:
+			t.Fatalf("unexpected event: %v.", event)
+		default:
+		}
+	}
+}
+
+func TestTopologySubscribe(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+	sub := o.Subscribe()
+
+	// Start the manager and feed it a new node
+	o.auther.Start()
+	go o.manager()
+	defer close(o.quit)
+
+	for up := false; !up; {
+		time.Sleep(10 * time.Millisecond)
+		o.lock.RLock()
+		up = o.mgrUp
+		o.lock.RUnlock()
+	}
+	p := newTestPeer(o, big.NewInt(0x3000000000))
+	o.upSink <- &state{Addrs: map[string][]string{p.nodeId.String(): nil}, Updated: 1}
+
+	select {
+	case event := <-sub:
+		if len(event.Added) != 1 || event.Added[0].Cmp(p.nodeId) != 0 || len(event.Removed) != 0 {
+			t.Fatalf("join event mismatch: have %v/%v, want %v/%v.", event.Added, event.Removed, p.nodeId, nil)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("join event not published.")
+	}
+	// Drop the node and wait for its removal
+	if err := o.DropPeer(p.nodeId); err != nil {
+		t.Fatalf("failed to drop peer: %v.", err)
+	}
+	select {
+	case event := <-sub:
+		if len(event.Removed) != 1 || event.Removed[0].Cmp(p.nodeId) != 0 || len(event.Added) != 0 {
+			t.Fatalf("leave event mismatch: have %v/%v, want %v/%v.", event.Added, event.Removed, nil, p.nodeId)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("leave event not published.")
+	}
+}
+
+func TestTopologyMigrate(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0x1000000000)
+	o.routes = newTable(o.nodeId)
+	sub := o.Subscribe()
+
+	// Start the manager and feed it a new node
+	o.auther.Start()
+	go o.manager()
+
+	for up := false; !up; {
+		time.Sleep(10 * time.Millisecond)
+		o.lock.RLock()
+		up = o.mgrUp
+		o.lock.RUnlock()
+	}
+	p := newTestPeer(o, big.NewInt(0x3000000000))
+	o.upSink <- &state{Addrs: map[string][]string{p.nodeId.String(): nil}, Updated: 1}
+
+	select {
+	case <-sub:
+	case <-time.After(time.Second):
+		t.Fatalf("join event not published.")
+	}
+	// Migrate the node and ensure the routing state is reported as rebuilt
+	if err := o.Migrate(big.NewInt(0x2000000000)); err != nil {
+		t.Fatalf("failed to migrate: %v.", err)
+	}
+	for _, leave := range []bool{true, false} {
+		select {
+		case event := <-sub:
+			have, want := event.Added, event.Removed
+			if leave {
+				have, want = want, have
+			}
+			if len(have) != 1 || have[0].Cmp(p.nodeId) != 0 || len(want) != 0 {
+				t.Fatalf("migration event mismatch (leave: %v): have %v/%v.", leave, event.Added, event.Removed)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("migration event not published (leave: %v).", leave)
+		}
+	}
+	// Cancel the subscription and ensure the channel is closed
+	o.Unsubscribe(sub)
+	if _, ok := <-sub; ok {
+		t.Fatalf("subscription not closed after unsubscribe.")
+	}
+	o.Unsubscribe(sub)
+
+	// Shut down the overlay and ensure all subscriptions are closed
+	subs := []<-chan TopologyEvent{o.Subscribe(), o.Subscribe()}
+	o.Shutdown()
+	subs = append(subs, o.Subscribe())
+
+	for i, sub := range subs {
+		select {
+		case _, ok := <-sub:
+			if ok {
+				t.Errorf("subscription #%d: event after shutdown.", i)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("subscription #%d: not closed on shutdown.", i)
+		}
+	}
+}
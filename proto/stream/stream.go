@@ -28,8 +28,8 @@ package stream
 import (
 	"bufio"
 	"encoding/gob"
-	"fmt"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -63,9 +63,10 @@ func Listen(addr *net.TCPAddr) (chan *Stream, chan struct{}, error) {
 	return sink, quit, nil
 }
 
-// Connects to a remote host and returns the connection stream.
+// Connects to a remote host and returns the connection stream. IPv6 hosts are
+// accepted in their raw form (optionally with a %zone suffix).
 func Dial(host string, port int) (*Stream, error) {
-	addr := fmt.Sprintf("%s:%d", host, port)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
 	sock, err := net.DialTimeout("tcp", addr, dialTimeout)
 	if err != nil {
 		return nil, err
@@ -69,6 +69,24 @@ func TestDial(t *testing.T) {
 	sock.Close()
 }
 
+func TestDialIPv6(t *testing.T) {
+	sock, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer sock.Close()
+
+	addr, err := net.ResolveTCPAddr("tcp", sock.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to resolve bracketed address: %v.", err)
+	}
+	strm, err := Dial(addr.IP.String(), addr.Port)
+	if err != nil {
+		t.Fatalf("failed to connect to IPv6 listener: %v", err)
+	}
+	strm.Close()
+}
+
 func TestSendRecv(t *testing.T) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {